@@ -0,0 +1,12 @@
+package manager
+
+import "time"
+
+var _ Clock = SystemClock{}
+
+// SystemClock reads the current time from the system
+type SystemClock struct{}
+
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
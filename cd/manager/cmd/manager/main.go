@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/3box/pipeline-tools/cd/manager"
 	"github.com/3box/pipeline-tools/cd/manager/common"
@@ -19,6 +21,7 @@ import (
 	"github.com/3box/pipeline-tools/cd/manager/common/aws/ddb"
 	"github.com/3box/pipeline-tools/cd/manager/common/aws/ecs"
 	"github.com/3box/pipeline-tools/cd/manager/jobmanager"
+	"github.com/3box/pipeline-tools/cd/manager/metrics"
 	"github.com/3box/pipeline-tools/cd/manager/notifs"
 	"github.com/3box/pipeline-tools/cd/manager/repository"
 	"github.com/3box/pipeline-tools/cd/manager/server"
@@ -34,24 +37,24 @@ func main() {
 	shutdownChan := make(chan bool)
 
 	// Create and initialize the job queue before the API handling
-	m := createJobQueue(waitGroup, shutdownChan)
+	m, exportMetrics := createJobQueue(waitGroup, shutdownChan)
 
 	// Setup API handling
-	serverInstance := startServer(waitGroup, m)
+	serverInstance := startServer(waitGroup, m, exportMetrics)
 
 	// Shutdown processing
 	waitGroup.Add(1)
-	go shutdown(waitGroup, func() bool {
-		close(shutdownChan)
+	go shutdown(waitGroup, func() {
+		// Stop accepting requests before draining the jobs being processed
 		if err := serverInstance.Shutdown(context.Background()); err != nil {
 			fmt.Printf("Server error on shutdown: %v", err)
 		}
-		return true
+		close(shutdownChan)
 	})
 	waitGroup.Wait()
 }
 
-func startServer(waitGroup *sync.WaitGroup, m manager.Manager) *http.Server {
+func startServer(waitGroup *sync.WaitGroup, m manager.Manager, exportMetrics bool) *http.Server {
 	serverAddress := os.Getenv("SERVER_ADDR")
 	if len(serverAddress) == 0 {
 		serverAddress = "0.0.0.0"
@@ -60,7 +63,14 @@ func startServer(waitGroup *sync.WaitGroup, m manager.Manager) *http.Server {
 	if len(serverPort) == 0 {
 		serverPort = "8080"
 	}
-	serverInstance := server.Setup(serverAddress+":"+serverPort, m)
+	// Deployments can only be approved by the approvers configured here, e.g. from a secret
+	approvers, err := server.ParseApprovers(os.Getenv("APPROVERS"))
+	if err != nil {
+		log.Fatalf("failed to parse approvers: %q", err)
+	} else if len(approvers) == 0 {
+		log.Println("no approvers configured, deployments waiting for approval cannot be approved")
+	}
+	serverInstance := server.Setup(serverAddress+":"+serverPort, m, exportMetrics, approvers)
 	waitGroup.Add(1)
 	go func() {
 		defer waitGroup.Done()
@@ -71,7 +81,7 @@ func startServer(waitGroup *sync.WaitGroup, m manager.Manager) *http.Server {
 	return &serverInstance
 }
 
-func createJobQueue(waitGroup *sync.WaitGroup, shutdownCh chan bool) manager.Manager {
+func createJobQueue(waitGroup *sync.WaitGroup, shutdownCh chan bool) (manager.Manager, bool) {
 	cfg, err := config.Config()
 	if err != nil {
 		log.Fatalf("Failed to create AWS cfg: %q", err)
@@ -81,14 +91,47 @@ func createJobQueue(waitGroup *sync.WaitGroup, shutdownCh chan bool) manager.Man
 	if err = db.InitializeJobs(); err != nil {
 		log.Fatalf("failed to populate jobs from database: %q", err)
 	}
-	deployment := ecs.NewEcs(cfg)
+	regionCfgs, err := config.RegionConfigs()
+	if err != nil {
+		log.Fatalf("Failed to create AWS region cfgs: %q", err)
+	}
+	var deployment manager.Deployment
+	if len(regionCfgs) > 0 {
+		deployment, err = ecs.NewMultiRegionEcs(cfg, regionCfgs)
+	} else {
+		deployment, err = ecs.NewEcs(cfg)
+	}
+	if err != nil {
+		log.Fatalf("failed to initialize deployment: %q", err)
+	}
+	// Check that the manager has the permissions it needs before any deployments are attempted. This can be skipped if
+	// the manager's role only allows access to specific resources, which the preflight probes can't account for.
+	if skipPreflight, _ := strconv.ParseBool(os.Getenv("SKIP_PREFLIGHT")); !skipPreflight {
+		if err = deployment.Preflight(context.Background()); err != nil {
+			log.Fatalf("deployment preflight failed: %q", err)
+		}
+	}
 	apiGw := apigw.NewApiGw(cfg)
 	repo := repository.NewRepository()
-	n, err := notifs.NewJobNotifs(db, cache)
+	discordNotifs, err := notifs.NewJobNotifs(db, cache)
 	if err != nil {
 		log.Fatalf("failed to initialize notifications: %q", err)
 	}
-	jobManager, err := jobmanager.NewJobManager(cache, db, deployment, apiGw, repo, n)
+	// Paging on-call about failed deployments is optional
+	pagerDutyNotifs, err := notifs.NewPagerDutyNotifs()
+	if err != nil {
+		log.Fatalf("failed to initialize pagerduty notifications: %q", err)
+	}
+	n := notifs.NewMultiNotifs(discordNotifs, pagerDutyNotifs)
+	// Prometheus metrics are optional so that environments that only use CloudWatch aren't affected
+	var m manager.Metrics
+	exportMetrics, _ := strconv.ParseBool(os.Getenv("PROMETHEUS_METRICS"))
+	if exportMetrics {
+		p := metrics.NewPrometheus(db)
+		prometheus.MustRegister(p)
+		m = p
+	}
+	jobManager, err := jobmanager.NewJobManager(cache, db, deployment, apiGw, repo, n, m)
 	if err != nil {
 		log.Fatalf("failed to create job queue: %q", err)
 	}
@@ -99,20 +142,21 @@ func createJobQueue(waitGroup *sync.WaitGroup, shutdownCh chan bool) manager.Man
 		jobManager.ProcessJobs(shutdownCh)
 		log.Println("stopped job queue processing")
 	}()
-	return jobManager
+	return jobManager, exportMetrics
 }
 
-func shutdown(waitGroup *sync.WaitGroup, cleanup func() bool) {
+func shutdown(waitGroup *sync.WaitGroup, cleanup func()) {
 	interruptCh := make(chan os.Signal, 1)
-	signal.Notify(interruptCh, os.Interrupt)
+	// ECS sends SIGTERM when stopping the manager's task
+	signal.Notify(interruptCh, os.Interrupt, syscall.SIGTERM)
 	<-interruptCh
 	fmt.Println("\nShutting down gracefully... (Enter ctrl+c to force shut down)")
-	if cleanup() {
-		waitGroup.Done()
-		fmt.Println("Done")
-		return
-	}
-	signal.Notify(interruptCh, syscall.SIGTERM)
-	<-interruptCh
+	go func() {
+		<-interruptCh
+		fmt.Println("\nForcing shut down")
+		os.Exit(1)
+	}()
+	cleanup()
 	waitGroup.Done()
+	fmt.Println("Done")
 }
@@ -4,36 +4,89 @@ import (
 	"context"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 
 	"github.com/3box/pipeline-tools/cd/manager"
 )
 
 func ConfigWithOverride(customEndpoint string) (aws.Config, error) {
+	return regionConfigWithOverride(customEndpoint, os.Getenv("AWS_REGION"))
+}
+
+func Config() (aws.Config, error) {
+	return regionConfig(os.Getenv("AWS_REGION"))
+}
+
+// RegionConfigs returns configurations for any regions other than the primary region that deployments should also
+// target, keyed by region. Regions are read from a comma-separated list in AWS_REGIONS.
+func RegionConfigs() (map[string]aws.Config, error) {
+	primaryRegion := os.Getenv("AWS_REGION")
+	regionCfgs := make(map[string]aws.Config)
+	for _, region := range strings.Split(os.Getenv("AWS_REGIONS"), ",") {
+		region = strings.TrimSpace(region)
+		if (len(region) > 0) && (region != primaryRegion) {
+			if _, found := regionCfgs[region]; !found {
+				if cfg, err := regionConfig(region); err != nil {
+					log.Printf("config: failed to load region config: %s, %v", region, err)
+					return nil, err
+				} else {
+					regionCfgs[region] = cfg
+				}
+			}
+		}
+	}
+	return regionCfgs, nil
+}
+
+func regionConfigWithOverride(customEndpoint, region string) (aws.Config, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
 	defer cancel()
 
-	endpointResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+	endpointResolver := aws.EndpointResolverWithOptionsFunc(func(service, _ string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
 			PartitionID:   "aws",
 			URL:           customEndpoint,
-			SigningRegion: os.Getenv("AWS_REGION"),
+			SigningRegion: region,
 		}, nil
 	})
-	return config.LoadDefaultConfig(ctx, config.WithEndpointResolverWithOptions(endpointResolver))
+	if cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region), config.WithEndpointResolverWithOptions(endpointResolver)); err != nil {
+		return aws.Config{}, err
+	} else {
+		return withAssumedRole(cfg), nil
+	}
 }
 
-func Config() (aws.Config, error) {
+func regionConfig(region string) (aws.Config, error) {
 	awsEndpoint := os.Getenv("AWS_ENDPOINT")
 	if len(awsEndpoint) > 0 {
-		log.Printf("config: using custom global aws endpoint: %s", awsEndpoint)
-		return ConfigWithOverride(awsEndpoint)
+		log.Printf("config: using custom global aws endpoint: %s, %s", awsEndpoint, region)
+		return regionConfigWithOverride(awsEndpoint, region)
 	}
 	// Load the default configuration
 	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
 	defer cancel()
 
-	return config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("AWS_REGION")))
+	if cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region)); err != nil {
+		return aws.Config{}, err
+	} else {
+		return withAssumedRole(cfg), nil
+	}
+}
+
+// withAssumedRole switches the configuration to use credentials for the role in AWS_ASSUME_ROLE_ARN, if set. This allows
+// the manager to run in one account and deploy into another. The default credentials are used to assume the role.
+func withAssumedRole(cfg aws.Config) aws.Config {
+	if roleArn := os.Getenv("AWS_ASSUME_ROLE_ARN"); len(roleArn) > 0 {
+		log.Printf("config: assuming role: %s, %s", roleArn, cfg.Region)
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleArn, func(options *stscreds.AssumeRoleOptions) {
+			options.RoleSessionName = manager.ServiceName
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return cfg
 }
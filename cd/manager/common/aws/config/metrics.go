@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+const callMetricsMiddlewareId = "CallMetrics"
+const callMetricsNamespace = "CdManager"
+
+// CallMetricsOptions returns API options that record the latency and outcome of each AWS call made by a client, if
+// AWS_CALL_METRICS is set. Metrics are written to stdout in CloudWatch Embedded Metric Format so that they're extracted
+// from the container logs without needing a separate CloudWatch client.
+func CallMetricsOptions() []func(*middleware.Stack) error {
+	if enabled, _ := strconv.ParseBool(os.Getenv("AWS_CALL_METRICS")); !enabled {
+		return nil
+	}
+	return []func(*middleware.Stack) error{addCallMetrics}
+}
+
+func addCallMetrics(stack *middleware.Stack) error {
+	// Add the middleware at the start of the "initialize" step so that the recorded latency includes any retries
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(
+		callMetricsMiddlewareId,
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			emitCallMetrics(
+				awsmiddleware.GetServiceID(ctx),
+				awsmiddleware.GetOperationName(ctx),
+				awsmiddleware.GetRegion(ctx),
+				time.Since(start),
+				err,
+			)
+			return out, metadata, err
+		},
+	), middleware.Before)
+}
+
+func emitCallMetrics(service, operation, region string, latency time.Duration, err error) {
+	errCount := 0
+	if err != nil {
+		errCount = 1
+	}
+	metrics, _ := json.Marshal(map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  callMetricsNamespace,
+				"Dimensions": [][]string{{"Env", "Service", "Operation"}},
+				"Metrics": []map[string]string{
+					{"Name": "Latency", "Unit": "Milliseconds"},
+					{"Name": "Errors", "Unit": "Count"},
+				},
+			}},
+		},
+		"Env":       os.Getenv(manager.EnvVar_Env),
+		"Service":   service,
+		"Operation": operation,
+		"Region":    region,
+		"Latency":   latency.Milliseconds(),
+		"Errors":    errCount,
+	})
+	// Write directly to stdout since the log package prefixes lines, which would prevent them from being parsed
+	fmt.Fprintln(os.Stdout, string(metrics))
+}
@@ -2,9 +2,11 @@ package ddb
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,25 +27,37 @@ import (
 var _ manager.Database = &DynamoDb{}
 
 type DynamoDb struct {
-	client     *dynamodb.Client
-	jobTable   string
-	buildTable string
-	cache      manager.Cache
-	cursor     time.Time
+	client        *dynamodb.Client
+	jobTable      string
+	buildTable    string
+	taskTable     string
+	leaseTable    string
+	settingsTable string
+	cache         manager.Cache
+	cursor        time.Time
+	// Identifies this manager instance as the holder of job leases
+	leaseOwner string
 }
 
 const defaultJobStateTtl = 2 * 7 * 24 * time.Hour // Two weeks
 
+// Parameters set on a job by requests made through the API (e.g. to cancel or approve a deployment), instead of by the
+// manager instance advancing the job
+var jobRequestParams = []string{job.JobParam_CanceledBy, job.DeployJobParam_RollbackOnCancel, job.DeployJobParam_ApprovedBy}
+
 // buildState represents build/deploy tag information. This information is maintained in a legacy DynamoDB table used by
 // our utility AWS Lambdas.
 type buildState struct {
-	Key       manager.DeployComponent `dynamodbav:"key"`
-	DeployTag string                  `dynamodbav:"deployTag"`
-	BuildInfo buildInfo               `dynamodbav:"buildInfo"`
+	Key           manager.DeployComponent `dynamodbav:"key"`
+	DeployTag     string                  `dynamodbav:"deployTag"`
+	DeployVersion string                  `dynamodbav:"deployVersion"`
+	DeployJob     string                  `dynamodbav:"deployJob"` // Job ID of the last full deployment
+	BuildInfo     buildInfo               `dynamodbav:"buildInfo"`
 }
 
 type buildInfo struct {
-	BuildTag string `dynamodbav:"sha_tag"`
+	BuildTag     string `dynamodbav:"sha_tag"`
+	BuildVersion string `dynamodbav:"version"`
 }
 
 func NewDynamoDb(cfg aws.Config, cache manager.Cache) manager.Database {
@@ -61,13 +75,24 @@ func NewDynamoDb(cfg aws.Config, cache manager.Cache) manager.Database {
 	}
 	jobTable := "ceramic-" + env + "-ops"
 	buildTable := "ceramic-utils-" + env
+	taskTable := "ceramic-" + env + "-tasks"
+	leaseTable := "ceramic-" + env + "-leases"
+	settingsTable := "ceramic-" + env + "-settings"
+	// Include the host name so that lease holders can be traced back to a manager instance, and a random suffix so that
+	// instances on the same host never share leases.
+	hostname, _ := os.Hostname()
+	leaseOwner := hostname + "/" + uuid.New().String()
 	dynamoDbClient := dynamodb.NewFromConfig(cfg)
 	db := &DynamoDb{
 		dynamoDbClient,
 		jobTable,
 		buildTable,
+		taskTable,
+		leaseTable,
+		settingsTable,
 		cache,
 		time.Unix(0, 0),
+		leaseOwner,
 	}
 	if err = db.createJobTable(); err != nil {
 		log.Fatalf("dynamodb: job table creation failed: %v", err)
@@ -75,6 +100,15 @@ func NewDynamoDb(cfg aws.Config, cache manager.Cache) manager.Database {
 	if err = db.createBuildTable(); err != nil {
 		log.Fatalf("dynamodb: build table creation failed: %v", err)
 	}
+	if err = db.createTaskTable(); err != nil {
+		log.Fatalf("dynamodb: task table creation failed: %v", err)
+	}
+	if err = db.createLeaseTable(); err != nil {
+		log.Fatalf("dynamodb: lease table creation failed: %v", err)
+	}
+	if err = db.createSettingsTable(); err != nil {
+		log.Fatalf("dynamodb: settings table creation failed: %v", err)
+	}
 	return db
 }
 
@@ -106,14 +140,45 @@ func (db DynamoDb) createBuildTable() error {
 	return utils.CreateTable(context.Background(), db.client, &createTableInput)
 }
 
+func (db DynamoDb) createTaskTable() error {
+	// Create the table if it doesn't already exist
+	createTableInput := dynamodb.CreateTableInput{
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("job"),
+				AttributeType: "S",
+			},
+			{
+				AttributeName: aws.String("task"),
+				AttributeType: "S",
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("job"),
+				KeyType:       "HASH",
+			},
+			{
+				AttributeName: aws.String("task"),
+				KeyType:       "RANGE",
+			},
+		},
+		TableName: aws.String(db.taskTable),
+	}
+	return utils.CreateTable(context.Background(), db.client, &createTableInput)
+}
+
 func (db DynamoDb) InitializeJobs() error {
 	ttlCursor := time.Now().AddDate(0, 0, -manager.DefaultTtlDays)
-	// Load all jobs in an advanced stage of processing (completed, failed, delayed, waiting, started, skipped), so that
-	// we know which jobs have already been dequeued.
+	// Load all jobs in an advanced stage of processing (completed, failed, delayed, waiting, started, skipped, waiting
+	// for approval), so that we know which jobs have already been dequeued.
 	if err := db.loadJobs(job.JobStage_Completed, ttlCursor); err != nil {
 		return err
 	} else if err = db.loadJobs(job.JobStage_Failed, ttlCursor); err != nil {
 		return err
+	} else if err = db.loadJobs(job.JobStage_RolledBack, ttlCursor); err != nil {
+		return err
 	} else if err = db.loadJobs(job.JobStage_Canceled, ttlCursor); err != nil {
 		return err
 	} else if err = db.loadJobs(job.JobStage_Waiting, ttlCursor); err != nil {
@@ -122,6 +187,8 @@ func (db DynamoDb) InitializeJobs() error {
 		return err
 	} else if err = db.loadJobs(job.JobStage_Dequeued, ttlCursor); err != nil {
 		return err
+	} else if err = db.loadJobs(job.JobStage_WaitingApproval, ttlCursor); err != nil {
+		return err
 	} else {
 		return db.loadJobs(job.JobStage_Skipped, ttlCursor)
 	}
@@ -136,7 +203,18 @@ func (db DynamoDb) loadJobs(stage job.JobStage, cursor time.Time) error {
 	})
 }
 
-func (db DynamoDb) QueueJob(jobState job.JobState) error {
+// EnqueueJob adds a job to the queue with the specified priority. Queued jobs are dequeued in order of descending
+// priority, and in the order they were queued for jobs with the same priority, e.g. so that an urgent hotfix deployment
+// can jump ahead of other queued jobs.
+func (db DynamoDb) EnqueueJob(jobState job.JobState, priority int) error {
+	if priority != 0 {
+		if jobState.Params == nil {
+			jobState.Params = map[string]interface{}{}
+		}
+		jobState.Params[job.JobParam_Priority] = float64(priority)
+	} else {
+		delete(jobState.Params, job.JobParam_Priority)
+	}
 	// Only write this job to the database since that's where our de/queueing is expected to happen from. The cache is
 	// just a hash-map from job IDs to job state for ACTIVE jobs (jobs are not added to the cache until they are in
 	// progress). This also means that we don't need to write jobs to the database if they're already in the cache.
@@ -146,9 +224,9 @@ func (db DynamoDb) QueueJob(jobState job.JobState) error {
 	return nil
 }
 
-// QueuedJobs returns jobs in order of their DB timestamps that have not yet been picked up from the database and are
-// thus not in the cache. We use the fact that a new job is not in the cache yet to determine whether a job is truly new
-// or if it has already started being processed.
+// QueuedJobs returns jobs in order of priority then DB timestamp that have not yet been picked up from the database and
+// are thus not in the cache. We use the fact that a new job is not in the cache yet to determine whether a job is truly
+// new or if it has already started being processed.
 func (db DynamoDb) QueuedJobs() []job.JobState {
 	// If available, use the timestamp of the previously found first job not already in processing as the start of the
 	// current database search. We can't know for sure that all subsequent jobs are unprocessed (e.g. force deploys or
@@ -185,10 +263,11 @@ func (db DynamoDb) QueuedJobs() []job.JobState {
 	if !cursorSet {
 		db.cursor = time.Now()
 	}
+	job.SortByPriority(jobs)
 	return jobs
 }
 
-// OrderedJobs returns jobs in order of their DB timestamps that are in the cache in a certain stage of processing
+// OrderedJobs returns jobs in order of priority then DB timestamp that are in the cache in a certain stage of processing
 func (db DynamoDb) OrderedJobs(jobStage job.JobStage) []job.JobState {
 	jobs := make([]job.JobState, 0, 0)
 	if err := db.iterateByStage(jobStage, db.cursor, true, func(jobState job.JobState) bool {
@@ -200,6 +279,7 @@ func (db DynamoDb) OrderedJobs(jobStage job.JobStage) []job.JobState {
 	}); err != nil {
 		log.Printf("orderedJobs: failed iteration through jobs: %v", err)
 	}
+	job.SortByPriority(jobs)
 	return jobs
 }
 
@@ -207,6 +287,24 @@ func (db DynamoDb) IterateByType(jobType job.JobType, asc bool, iter func(job.Jo
 	return db.iterateByType(jobType, time.Now().AddDate(0, 0, -manager.DefaultTtlDays), asc, iter)
 }
 
+// IterateByJob iterates through the states of a single job, looked up by job ID
+func (db DynamoDb) IterateByJob(jobId string, asc bool, iter func(job.JobState) bool) error {
+	return db.iterateEvents(&dynamodb.QueryInput{
+		TableName:              aws.String(db.jobTable),
+		IndexName:              aws.String(job.JobTsIndex),
+		KeyConditionExpression: aws.String("#job = :job and #ts >= :ts"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":job": &types.AttributeValueMemberS{Value: jobId},
+			":ts":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().AddDate(0, 0, -manager.DefaultTtlDays).UnixNano(), 10)},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#job": "job",
+			"#ts":  "ts",
+		},
+		ScanIndexForward: aws.Bool(asc),
+	}, iter)
+}
+
 func (db DynamoDb) iterateByStage(jobStage job.JobStage, cursor time.Time, asc bool, iter func(job.JobState) bool) error {
 	// Only look for jobs up till the current time. This allows us to schedule jobs in the future (e.g. smoke tests to
 	// start a few minutes after a deployment is complete).
@@ -270,8 +368,8 @@ func (db DynamoDb) iterateEvents(queryInput *dynamodb.QueryInput, iter func(job.
 				return err
 			}
 			for _, jobState := range jobsPage {
-				if jobState.Type == job.JobType_Deploy {
-					// Marshal layout back into `Layout` structure
+				if (jobState.Type == job.JobType_Deploy) || (jobState.Type == job.JobType_Restart) {
+					// Marshal layout back into `Layout` structure. Deploy and restart jobs use the same parameter name.
 					if layout, found := jobState.Params[job.DeployJobParam_Layout].(map[string]interface{}); found {
 						var marshaledLayout manager.Layout
 						if err = mapstructure.Decode(layout, &marshaledLayout); err != nil {
@@ -294,16 +392,41 @@ func (db DynamoDb) iterateEvents(queryInput *dynamodb.QueryInput, iter func(job.
 }
 
 func (db DynamoDb) AdvanceJob(jobState job.JobState) error {
-	if err := db.WriteJob(jobState); err != nil {
+	// Carry over requests recorded on the previous state of a deployment while it was being advanced, so that they aren't
+	// lost when the new state is written.
+	if cachedJob, found := db.cache.JobById(jobState.JobId); found && (jobState.Type == job.JobType_Deploy) {
+		if requests, err := db.jobRequests(cachedJob); err != nil {
+			return err
+		} else {
+			jobState = withJobRequests(jobState, requests)
+		}
+	}
+	// Keep the ID of the new row in the cache so that requests can be recorded on the job's current state
+	jobState.Id = uuid.New().String()
+	if err := db.writeJob(jobState); err != nil {
 		return err
 	}
 	db.cache.WriteJob(jobState)
 	return nil
 }
 
+// RequeueJob sends a job that was already picked up back to the queue. The job is removed from the cache so that it's
+// dequeued again like a new job.
+func (db DynamoDb) RequeueJob(jobState job.JobState) error {
+	if err := db.WriteJob(jobState); err != nil {
+		return err
+	}
+	db.cache.DeleteJob(jobState.JobId)
+	return nil
+}
+
 func (db DynamoDb) WriteJob(jobState job.JobState) error {
 	// Generate a new UUID for every job update
 	jobState.Id = uuid.New().String()
+	return db.writeJob(jobState)
+}
+
+func (db DynamoDb) writeJob(jobState job.JobState) error {
 	// Set entry expiration
 	jobState.Ttl = time.Now().Add(defaultJobStateTtl)
 	if attributeValues, err := attributevalue.MarshalMapWithOptions(jobState, func(options *attributevalue.EncoderOptions) {
@@ -365,6 +488,47 @@ func (db DynamoDb) UpdateDeployTag(component manager.DeployComponent, deployTag
 	return err
 }
 
+func (db DynamoDb) UpdateBuildVersion(component manager.DeployComponent, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.buildTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: string(component)},
+		},
+		UpdateExpression: aws.String("set #buildInfo.#version = :version"),
+		ExpressionAttributeNames: map[string]string{
+			"#buildInfo": "buildInfo",
+			"#version":   "version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberS{Value: version},
+		},
+	})
+	return err
+}
+
+func (db DynamoDb) UpdateDeployVersion(component manager.DeployComponent, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.buildTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: string(component)},
+		},
+		UpdateExpression: aws.String("set #deployVersion = :version"),
+		ExpressionAttributeNames: map[string]string{
+			"#deployVersion": "deployVersion",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberS{Value: version},
+		},
+	})
+	return err
+}
+
 func (db DynamoDb) GetBuildTags() (map[manager.DeployComponent]string, error) {
 	if buildStates, err := db.getBuildStates(); err != nil {
 		return nil, err
@@ -389,6 +553,92 @@ func (db DynamoDb) GetDeployTags() (map[manager.DeployComponent]string, error) {
 	}
 }
 
+// GetBuildTag returns the most recently built tag for a component, or an empty string if none was recorded
+func (db DynamoDb) GetBuildTag(component manager.DeployComponent) (string, error) {
+	if state, err := db.getBuildState(component); err != nil {
+		return "", err
+	} else {
+		return state.BuildInfo.BuildTag, nil
+	}
+}
+
+// GetDeployTag returns the tag currently deployed for a component, or an empty string if none was recorded. Unlike the
+// tags returned by GetDeployTags, the deployment target recorded along with the tag (e.g. "<tag>,<sha>") is stripped.
+func (db DynamoDb) GetDeployTag(component manager.DeployComponent) (string, error) {
+	if state, err := db.getBuildState(component); err != nil {
+		return "", err
+	} else {
+		return strings.Split(state.DeployTag, ",")[0], nil
+	}
+}
+
+// UpdateDeployJob records the job ID of the last full deployment of a component, so that the deployment can be looked up
+// directly instead of searching through all deployments.
+func (db DynamoDb) UpdateDeployJob(component manager.DeployComponent, jobId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.buildTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: string(component)},
+		},
+		UpdateExpression: aws.String("set #deployJob = :jobId"),
+		ExpressionAttributeNames: map[string]string{
+			"#deployJob": "deployJob",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":jobId": &types.AttributeValueMemberS{Value: jobId},
+		},
+	})
+	return err
+}
+
+// GetDeployJob returns the job ID of the last full deployment of a component, if recorded
+func (db DynamoDb) GetDeployJob(component manager.DeployComponent) (string, error) {
+	if state, err := db.getBuildState(component); err != nil {
+		return "", err
+	} else {
+		return state.DeployJob, nil
+	}
+}
+
+// GetDeployVersions returns the release labels of the deployed tags. Components deployed without a label are omitted.
+func (db DynamoDb) GetDeployVersions() (map[manager.DeployComponent]string, error) {
+	if buildStates, err := db.getBuildStates(); err != nil {
+		return nil, err
+	} else {
+		deployVersions := make(map[manager.DeployComponent]string, len(buildStates))
+		for _, state := range buildStates {
+			if len(state.DeployVersion) > 0 {
+				deployVersions[state.Key] = state.DeployVersion
+			}
+		}
+		return deployVersions, nil
+	}
+}
+
+func (db DynamoDb) getBuildState(component manager.DeployComponent) (*buildState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	if getItemOutput, err := db.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(db.buildTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: string(component)},
+		},
+	}); err != nil {
+		return nil, err
+	} else {
+		state := new(buildState)
+		// A missing item leaves the state empty
+		if err = attributevalue.UnmarshalMapWithOptions(getItemOutput.Item, state); err != nil {
+			return nil, err
+		}
+		return state, nil
+	}
+}
+
 func (db DynamoDb) getBuildStates() ([]buildState, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
 	defer cancel()
@@ -406,3 +656,312 @@ func (db DynamoDb) getBuildStates() ([]buildState, error) {
 		return buildStates, nil
 	}
 }
+
+func (db DynamoDb) WriteLaunchedTask(launchedTask manager.LaunchedTask) error {
+	// Set entry expiration to match that of the job that launched the task
+	launchedTask.Ttl = time.Now().Add(defaultJobStateTtl)
+	if attributeValues, err := attributevalue.MarshalMapWithOptions(launchedTask, func(options *attributevalue.EncoderOptions) {
+		options.EncodeTime = func(time time.Time) (types.AttributeValue, error) {
+			return &types.AttributeValueMemberN{Value: strconv.FormatInt(time.UnixNano(), 10)}, nil
+		}
+	}); err != nil {
+		return err
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+		defer cancel()
+
+		_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(db.taskTable),
+			Item:      attributeValues,
+		})
+		return err
+	}
+}
+
+// ApproveJob records who approved a job waiting for approval. The job manager picks up the approval the next time it
+// advances the job.
+func (db DynamoDb) ApproveJob(jobState job.JobState, approver string) error {
+	if jobState.Stage != job.JobStage_WaitingApproval {
+		return fmt.Errorf("approveJob: job not waiting for approval: %s, %s", jobState.JobId, jobState.Stage)
+	} else {
+		return db.updateJobParams(jobState, map[string]interface{}{job.DeployJobParam_ApprovedBy: approver})
+	}
+}
+
+// CancelJob records a request to cancel a deployment that has been dequeued but hasn't finished yet. The job manager
+// cancels the deployment the next time it advances the job.
+func (db DynamoDb) CancelJob(jobState job.JobState, canceledBy string, rollback bool) error {
+	if jobState.Type != job.JobType_Deploy {
+		return fmt.Errorf("cancelJob: only deployments can be canceled: %s, %s", jobState.JobId, jobState.Type)
+	} else if job.IsFinishedJob(jobState) {
+		return fmt.Errorf("cancelJob: job already finished: %s, %s", jobState.JobId, jobState.Stage)
+	} else {
+		return db.updateJobParams(jobState, map[string]interface{}{
+			job.JobParam_CanceledBy:             canceledBy,
+			job.DeployJobParam_RollbackOnCancel: rollback,
+		})
+	}
+}
+
+// MarkJobHeld records on a queued job that it's being held in the queue, e.g. by maintenance mode. The queued job is
+// updated in place, only if it isn't already marked, so that exactly one manager instance sees this return true and sends
+// the notification for it.
+func (db DynamoDb) MarkJobHeld(jobState job.JobState) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.jobTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: jobState.Id},
+		},
+		UpdateExpression:    aws.String("set #params.#held = :held"),
+		ConditionExpression: aws.String("#stage = :stage and attribute_not_exists(#params.#held)"),
+		ExpressionAttributeNames: map[string]string{
+			"#params": "params",
+			"#held":   job.DeployJobParam_HeldNotified,
+			"#stage":  "stage",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":held":  &types.AttributeValueMemberBOOL{Value: true},
+			":stage": &types.AttributeValueMemberS{Value: string(job.JobStage_Queued)},
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CancelQueuedJob cancels a job that hasn't been dequeued yet, e.g. a duplicate submitted by mistake. The job's lease is
+// claimed first, which fails if a manager instance is advancing the job, and keeps any instance from dequeuing the job
+// afterwards. The job's latest state is then checked again, in case it was dequeued before the lease was claimed. The
+// canceled job state is returned so that the caller can send a notification.
+func (db DynamoDb) CancelQueuedJob(queuedJob job.JobState, canceledBy string) (job.JobState, error) {
+	if queuedJob.Stage != job.JobStage_Queued {
+		return job.JobState{}, fmt.Errorf("cancelQueuedJob: %w: %s, %s", manager.Error_JobNotQueued, queuedJob.JobId, queuedJob.Stage)
+	} else if claimed, err := db.claimQueuedJobLease(queuedJob.JobId); err != nil {
+		return job.JobState{}, err
+	} else if !claimed {
+		return job.JobState{}, fmt.Errorf("cancelQueuedJob: %w: %s", manager.Error_JobNotQueued, queuedJob.JobId)
+	} else if latestJob, err := db.LatestJobState(queuedJob.JobId); (err != nil) || (latestJob.Id != queuedJob.Id) {
+		// Give the lease back so that the instance that picked up the job can keep advancing it
+		if releaseErr := db.releaseLease(queuedJob.JobId, leaseOwner_Canceled); releaseErr != nil {
+			log.Printf("cancelQueuedJob: release lease failed: %s, %v", queuedJob.JobId, releaseErr)
+		}
+		if err != nil {
+			return job.JobState{}, err
+		}
+		return job.JobState{}, fmt.Errorf("cancelQueuedJob: %w: %s, %s", manager.Error_JobNotQueued, queuedJob.JobId, latestJob.Stage)
+	}
+	// Copy the parameters so that the queued job state isn't modified in place
+	jobState := queuedJob
+	jobState.Params = make(map[string]interface{}, len(queuedJob.Params)+1)
+	for k, v := range queuedJob.Params {
+		jobState.Params[k] = v
+	}
+	jobState.Params[job.JobParam_CanceledBy] = canceledBy
+	jobState.Stage = job.JobStage_Canceled
+	jobState.Ts = time.Now()
+	return jobState, db.AdvanceJob(jobState)
+}
+
+// LatestJobState returns the most recent state of a job written by any manager instance
+func (db DynamoDb) LatestJobState(jobId string) (job.JobState, error) {
+	ttlCursor := time.Now().AddDate(0, 0, -manager.DefaultTtlDays)
+	// Job states are looked up by type, so find the job's type first, from the cache or from the job's queued state
+	var jobType job.JobType
+	if cachedJob, found := db.cache.JobById(jobId); found {
+		jobType = cachedJob.Type
+	} else if err := db.iterateByStage(job.JobStage_Queued, ttlCursor, false, func(js job.JobState) bool {
+		if js.JobId == jobId {
+			jobType = js.Type
+			// Stop iterating, we found the job we were looking for.
+			return false
+		}
+		return true
+	}); err != nil {
+		return job.JobState{}, err
+	}
+	if len(jobType) == 0 {
+		return job.JobState{}, fmt.Errorf("latestJobState: job not found: %s", jobId)
+	}
+	var latestJob *job.JobState
+	// Iterate the DB in descending order of timestamp so that the most recent state of the job is found first
+	if err := db.iterateByType(jobType, ttlCursor, false, func(js job.JobState) bool {
+		if js.JobId == jobId {
+			latestJob = &js
+			// Stop iterating, we found the job we were looking for.
+			return false
+		}
+		return true
+	}); err != nil {
+		return job.JobState{}, err
+	} else if latestJob == nil {
+		return job.JobState{}, fmt.Errorf("latestJobState: job not found: %s", jobId)
+	}
+	return *latestJob, nil
+}
+
+// updateJobParams records parameters on the current state of a job without changing its stage. The job's row is updated
+// in place, on the condition that it's still in the expected stage, instead of writing a new state that could race the
+// manager instance advancing the job. That instance picks up the parameters the next time it advances the job.
+func (db DynamoDb) updateJobParams(jobState job.JobState, params map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	names := map[string]string{
+		"#params": "params",
+		"#stage":  "stage",
+	}
+	values := map[string]types.AttributeValue{
+		":stage": &types.AttributeValueMemberS{Value: string(jobState.Stage)},
+	}
+	updates := make([]string, 0, len(params))
+	i := 0
+	for k, v := range params {
+		attributeValue, err := attributevalue.Marshal(v)
+		if err != nil {
+			return err
+		}
+		names[fmt.Sprintf("#p%d", i)] = k
+		values[fmt.Sprintf(":p%d", i)] = attributeValue
+		updates = append(updates, fmt.Sprintf("#params.#p%d = :p%d", i, i))
+		i++
+	}
+	if _, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.jobTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: jobState.Id},
+		},
+		UpdateExpression:          aws.String("set " + strings.Join(updates, ", ")),
+		ConditionExpression:       aws.String("#stage = :stage"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}); isConditionFailed(err) {
+		return fmt.Errorf("updateJobParams: %w: %s, %s", manager.Error_JobStateChanged, jobState.JobId, jobState.Stage)
+	} else if err != nil {
+		return err
+	}
+	// Update the cached job too, if this instance has the same state of the job
+	if cachedJob, found := db.cache.JobById(jobState.JobId); found && (cachedJob.Id == jobState.Id) {
+		db.cache.WriteJob(withJobRequests(cachedJob, params))
+	}
+	return nil
+}
+
+// SyncJobParams returns a job state updated with any requests recorded on the job's current state in the database, e.g.
+// by another manager instance.
+func (db DynamoDb) SyncJobParams(jobState job.JobState) (job.JobState, error) {
+	if requests, err := db.jobRequests(jobState); err != nil {
+		return jobState, err
+	} else if syncedJob := withJobRequests(jobState, requests); len(syncedJob.Params) != len(jobState.Params) {
+		db.cache.WriteJob(syncedJob)
+		return syncedJob, nil
+	}
+	return jobState, nil
+}
+
+// jobRequests reads the requests recorded on a state of a job from the database
+func (db DynamoDb) jobRequests(jobState job.JobState) (map[string]interface{}, error) {
+	if len(jobState.Id) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	output, err := db.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(db.jobTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: jobState.Id},
+		},
+		ConsistentRead:           aws.Bool(true),
+		ProjectionExpression:     aws.String("#params"),
+		ExpressionAttributeNames: map[string]string{"#params": "params"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var storedJob job.JobState
+	if err = attributevalue.UnmarshalMap(output.Item, &storedJob); err != nil {
+		return nil, err
+	}
+	requests := make(map[string]interface{})
+	for _, param := range jobRequestParams {
+		if value, found := storedJob.Params[param]; found {
+			requests[param] = value
+		}
+	}
+	return requests, nil
+}
+
+// withJobRequests returns a job state with the specified requests added to it, unless already present. The parameters are
+// copied so that the original job state isn't modified in place.
+func withJobRequests(jobState job.JobState, requests map[string]interface{}) job.JobState {
+	params := make(map[string]interface{}, len(jobState.Params)+len(requests))
+	for k, v := range jobState.Params {
+		params[k] = v
+	}
+	updated := false
+	for k, v := range requests {
+		if _, found := params[k]; !found {
+			params[k] = v
+			updated = true
+		}
+	}
+	if updated {
+		jobState.Params = params
+	}
+	return jobState
+}
+
+// Ping checks that the database is reachable by describing the job table, which is cheap and doesn't consume capacity
+func (db DynamoDb) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(db.jobTable)})
+	return err
+}
+
+func (db DynamoDb) LaunchedTasks(jobId string) ([]manager.LaunchedTask, error) {
+	launchedTasks := make([]manager.LaunchedTask, 0)
+	p := dynamodb.NewQueryPaginator(db.client, &dynamodb.QueryInput{
+		TableName:              aws.String(db.taskTable),
+		KeyConditionExpression: aws.String("#job = :job"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":job": &types.AttributeValueMemberS{Value: jobId},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#job": "job",
+		},
+	})
+	for p.HasMorePages() {
+		if err := func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+			defer cancel()
+
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			var tasksPage []manager.LaunchedTask
+			if err = attributevalue.UnmarshalListOfMapsWithOptions(page.Items, &tasksPage, func(options *attributevalue.DecoderOptions) {
+				options.DecodeTime = attributevalue.DecodeTimeAttributes{
+					S: utils.TsDecode,
+					N: utils.TsDecode,
+				}
+			}); err != nil {
+				log.Printf("launchedTasks: unable to unmarshal launched tasks: %s, %v", jobId, err)
+				return err
+			}
+			launchedTasks = append(launchedTasks, tasksPage...)
+			return nil
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return launchedTasks, nil
+}
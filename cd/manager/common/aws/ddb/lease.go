@@ -0,0 +1,203 @@
+package ddb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/aws/utils"
+)
+
+// Job leases make sure that only one manager instance advances a job at a time when multiple instances are running. A
+// lease is held by writing an entry for the job to the lease table, conditioned on there being no unexpired lease held
+// by another instance. Leases expire on their own so that the jobs of an instance that crashed are picked up by other
+// instances, and expired leases are eventually deleted by DynamoDB using the lease's TTL attribute.
+
+// Owner of the leases of jobs canceled before being dequeued
+const leaseOwner_Canceled = "canceled"
+
+// How long to keep a lease around after it expires before letting DynamoDB delete it
+const leaseTtlMargin = 24 * time.Hour
+
+func (db DynamoDb) createLeaseTable() error {
+	// Create the table if it doesn't already exist
+	createTableInput := dynamodb.CreateTableInput{
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("job"),
+				AttributeType: "S",
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("job"),
+				KeyType:       "HASH",
+			},
+		},
+		TableName: aws.String(db.leaseTable),
+	}
+	if err := utils.CreateTable(context.Background(), db.client, &createTableInput); err != nil {
+		return err
+	}
+	return db.enableLeaseTtl()
+}
+
+// enableLeaseTtl turns on TTL for the lease table, so that leases left behind by instances that crashed are cleaned up
+func (db DynamoDb) enableLeaseTtl() error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	if output, err := db.client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(db.leaseTable),
+	}); err != nil {
+		return err
+	} else if (output.TimeToLiveDescription != nil) &&
+		((output.TimeToLiveDescription.TimeToLiveStatus == types.TimeToLiveStatusEnabled) ||
+			(output.TimeToLiveDescription.TimeToLiveStatus == types.TimeToLiveStatusEnabling)) {
+		return nil
+	}
+	_, err := db.client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(db.leaseTable),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("ttl"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// AcquireJobLease takes or extends the lease on a job. It returns false if another instance holds an unexpired lease.
+func (db DynamoDb) AcquireJobLease(jobId string, duration time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	now := time.Now()
+	_, err := db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.leaseTable),
+		Item: map[string]types.AttributeValue{
+			"job":     &types.AttributeValueMemberS{Value: jobId},
+			"owner":   &types.AttributeValueMemberS{Value: db.leaseOwner},
+			"expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(duration).UnixNano(), 10)},
+			"ttl":     leaseTtl(now.Add(duration)),
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#job) OR #owner = :owner OR #expires < :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#job":     "job",
+			"#owner":   "owner",
+			"#expires": "expires",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: db.leaseOwner},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixNano(), 10)},
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// claimQueuedJobLease takes the lease on a job that no manager instance has picked up yet, on behalf of a request to cancel
+// the job. The lease doesn't expire until the job has aged out of the queue, so no instance can acquire it and dequeue the
+// job. It returns false if the job was already picked up.
+func (db DynamoDb) claimQueuedJobLease(jobId string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	expires := time.Now().AddDate(0, 0, manager.DefaultTtlDays)
+	_, err := db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.leaseTable),
+		Item: map[string]types.AttributeValue{
+			"job":     &types.AttributeValueMemberS{Value: jobId},
+			"owner":   &types.AttributeValueMemberS{Value: leaseOwner_Canceled},
+			"expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.UnixNano(), 10)},
+			"ttl":     leaseTtl(expires),
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#job)"),
+		ExpressionAttributeNames: map[string]string{
+			"#job": "job",
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RenewJobLease extends a lease held by this instance. It returns manager.Error_LeaseLost if the lease expired and was
+// taken by another instance in the meantime.
+func (db DynamoDb) RenewJobLease(jobId string, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	expires := time.Now().Add(duration)
+	_, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.leaseTable),
+		Key: map[string]types.AttributeValue{
+			"job": &types.AttributeValueMemberS{Value: jobId},
+		},
+		UpdateExpression:    aws.String("set #expires = :expires, #ttl = :ttl"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner":   "owner",
+			"#expires": "expires",
+			"#ttl":     "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":   &types.AttributeValueMemberS{Value: db.leaseOwner},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.UnixNano(), 10)},
+			":ttl":     leaseTtl(expires),
+		},
+	})
+	if isConditionFailed(err) {
+		return manager.Error_LeaseLost
+	}
+	return err
+}
+
+// ReleaseJobLease gives up a lease held by this instance so that other instances don't have to wait for it to expire.
+// Releasing a lease that isn't held by this instance does nothing.
+func (db DynamoDb) ReleaseJobLease(jobId string) error {
+	return db.releaseLease(jobId, db.leaseOwner)
+}
+
+// releaseLease deletes the lease on a job, if it's held by the specified owner
+func (db DynamoDb) releaseLease(jobId, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(db.leaseTable),
+		Key: map[string]types.AttributeValue{
+			"job": &types.AttributeValueMemberS{Value: jobId},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// leaseTtl returns the TTL attribute of a lease expiring at the specified time. DynamoDB expects TTLs in Unix seconds.
+func leaseTtl(expires time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Add(leaseTtlMargin).Unix(), 10)}
+}
+
+func isConditionFailed(err error) bool {
+	var conditionErr *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionErr)
+}
@@ -0,0 +1,85 @@
+package ddb
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/aws/utils"
+)
+
+// Settings are stored in the database, instead of in the environment of each manager instance, so that they apply to
+// all instances and survive restarts.
+
+const settingsKey_Maintenance = "maintenance"
+
+func (db DynamoDb) createSettingsTable() error {
+	// Create the table if it doesn't already exist
+	createTableInput := dynamodb.CreateTableInput{
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("key"),
+				AttributeType: "S",
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("key"),
+				KeyType:       "HASH",
+			},
+		},
+		TableName: aws.String(db.settingsTable),
+	}
+	return utils.CreateTable(context.Background(), db.client, &createTableInput)
+}
+
+// GetMaintenance returns the maintenance flag. A flag that was never set is returned as cleared.
+func (db DynamoDb) GetMaintenance() (*manager.Maintenance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	if getItemOutput, err := db.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(db.settingsTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: settingsKey_Maintenance},
+		},
+		ConsistentRead: aws.Bool(true),
+	}); err != nil {
+		return nil, err
+	} else {
+		maintenance := new(manager.Maintenance)
+		if err = attributevalue.UnmarshalMapWithOptions(getItemOutput.Item, maintenance, func(options *attributevalue.DecoderOptions) {
+			options.DecodeTime = attributevalue.DecodeTimeAttributes{
+				S: utils.TsDecode,
+				N: utils.TsDecode,
+			}
+		}); err != nil {
+			return nil, err
+		}
+		return maintenance, nil
+	}
+}
+
+// SetMaintenance sets or clears the maintenance flag
+func (db DynamoDb) SetMaintenance(enabled bool, setBy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	_, err := db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.settingsTable),
+		Item: map[string]types.AttributeValue{
+			"key":     &types.AttributeValueMemberS{Value: settingsKey_Maintenance},
+			"enabled": &types.AttributeValueMemberBOOL{Value: enabled},
+			"setBy":   &types.AttributeValueMemberS{Value: setBy},
+			"ts":      &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().UnixNano(), 10)},
+		},
+	})
+	return err
+}
@@ -2,19 +2,34 @@ package ecs
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 
 	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/aws/config"
 )
 
 var _ manager.Deployment = &Ecs{}
@@ -22,69 +37,454 @@ var _ manager.Deployment = &Ecs{}
 type Ecs struct {
 	ecsClient *ecs.Client
 	ssmClient *ssm.Client
+	ecrClient *ecr.Client
+	elbClient *elb.Client
 	env       manager.EnvType
+	region    string
 	ecrUri    string
+	// Whether services must be stable by the same measure as the AWS "ServicesStable" waiter to be considered deployed
+	strictServiceCheck bool
+	// Number of tasks from a new service deployment that are allowed to fail before the service is considered to be
+	// crash-looping. The check is disabled if 0.
+	maxFailedTasks int32
+	// Time to wait after updating a single-instance service before stopping its running tasks, so that connections to
+	// the old tasks (e.g. IPFS peers) can drain. No delay if 0.
+	drainDelay time.Duration
+	// Fargate platform version for launched tasks and created services, e.g. "1.4.0". AWS uses "LATEST" if not set.
+	platformVersion string
+	// Whether the new tasks of services behind a load balancer must be healthy in their target groups to be considered
+	// deployed, and not just running. This only applies when the strict service check is disabled, since ECS already
+	// waits for health checks to pass before considering a deployment complete.
+	checkTargetHealth bool
+	// SSM path with environment overrides (e.g. feature flags) applied to all tasks launched in this environment
+	defaultOverridesPath string
+	// Whether services scaled down to 0 (e.g. for maintenance) stay scaled down when deployed, with only their task
+	// definition updated, instead of being scaled up to the number of replicas in the layout.
+	preserveScaledDown bool
+	// Default overrides last read from SSM, shared by all copies of this object
+	defaultOverridesCache *overridesCache
+	// Whether SSM parameters are read with decryption up front, instead of only after finding a SecureString
+	ssmWithDecryption bool
+}
+
+// overridesCache holds environment overrides and secrets read from SSM
+type overridesCache struct {
+	mu        sync.Mutex
+	overrides map[string]string
+	secrets   map[string]manager.SecretRef
+	ts        time.Time
 }
 
 type ecsFailure struct {
 	arn, detail, reason string
 }
 
+var _ manager.ErrorCoder = ecsFailures{}
+
+// ecsFailures are the failures reported by an ECS API call, e.g. when tasks could not be launched
+type ecsFailures []ecsFailure
+
+func (f ecsFailures) Error() string {
+	return fmt.Sprintf("%v", []ecsFailure(f))
+}
+
+// ErrorCode classifies the failures based on the first one with a recognizable reason. Also see
+// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/api_failures_messages.html.
+func (f ecsFailures) ErrorCode() manager.ErrorCode {
+	for _, failure := range f {
+		if strings.HasPrefix(failure.reason, "RESOURCE:") || strings.Contains(failure.reason, "Capacity") {
+			return manager.ErrorCode_Capacity
+		} else if strings.Contains(failure.reason, "CannotPullContainer") {
+			return manager.ErrorCode_ImageNotFound
+		} else if strings.Contains(strings.ToLower(failure.reason), "throttl") {
+			return manager.ErrorCode_Throttling
+		}
+	}
+	return manager.ErrorCode_Unknown
+}
+
 const (
 	deployType_Service string = "service"
 	deployType_Task    string = "task"
+	deployType_Runner  string = "runner"
 )
 
 const resourceTag = "Ceramic"
+const shaTag = "Sha"
+const versionTag = "Version"
+const jobIdTag = "JobId"
+const timestampTag = "Timestamp"
+const maxDescribeTasks = 100
+const maxStartedByLen = 36 // ECS limit on the length of the "startedBy" tag on tasks
+const fargateCapacityProviderPfx = "FARGATE"
+const requestedByTag = "RequestedBy"
+const maxStopReasonLen = 255
 const publicEcrUri = "public.ecr.aws/r5b3e0r5/3box/"
+const prepullFamilySuffix = "-prepull"
+const secretsFamilySuffix = "-secrets"
+const defaultOverridesCacheTtl = 5 * time.Minute
+const defaultMaxFailedTasks int32 = 3
+const ecsFailureReason_Missing = "MISSING"
+const ecsServiceStatus_Inactive = "INACTIVE"
+const ecsStoppedReason_CannotPull = "CannotPullContainer"
+const ecsTaskSetStatus_Primary = "PRIMARY"
+const ecsAttachmentType_Eni = "ElasticNetworkInterface"
+const ecsAttachmentDetail_PrivateIp = "privateIPv4Address"
+const primaryContainerLabel = "cd-manager.primary" // Docker label marking a task definition's primary container
+
+// Parts of ECS service event messages that point to a problem with a deployment
+var ecsNotableEventMessages = []string{"unable to place", "unhealthy", "failed", "insufficient"}
 
-func NewEcs(cfg aws.Config) manager.Deployment {
-	ecrUri := os.Getenv("AWS_ACCOUNT_ID") + ".dkr.ecr." + os.Getenv("AWS_REGION") + ".amazonaws.com/"
-	return &Ecs{ecs.NewFromConfig(cfg), ssm.NewFromConfig(cfg), manager.EnvType(os.Getenv(manager.EnvVar_Env)), ecrUri}
+func NewEcs(cfg aws.Config) (manager.Deployment, error) {
+	if e, err := newEcs(cfg); err != nil {
+		return nil, err
+	} else {
+		return &e, nil
+	}
 }
 
-func (e Ecs) LaunchServiceTask(cluster, service, family, container string, overrides map[string]string) (string, error) {
-	if output, err := e.describeEcsService(cluster, service); err != nil {
-		return "", err
+func newEcs(cfg aws.Config) (Ecs, error) {
+	// Validate the configuration up front, otherwise a misconfiguration would only surface as malformed ECR URIs or
+	// cluster names in the middle of a deployment.
+	env, err := manager.ParseEnvType(os.Getenv(manager.EnvVar_Env))
+	if err != nil {
+		return Ecs{}, fmt.Errorf("newEcs: invalid %s: %w", manager.EnvVar_Env, err)
+	}
+	// Images are pulled from the ECR registry in the same region as the cluster
+	if ecrUri, err := buildEcrUri(os.Getenv("AWS_ACCOUNT_ID"), cfg.Region); err != nil {
+		return Ecs{}, fmt.Errorf("newEcs: invalid AWS_ACCOUNT_ID or AWS_REGION: %w", err)
 	} else {
-		return e.runEcsTask(cluster, family, container, output.Services[0].NetworkConfiguration, overrides)
+		// Reject malformed values instead of silently falling back to the lenient service and target health checks
+		strictServiceCheck := false
+		if configStrictServiceCheck, found := os.LookupEnv("STRICT_SERVICE_CHECK"); found && (len(configStrictServiceCheck) > 0) {
+			if strictServiceCheck, err = strconv.ParseBool(configStrictServiceCheck); err != nil {
+				return Ecs{}, fmt.Errorf("newEcs: invalid STRICT_SERVICE_CHECK: %w", err)
+			}
+		}
+		checkTargetHealth := false
+		if configCheckTargetHealth, found := os.LookupEnv("CHECK_TARGET_HEALTH"); found && (len(configCheckTargetHealth) > 0) {
+			if checkTargetHealth, err = strconv.ParseBool(configCheckTargetHealth); err != nil {
+				return Ecs{}, fmt.Errorf("newEcs: invalid CHECK_TARGET_HEALTH: %w", err)
+			}
+		}
+		maxFailedTasks := defaultMaxFailedTasks
+		if configMaxFailedTasks, found := os.LookupEnv("MAX_FAILED_TASKS"); found && (len(configMaxFailedTasks) > 0) {
+			if parsedMaxFailedTasks, err := strconv.ParseInt(configMaxFailedTasks, 10, 32); err != nil {
+				return Ecs{}, fmt.Errorf("newEcs: invalid MAX_FAILED_TASKS: %w", err)
+			} else if parsedMaxFailedTasks < 0 {
+				return Ecs{}, fmt.Errorf("newEcs: invalid MAX_FAILED_TASKS: must not be negative: %d", parsedMaxFailedTasks)
+			} else {
+				maxFailedTasks = int32(parsedMaxFailedTasks)
+			}
+		}
+		var drainDelay time.Duration
+		if configDrainDelay, found := os.LookupEnv("SERVICE_DRAIN_DELAY"); found && (len(configDrainDelay) > 0) {
+			if parsedDrainDelay, err := time.ParseDuration(configDrainDelay); err != nil {
+				return Ecs{}, fmt.Errorf("newEcs: invalid SERVICE_DRAIN_DELAY: %w", err)
+			} else if parsedDrainDelay < 0 {
+				return Ecs{}, fmt.Errorf("newEcs: invalid SERVICE_DRAIN_DELAY: must not be negative: %s", parsedDrainDelay)
+			} else {
+				drainDelay = parsedDrainDelay
+			}
+		}
+		// Pin the platform version so that a new Fargate platform version can't change the behavior of tasks unannounced
+		platformVersion := os.Getenv("FARGATE_PLATFORM_VERSION")
+		defaultOverridesPath := os.Getenv("DEFAULT_OVERRIDES_PATH")
+		preserveScaledDown := true
+		if configPreserveScaledDown, found := os.LookupEnv("PRESERVE_SCALED_DOWN"); found && (len(configPreserveScaledDown) > 0) {
+			if preserveScaledDown, err = strconv.ParseBool(configPreserveScaledDown); err != nil {
+				return Ecs{}, fmt.Errorf("newEcs: invalid PRESERVE_SCALED_DOWN: %w", err)
+			}
+		}
+		ssmWithDecryption := false
+		if configSsmWithDecryption, found := os.LookupEnv("SSM_WITH_DECRYPTION"); found && (len(configSsmWithDecryption) > 0) {
+			if ssmWithDecryption, err = strconv.ParseBool(configSsmWithDecryption); err != nil {
+				return Ecs{}, fmt.Errorf("newEcs: invalid SSM_WITH_DECRYPTION: %w", err)
+			}
+		}
+		return Ecs{
+			ecs.NewFromConfig(cfg, func(o *ecs.Options) {
+				o.APIOptions = append(o.APIOptions, config.CallMetricsOptions()...)
+			}),
+			ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+				o.APIOptions = append(o.APIOptions, config.CallMetricsOptions()...)
+			}),
+			ecr.NewFromConfig(cfg, func(o *ecr.Options) {
+				o.APIOptions = append(o.APIOptions, config.CallMetricsOptions()...)
+			}),
+			elb.NewFromConfig(cfg, func(o *elb.Options) {
+				o.APIOptions = append(o.APIOptions, config.CallMetricsOptions()...)
+			}),
+			env,
+			cfg.Region,
+			ecrUri,
+			strictServiceCheck,
+			maxFailedTasks,
+			drainDelay,
+			platformVersion,
+			checkTargetHealth,
+			defaultOverridesPath,
+			preserveScaledDown,
+			new(overridesCache),
+			ssmWithDecryption,
+		}, nil
 	}
 }
 
-func (e Ecs) LaunchTask(cluster, family, container, vpcConfigParam string, overrides map[string]string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+// buildEcrUri returns the URI of the private ECR registry for an account and region, e.g.
+// "967314784947.dkr.ecr.us-east-2.amazonaws.com/".
+func buildEcrUri(accountId, region string) (string, error) {
+	if len(accountId) == 0 {
+		return "", fmt.Errorf("buildEcrUri: missing account id")
+	} else if len(region) == 0 {
+		return "", fmt.Errorf("buildEcrUri: missing region")
+	}
+	return accountId + ".dkr.ecr." + region + ".amazonaws.com/", nil
+}
 
-	// Get the VPC configuration from SSM
-	input := &ssm.GetParameterInput{
-		Name:           aws.String(vpcConfigParam),
-		WithDecryption: false,
+// LaunchServiceTask launches a task with the same network configuration as a service. Only the job, requester,
+// overrides, and secrets from the launch options apply.
+func (e Ecs) LaunchServiceTask(ctx context.Context, cluster, service, family, container string, opts manager.LaunchOptions) (string, error) {
+	if output, err := e.describeEcsService(ctx, cluster, service); err != nil {
+		return "", err
+	} else {
+		// Service tasks always run the command from their task definition
+		return e.runEcsTask(ctx, cluster, family, container, output.Services[0].NetworkConfiguration, manager.LaunchOptions{
+			JobId:       opts.JobId,
+			RequestedBy: opts.RequestedBy,
+			Overrides:   opts.Overrides,
+			Secrets:     opts.Secrets,
+		})
+	}
+}
+
+// LaunchTask launches a standalone task. If a command is specified, it replaces the default command from the task
+// definition for the specified container, e.g. to run a one-off migration sub-command. Unless a network configuration
+// is specified, it's composed from VPC configurations stored in SSM (see mergeSsmNetworkConfigs). If an SSM path is
+// specified, all parameters under it are passed to the task as environment overrides or secrets (see getSsmOverrides),
+// with the explicitly specified overrides and secrets taking precedence. The environment's default overrides apply to all
+// launched tasks (see defaultOverrides).
+func (e Ecs) LaunchTask(ctx context.Context, cluster, family, container string, opts manager.LaunchOptions) (string, error) {
+	if len(opts.OverridesPath) > 0 {
+		if ssmOverrides, ssmSecrets, err := e.getSsmOverrides(ctx, opts.OverridesPath); err != nil {
+			log.Printf("launchTask: get ssm overrides error: %s, %s, %s, %v", cluster, family, opts.OverridesPath, err)
+			return "", err
+		} else {
+			opts.Overrides, opts.Secrets = mergeEnvironment(ssmOverrides, ssmSecrets, opts.Overrides, opts.Secrets)
+		}
+	}
+	// Use the explicitly specified network configuration, if any
+	if networkConfig := opts.NetworkConfig; networkConfig != nil {
+		assignPublicIp := types.AssignPublicIpDisabled
+		if networkConfig.AssignPublicIp {
+			assignPublicIp = types.AssignPublicIpEnabled
+		}
+		vpcConfig := types.AwsVpcConfiguration{
+			Subnets:        networkConfig.Subnets,
+			SecurityGroups: networkConfig.SecurityGroups,
+			AssignPublicIp: assignPublicIp,
+		}
+		return e.runEcsTask(ctx, cluster, family, container, &types.NetworkConfiguration{AwsvpcConfiguration: &vpcConfig}, opts)
 	}
-	output, err := e.ssmClient.GetParameter(ctx, input)
+	// Otherwise, get the VPC configuration from SSM
+	vpcNetworkConfig, err := e.mergeSsmNetworkConfigs(ctx, opts.VpcConfigParams)
 	if err != nil {
-		log.Printf("launchTask: get vpc config error: %s, %s, %s, %+v, %v", cluster, family, vpcConfigParam, overrides, err)
+		log.Printf("launchTask: get vpc config error: %s, %s, %v, %v", cluster, family, opts.VpcConfigParams, err)
 		return "", err
 	}
+	return e.runEcsTask(ctx, cluster, family, container, vpcNetworkConfig, opts)
+}
+
+// getSsmNetworkConfig reads a VPC configuration stored as JSON in SSM
+func (e Ecs) getSsmNetworkConfig(ctx context.Context, vpcConfigParam string) (*types.NetworkConfiguration, error) {
+	vpcConfigValue, err := e.getSsmParameter(ctx, vpcConfigParam)
+	if err != nil {
+		return nil, err
+	}
+	var vpcConfig types.AwsVpcConfiguration
+	if err = json.Unmarshal([]byte(vpcConfigValue), &vpcConfig); err != nil {
+		log.Printf("getSsmNetworkConfig: error unmarshaling network configuration: %s, %v", vpcConfigParam, err)
+		return nil, fmt.Errorf("getSsmNetworkConfig: invalid vpc config in %s: %w", vpcConfigParam, err)
+	}
+	return &types.NetworkConfiguration{AwsvpcConfiguration: &vpcConfig}, nil
+}
+
+// mergeSsmNetworkConfigs composes a VPC configuration from several configurations stored in SSM, e.g. the subnets
+// shared by all tasks and a security group for a specific workload. Subnets and security groups from later parameters
+// are appended to the ones already found, while a public IP setting from a later parameter overrides earlier ones. The
+// merged configuration must include at least one subnet.
+func (e Ecs) mergeSsmNetworkConfigs(ctx context.Context, vpcConfigParams []string) (*types.NetworkConfiguration, error) {
+	if len(vpcConfigParams) == 0 {
+		return nil, fmt.Errorf("mergeSsmNetworkConfigs: missing vpc config params")
+	}
 	var vpcConfig types.AwsVpcConfiguration
-	if err = json.Unmarshal([]byte(*output.Parameter.Value), &vpcConfig); err != nil {
-		log.Printf("launchTask: error unmarshaling worker network configuration: %s, %s, %s, %+v, %v", cluster, family, vpcConfigParam, overrides, err)
+	for _, vpcConfigParam := range vpcConfigParams {
+		if networkConfig, err := e.getSsmNetworkConfig(ctx, vpcConfigParam); err != nil {
+			return nil, err
+		} else {
+			paramVpcConfig := networkConfig.AwsvpcConfiguration
+			for _, subnet := range paramVpcConfig.Subnets {
+				if !slices.Contains(vpcConfig.Subnets, subnet) {
+					vpcConfig.Subnets = append(vpcConfig.Subnets, subnet)
+				}
+			}
+			for _, securityGroup := range paramVpcConfig.SecurityGroups {
+				if !slices.Contains(vpcConfig.SecurityGroups, securityGroup) {
+					vpcConfig.SecurityGroups = append(vpcConfig.SecurityGroups, securityGroup)
+				}
+			}
+			if len(paramVpcConfig.AssignPublicIp) > 0 {
+				vpcConfig.AssignPublicIp = paramVpcConfig.AssignPublicIp
+			}
+		}
+	}
+	if len(vpcConfig.Subnets) == 0 {
+		return nil, fmt.Errorf("mergeSsmNetworkConfigs: no subnets in vpc config: %v", vpcConfigParams)
+	}
+	return &types.NetworkConfiguration{AwsvpcConfiguration: &vpcConfig}, nil
+}
+
+// getSsmOverrides reads all parameters under an SSM path, including nested paths, as environment variables. Variable
+// names are the parameter names relative to the path, with any remaining "/" replaced by "_", e.g. the parameter
+// "/ceramic/dev/anchor/ETH_RPC_URL" under the path "/ceramic/dev/anchor" becomes "ETH_RPC_URL".
+//
+// SecureString parameters are never decrypted here. They are returned as secrets referring to the parameter so that ECS
+// injects them into the container, and their values don't show up in the task's overrides or in the logs.
+func (e Ecs) getSsmOverrides(ctx context.Context, path string) (map[string]string, map[string]manager.SecretRef, error) {
+	path = "/" + strings.Trim(path, "/")
+	overrides := make(map[string]string)
+	secrets := make(map[string]manager.SecretRef)
+	p := ssm.NewGetParametersByPathPaginator(e.ssmClient, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(false),
+	})
+	for p.HasMorePages() {
+		httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+		page, err := p.NextPage(httpCtx)
+		httpCancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, parameter := range page.Parameters {
+			name := strings.ReplaceAll(strings.TrimPrefix(aws.ToString(parameter.Name), path+"/"), "/", "_")
+			if parameter.Type == ssmTypes.ParameterTypeSecureString {
+				secrets[name] = manager.SecretRef{ValueFrom: aws.ToString(parameter.ARN)}
+			} else {
+				overrides[name] = aws.ToString(parameter.Value)
+			}
+		}
+	}
+	return overrides, secrets, nil
+}
+
+// mergeEnvironment merges two sets of environment overrides and secrets, with the second set taking precedence. A
+// variable can only come from one of overrides or secrets, so a variable from the second set replaces the variable with
+// the same name from the first set in both.
+func mergeEnvironment(baseOverrides map[string]string, baseSecrets map[string]manager.SecretRef, overrides map[string]string, secrets map[string]manager.SecretRef) (map[string]string, map[string]manager.SecretRef) {
+	mergedOverrides := make(map[string]string, len(baseOverrides)+len(overrides))
+	mergedSecrets := make(map[string]manager.SecretRef, len(baseSecrets)+len(secrets))
+	for k, v := range baseOverrides {
+		mergedOverrides[k] = v
+	}
+	for k, v := range baseSecrets {
+		mergedSecrets[k] = v
+	}
+	for k, v := range overrides {
+		mergedOverrides[k] = v
+		delete(mergedSecrets, k)
+	}
+	for k, v := range secrets {
+		mergedSecrets[k] = v
+		delete(mergedOverrides, k)
+	}
+	return mergedOverrides, mergedSecrets
+}
+
+// environmentNames returns the sorted names of environment overrides, so that overrides can be logged without their
+// values
+func environmentNames(overrides map[string]string) []string {
+	names := make([]string, 0, len(overrides))
+	for k := range overrides {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultOverrides returns the environment's default overrides and secrets, if configured, which apply to all launched
+// tasks. The overrides and secrets for a launch take precedence, so that defaults like feature flags can still be changed
+// for one task. The defaults are cached for a few minutes so that each launch doesn't need to read them from SSM. The
+// returned maps must not be modified.
+func (e Ecs) defaultOverrides(ctx context.Context) (map[string]string, map[string]manager.SecretRef, error) {
+	if len(e.defaultOverridesPath) == 0 {
+		return nil, nil, nil
+	}
+	c := e.defaultOverridesCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.ts.IsZero() && (time.Since(c.ts) < defaultOverridesCacheTtl) {
+		return c.overrides, c.secrets, nil
+	}
+	overrides, secrets, err := e.getSsmOverrides(ctx, e.defaultOverridesPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.overrides, c.secrets, c.ts = overrides, secrets, time.Now()
+	return overrides, secrets, nil
+}
+
+// withTraceContext adds the trace context of the job launching a task, if any, to the task's environment so that the
+// task can continue the job's trace. Explicit overrides take precedence.
+func withTraceContext(ctx context.Context, overrides map[string]string) map[string]string {
+	traceContext := manager.TraceContext(ctx)
+	if len(traceContext) == 0 {
+		return overrides
+	}
+	tracedOverrides := make(map[string]string, len(traceContext)+len(overrides))
+	for k, v := range traceContext {
+		tracedOverrides[k] = v
+	}
+	for k, v := range overrides {
+		tracedOverrides[k] = v
+	}
+	return tracedOverrides
+}
+
+// getSsmParameter reads a parameter from SSM. Parameters are read without decryption by default, unless
+// SSM_WITH_DECRYPTION is set. If the parameter turns out to be a SecureString, it is read again with decryption so that
+// callers always get the plaintext value.
+func (e Ecs) getSsmParameter(ctx context.Context, name string) (string, error) {
+	if output, err := e.getSsmParameterOutput(ctx, name, e.ssmWithDecryption); err != nil {
 		return "", err
+	} else if !e.ssmWithDecryption && (output.Parameter.Type == "SecureString") {
+		if output, err = e.getSsmParameterOutput(ctx, name, true); err != nil {
+			return "", err
+		}
+		return *output.Parameter.Value, nil
+	} else {
+		return *output.Parameter.Value, nil
 	}
-	return e.runEcsTask(cluster, family, container, &types.NetworkConfiguration{AwsvpcConfiguration: &vpcConfig}, overrides)
 }
 
-func (e Ecs) CheckTask(cluster, taskDefId string, running, stable bool, taskIds ...string) (bool, *int32, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+func (e Ecs) getSsmParameterOutput(ctx context.Context, name string, withDecryption bool) (*ssm.GetParameterOutput, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
 
-	// Describe cluster tasks matching the specified ARNs
-	input := &ecs.DescribeTasksInput{
-		Cluster: aws.String(cluster),
-		Tasks:   taskIds,
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(withDecryption),
 	}
-	output, err := e.ecsClient.DescribeTasks(ctx, input)
+	return e.ssmClient.GetParameter(httpCtx, input)
+}
+
+// CheckTask is a convenience wrapper around CheckTasks that returns whether all the specified tasks are in the requested
+// state, along with the highest exit code among the stopped tasks.
+func (e Ecs) CheckTask(ctx context.Context, cluster, taskDefId string, running, stable bool, taskIds ...string) (bool, *int32, error) {
+	taskStates, err := e.CheckTasks(ctx, cluster, stable, taskIds...)
 	if err != nil {
-		log.Printf("checkTask: describe service error: %s, %s, %v", cluster, taskIds, err)
+		log.Printf("checkTask: check tasks error: %s, %s, %v", cluster, taskIds, err)
 		return false, nil, err
 	}
 	// If checking for running tasks, at least one task must be present, but when checking for stopped tasks, it's ok to
@@ -92,28 +492,26 @@ func (e Ecs) CheckTask(cluster, taskDefId string, running, stable bool, taskIds
 	tasksFound := !running
 	tasksInState := true
 	var exitCode *int32 = nil
-	if len(output.Tasks) > 0 {
-		for _, task := range output.Tasks {
-			// If a task definition ARN was specified, make sure that we found at least one task with that definition.
-			if (len(taskDefId) == 0) || (*task.TaskDefinitionArn == taskDefId) {
-				tasksFound = true
-				// If checking for stable tasks, make sure that the task has been running for a few minutes.
-				if running {
-					if (*task.LastStatus != string(types.DesiredStatusRunning)) ||
-						(stable && time.Now().Before((*task.StartedAt).Add(manager.DefaultWaitTime))) {
-						tasksInState = false
-					}
-				} else {
-					if *task.LastStatus != string(types.DesiredStatusStopped) {
-						tasksInState = false
-					} else
-					// We always configure the primary application in a task as the first container, so we only care
-					// about its exit code. Among the first containers across all matching tasks, return the highest
-					// exit code.
-					if task.Containers[0].ExitCode != nil {
-						if (exitCode == nil) || (*task.Containers[0].ExitCode > *exitCode) {
-							exitCode = task.Containers[0].ExitCode
-						}
+	for _, taskState := range taskStates {
+		// If a task definition ARN was specified, make sure that we found at least one task with that definition.
+		if (taskState.Status != manager.TaskStatus_Missing) && ((len(taskDefId) == 0) || (taskState.TaskDefArn == taskDefId)) {
+			// A task whose image couldn't be pulled will never run, so fail right away instead of waiting for a timeout
+			if err = imagePullError(cluster, taskState); err != nil {
+				return false, nil, err
+			}
+			tasksFound = true
+			if running {
+				if taskState.Status != manager.TaskStatus_Running {
+					tasksInState = false
+				}
+			} else {
+				if taskState.Status != manager.TaskStatus_Stopped {
+					tasksInState = false
+				} else
+				// Among the primary containers across all matching tasks, return the highest exit code.
+				if taskState.ExitCode != nil {
+					if (exitCode == nil) || (*taskState.ExitCode > *exitCode) {
+						exitCode = taskState.ExitCode
 					}
 				}
 			}
@@ -122,30 +520,93 @@ func (e Ecs) CheckTask(cluster, taskDefId string, running, stable bool, taskIds
 	return tasksFound && tasksInState, exitCode, nil
 }
 
-func (e Ecs) GetLayout(clusters []string) (*manager.Layout, error) {
+// CheckTasks returns the state of each of the specified tasks, keyed by the task ARN or ID it was requested with. If
+// `stable` is set, tasks are only reported as running once they have been running for a few minutes.
+func (e Ecs) CheckTasks(ctx context.Context, cluster string, stable bool, taskIds ...string) (map[string]manager.TaskState, error) {
+	// Describe cluster tasks matching the specified ARNs
+	tasks, err := e.describeEcsTasks(ctx, cluster, taskIds)
+	if err != nil {
+		log.Printf("checkTasks: describe tasks error: %s, %s, %v", cluster, taskIds, err)
+		return nil, err
+	}
+	taskStates := make(map[string]manager.TaskState, len(taskIds))
+	for _, taskId := range taskIds {
+		taskState := manager.TaskState{Status: manager.TaskStatus_Missing}
+		for _, task := range tasks {
+			// Tasks can be requested using either their full ARN or just their ID, which is the last part of the ARN
+			if taskArn := aws.ToString(task.TaskArn); (taskArn == taskId) || strings.HasSuffix(taskArn, "/"+taskId) {
+				taskState = e.ecsTaskState(task, stable)
+				break
+			}
+		}
+		taskStates[taskId] = taskState
+	}
+	return taskStates, nil
+}
+
+func (e Ecs) ecsTaskState(task types.Task, stable bool) manager.TaskState {
+	taskState := manager.TaskState{
+		Status:        manager.TaskStatus_Pending,
+		LastStatus:    aws.ToString(task.LastStatus),
+		TaskDefArn:    aws.ToString(task.TaskDefinitionArn),
+		StoppedReason: aws.ToString(task.StoppedReason),
+	}
+	if len(task.Containers) > 0 {
+		taskState.Image = aws.ToString(task.Containers[0].Image)
+		// The container's reason is more specific than the task's when a task fails to start, e.g. the task's reason is
+		// "Task failed to start" while the container's is "CannotPullContainerError: ..."
+		if containerReason := aws.ToString(task.Containers[0].Reason); len(containerReason) > 0 {
+			taskState.StoppedReason = containerReason
+		}
+	}
+	if taskState.LastStatus == string(types.DesiredStatusRunning) {
+		// If checking for stable tasks, make sure that the task has been running for a few minutes.
+		if !stable || ((task.StartedAt != nil) && !time.Now().Before(task.StartedAt.Add(manager.DefaultWaitTime))) {
+			taskState.Status = manager.TaskStatus_Running
+		}
+	} else if taskState.LastStatus == string(types.DesiredStatusStopped) {
+		taskState.Status = manager.TaskStatus_Stopped
+		// We always configure the primary application in a task as the first container, so we only care about its exit
+		// code.
+		if len(task.Containers) > 0 {
+			taskState.ExitCode = task.Containers[0].ExitCode
+		}
+	}
+	return taskState
+}
+
+// imagePullError returns an error if a task stopped because the image for its primary container couldn't be pulled
+func imagePullError(cluster string, taskState manager.TaskState) error {
+	if (taskState.Status == manager.TaskStatus_Stopped) && strings.Contains(taskState.StoppedReason, ecsStoppedReason_CannotPull) {
+		return fmt.Errorf("%w for %s: %s, %s, %s", manager.Error_ImagePullFailed, taskState.Image, cluster, taskState.TaskDefArn, taskState.StoppedReason)
+	}
+	return nil
+}
+
+func (e Ecs) GetLayout(ctx context.Context, clusters []string) (*manager.Layout, error) {
 	// First validate and filter the list of clusters since not all clusters might be present in all envs.
-	if descClusterOutput, err := e.describeEcsClusters(clusters); err != nil {
+	if descClusterOutput, err := e.describeEcsClusters(ctx, clusters); err != nil {
 		log.Printf("getLayout: describe clusters error: %v, %v", clusters, err)
 		return nil, err
 	} else {
 		layout := &manager.Layout{Clusters: map[string]*manager.Cluster{}}
 		for _, cluster := range descClusterOutput.Clusters {
 			clusterName := *cluster.ClusterName
-			if clusterServices, err := e.listEcsServices(clusterName); err != nil {
-				log.Printf("getLayout: list services error: %s, %v", cluster, err)
+			if serviceArns, err := e.listEcsServices(ctx, clusterName); err != nil {
+				log.Printf("getLayout: list services error: %s, %v", clusterName, err)
 				return nil, err
-			} else if len(clusterServices.ServiceArns) > 0 {
+			} else if len(serviceArns) > 0 {
 				layout.Clusters[clusterName] = &manager.Cluster{ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{}}}
-				for _, serviceArn := range clusterServices.ServiceArns {
+				for _, serviceArn := range serviceArns {
 					service := e.serviceNameFromArn(serviceArn)
-					if ecsService, err := e.describeEcsService(clusterName, service); err != nil {
-						log.Printf("getLayout: describe service error: %s, %s, %v", cluster, service, err)
+					if ecsService, err := e.describeEcsService(ctx, clusterName, service); err != nil {
+						log.Printf("getLayout: describe service error: %s, %s, %v", clusterName, service, err)
 						return nil, err
 					} else {
 						taskDefArn := *ecsService.Services[0].TaskDefinition
 						containerDefNames := make([]string, 0, 1)
-						if taskDef, err := e.getEcsTaskDefinition(taskDefArn); err != nil {
-							log.Printf("getLayout: get task def error: %s, %s, %s, %v", taskDefArn, cluster, service, err)
+						if taskDef, err := e.getEcsTaskDefinition(ctx, taskDefArn); err != nil {
+							log.Printf("getLayout: get task def error: %s, %s, %s, %v", taskDefArn, clusterName, service, err)
 							return nil, err
 						} else {
 							for _, containerDef := range taskDef.ContainerDefinitions {
@@ -162,22 +623,30 @@ func (e Ecs) GetLayout(clusters []string) (*manager.Layout, error) {
 	}
 }
 
-func (e Ecs) UpdateLayout(layout *manager.Layout, deployTag string) error {
+func (e Ecs) UpdateLayout(ctx context.Context, layout *manager.Layout, deployTag, sha, version, jobId string, createIfMissing bool, rolloutPercent int) error {
+	// Tag new task definitions so that they can be traced back to the commit, release, and deployment that created them
+	taskDefTags := e.taskDefTags(sha, version, jobId, time.Now())
+	var clusterErrs manager.ClusterErrors
 	for clusterName, cluster := range layout.Clusters {
-		clusterRepo := e.getEcrRepo(*layout.Repo) // The main layout repo should never be null
-		if cluster.Repo != nil {
-			clusterRepo = e.getEcrRepo(*cluster.Repo)
-		}
-		if err := e.updateEnvCluster(cluster, clusterName, clusterRepo, deployTag); err != nil {
+		if err := e.updateEnvCluster(ctx, layout, cluster, clusterName, deployTag, jobId, createIfMissing, rolloutPercent, taskDefTags); errors.Is(err, context.Canceled) {
 			return err
+		} else if err != nil {
+			// Keep updating the other clusters so that all failures are reported, not just the first one
+			clusterErrs = append(clusterErrs, manager.ClusterError{Region: e.region, Cluster: clusterName, Err: err})
 		}
 	}
+	if len(clusterErrs) > 0 {
+		sort.Slice(clusterErrs, func(i, j int) bool {
+			return clusterErrs[i].Cluster < clusterErrs[j].Cluster
+		})
+		return clusterErrs
+	}
 	return nil
 }
 
-func (e Ecs) CheckLayout(layout *manager.Layout) (bool, error) {
+func (e Ecs) CheckLayout(ctx context.Context, layout *manager.Layout) (bool, error) {
 	for clusterName, cluster := range layout.Clusters {
-		if deployed, err := e.checkEnvCluster(cluster, clusterName); err != nil {
+		if deployed, err := e.checkEnvCluster(ctx, cluster, clusterName); err != nil {
 			return false, err
 		} else if !deployed {
 			return false, nil
@@ -186,305 +655,1895 @@ func (e Ecs) CheckLayout(layout *manager.Layout) (bool, error) {
 	return true, nil
 }
 
-func (e Ecs) describeEcsClusters(clusters []string) (*ecs.DescribeClustersOutput, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+// RampLayout shifts the services in a layout that are being deployed in stages to the specified percentage of their
+// desired count. At 100%, the new task definitions replace the ones that were running before the deployment. Services
+// using rolling updates are always deployed all at once, so there's nothing to ramp for them.
+func (e Ecs) RampLayout(ctx context.Context, layout *manager.Layout, percent int) error {
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service, task := range cluster.ServiceTasks.Tasks {
+				if task.RolloutPercent > 0 {
+					if err := e.rampEcsService(ctx, clusterName, service, task.Id, percent); err != nil {
+						return err
+					}
+					task.RolloutPercent = percent
+					task.RolloutStepStart = time.Now().UnixNano()
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	if output, err := e.ecsClient.DescribeClusters(ctx, &ecs.DescribeClustersInput{Clusters: clusters}); err != nil {
-		log.Printf("describeEcsClusters: %v", err)
-		return nil, err
+// RevertLayout points the services in a layout at an earlier revision of their task definitions. Only services are
+// reverted, since other tasks are launched from the latest revision of their task family.
+func (e Ecs) RevertLayout(ctx context.Context, layout *manager.Layout, revision string) error {
+	if jobId, err := e.revisionJobId(ctx, layout, revision); err != nil {
+		return err
 	} else {
-		return output, nil
+		return e.revertLayout(ctx, layout, revision, jobId)
 	}
 }
 
-func (e Ecs) describeEcsService(cluster, service string) (*ecs.DescribeServicesOutput, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+// ResolveRevision points the services in a layout at the revisions of their task definitions that RevertLayout would
+// revert them to, without updating the services.
+func (e Ecs) ResolveRevision(ctx context.Context, layout *manager.Layout, revision string) error {
+	jobId, err := e.revisionJobId(ctx, layout, revision)
+	if err != nil {
+		return err
+	}
+	for _, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for _, task := range cluster.ServiceTasks.Tasks {
+				if taskDefArn, err := e.findTaskDefRevision(ctx, task.Id, revision, jobId); err != nil {
+					return err
+				} else {
+					task.PrevId = task.Id
+					task.Id = taskDefArn
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	input := &ecs.DescribeServicesInput{
-		Services: []string{service},
-		Cluster:  aws.String(cluster),
+// revisionJobId returns the deployment that registered the revision to revert a layout to. The revision is a task
+// definition ARN or "family:revision" of one of the layout's services, or a revision number if all services share a task
+// family. The revisions of other task families are then the ones registered by the same deployment. An empty ID is only
+// returned for older, untagged revisions of a single task family.
+func (e Ecs) revisionJobId(ctx context.Context, layout *manager.Layout, revision string) (string, error) {
+	families := make(map[string]string)
+	for _, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for _, task := range cluster.ServiceTasks.Tasks {
+				families[manager.TaskDefFamily(task.Id)] = task.Id
+			}
+		}
 	}
-	if output, err := e.ecsClient.DescribeServices(ctx, input); err != nil {
-		log.Printf("describeEcsService: %s, %s, %v", service, cluster, err)
+	var taskDefArn string
+	if _, err := strconv.Atoi(revision); err == nil {
+		if len(families) != 1 {
+			return "", fmt.Errorf("revisionJobId: revision number is ambiguous for multiple task families, use family:revision instead: %s", revision)
+		}
+		for _, familyTaskDefArn := range families {
+			taskDefArn = familyTaskDefArn
+		}
+	} else if taskDefArn = families[manager.TaskDefFamily(revision)]; len(taskDefArn) == 0 {
+		return "", fmt.Errorf("revisionJobId: revision is not from a task family in the layout: %s", revision)
+	}
+	taskDefId, err := manager.TaskDefRevision(taskDefArn, revision)
+	if err != nil {
+		return "", err
+	}
+	taskDef, tags, err := e.getEcsTaskDefinitionWithTags(ctx, taskDefId)
+	if err != nil {
+		return "", err
+	} else if taskDef.Status != types.TaskDefinitionStatusActive {
+		return "", fmt.Errorf("revisionJobId: revision is no longer active: %s", taskDefId)
+	}
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == jobIdTag {
+			return aws.ToString(tag.Value), nil
+		}
+	}
+	if len(families) > 1 {
+		return "", fmt.Errorf("revisionJobId: revision is not tagged with the deployment that registered it: %s", taskDefId)
+	}
+	return "", nil
+}
+
+// revertLayout points each service in a layout at the revision of its task definition registered by a deployment, or at
+// the specified revision if the deployment isn't known.
+func (e Ecs) revertLayout(ctx context.Context, layout *manager.Layout, revision, jobId string) error {
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service, task := range cluster.ServiceTasks.Tasks {
+				if taskDefArn, err := e.revertEcsService(ctx, clusterName, service, revision, jobId); err != nil {
+					return err
+				} else {
+					task.PrevId = task.Id
+					task.Id = taskDefArn
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterLayout registers new task definitions for the services in a layout without updating the services, so that a
+// later deployment can promote the services to them. The layout is updated with the new task definition ARNs.
+func (e Ecs) RegisterLayout(ctx context.Context, layout *manager.Layout, deployTag, sha, version, jobId string) error {
+	taskDefTags := e.taskDefTags(sha, version, jobId, time.Now())
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service, task := range cluster.ServiceTasks.Tasks {
+				if image, err := e.taskImage(layout, cluster, cluster.ServiceTasks, task, clusterName, service, deployTag); err != nil {
+					return err
+				} else if descSvcOutput, err := e.describeEcsService(ctx, clusterName, service); err != nil {
+					log.Printf("registerLayout: describe service error: %s, %s, %v", clusterName, service, err)
+					return err
+				} else if isExternalEcsService(descSvcOutput.Services[0]) {
+					return fmt.Errorf("registerLayout: registering task definitions for services using task sets is not supported: %s, %s", clusterName, service)
+				} else if newTaskDefArn, err := e.updateEcsTaskDefinition(ctx, *descSvcOutput.Services[0].TaskDefinition, image, task.Name, taskDefTags); err != nil {
+					return err
+				} else {
+					task.Id = newTaskDefArn
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PromoteLayout points the services in a layout at the task definitions recorded in the layout, e.g. ones registered
+// earlier by RegisterLayout. As with regular deployments, the services in a cluster are rolled back together if any of
+// them can't be updated.
+func (e Ecs) PromoteLayout(ctx context.Context, layout *manager.Layout) error {
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.ServiceTasks == nil {
+			continue
+		}
+		serviceUpdates := make([]ecsServiceUpdate, 0, len(cluster.ServiceTasks.Tasks))
+		for service, task := range cluster.ServiceTasks.Tasks {
+			if descSvcOutput, err := e.describeEcsService(ctx, clusterName, service); err != nil {
+				log.Printf("promoteLayout: describe service error: %s, %s, %v", clusterName, service, err)
+				return err
+			} else if isExternalEcsService(descSvcOutput.Services[0]) {
+				return fmt.Errorf("promoteLayout: promoting services using task sets is not supported: %s, %s", clusterName, service)
+			} else {
+				serviceUpdates = append(serviceUpdates, ecsServiceUpdate{service, task, task.Id, descSvcOutput.Services[0]})
+			}
+		}
+		for idx, serviceUpdate := range serviceUpdates {
+			if err := e.deployEcsService(ctx, clusterName, serviceUpdate.service, serviceUpdate.taskDefArn, serviceUpdate.task.Replicas, serviceUpdate.ecsService); err != nil {
+				e.rollbackEcsServices(ctx, clusterName, serviceUpdates[:idx+1])
+				return fmt.Errorf("promoteLayout: %s, %s: %w", clusterName, serviceUpdate.service, err)
+			}
+			serviceUpdate.task.PrevId = aws.ToString(serviceUpdate.ecsService.TaskDefinition)
+		}
+	}
+	return nil
+}
+
+func (e Ecs) RestartLayout(ctx context.Context, layout *manager.Layout) error {
+	for clusterName, cluster := range layout.Clusters {
+		if err := e.restartEnvCluster(ctx, cluster, clusterName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckRestart checks whether the services and tasks in a layout have been restarted, i.e. are only running tasks started
+// since the restart. The tasks that were running before the restart still pass CheckLayout, so it can't be used for this.
+func (e Ecs) CheckRestart(ctx context.Context, layout *manager.Layout, since time.Time) (bool, error) {
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service := range cluster.ServiceTasks.Tasks {
+				if restarted, err := e.checkEcsServiceRestart(ctx, clusterName, service, since); err != nil {
+					return false, err
+				} else if !restarted {
+					return false, nil
+				}
+			}
+		}
+		if cluster.Tasks != nil {
+			for _, task := range cluster.Tasks.Tasks {
+				if restarted, err := e.checkEcsTaskRestart(ctx, clusterName, task.Id, since); err != nil {
+					return false, err
+				} else if !restarted {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+func (e Ecs) StopTask(ctx context.Context, cluster, taskArn, reason string) error {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	// ECS limits the reason to 255 characters. Reasons can include free-form text from operators, so cut them by rune to
+	// avoid splitting multi-byte characters.
+	if utf8.RuneCountInString(reason) > maxStopReasonLen {
+		reason = string([]rune(reason)[:maxStopReasonLen])
+	}
+	input := &ecs.StopTaskInput{
+		Task:    aws.String(taskArn),
+		Cluster: aws.String(cluster),
+		Reason:  aws.String(reason),
+	}
+	if _, err := e.ecsClient.StopTask(httpCtx, input); err != nil {
+		log.Printf("stopTask: %s, %s, %s, %v", cluster, taskArn, reason, err)
+		return err
+	}
+	return nil
+}
+
+// PruneLayout deregisters all but the `keep` most recent task definition revisions for each task in the layout. Revisions
+// still used by services or running tasks in the layout's clusters, or explicitly retained (e.g. registered for a later
+// promotion), are never deregistered.
+func (e Ecs) PruneLayout(ctx context.Context, layout *manager.Layout, keep int, retain map[string]bool) error {
+	clusters := make([]string, 0, len(layout.Clusters))
+	for clusterName := range layout.Clusters {
+		clusters = append(clusters, clusterName)
+	}
+	inUse, err := e.inUseTaskDefinitions(ctx, clusters)
+	if err != nil {
+		return err
+	}
+	for taskDefArn := range retain {
+		inUse[taskDefArn] = true
+	}
+	for _, cluster := range layout.Clusters {
+		for _, taskSet := range []*manager.TaskSet{cluster.ServiceTasks, cluster.Tasks, cluster.Runners} {
+			if taskSet != nil {
+				for _, task := range taskSet.Tasks {
+					if len(task.Id) > 0 {
+						if err := e.deregisterOldTaskDefinitions(ctx, e.taskFamilyFromArn(task.Id), keep, inUse); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (e Ecs) ListServices(ctx context.Context, cluster string) ([]string, error) {
+	if serviceArns, err := e.listEcsServices(ctx, cluster); err != nil {
+		log.Printf("listServices: list services error: %s, %v", cluster, err)
 		return nil, err
-	} else if len(output.Failures) > 0 {
-		ecsFailures := e.parseEcsFailures(output.Failures)
-		log.Printf("describeEcsService: %s, %s, %v", service, cluster, ecsFailures)
-		return nil, fmt.Errorf("%v", ecsFailures)
 	} else {
-		return output, nil
+		services := make([]string, 0, len(serviceArns))
+		for _, serviceArn := range serviceArns {
+			services = append(services, e.serviceNameFromArn(serviceArn))
+		}
+		return services, nil
+	}
+}
+
+// ListRunningTasks returns the tasks running in a cluster, optionally only those launched by the manager (e.g. anchor
+// workers), which are tagged with the job that launched them.
+func (e Ecs) ListRunningTasks(ctx context.Context, cluster string, managerOnly bool) ([]manager.TaskInfo, error) {
+	if taskArns, err := e.listEcsTasks(ctx, cluster, ""); err != nil {
+		log.Printf("listRunningTasks: list tasks error: %s, %v", cluster, err)
+		return nil, err
+	} else if tasks, err := e.describeEcsTasks(ctx, cluster, taskArns); err != nil {
+		log.Printf("listRunningTasks: describe tasks error: %s, %v", cluster, err)
+		return nil, err
+	} else {
+		taskInfos := make([]manager.TaskInfo, 0, len(tasks))
+		for _, task := range tasks {
+			taskInfo := manager.TaskInfo{
+				TaskArn:    aws.ToString(task.TaskArn),
+				Family:     e.taskFamilyFromArn(aws.ToString(task.TaskDefinitionArn)),
+				StartedBy:  aws.ToString(task.StartedBy),
+				Status:     aws.ToString(task.LastStatus),
+				LaunchedAt: task.CreatedAt,
+			}
+			for _, tag := range task.Tags {
+				if aws.ToString(tag.Key) == jobIdTag {
+					taskInfo.JobId = aws.ToString(tag.Value)
+				}
+			}
+			if !managerOnly || (len(taskInfo.JobId) > 0) {
+				taskInfos = append(taskInfos, taskInfo)
+			}
+		}
+		// Show the longest running tasks first
+		sort.Slice(taskInfos, func(i, j int) bool {
+			return (taskInfos[i].LaunchedAt != nil) && ((taskInfos[j].LaunchedAt == nil) || taskInfos[i].LaunchedAt.Before(*taskInfos[j].LaunchedAt))
+		})
+		return taskInfos, nil
+	}
+}
+
+func (e Ecs) GetContainerImage(ctx context.Context, taskDefArn, container string) (string, error) {
+	if taskDef, err := e.getEcsTaskDefinition(ctx, taskDefArn); err != nil {
+		return "", err
+	} else {
+		if idx, err := primaryEcsContainer(taskDef, container); err != nil {
+			return "", fmt.Errorf("getContainerImage: %w", err)
+		} else {
+			return *taskDef.ContainerDefinitions[idx].Image, nil
+		}
+	}
+}
+
+// GetCurrentImage returns the image that a service's primary container is running, without the registry, e.g.
+// "ceramic-prod-node:3ba6b9a" instead of "967314784947.dkr.ecr.us-east-2.amazonaws.com/ceramic-prod-node:3ba6b9a".
+func (e Ecs) GetCurrentImage(ctx context.Context, cluster, service string) (string, error) {
+	if output, err := e.describeEcsService(ctx, cluster, service); err != nil {
+		log.Printf("getCurrentImage: describe service error: %s, %s, %v", cluster, service, err)
+		return "", err
+	} else if image, err := e.GetContainerImage(ctx, *output.Services[0].TaskDefinition, ""); err != nil {
+		log.Printf("getCurrentImage: get container image error: %s, %s, %v", cluster, service, err)
+		return "", err
+	} else {
+		return imageWithoutRegistry(image), nil
+	}
+}
+
+// imageWithoutRegistry strips the registry from an image reference. As with Docker, the first part of the path is only
+// treated as a registry if it looks like a hostname, so that e.g. "ceramicnetwork/js-ceramic:latest" is left as is.
+func imageWithoutRegistry(image string) string {
+	if idx := strings.Index(image, "/"); idx != -1 {
+		if registry := image[:idx]; strings.ContainsAny(registry, ".:") || (registry == "localhost") {
+			return image[idx+1:]
+		}
+	}
+	return image
+}
+
+// GetServiceStatus returns the state of the primary deployment of a service, along with its most recent event
+func (e Ecs) GetServiceStatus(ctx context.Context, cluster, service string) (*manager.ServiceStatus, error) {
+	if output, err := e.describeEcsService(ctx, cluster, service); err != nil {
+		log.Printf("getServiceStatus: describe service error: %s, %s, %v", cluster, service, err)
+		return nil, err
+	} else {
+		ecsService := output.Services[0]
+		serviceStatus := &manager.ServiceStatus{
+			Cluster:      cluster,
+			Service:      service,
+			TaskDef:      *ecsService.TaskDefinition,
+			Images:       make(map[string]string),
+			RunningCount: ecsService.RunningCount,
+			DesiredCount: ecsService.DesiredCount,
+		}
+		for _, deployment := range ecsService.Deployments {
+			if (deployment.Status != nil) && (*deployment.Status == "PRIMARY") {
+				serviceStatus.TaskDef = *deployment.TaskDefinition
+				serviceStatus.RolloutState = string(deployment.RolloutState)
+			}
+		}
+		// Events are returned most recent first
+		if len(ecsService.Events) > 0 {
+			serviceStatus.LastEvent = aws.ToString(ecsService.Events[0].Message)
+			serviceStatus.LastEventTs = ecsService.Events[0].CreatedAt
+		}
+		if taskDef, err := e.getEcsTaskDefinition(ctx, serviceStatus.TaskDef); err != nil {
+			log.Printf("getServiceStatus: get task def error: %s, %s, %s, %v", cluster, service, serviceStatus.TaskDef, err)
+			return nil, err
+		} else {
+			for _, containerDef := range taskDef.ContainerDefinitions {
+				serviceStatus.Images[*containerDef.Name] = *containerDef.Image
+			}
+		}
+		return serviceStatus, nil
+	}
+}
+
+// Ping checks that ECS is reachable by describing the environment's main cluster
+func (e Ecs) Ping(ctx context.Context) error {
+	if _, err := e.describeEcsClusters(ctx, []string{manager.GetEnvClusters(string(e.env)).Private}); err != nil {
+		log.Printf("ping: describe clusters error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (e Ecs) describeEcsClusters(ctx context.Context, clusters []string) (*ecs.DescribeClustersOutput, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	if output, err := e.ecsClient.DescribeClusters(httpCtx, &ecs.DescribeClustersInput{Clusters: clusters}); err != nil {
+		log.Printf("describeEcsClusters: %v", err)
+		return nil, err
+	} else {
+		return output, nil
+	}
+}
+
+func (e Ecs) describeEcsTasks(ctx context.Context, cluster string, taskArns []string) ([]types.Task, error) {
+	tasks := make([]types.Task, 0, len(taskArns))
+	// Tasks can only be described 100 at a time
+	for start := 0; start < len(taskArns); start += maxDescribeTasks {
+		end := start + maxDescribeTasks
+		if end > len(taskArns) {
+			end = len(taskArns)
+		}
+		if output, err := func() (*ecs.DescribeTasksOutput, error) {
+			httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+			defer httpCancel()
+
+			return e.ecsClient.DescribeTasks(httpCtx, &ecs.DescribeTasksInput{
+				Cluster: aws.String(cluster),
+				Tasks:   taskArns[start:end],
+				Include: []types.TaskField{types.TaskFieldTags},
+			})
+		}(); err != nil {
+			log.Printf("describeEcsTasks: %s, %v", cluster, err)
+			return nil, err
+		} else {
+			tasks = append(tasks, output.Tasks...)
+		}
+	}
+	return tasks, nil
+}
+
+func (e Ecs) describeEcsService(ctx context.Context, cluster, service string) (*ecs.DescribeServicesOutput, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	input := &ecs.DescribeServicesInput{
+		Services: []string{service},
+		Cluster:  aws.String(cluster),
+	}
+	if output, err := e.ecsClient.DescribeServices(httpCtx, input); err != nil {
+		log.Printf("describeEcsService: %s, %s, %v", service, cluster, err)
+		return nil, err
+	} else if len(output.Failures) > 0 {
+		failures := e.parseEcsFailures(output.Failures)
+		log.Printf("describeEcsService: %s, %s, %v", service, cluster, failures)
+		return nil, failures
+	} else {
+		return output, nil
+	}
+}
+
+func (e Ecs) listEcsServices(ctx context.Context, cluster string) ([]string, error) {
+	input := &ecs.ListServicesInput{
+		Cluster: aws.String(cluster),
+	}
+	// Services are returned 10 at a time by default, so make sure we go through all the pages.
+	serviceArns := make([]string, 0)
+	p := ecs.NewListServicesPaginator(e.ecsClient, input)
+	for p.HasMorePages() {
+		if page, err := func() (*ecs.ListServicesOutput, error) {
+			httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+			defer httpCancel()
+
+			return p.NextPage(httpCtx)
+		}(); err != nil {
+			log.Printf("listEcsServices: %s, %v", cluster, err)
+			return nil, err
+		} else {
+			serviceArns = append(serviceArns, page.ServiceArns...)
+		}
+	}
+	return serviceArns, nil
+}
+
+// validateOverrides returns a copy of the environment overrides with surrounding whitespace trimmed from keys and values,
+// or an error listing the keys whose name or value is empty.
+func validateOverrides(overrides map[string]string) (map[string]string, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	validOverrides := make(map[string]string, len(overrides))
+	invalidKeys := make([]string, 0)
+	for k, v := range overrides {
+		trimmedKey := strings.TrimSpace(k)
+		trimmedValue := strings.TrimSpace(v)
+		if (len(trimmedKey) == 0) || (len(trimmedValue) == 0) {
+			invalidKeys = append(invalidKeys, strconv.Quote(k))
+		} else if _, found := validOverrides[trimmedKey]; found {
+			// Two keys that only differ by whitespace would silently overwrite each other
+			invalidKeys = append(invalidKeys, strconv.Quote(k))
+		} else {
+			validOverrides[trimmedKey] = trimmedValue
+		}
+	}
+	if len(invalidKeys) > 0 {
+		sort.Strings(invalidKeys)
+		return nil, fmt.Errorf("validateOverrides: empty or duplicate override keys or values: %s", strings.Join(invalidKeys, ", "))
+	}
+	return validOverrides, nil
+}
+
+func (e Ecs) runEcsTask(ctx context.Context, cluster, family, container string, networkConfig *types.NetworkConfiguration, opts manager.LaunchOptions) (string, error) {
+	command, capacityProvider := opts.Command, opts.CapacityProvider
+	overrides, secrets := opts.Overrides, opts.Secrets
+	if slices.Contains(command, "") {
+		log.Printf("runEcsTask: invalid command: %s, %s, %q", cluster, family, command)
+		return "", fmt.Errorf("runEcsTask: empty command argument: %s, %s, %q", cluster, family, command)
+	}
+	// Make sure that the container exists in the task definition, otherwise the overrides would silently not apply.
+	resolved := false
+	if (len(overrides) > 0) || (len(command) > 0) || (len(secrets) > 0) {
+		if resolvedContainer, err := e.resolveEcsContainer(ctx, family, container); err != nil {
+			log.Printf("runEcsTask: resolve container error: %s, %s, %s, %v", cluster, family, container, err)
+			return "", err
+		} else {
+			container = resolvedContainer
+			resolved = true
+		}
+	}
+	// The environment's default overrides and the job's trace context are added to every launch, but only if it's clear
+	// which container they apply to. Tasks with several containers and no primary one are still launched without them.
+	defaultOverrides, defaultSecrets, err := e.defaultOverrides(ctx)
+	if err != nil {
+		log.Printf("runEcsTask: get default overrides error: %s, %s, %s, %v", cluster, family, e.defaultOverridesPath, err)
+		return "", err
+	}
+	traceOverrides := withTraceContext(ctx, nil)
+	if (len(defaultOverrides) > 0) || (len(defaultSecrets) > 0) || (len(traceOverrides) > 0) {
+		if !resolved {
+			if resolvedContainer, err := e.resolveEcsContainer(ctx, family, container); err != nil {
+				log.Printf("runEcsTask: skipping default overrides, resolve container error: %s, %s, %s, %v", cluster, family, container, err)
+			} else {
+				container = resolvedContainer
+				resolved = true
+			}
+		}
+		if resolved {
+			overrides, secrets = mergeEnvironment(defaultOverrides, defaultSecrets, overrides, secrets)
+			overrides = withTraceContext(ctx, overrides)
+		}
+	}
+	// Catch invalid overrides before making any API calls since RunTask only returns an opaque error for them
+	overrides, err = validateOverrides(overrides)
+	if err != nil {
+		log.Printf("runEcsTask: invalid overrides: %s, %s, %v", cluster, family, err)
+		return "", err
+	}
+	taskDef := family
+	if len(secrets) > 0 {
+		if taskDef, err = e.secretsEcsTaskDefinition(ctx, family, container, secrets); err != nil {
+			log.Printf("runEcsTask: task def with secrets error: %s, %s, %s, %v", cluster, family, container, err)
+			return "", err
+		}
+	}
+
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	input := &ecs.RunTaskInput{
+		TaskDefinition:       aws.String(taskDef),
+		Cluster:              aws.String(cluster),
+		Count:                aws.Int32(1),
+		EnableExecuteCommand: true,
+		NetworkConfiguration: networkConfig,
+		StartedBy:            aws.String(startedBy(opts.JobId)),
+		Tags:                 e.taskTags(opts.JobId, opts.RequestedBy),
+	}
+	// A launch retried after a timeout could otherwise start a duplicate task. ECS returns the task from the original
+	// launch for a repeated client token instead.
+	launchToken := clientToken(opts.JobId, family)
+	if len(launchToken) > 0 {
+		input.ClientToken = aws.String(launchToken)
+	}
+	// The launch type and capacity provider strategy are mutually exclusive
+	if len(capacityProvider) > 0 {
+		input.CapacityProviderStrategy = []types.CapacityProviderStrategyItem{{
+			CapacityProvider: aws.String(capacityProvider),
+			Weight:           1,
+		}}
+	} else {
+		input.LaunchType = types.LaunchTypeFargate
+	}
+	// The platform version only applies to Fargate, including the Fargate Spot capacity provider
+	if (len(e.platformVersion) > 0) && ((len(capacityProvider) == 0) || strings.HasPrefix(capacityProvider, fargateCapacityProviderPfx)) {
+		input.PlatformVersion = aws.String(e.platformVersion)
+	}
+	if opts.Placement != nil {
+		input.PlacementStrategy, input.PlacementConstraints = ecsPlacement(*opts.Placement)
+	}
+	if (len(overrides) > 0) || (len(command) > 0) {
+		containerOverride := types.ContainerOverride{Name: aws.String(container)}
+		if len(overrides) > 0 {
+			containerOverride.Environment = make([]types.KeyValuePair, 0, len(overrides))
+			for k, v := range overrides {
+				containerOverride.Environment = append(containerOverride.Environment, types.KeyValuePair{Name: aws.String(k), Value: aws.String(v)})
+			}
+		}
+		// The command override replaces the default command from the task definition
+		if len(command) > 0 {
+			containerOverride.Command = command
+		}
+		input.Overrides = &types.TaskOverride{ContainerOverrides: []types.ContainerOverride{containerOverride}}
+	}
+	if output, err := e.ecsClient.RunTask(httpCtx, input); err != nil {
+		log.Printf("runEcsTask: %s, %s, %s, %s, %v, %v", cluster, family, container, launchToken, environmentNames(overrides), err)
+		return "", err
+	} else if len(output.Tasks) == 0 {
+		failures := e.parseEcsFailures(output.Failures)
+		log.Printf("runEcsTask: no tasks launched: %s, %s, %s, %s, %v, %v", cluster, family, container, launchToken, environmentNames(overrides), failures)
+		return "", fmt.Errorf("runEcsTask: no tasks launched: %s, %s, %w", cluster, family, failures)
+	} else {
+		log.Printf("runEcsTask: launched task: %s, %s, %s, %s", cluster, family, launchToken, *output.Tasks[0].TaskArn)
+		return *output.Tasks[0].TaskArn, nil
+	}
+}
+
+// ecsPlacement converts a placement into the strategies and constraints expected by RunTask
+func ecsPlacement(placement manager.Placement) ([]types.PlacementStrategy, []types.PlacementConstraint) {
+	var strategies []types.PlacementStrategy
+	for _, s := range placement.Strategies {
+		strategy := types.PlacementStrategy{Type: types.PlacementStrategyType(s.Type)}
+		if len(s.Field) > 0 {
+			strategy.Field = aws.String(s.Field)
+		}
+		strategies = append(strategies, strategy)
+	}
+	var constraints []types.PlacementConstraint
+	for _, c := range placement.Constraints {
+		constraint := types.PlacementConstraint{Type: types.PlacementConstraintType(c.Type)}
+		if len(c.Expression) > 0 {
+			constraint.Expression = aws.String(c.Expression)
+		}
+		constraints = append(constraints, constraint)
+	}
+	return strategies, constraints
+}
+
+// clientToken returns the RunTask idempotency token for a task launched by a job, which is the hex-encoded hash of the
+// job ID and task family so that it fits within the 64 character limit. Tasks launched outside a job aren't deduplicated.
+func clientToken(jobId, family string) string {
+	if len(jobId) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(jobId + "/" + family))
+	return hex.EncodeToString(hash[:])
+}
+
+// startedBy returns the "startedBy" value for a task launched by a job so that the task can be traced back to the job.
+// ECS limits "startedBy" to 36 letters, numbers, hyphens, and underscores, so other characters are replaced with hyphens
+// and the job ID is truncated if needed.
+func startedBy(jobId string) string {
+	if len(jobId) == 0 {
+		return manager.ServiceName
+	}
+	id := strings.Map(func(r rune) rune {
+		if ((r >= 'a') && (r <= 'z')) || ((r >= 'A') && (r <= 'Z')) || ((r >= '0') && (r <= '9')) || (r == '_') {
+			return r
+		}
+		return '-'
+	}, jobId)
+	if len(id) > maxStartedByLen {
+		id = id[:maxStartedByLen]
+	}
+	return id
+}
+
+// taskTags returns the tags for a launched task, which record the job that launched it and who requested the job
+func (e Ecs) taskTags(jobId, requestedBy string) []types.Tag {
+	tags := []types.Tag{{Key: aws.String(resourceTag), Value: aws.String(string(e.env))}}
+	if len(jobId) > 0 {
+		tags = append(tags, types.Tag{Key: aws.String(jobIdTag), Value: aws.String(jobId)})
+	}
+	if len(requestedBy) > 0 {
+		tags = append(tags, types.Tag{Key: aws.String(requestedByTag), Value: aws.String(requestedBy)})
+	}
+	return tags
+}
+
+func (e Ecs) updateEcsTaskDefinition(ctx context.Context, taskDefArn, image, containerName string, tags []types.Tag) (string, error) {
+	taskDef, err := e.getEcsTaskDefinition(ctx, taskDefArn)
+	if err != nil {
+		log.Printf("updateEcsTaskDefinition: get task def error: %s, %s, %v", taskDefArn, image, err)
+		return "", err
+	}
+	// Register a new task definition with an updated image
+	idx, err := primaryEcsContainer(taskDef, containerName)
+	if err != nil {
+		return "", fmt.Errorf("updateEcsTaskDefinition: %w", err)
+	}
+	taskDef.ContainerDefinitions[idx].Image = aws.String(image)
+	if newTaskDefArn, err := e.registerEcsTaskDefinition(ctx, taskDef, tags); err != nil {
+		log.Printf("updateEcsTaskDefinition: register task def error: %s, %s, %s, %v", taskDefArn, image, containerName, err)
+		return "", err
+	} else {
+		return newTaskDefArn, nil
+	}
+}
+
+// secretsEcsTaskDefinition returns a task definition for the family that provides the specified secrets to the
+// container. Secrets can't be passed through container overrides when running a task, so a task definition with the
+// secrets is registered if the task definition doesn't already have the same secrets.
+//
+// Such task definitions are registered under a separate family (e.g. "ceramic-dev-cas-anchor-secrets") so that the
+// secrets for one launch don't carry over into later deployments of the original family, which always start from its
+// latest revision. The latest revision of the separate family is reused if it's identical, so that a retried launch
+// runs the same task definition.
+func (e Ecs) secretsEcsTaskDefinition(ctx context.Context, family, containerName string, secrets map[string]manager.SecretRef) (string, error) {
+	taskDef, err := e.getEcsTaskDefinition(ctx, family)
+	if err != nil {
+		log.Printf("secretsEcsTaskDefinition: get task def error: %s, %s, %v", family, containerName, err)
+		return "", err
+	}
+	idx, err := primaryEcsContainer(taskDef, containerName)
+	if err != nil {
+		return "", fmt.Errorf("secretsEcsTaskDefinition: %w", err)
+	}
+	// Merge the secrets with any the container already has, overriding existing secrets with the same name
+	containerDef := taskDef.ContainerDefinitions[idx]
+	updated := false
+	containerSecrets := make([]types.Secret, len(containerDef.Secrets))
+	copy(containerSecrets, containerDef.Secrets)
+	for name, secretRef := range secrets {
+		found := false
+		for secretIdx, containerSecret := range containerSecrets {
+			if *containerSecret.Name == name {
+				found = true
+				if *containerSecret.ValueFrom != secretRef.ValueFrom {
+					containerSecrets[secretIdx].ValueFrom = aws.String(secretRef.ValueFrom)
+					updated = true
+				}
+			}
+		}
+		if !found {
+			containerSecrets = append(containerSecrets, types.Secret{Name: aws.String(name), ValueFrom: aws.String(secretRef.ValueFrom)})
+			updated = true
+		}
+	}
+	if !updated {
+		return *taskDef.TaskDefinitionArn, nil
+	}
+	taskDef.ContainerDefinitions[idx].Secrets = containerSecrets
+	secretsFamily := aws.ToString(taskDef.Family) + secretsFamilySuffix
+	taskDef.Family = aws.String(secretsFamily)
+	// The separate family won't exist before the first launch with secrets
+	if secretsTaskDef, err := e.getEcsTaskDefinition(ctx, secretsFamily); (err == nil) && sameTaskDefinition(taskDef, secretsTaskDef) {
+		return *secretsTaskDef.TaskDefinitionArn, nil
+	}
+	if newTaskDefArn, err := e.registerEcsTaskDefinition(ctx, taskDef, []types.Tag{{Key: aws.String(resourceTag), Value: aws.String(string(e.env))}}); err != nil {
+		log.Printf("secretsEcsTaskDefinition: register task def error: %s, %s, %v", secretsFamily, containerName, err)
+		return "", err
+	} else {
+		// Only the latest revision is ever reused, so clean up older ones. This isn't an error big enough to fail the
+		// launch, just report and move on.
+		if err = e.deregisterOldTaskDefinitions(ctx, secretsFamily, 1, nil); err != nil {
+			log.Printf("secretsEcsTaskDefinition: deregister old task defs error: %s, %v", secretsFamily, err)
+		}
+		return newTaskDefArn, nil
+	}
+}
+
+// sameTaskDefinition returns whether two task definitions would run the same containers with the same settings
+func sameTaskDefinition(a, b *types.TaskDefinition) bool {
+	type runSettings struct {
+		ContainerDefinitions []types.ContainerDefinition
+		Cpu, Memory          *string
+		ExecutionRoleArn     *string
+		TaskRoleArn          *string
+		Volumes              []types.Volume
+	}
+	aJson, aErr := json.Marshal(runSettings{a.ContainerDefinitions, a.Cpu, a.Memory, a.ExecutionRoleArn, a.TaskRoleArn, a.Volumes})
+	bJson, bErr := json.Marshal(runSettings{b.ContainerDefinitions, b.Cpu, b.Memory, b.ExecutionRoleArn, b.TaskRoleArn, b.Volumes})
+	return (aErr == nil) && (bErr == nil) && (string(aJson) == string(bJson))
+}
+
+// resolveEcsContainer returns the name of the container in a task definition that overrides and secrets should apply to.
+// See primaryEcsContainer for how the container is chosen.
+func (e Ecs) resolveEcsContainer(ctx context.Context, taskDefId, containerName string) (string, error) {
+	if taskDef, err := e.getEcsTaskDefinition(ctx, taskDefId); err != nil {
+		return "", err
+	} else if idx, err := primaryEcsContainer(taskDef, containerName); err != nil {
+		return "", fmt.Errorf("resolveEcsContainer: %w", err)
+	} else {
+		return *taskDef.ContainerDefinitions[idx].Name, nil
+	}
+}
+
+// primaryEcsContainer returns the index of the container in a task definition that deployments and launched tasks
+// operate on. A container name, if specified, must match one of the containers. Otherwise, the primary container is the
+// one with the "cd-manager.primary" Docker label set, the one named after the task family, or the only container in the
+// task definition, in that order.
+func primaryEcsContainer(taskDef *types.TaskDefinition, containerName string) (int, error) {
+	containerNames := make([]string, 0, len(taskDef.ContainerDefinitions))
+	for _, containerDef := range taskDef.ContainerDefinitions {
+		containerNames = append(containerNames, *containerDef.Name)
+	}
+	if len(containerName) > 0 {
+		if idx := slices.Index(containerNames, containerName); idx != -1 {
+			return idx, nil
+		}
+		return -1, fmt.Errorf("container not found: %s, %s, valid containers: %s", *taskDef.TaskDefinitionArn, containerName, strings.Join(containerNames, ", "))
+	}
+	for idx, containerDef := range taskDef.ContainerDefinitions {
+		if primary, _ := strconv.ParseBool(containerDef.DockerLabels[primaryContainerLabel]); primary {
+			return idx, nil
+		}
+	}
+	if idx := slices.Index(containerNames, aws.ToString(taskDef.Family)); idx != -1 {
+		return idx, nil
+	} else if len(containerNames) == 1 {
+		return 0, nil
+	}
+	return -1, fmt.Errorf("primary container not found: %s, valid containers: %s", *taskDef.TaskDefinitionArn, strings.Join(containerNames, ", "))
+}
+
+// RegisterPrepullTask registers a task definition that can be launched to pull an image ahead of a deployment. It is
+// based on the specified task definition but only contains the specified container, whose command is replaced so that
+// it doesn't start the application. The image's own entrypoint is used since not all images contain a shell (e.g.
+// distroless images), so the container might not exit on its own, but only whether it starts matters.
+//
+// The task definition is registered under a separate family so that it doesn't affect the original task family.
+func (e Ecs) RegisterPrepullTask(ctx context.Context, taskDefArn, container string, repo manager.Repo, tag string) (string, error) {
+	taskDef, err := e.getEcsTaskDefinition(ctx, taskDefArn)
+	if err != nil {
+		log.Printf("registerPrepullTask: get task def error: %s, %s, %v", taskDefArn, container, err)
+		return "", err
+	}
+	idx, err := primaryEcsContainer(taskDef, container)
+	if err != nil {
+		return "", fmt.Errorf("registerPrepullTask: %w", err)
+	}
+	containerDef := taskDef.ContainerDefinitions[idx]
+	containerDef.Image = aws.String(e.getEcrRepo(repo) + ":" + tag)
+	containerDef.EntryPoint = nil
+	containerDef.Command = []string{"true"}
+	containerDef.Essential = aws.Bool(true)
+	// Strip anything the application would have needed to run, or that depends on other containers
+	containerDef.DependsOn = nil
+	containerDef.HealthCheck = nil
+	containerDef.MountPoints = nil
+	containerDef.VolumesFrom = nil
+	containerDef.Secrets = nil
+	taskDef.ContainerDefinitions = []types.ContainerDefinition{containerDef}
+	taskDef.Volumes = nil
+	family := e.taskFamilyFromArn(taskDefArn) + prepullFamilySuffix
+	taskDef.Family = aws.String(family)
+	if prepullTaskDefArn, err := e.registerEcsTaskDefinition(ctx, taskDef, e.taskDefTags("", "", "", time.Now())); err != nil {
+		log.Printf("registerPrepullTask: register task def error: %s, %s, %v", taskDefArn, container, err)
+		return "", err
+	} else {
+		// Only the latest revision is ever needed for pre-pulling, so clean up older ones. This isn't an error big
+		// enough to fail the pre-pull, just report and move on.
+		if err = e.deregisterOldTaskDefinitions(ctx, family, 1, nil); err != nil {
+			log.Printf("registerPrepullTask: deregister old task defs error: %s, %v", family, err)
+		}
+		return prepullTaskDefArn, nil
+	}
+}
+
+func (e Ecs) registerEcsTaskDefinition(ctx context.Context, taskDef *types.TaskDefinition, tags []types.Tag) (string, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	regTaskDefInput := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDef.ContainerDefinitions,
+		Family:                  taskDef.Family,
+		Cpu:                     taskDef.Cpu,
+		EphemeralStorage:        taskDef.EphemeralStorage,
+		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
+		InferenceAccelerators:   taskDef.InferenceAccelerators,
+		IpcMode:                 taskDef.IpcMode,
+		Memory:                  taskDef.Memory,
+		NetworkMode:             taskDef.NetworkMode,
+		PidMode:                 taskDef.PidMode,
+		PlacementConstraints:    taskDef.PlacementConstraints,
+		ProxyConfiguration:      taskDef.ProxyConfiguration,
+		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+		RuntimePlatform:         taskDef.RuntimePlatform,
+		TaskRoleArn:             taskDef.TaskRoleArn,
+		Volumes:                 taskDef.Volumes,
+		Tags:                    tags,
+	}
+	if regTaskDefOutput, err := e.ecsClient.RegisterTaskDefinition(httpCtx, regTaskDefInput); err != nil {
+		return "", err
+	} else {
+		return *regTaskDefOutput.TaskDefinition.TaskDefinitionArn, nil
+	}
+}
+
+// getEcsTaskDefinitionWithTags returns a task definition along with its tags, which aren't included by default
+func (e Ecs) getEcsTaskDefinitionWithTags(ctx context.Context, taskDefArn string) (*types.TaskDefinition, []types.Tag, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	input := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefArn),
+		Include:        []types.TaskDefinitionField{types.TaskDefinitionFieldTags},
+	}
+	if output, err := e.ecsClient.DescribeTaskDefinition(httpCtx, input); err != nil {
+		log.Printf("getEcsTaskDefinitionWithTags: describe task def error: %s, %v", taskDefArn, err)
+		return nil, nil, err
+	} else {
+		return output.TaskDefinition, output.Tags, nil
+	}
+}
+
+func (e Ecs) getEcsTaskDefinition(ctx context.Context, taskDefArn string) (*types.TaskDefinition, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	input := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefArn),
+	}
+	if output, err := e.ecsClient.DescribeTaskDefinition(httpCtx, input); err != nil {
+		log.Printf("getEcsTaskDefinition: describe task def error: %s, %v", taskDefArn, err)
+		return nil, err
+	} else {
+		return output.TaskDefinition, nil
+	}
+}
+
+// prepareEcsService registers a new task definition for a service with an updated image. Services that are created or
+// that use task sets are deployed right away, in which case no service is returned. Otherwise, the returned service (as
+// it was before the update) still needs to be deployed with the new task definition using deployEcsService.
+func (e Ecs) prepareEcsService(ctx context.Context, cluster, service, family, image string, task *manager.Task, createIfMissing bool, rolloutPercent int, taskDefTags []types.Tag) (string, *types.Service, error) {
+	containerName, replicas := task.Name, task.Replicas
+	// Describe service to get task definition ARN
+	descSvcOutput, err := e.describeEcsService(ctx, cluster, service)
+	if createIfMissing && (isEcsServiceMissing(err) || ((err == nil) && (aws.ToString(descSvcOutput.Services[0].Status) == ecsServiceStatus_Inactive))) {
+		newTaskDefArn, err := e.createEcsService(ctx, cluster, service, family, image, containerName, replicas, taskDefTags)
+		return newTaskDefArn, nil, err
+	} else if err != nil {
+		log.Printf("prepareEcsService: describe service error: %s, %s, %s, %v", cluster, service, image, err)
+		return "", nil, err
+	} else if isExternalEcsService(descSvcOutput.Services[0]) {
+		newTaskDefArn, err := e.updateEcsTaskSets(ctx, cluster, service, image, containerName, replicas, rolloutPercent, descSvcOutput.Services[0], taskDefTags)
+		if (err == nil) && (rolloutPercent > 0) && (rolloutPercent < 100) {
+			// Record the scale of the new task set so that it can be ramped up, and so that the layout check can tell
+			// when the task set has reached it.
+			task.RolloutPercent = rolloutPercent
+			task.RolloutStepStart = time.Now().UnixNano()
+		}
+		return newTaskDefArn, nil, err
+	} else if (rolloutPercent > 0) && (rolloutPercent < 100) {
+		// A rolling update can't be paused part of the way through, so staged rollouts need the external deployment
+		// controller.
+		log.Printf("prepareEcsService: staged rollout not supported for rolling updates: %s, %s, %d", cluster, service, rolloutPercent)
+	}
+	// Update task definition with new image
+	newTaskDefArn, err := e.updateEcsTaskDefinition(ctx, *descSvcOutput.Services[0].TaskDefinition, image, containerName, taskDefTags)
+	if err != nil {
+		log.Printf("prepareEcsService: update task def error: %s, %s, %s, %v", cluster, service, image, err)
+		return "", nil, err
+	}
+	return newTaskDefArn, &descSvcOutput.Services[0], nil
+}
+
+// deployEcsService updates a service using rolling updates to run the specified task definition
+func (e Ecs) deployEcsService(ctx context.Context, cluster, service, taskDefArn string, replicas int32, ecsService types.Service) error {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	updateSvcInput := &ecs.UpdateServiceInput{
+		Service:              aws.String(service),
+		Cluster:              aws.String(cluster),
+		EnableExecuteCommand: aws.Bool(true),
+		ForceNewDeployment:   true, // enable this so that the deployment circuit breaker can kick-in
+		TaskDefinition:       aws.String(taskDefArn),
+	}
+	updateSvcInput.DesiredCount = aws.Int32(e.desiredCount(cluster, service, replicas, ecsService))
+	if _, err := e.ecsClient.UpdateService(httpCtx, updateSvcInput); err != nil {
+		log.Printf("deployEcsService: update service error: %s, %s, %s, %v", cluster, service, taskDefArn, err)
+		return err
+	}
+	return nil
+}
+
+// desiredCount returns the desired count to deploy a service with. The service's current desired count is preserved
+// unless the layout explicitly requests a different number of replicas, or the service was scaled down to 0.
+func (e Ecs) desiredCount(cluster, service string, replicas int32, ecsService types.Service) int32 {
+	if (ecsService.DesiredCount == 0) && e.preserveScaledDown {
+		if replicas > 0 {
+			log.Printf("desiredCount: leaving scaled down service at 0 instead of %d: %s, %s", replicas, cluster, service)
+		}
+		return 0
+	} else if replicas > 0 {
+		return replicas
+	}
+	return ecsService.DesiredCount
+}
+
+// revertEcsService points a service at an earlier revision of its task definition, without registering a new revision
+func (e Ecs) revertEcsService(ctx context.Context, cluster, service, revision, jobId string) (string, error) {
+	descSvcOutput, err := e.describeEcsService(ctx, cluster, service)
+	if err != nil {
+		log.Printf("revertEcsService: describe service error: %s, %s, %s, %v", cluster, service, revision, err)
+		return "", err
+	} else if isExternalEcsService(descSvcOutput.Services[0]) {
+		return "", fmt.Errorf("revertEcsService: reverting services using task sets is not supported: %s, %s", cluster, service)
+	}
+	taskDefArn, err := e.findTaskDefRevision(ctx, *descSvcOutput.Services[0].TaskDefinition, revision, jobId)
+	if err != nil {
+		log.Printf("revertEcsService: find task def error: %s, %s, %s, %s, %v", cluster, service, revision, jobId, err)
+		return "", err
+	} else if err = e.deployEcsService(ctx, cluster, service, taskDefArn, 0, descSvcOutput.Services[0]); err != nil {
+		return "", err
+	}
+	return taskDefArn, nil
+}
+
+// findTaskDefRevision returns the full ARN of the active revision in a task definition's family that was registered by a
+// deployment, or of the specified revision if the deployment isn't known.
+func (e Ecs) findTaskDefRevision(ctx context.Context, taskDefArn, revision, jobId string) (string, error) {
+	family := manager.TaskDefFamily(taskDefArn)
+	if len(jobId) == 0 {
+		if taskDefId, err := manager.TaskDefRevision(taskDefArn, revision); err != nil {
+			return "", err
+		} else if taskDef, err := e.getEcsTaskDefinition(ctx, taskDefId); err != nil {
+			return "", err
+		} else if taskDef.Status != types.TaskDefinitionStatusActive {
+			return "", fmt.Errorf("findTaskDefRevision: revision is no longer active: %s", taskDefId)
+		} else {
+			return *taskDef.TaskDefinitionArn, nil
+		}
+	}
+	// Look through the active revisions from newest to oldest, which is where a recent deployment will be found first
+	input := &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Sort:         types.SortOrderDesc,
+		Status:       types.TaskDefinitionStatusActive,
+	}
+	p := ecs.NewListTaskDefinitionsPaginator(e.ecsClient, input)
+	for p.HasMorePages() {
+		if page, err := func() (*ecs.ListTaskDefinitionsOutput, error) {
+			httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+			defer httpCancel()
+
+			return p.NextPage(httpCtx)
+		}(); err != nil {
+			log.Printf("findTaskDefRevision: list task defs error: %s, %v", family, err)
+			return "", err
+		} else {
+			for _, revisionArn := range page.TaskDefinitionArns {
+				// The family prefix can also match other families, so skip revisions that aren't from the exact family
+				if e.taskFamilyFromArn(revisionArn) == family {
+					if _, tags, err := e.getEcsTaskDefinitionWithTags(ctx, revisionArn); err != nil {
+						return "", err
+					} else {
+						for _, tag := range tags {
+							if (aws.ToString(tag.Key) == jobIdTag) && (aws.ToString(tag.Value) == jobId) {
+								return revisionArn, nil
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("findTaskDefRevision: no active revision registered by deployment: %s, %s", family, jobId)
+}
+
+// createEcsService creates a service that doesn't exist yet, e.g. when bootstrapping a new environment. The service's
+// task definition family must already exist, and its network configuration is read from SSM, e.g. from
+// "/ceramic-dev-cas-api/network_configuration".
+func (e Ecs) createEcsService(ctx context.Context, cluster, service, family, image, containerName string, replicas int32, taskDefTags []types.Tag) (string, error) {
+	log.Printf("createEcsService: creating missing service: %s, %s, %s, %s", cluster, service, family, image)
+	newTaskDefArn, err := e.updateEcsTaskFamily(ctx, family, image, containerName, taskDefTags)
+	if err != nil {
+		log.Printf("createEcsService: update task family error: %s, %s, %s, %s, %v", cluster, service, family, image, err)
+		return "", err
+	}
+	networkConfig, err := e.getSsmNetworkConfig(ctx, "/"+service+"/network_configuration")
+	if err != nil {
+		log.Printf("createEcsService: get network config error: %s, %s, %s, %v", cluster, service, image, err)
+		return "", err
+	}
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	desiredCount := int32(1)
+	if replicas > 0 {
+		desiredCount = replicas
+	}
+	createSvcInput := &ecs.CreateServiceInput{
+		ServiceName:          aws.String(service),
+		Cluster:              aws.String(cluster),
+		DesiredCount:         aws.Int32(desiredCount),
+		EnableExecuteCommand: true,
+		LaunchType:           types.LaunchTypeFargate,
+		NetworkConfiguration: networkConfig,
+		TaskDefinition:       aws.String(newTaskDefArn),
+		Tags:                 []types.Tag{{Key: aws.String(resourceTag), Value: aws.String(string(e.env))}},
+	}
+	if len(e.platformVersion) > 0 {
+		createSvcInput.PlatformVersion = aws.String(e.platformVersion)
+	}
+	if _, err = e.ecsClient.CreateService(httpCtx, createSvcInput); err != nil {
+		log.Printf("createEcsService: create service error: %s, %s, %s, %s, %v", cluster, service, image, newTaskDefArn, err)
+		return "", err
+	}
+	return newTaskDefArn, nil
+}
+
+// updateEcsTaskSets deploys a service using the external deployment controller by creating a task set for the new task
+// definition, configured the same as the primary task set. The new task set starts at the specified percentage of the
+// service's desired count so that it only gets part of the traffic, and is then ramped up by rampEcsService. For a full
+// rollout, the new task set replaces the primary task set right away.
+func (e Ecs) updateEcsTaskSets(ctx context.Context, cluster, service, image, containerName string, replicas int32, rolloutPercent int, ecsService types.Service, taskDefTags []types.Tag) (string, error) {
+	primaryTaskSet := findEcsTaskSet(ecsService, func(taskSet types.TaskSet) bool {
+		return aws.ToString(taskSet.Status) == ecsTaskSetStatus_Primary
+	})
+	if primaryTaskSet == nil {
+		return "", fmt.Errorf("updateEcsTaskSets: missing primary task set: %s, %s", cluster, service)
+	}
+	newTaskDefArn, err := e.updateEcsTaskDefinition(ctx, *primaryTaskSet.TaskDefinition, image, containerName, taskDefTags)
+	if err != nil {
+		log.Printf("updateEcsTaskSets: update task def error: %s, %s, %s, %v", cluster, service, image, err)
+		return "", err
+	}
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	// Task sets are scaled relative to the service's desired count, so update it first if needed
+	if desiredCount := e.desiredCount(cluster, service, replicas, ecsService); desiredCount != ecsService.DesiredCount {
+		if _, err = e.ecsClient.UpdateService(httpCtx, &ecs.UpdateServiceInput{
+			Service:      aws.String(service),
+			Cluster:      aws.String(cluster),
+			DesiredCount: aws.Int32(desiredCount),
+		}); err != nil {
+			log.Printf("updateEcsTaskSets: update service error: %s, %s, %d, %v", cluster, service, desiredCount, err)
+			return "", err
+		}
+	}
+	if (rolloutPercent <= 0) || (rolloutPercent > 100) {
+		rolloutPercent = 100
+	}
+	createTaskSetInput := &ecs.CreateTaskSetInput{
+		Cluster:                  aws.String(cluster),
+		Service:                  aws.String(service),
+		TaskDefinition:           aws.String(newTaskDefArn),
+		CapacityProviderStrategy: primaryTaskSet.CapacityProviderStrategy,
+		LaunchType:               primaryTaskSet.LaunchType,
+		LoadBalancers:            primaryTaskSet.LoadBalancers,
+		NetworkConfiguration:     primaryTaskSet.NetworkConfiguration,
+		PlatformVersion:          primaryTaskSet.PlatformVersion,
+		ServiceRegistries:        primaryTaskSet.ServiceRegistries,
+		Scale:                    &types.Scale{Unit: types.ScaleUnitPercent, Value: float64(rolloutPercent)},
+		Tags:                     []types.Tag{{Key: aws.String(resourceTag), Value: aws.String(string(e.env))}},
+	}
+	// The platform version only applies to Fargate task sets
+	if (len(e.platformVersion) > 0) && (primaryTaskSet.PlatformVersion != nil) {
+		createTaskSetInput.PlatformVersion = aws.String(e.platformVersion)
+	}
+	output, err := e.ecsClient.CreateTaskSet(httpCtx, createTaskSetInput)
+	if err != nil {
+		log.Printf("updateEcsTaskSets: create task set error: %s, %s, %s, %v", cluster, service, newTaskDefArn, err)
+		return "", err
+	} else if rolloutPercent == 100 {
+		if err = e.promoteEcsTaskSet(ctx, cluster, service, *output.TaskSet.Id, ecsService.TaskSets); err != nil {
+			return "", err
+		}
+	}
+	return newTaskDefArn, nil
+}
+
+// rampEcsService scales the task set for a task definition to the specified percentage of the service's desired count,
+// and makes it the primary task set once it's at 100%.
+func (e Ecs) rampEcsService(ctx context.Context, cluster, service, taskDefArn string, percent int) error {
+	output, err := e.describeEcsService(ctx, cluster, service)
+	if err != nil {
+		log.Printf("rampEcsService: describe service error: %s, %s, %s, %v", cluster, service, taskDefArn, err)
+		return err
+	} else if !isExternalEcsService(output.Services[0]) {
+		return nil
+	}
+	taskSet := findEcsTaskSet(output.Services[0], func(taskSet types.TaskSet) bool {
+		return aws.ToString(taskSet.TaskDefinition) == taskDefArn
+	})
+	if taskSet == nil {
+		return fmt.Errorf("rampEcsService: task set not found: %s, %s, %s", cluster, service, taskDefArn)
+	}
+	if (taskSet.Scale == nil) || (taskSet.Scale.Value != float64(percent)) {
+		httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+		defer httpCancel()
+
+		if _, err = e.ecsClient.UpdateTaskSet(httpCtx, &ecs.UpdateTaskSetInput{
+			Cluster: aws.String(cluster),
+			Service: aws.String(service),
+			TaskSet: taskSet.Id,
+			Scale:   &types.Scale{Unit: types.ScaleUnitPercent, Value: float64(percent)},
+		}); err != nil {
+			log.Printf("rampEcsService: update task set error: %s, %s, %s, %d, %v", cluster, service, taskDefArn, percent, err)
+			return err
+		}
+	}
+	if (percent >= 100) && (aws.ToString(taskSet.Status) != ecsTaskSetStatus_Primary) {
+		return e.promoteEcsTaskSet(ctx, cluster, service, *taskSet.Id, output.Services[0].TaskSets)
+	}
+	return nil
+}
+
+// promoteEcsTaskSet makes a task set the primary task set of its service, then deletes the service's other task sets
+// along with their tasks.
+func (e Ecs) promoteEcsTaskSet(ctx context.Context, cluster, service, taskSetId string, taskSets []types.TaskSet) error {
+	// Give each call its own timeout so that deleting several task sets can't run out of time partway through
+	if _, err := func() (*ecs.UpdateServicePrimaryTaskSetOutput, error) {
+		httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+		defer httpCancel()
+
+		return e.ecsClient.UpdateServicePrimaryTaskSet(httpCtx, &ecs.UpdateServicePrimaryTaskSetInput{
+			Cluster:        aws.String(cluster),
+			Service:        aws.String(service),
+			PrimaryTaskSet: aws.String(taskSetId),
+		})
+	}(); err != nil {
+		log.Printf("promoteEcsTaskSet: update primary task set error: %s, %s, %s, %v", cluster, service, taskSetId, err)
+		return err
+	}
+	for _, taskSet := range taskSets {
+		if *taskSet.Id != taskSetId {
+			if _, err := func() (*ecs.DeleteTaskSetOutput, error) {
+				httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+				defer httpCancel()
+
+				return e.ecsClient.DeleteTaskSet(httpCtx, &ecs.DeleteTaskSetInput{
+					Cluster: aws.String(cluster),
+					Service: aws.String(service),
+					TaskSet: taskSet.Id,
+					Force:   aws.Bool(true),
+				})
+			}(); err != nil {
+				log.Printf("promoteEcsTaskSet: delete task set error: %s, %s, %s, %v", cluster, service, *taskSet.Id, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isExternalEcsService returns true if a service is deployed through task sets instead of rolling updates
+func isExternalEcsService(ecsService types.Service) bool {
+	return (ecsService.DeploymentController != nil) && (ecsService.DeploymentController.Type == types.DeploymentControllerTypeExternal)
+}
+
+// findEcsTaskSet returns the first task set of a service that matches the filter, if any
+func findEcsTaskSet(ecsService types.Service, filter func(types.TaskSet) bool) *types.TaskSet {
+	for _, taskSet := range ecsService.TaskSets {
+		if filter(taskSet) {
+			return &taskSet
+		}
+	}
+	return nil
+}
+
+// isEcsServiceMissing returns true if describing a service failed because the service doesn't exist
+func isEcsServiceMissing(err error) bool {
+	var failures ecsFailures
+	if errors.As(err, &failures) {
+		for _, failure := range failures {
+			if failure.reason == ecsFailureReason_Missing {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e Ecs) updateEcsTask(ctx context.Context, cluster, familyPfx, image, containerName string, taskDefTags []types.Tag) (string, error) {
+	if newTaskDefArn, err := e.updateEcsTaskFamily(ctx, familyPfx, image, containerName, taskDefTags); err != nil {
+		log.Printf("updateEcsTask: update task family error: %s, %s, %s, %v", cluster, familyPfx, image, err)
+		return "", err
+	} else
+	// Stop the permanently running tasks in the family that aren't running the new revision. Since there is no deployment
+	// configuration for tasks, we can't rely on ECS to manage the deployment for us.
+	if err = e.stopEcsTasks(ctx, cluster, e.taskFamilyFromArn(newTaskDefArn), keepTaskDefinition(newTaskDefArn)); err != nil {
+		log.Printf("updateEcsTask: stop tasks error: %s, %s, %s, %s, %v", cluster, familyPfx, image, newTaskDefArn, err)
+		return "", err
+	} else {
+		return newTaskDefArn, nil
+	}
+}
+
+// updateEcsTaskFamily registers a new revision of the latest task definition in a family with an updated image
+func (e Ecs) updateEcsTaskFamily(ctx context.Context, familyPfx, image, containerName string, taskDefTags []types.Tag) (string, error) {
+	if prevTaskDefArn, err := e.getEcsTaskDefinitionArn(ctx, familyPfx); err != nil {
+		log.Printf("updateEcsTaskFamily: get task def error: %s, %s, %v", familyPfx, image, err)
+		return "", err
+	} else if newTaskDefArn, err := e.updateEcsTaskDefinition(ctx, prevTaskDefArn, image, containerName, taskDefTags); err != nil {
+		log.Printf("updateEcsTaskFamily: update task def error: %s, %s, %s, %v", familyPfx, image, prevTaskDefArn, err)
+		return "", err
+	} else {
+		return newTaskDefArn, nil
+	}
+}
+
+func (e Ecs) getEcsTaskDefinitionArn(ctx context.Context, familyPfx string) (string, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	// List all task definitions and get the latest definition's ARN. We only need the first result in descending order,
+	// so there's no need to paginate.
+	input := &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(familyPfx),
+		MaxResults:   aws.Int32(1),
+		Sort:         types.SortOrderDesc,
+	}
+	output, err := e.ecsClient.ListTaskDefinitions(httpCtx, input)
+	if err != nil {
+		log.Printf("getEcsTaskDefinitionArn: list task defs error: %s, %v", familyPfx, err)
+		return "", err
+	} else if len(output.TaskDefinitionArns) == 0 {
+		return "", fmt.Errorf("getEcsTaskDefinitionArn: no task definitions found: %s", familyPfx)
+	}
+	return output.TaskDefinitionArns[0], nil
+}
+
+// inUseTaskDefinitions returns the task definitions used by the services, including their in-progress deployments and
+// task sets, and the running tasks in a set of clusters
+func (e Ecs) inUseTaskDefinitions(ctx context.Context, clusters []string) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	for _, cluster := range clusters {
+		if serviceArns, err := e.listEcsServices(ctx, cluster); err != nil {
+			log.Printf("inUseTaskDefinitions: list services error: %s, %v", cluster, err)
+			return nil, err
+		} else {
+			for _, serviceArn := range serviceArns {
+				if descSvcOutput, err := e.describeEcsService(ctx, cluster, e.serviceNameFromArn(serviceArn)); err != nil {
+					return nil, err
+				} else {
+					ecsService := descSvcOutput.Services[0]
+					inUse[aws.ToString(ecsService.TaskDefinition)] = true
+					for _, deployment := range ecsService.Deployments {
+						inUse[aws.ToString(deployment.TaskDefinition)] = true
+					}
+					for _, taskSet := range ecsService.TaskSets {
+						inUse[aws.ToString(taskSet.TaskDefinition)] = true
+					}
+				}
+			}
+		}
+		if taskArns, err := e.listEcsTasks(ctx, cluster, ""); err != nil {
+			log.Printf("inUseTaskDefinitions: list tasks error: %s, %v", cluster, err)
+			return nil, err
+		} else if tasks, err := e.describeEcsTasks(ctx, cluster, taskArns); err != nil {
+			log.Printf("inUseTaskDefinitions: describe tasks error: %s, %v", cluster, err)
+			return nil, err
+		} else {
+			for _, task := range tasks {
+				inUse[aws.ToString(task.TaskDefinitionArn)] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+func (e Ecs) deregisterOldTaskDefinitions(ctx context.Context, family string, keep int, inUse map[string]bool) error {
+	// List task definitions from newest to oldest, then deregister everything after the first `keep` revisions that
+	// isn't in use
+	input := &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Sort:         types.SortOrderDesc,
+	}
+	numFound := 0
+	numDeregistered := 0
+	p := ecs.NewListTaskDefinitionsPaginator(e.ecsClient, input)
+	for p.HasMorePages() {
+		if page, err := func() (*ecs.ListTaskDefinitionsOutput, error) {
+			httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+			defer httpCancel()
+
+			return p.NextPage(httpCtx)
+		}(); err != nil {
+			log.Printf("deregisterOldTaskDefinitions: list task defs error: %s, %v", family, err)
+			return err
+		} else {
+			for _, taskDefArn := range page.TaskDefinitionArns {
+				// The family prefix can also match other families (e.g. "ceramic-dev-node" would also match
+				// "ceramic-dev-node-1"), so make sure that we only deregister revisions from the exact family.
+				if e.taskFamilyFromArn(taskDefArn) == family {
+					numFound++
+					if (numFound > keep) && !inUse[taskDefArn] {
+						if err = e.deregisterEcsTaskDefinition(ctx, taskDefArn); err != nil {
+							log.Printf("deregisterOldTaskDefinitions: deregister task def error: %s, %s, %v", family, taskDefArn, err)
+							return err
+						}
+						numDeregistered++
+					}
+				}
+			}
+		}
+	}
+	if numDeregistered > 0 {
+		log.Printf("deregisterOldTaskDefinitions: deregistered %d task defs: %s", numDeregistered, family)
+	}
+	return nil
+}
+
+func (e Ecs) deregisterEcsTaskDefinition(ctx context.Context, taskDefArn string) error {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	_, err := e.ecsClient.DeregisterTaskDefinition(httpCtx, &ecs.DeregisterTaskDefinitionInput{TaskDefinition: aws.String(taskDefArn)})
+	return err
+}
+
+// stopDrainedEcsTasks stops the tasks left over from earlier deployments of a service, if the service can only run a
+// single instance of a task at a time. We use the latter configuration in special cases where the application cannot
+// support running more than one instance of a service task at a time, so the new tasks can't come up until the old ones
+// are stopped. Otherwise, ECS can manage the deployment for us.
+//
+// The old tasks are only stopped once the configured drain delay has passed since the new deployment was created.
+// StopTask sends SIGTERM followed by SIGKILL after the container's stop timeout, which isn't always enough time for
+// connections to the old tasks to be closed cleanly. This is called each time a deployment or restart is checked instead
+// of waiting for the delay inline, so that the job loop isn't held up.
+func (e Ecs) stopDrainedEcsTasks(ctx context.Context, cluster, service string, ecsService types.Service) error {
+	if (ecsService.DeploymentConfiguration == nil) || (aws.ToInt32(ecsService.DeploymentConfiguration.MaximumPercent) >= 200) {
+		return nil
+	}
+	var primary *types.Deployment
+	draining := false
+	for i, deployment := range ecsService.Deployments {
+		if aws.ToString(deployment.Status) == "PRIMARY" {
+			primary = &ecsService.Deployments[i]
+		} else if deployment.RunningCount > 0 {
+			draining = true
+		}
+	}
+	if (primary == nil) || (primary.CreatedAt == nil) || !draining {
+		return nil
+	} else if time.Since(*primary.CreatedAt) < e.drainDelay {
+		log.Printf("stopDrainedEcsTasks: waiting for service to drain: %s, %s, %s", cluster, service, e.drainDelay)
+		return nil
+	}
+	// Tasks created since the new deployment belong to it, even if a restart deployed the same task definition again
+	deployedAt := *primary.CreatedAt
+	family := e.taskFamilyFromArn(aws.ToString(primary.TaskDefinition))
+	if err := e.stopEcsTasks(ctx, cluster, family, func(task types.Task) bool {
+		return (task.CreatedAt != nil) && !task.CreatedAt.Before(deployedAt)
+	}); err != nil {
+		log.Printf("stopDrainedEcsTasks: stop tasks error: %s, %s, %v", cluster, service, err)
+		return err
+	}
+	return nil
+}
+
+// stopEcsTasks stops the running tasks in a family. If a filter is specified, tasks it keeps are left alone, e.g. so that
+// tasks started for a new deployment aren't stopped along with the old ones. This doesn't wait for the tasks to stop so
+// that the job loop isn't held up, so deployments confirm that they have stopped when checking the environment.
+func (e Ecs) stopEcsTasks(ctx context.Context, cluster, family string, keep func(types.Task) bool) error {
+	if taskArns, err := e.listEcsTasks(ctx, cluster, family); err != nil {
+		log.Printf("stopEcsTasks: list tasks error: %s, %s, %v", cluster, family, err)
+		return err
+	} else if taskArns, err = e.filterEcsTasks(ctx, cluster, taskArns, keep); err != nil {
+		log.Printf("stopEcsTasks: filter tasks error: %s, %s, %v", cluster, family, err)
+		return err
+	} else {
+		// Give each call its own timeout so that stopping many tasks can't run out of time partway through
+		for _, taskArn := range taskArns {
+			if _, err = func() (*ecs.StopTaskOutput, error) {
+				httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+				defer httpCancel()
+
+				return e.ecsClient.StopTask(httpCtx, &ecs.StopTaskInput{
+					Task:    aws.String(taskArn),
+					Cluster: aws.String(cluster),
+				})
+			}(); err != nil {
+				log.Printf("stopEcsTasks: stop task error: %s, %s, %v", cluster, family, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterEcsTasks returns the tasks that the filter doesn't keep. All tasks are returned if no filter is specified.
+func (e Ecs) filterEcsTasks(ctx context.Context, cluster string, taskArns []string, keep func(types.Task) bool) ([]string, error) {
+	if (keep == nil) || (len(taskArns) == 0) {
+		return taskArns, nil
+	}
+	if tasks, err := e.describeEcsTasks(ctx, cluster, taskArns); err != nil {
+		return nil, err
+	} else {
+		filteredTaskArns := make([]string, 0, len(tasks))
+		for _, task := range tasks {
+			if !keep(task) {
+				filteredTaskArns = append(filteredTaskArns, *task.TaskArn)
+			}
+		}
+		return filteredTaskArns, nil
+	}
+}
+
+// keepTaskDefinition returns a filter for stopEcsTasks that keeps the tasks running the specified task definition
+func keepTaskDefinition(taskDefArn string) func(types.Task) bool {
+	return func(task types.Task) bool {
+		return aws.ToString(task.TaskDefinitionArn) == taskDefArn
+	}
+}
+
+// checkEcsService checks whether a service has been deployed with a task's task definition. A service that hasn't been
+// deployed within its stabilization timeout, if any, fails the check.
+func (e Ecs) checkEcsService(ctx context.Context, cluster, service string, task *manager.Task, timeout time.Duration) (bool, error) {
+	output, err := e.describeEcsService(ctx, cluster, service)
+	if err != nil {
+		log.Printf("checkEcsService: describe service error: %s, %s, %s, %v", cluster, service, task.Id, err)
+		return false, err
+	}
+	ecsService := output.Services[0]
+	reportEcsServiceEvents(cluster, service, task, ecsService)
+	if err = e.stopDrainedEcsTasks(ctx, cluster, service, ecsService); err != nil {
+		return false, err
+	} else if deployed, err := e.checkEcsServiceDeployed(ctx, cluster, service, task, ecsService); err != nil {
+		return false, err
+	} else if !deployed && (timeout > 0) {
+		return false, checkEcsServiceStabilizeTimeout(cluster, service, task, timeout, ecsService)
+	} else {
+		return deployed, nil
+	}
+}
+
+func (e Ecs) checkEcsServiceDeployed(ctx context.Context, cluster, service string, task *manager.Task, ecsService types.Service) (bool, error) {
+	taskDefArn := task.Id
+	family := e.taskFamilyFromArn(taskDefArn)
+	if err := e.checkEcsServiceFailures(cluster, service, taskDefArn, ecsService); err != nil {
+		return false, err
+	} else if err = e.checkEcsServicePulls(ctx, cluster, service, taskDefArn, ecsService); err != nil {
+		return false, err
+	} else if isExternalEcsService(ecsService) {
+		return e.checkEcsTaskSet(cluster, service, task, ecsService)
+	} else if (ecsService.DesiredCount == 0) && (aws.ToString(ecsService.TaskDefinition) == taskDefArn) {
+		// A service that was left scaled down has no tasks to wait for, so it's deployed as soon as it points to the new
+		// task definition.
+		return true, nil
+	}
+	// By default, a service is considered deployed as soon as tasks with the new task definition have been running for
+	// a few minutes, which is faster than waiting for ECS to consider the deployment complete.
+	if e.strictServiceCheck {
+		return e.checkEcsServiceStable(cluster, service, taskDefArn, ecsService)
+	}
+	if taskArns, err := e.listEcsTasks(ctx, cluster, family); err != nil {
+		log.Printf("checkEcsServiceDeployed: list tasks error: %s, %s, %s, %v", cluster, family, taskDefArn, err)
+		return false, err
+	} else if len(taskArns) > 0 {
+		// For each running task, check if it's been up for a few minutes.
+		if deployed, _, err := e.CheckTask(ctx, cluster, taskDefArn, true, true, taskArns...); err != nil {
+			log.Printf("checkEcsServiceDeployed: check task error: %s, %s, %s, %v", cluster, family, taskDefArn, err)
+			return false, err
+		} else if !deployed {
+			return false, nil
+		} else if e.checkTargetHealth {
+			return e.checkEcsTargetHealth(ctx, cluster, service, taskDefArn, taskArns, ecsService)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// checkEcsServiceStabilizeTimeout fails a service that has been deploying a task definition for longer than its
+// stabilization timeout, measured from when the deployment or task set with the new task definition was created. For
+// services deployed in stages, the time since the current step of the rollout started is used instead, so that each
+// step gets the full timeout.
+func checkEcsServiceStabilizeTimeout(cluster, service string, task *manager.Task, timeout time.Duration, ecsService types.Service) error {
+	taskDefArn := task.Id
+	var since *time.Time
+	// Deployments are listed from newest to oldest, so the first one with the new task definition is the one started
+	// by this deployment.
+	for _, deployment := range ecsService.Deployments {
+		if aws.ToString(deployment.TaskDefinition) == taskDefArn {
+			since = deployment.CreatedAt
+			break
+		}
+	}
+	for _, taskSet := range ecsService.TaskSets {
+		if aws.ToString(taskSet.TaskDefinition) == taskDefArn {
+			since = taskSet.CreatedAt
+			break
+		}
 	}
-}
-
-func (e Ecs) listEcsServices(cluster string) (*ecs.ListServicesOutput, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
-
-	input := &ecs.ListServicesInput{
-		Cluster: aws.String(cluster),
+	if task.RolloutStepStart > 0 {
+		stepStart := time.Unix(0, task.RolloutStepStart)
+		since = &stepStart
 	}
-	if output, err := e.ecsClient.ListServices(ctx, input); err != nil {
-		log.Printf("listEcsServices: %s, %v", cluster, err)
-		return nil, err
-	} else {
-		return output, nil
+	if (since != nil) && (time.Since(*since) > timeout) {
+		return fmt.Errorf("checkEcsServiceStabilizeTimeout: %w: not stable after %s: %s, %s, %s", manager.Error_StabilizeTimeout, timeout, cluster, service, taskDefArn)
 	}
+	return nil
 }
 
-func (e Ecs) runEcsTask(cluster, family, container string, networkConfig *types.NetworkConfiguration, overrides map[string]string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+// stabilizeTimeout returns the stabilization timeout of a service, falling back to the default of its task set. Layouts
+// are validated before deployment, so invalid timeouts are treated as unset.
+func stabilizeTimeout(taskSet *manager.TaskSet, task *manager.Task) time.Duration {
+	timeout := task.StabilizeTimeout
+	if len(timeout) == 0 {
+		timeout = taskSet.StabilizeTimeout
+	}
+	parsedTimeout, _ := time.ParseDuration(timeout)
+	return parsedTimeout
+}
 
-	input := &ecs.RunTaskInput{
-		TaskDefinition:       aws.String(family),
-		Cluster:              aws.String(cluster),
-		Count:                aws.Int32(1),
-		EnableExecuteCommand: true,
-		LaunchType:           "FARGATE",
-		NetworkConfiguration: networkConfig,
-		StartedBy:            aws.String(manager.ServiceName),
-		Tags:                 []types.Tag{{Key: aws.String(resourceTag), Value: aws.String(string(e.env))}},
+// reportEcsServiceEvents logs the service events (e.g. "has started 1 tasks", "was unable to place a task") that are new
+// since the last check of a deployment, and records the notable ones in the task so that they can be surfaced in
+// notifications. On the first check, only events since the deployment or task set with the task definition was created
+// are reported.
+func reportEcsServiceEvents(cluster, service string, task *manager.Task, ecsService types.Service) {
+	var since time.Time
+	if len(task.LastEventId) == 0 {
+		for _, deployment := range ecsService.Deployments {
+			if (aws.ToString(deployment.TaskDefinition) == task.Id) && (deployment.CreatedAt != nil) {
+				since = *deployment.CreatedAt
+			}
+		}
+		// Services with an external deployment controller have task sets instead of deployments
+		for _, taskSet := range ecsService.TaskSets {
+			if (aws.ToString(taskSet.TaskDefinition) == task.Id) && (taskSet.CreatedAt != nil) {
+				since = *taskSet.CreatedAt
+			}
+		}
 	}
-	if (overrides != nil) && (len(overrides) > 0) {
-		overrideEnv := make([]types.KeyValuePair, 0, len(overrides))
-		for k, v := range overrides {
-			overrideEnv = append(overrideEnv, types.KeyValuePair{Name: aws.String(k), Value: aws.String(v)})
+	task.Events = nil
+	// Events are returned newest first, so walk them in reverse to report them in the order they happened
+	newEvents := make([]types.ServiceEvent, 0)
+	for _, event := range ecsService.Events {
+		if (aws.ToString(event.Id) == task.LastEventId) || ((event.CreatedAt != nil) && event.CreatedAt.Before(since)) {
+			break
 		}
-		input.Overrides = &types.TaskOverride{
-			ContainerOverrides: []types.ContainerOverride{
-				{
-					Name:        aws.String(container),
-					Environment: overrideEnv,
-				},
-			},
+		newEvents = append(newEvents, event)
+	}
+	for i := len(newEvents) - 1; i >= 0; i-- {
+		message := aws.ToString(newEvents[i].Message)
+		log.Printf("checkEcsService: service event: %s, %s, %s", cluster, service, message)
+		if isNotableEcsServiceEvent(message) {
+			task.Events = append(task.Events, message)
 		}
 	}
-	if output, err := e.ecsClient.RunTask(ctx, input); err != nil {
-		log.Printf("runEcsTask: %s, %s, %s, %+v, %v", cluster, family, container, overrides, err)
-		return "", err
-	} else {
-		return *output.Tasks[0].TaskArn, nil
+	if len(ecsService.Events) > 0 {
+		task.LastEventId = aws.ToString(ecsService.Events[0].Id)
 	}
 }
 
-func (e Ecs) updateEcsTaskDefinition(taskDefArn, image, containerName string) (string, error) {
-	taskDef, err := e.getEcsTaskDefinition(taskDefArn)
-	if err != nil {
-		log.Printf("updateEcsTaskDefinition: get task def error: %s, %s, %v", taskDefArn, image, err)
-		return "", err
+// isNotableEcsServiceEvent returns true for service events that point to a problem with a deployment
+func isNotableEcsServiceEvent(message string) bool {
+	message = strings.ToLower(message)
+	for _, notable := range ecsNotableEventMessages {
+		if strings.Contains(message, notable) {
+			return true
+		}
 	}
-	// Register a new task definition with an updated image
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+	return false
+}
 
-	for idx, containerDef := range taskDef.ContainerDefinitions {
-		if *containerDef.Name == containerName {
-			taskDef.ContainerDefinitions[idx].Image = aws.String(image)
-			regTaskDefInput := &ecs.RegisterTaskDefinitionInput{
-				ContainerDefinitions:    taskDef.ContainerDefinitions,
-				Family:                  taskDef.Family,
-				Cpu:                     taskDef.Cpu,
-				EphemeralStorage:        taskDef.EphemeralStorage,
-				ExecutionRoleArn:        taskDef.ExecutionRoleArn,
-				InferenceAccelerators:   taskDef.InferenceAccelerators,
-				IpcMode:                 taskDef.IpcMode,
-				Memory:                  taskDef.Memory,
-				NetworkMode:             taskDef.NetworkMode,
-				PidMode:                 taskDef.PidMode,
-				PlacementConstraints:    taskDef.PlacementConstraints,
-				ProxyConfiguration:      taskDef.ProxyConfiguration,
-				RequiresCompatibilities: taskDef.RequiresCompatibilities,
-				RuntimePlatform:         taskDef.RuntimePlatform,
-				TaskRoleArn:             taskDef.TaskRoleArn,
-				Volumes:                 taskDef.Volumes,
-				Tags:                    []types.Tag{{Key: aws.String(resourceTag), Value: aws.String(string(e.env))}},
-			}
-			if regTaskDefOutput, err := e.ecsClient.RegisterTaskDefinition(ctx, regTaskDefInput); err != nil {
-				log.Printf("updateEcsTaskDefinition: register task def error: %s, %s, %s, %v", taskDefArn, image, containerName, err)
-				return "", err
-			} else {
-				return *regTaskDefOutput.TaskDefinition.TaskDefinitionArn, nil
+// checkEcsServiceFailures fails fast if the deployment for the new task definition keeps failing to start tasks, instead
+// of waiting for the deployment to time out.
+func (e Ecs) checkEcsServiceFailures(cluster, service, taskDefArn string, ecsService types.Service) error {
+	if e.maxFailedTasks <= 0 {
+		return nil
+	}
+	for _, deployment := range ecsService.Deployments {
+		// ECS resets the failed task count once the deployment has a task running successfully
+		if (aws.ToString(deployment.TaskDefinition) == taskDefArn) && (deployment.FailedTasks > e.maxFailedTasks) {
+			// Include the most recent service event since it usually explains why tasks are failing
+			lastEvent := ""
+			if (len(ecsService.Events) > 0) && (ecsService.Events[0].Message != nil) {
+				lastEvent = *ecsService.Events[0].Message
 			}
+			return fmt.Errorf("checkEcsServiceFailures: %w: %d failed tasks: %s, %s, %s, %s", manager.Error_CrashLooping, deployment.FailedTasks, cluster, service, taskDefArn, lastEvent)
 		}
 	}
-	return "", fmt.Errorf("updateEcsTaskDefinition: container not found: %s, %s, %s", taskDefArn, image, containerName)
+	return nil
 }
 
-func (e Ecs) getEcsTaskDefinition(taskDefArn string) (*types.TaskDefinition, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+// checkEcsServicePulls fails fast if tasks with the new task definition stopped because their image couldn't be pulled,
+// which would otherwise only surface once the deployment times out. Stopped tasks are only looked up if the service
+// reports failed tasks, so that healthy deployments don't make the extra calls on every check.
+func (e Ecs) checkEcsServicePulls(ctx context.Context, cluster, service, taskDefArn string, ecsService types.Service) error {
+	if !ecsServiceTasksFailed(taskDefArn, ecsService) {
+		return nil
+	} else if taskArns, err := e.listEcsTasksByStatus(ctx, cluster, e.taskFamilyFromArn(taskDefArn), types.DesiredStatusStopped); err != nil {
+		log.Printf("checkEcsServicePulls: list stopped tasks error: %s, %s, %s, %v", cluster, service, taskDefArn, err)
+		return err
+	} else if len(taskArns) > 0 {
+		if taskStates, err := e.CheckTasks(ctx, cluster, false, taskArns...); err != nil {
+			log.Printf("checkEcsServicePulls: check tasks error: %s, %s, %s, %v", cluster, service, taskDefArn, err)
+			return err
+		} else {
+			for _, taskState := range taskStates {
+				if taskState.TaskDefArn == taskDefArn {
+					if err = imagePullError(cluster, taskState); err != nil {
+						return fmt.Errorf("checkEcsServicePulls: %s: %w", service, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	input := &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: aws.String(taskDefArn),
+// ecsServiceTasksFailed returns whether tasks with a task definition might have failed to start. ECS counts tasks that
+// failed to start, e.g. because their image couldn't be pulled, against the service deployment. Task sets don't report
+// failed tasks, so a task set with fewer running and pending tasks than desired is treated as failing instead.
+func ecsServiceTasksFailed(taskDefArn string, ecsService types.Service) bool {
+	for _, deployment := range ecsService.Deployments {
+		if (aws.ToString(deployment.TaskDefinition) == taskDefArn) && (deployment.FailedTasks > 0) {
+			return true
+		}
 	}
-	if output, err := e.ecsClient.DescribeTaskDefinition(ctx, input); err != nil {
-		log.Printf("getEcsTaskDefinition: describe task def error: %s, %v", taskDefArn, err)
-		return nil, err
-	} else {
-		return output.TaskDefinition, nil
+	for _, taskSet := range ecsService.TaskSets {
+		if (aws.ToString(taskSet.TaskDefinition) == taskDefArn) && (taskSet.RunningCount+taskSet.PendingCount < taskSet.ComputedDesiredCount) {
+			return true
+		}
 	}
+	return false
 }
 
-func (e Ecs) updateEcsService(cluster, service, image, containerName string, tempTask bool) (string, error) {
-	// Describe service to get task definition ARN
-	descSvcOutput, err := e.describeEcsService(cluster, service)
-	if err != nil {
-		log.Printf("updateEcsService: describe service error: %s, %s, %s, %v, %v", cluster, service, image, tempTask, err)
-		return "", err
+// checkEcsTargetHealth checks whether the running tasks with the new task definition are healthy in the target groups of
+// the service's load balancers. Tasks use the "awsvpc" network mode, so they're registered as targets by IP address.
+func (e Ecs) checkEcsTargetHealth(ctx context.Context, cluster, service, taskDefArn string, taskArns []string, ecsService types.Service) (bool, error) {
+	if len(ecsService.LoadBalancers) == 0 {
+		return true, nil
 	}
-	// Update task definition with new image
-	newTaskDefArn, err := e.updateEcsTaskDefinition(*descSvcOutput.Services[0].TaskDefinition, image, containerName)
+	tasks, err := e.describeEcsTasks(ctx, cluster, taskArns)
 	if err != nil {
-		log.Printf("updateEcsService: update task def error: %s, %s, %s, %v, %v", cluster, service, image, tempTask, err)
-		return "", err
+		log.Printf("checkEcsTargetHealth: describe tasks error: %s, %s, %s, %v", cluster, service, taskDefArn, err)
+		return false, err
 	}
-	// Update the service to use the new task definition
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
-
-	updateSvcInput := &ecs.UpdateServiceInput{
-		Service:              aws.String(service),
-		Cluster:              aws.String(cluster),
-		EnableExecuteCommand: aws.Bool(true),
-		ForceNewDeployment:   true, // enable this so that the deployment circuit breaker can kick-in
-		TaskDefinition:       aws.String(newTaskDefArn),
+	taskIps := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		if aws.ToString(task.TaskDefinitionArn) == taskDefArn {
+			if taskIp := ecsTaskIp(task); len(taskIp) > 0 {
+				taskIps = append(taskIps, taskIp)
+			}
+		}
 	}
-	if _, err = e.ecsClient.UpdateService(ctx, updateSvcInput); err != nil {
-		log.Printf("updateEcsService: update service error: %s, %s, %s, %s, %v, %v", cluster, service, image, newTaskDefArn, tempTask, err)
-		return "", err
-	} else
-	// Stop any permanently running tasks in the service if the deployment requires only a single instance of the
-	// service task to run. We use the latter configuration in special cases where the application cannot support
-	// running more than one instance of a service task at a time. Otherwise, ECS can manage the deployment for us.
-	if !tempTask && (*descSvcOutput.Services[0].DeploymentConfiguration.MaximumPercent < 200) {
-		if err = e.stopEcsTasks(cluster, e.taskFamilyFromArn(newTaskDefArn)); err != nil {
-			log.Printf("updateEcsService: stop tasks error: %s, %s, %s, %s, %v, %v", cluster, service, image, newTaskDefArn, tempTask, err)
-			return "", err
+	if len(taskIps) == 0 {
+		return false, nil
+	}
+	for _, loadBalancer := range ecsService.LoadBalancers {
+		// Classic load balancers don't have target groups
+		if loadBalancer.TargetGroupArn == nil {
+			continue
+		}
+		targets := make([]elbTypes.TargetDescription, len(taskIps))
+		for i, taskIp := range taskIps {
+			targets[i] = elbTypes.TargetDescription{Id: aws.String(taskIp), Port: loadBalancer.ContainerPort}
+		}
+		if healthy, err := e.checkElbTargets(ctx, *loadBalancer.TargetGroupArn, targets); err != nil {
+			log.Printf("checkEcsTargetHealth: describe target health error: %s, %s, %s, %v", cluster, service, *loadBalancer.TargetGroupArn, err)
+			return false, err
+		} else if !healthy {
+			return false, nil
 		}
 	}
-	return newTaskDefArn, nil
+	return true, nil
 }
 
-func (e Ecs) updateEcsTask(cluster, familyPfx, image, containerName string, tempTask bool) (string, error) {
-	if prevTaskDefArn, err := e.getEcsTaskDefinitionArn(familyPfx); err != nil {
-		log.Printf("updateEcsTask: get task def error: %s, %s, %s, %v, %v", cluster, familyPfx, image, tempTask, err)
-		return "", err
-	} else if newTaskDefArn, err := e.updateEcsTaskDefinition(prevTaskDefArn, image, containerName); err != nil {
-		log.Printf("updateEcsTask: update task def error: %s, %s, %s, %s, %v, %v", cluster, familyPfx, image, prevTaskDefArn, tempTask, err)
-		return "", err
+func (e Ecs) checkElbTargets(ctx context.Context, targetGroupArn string, targets []elbTypes.TargetDescription) (bool, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	if output, err := e.elbClient.DescribeTargetHealth(httpCtx, &elb.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        targets,
+	}); err != nil {
+		return false, err
 	} else {
-		if !tempTask {
-			// Stop all permanently running tasks in the service. Since there is no deployment configuration for tasks,
-			// we can't rely on ECS to manage the deployment for us.
-			if err = e.stopEcsTasks(cluster, e.taskFamilyFromArn(newTaskDefArn)); err != nil {
-				log.Printf("updateEcsTask: stop tasks error: %s, %s, %s, %s, %s, %v, %v", cluster, familyPfx, image, prevTaskDefArn, newTaskDefArn, tempTask, err)
-				return "", err
+		for _, targetHealth := range output.TargetHealthDescriptions {
+			if (targetHealth.TargetHealth == nil) || (targetHealth.TargetHealth.State != elbTypes.TargetHealthStateEnumHealthy) {
+				return false, nil
 			}
 		}
-		return newTaskDefArn, nil
+		return len(output.TargetHealthDescriptions) > 0, nil
 	}
 }
 
-func (e Ecs) getEcsTaskDefinitionArn(familyPfx string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
-
-	// List all task definitions and get the latest definition's ARN
-	input := &ecs.ListTaskDefinitionsInput{
-		FamilyPrefix: aws.String(familyPfx),
-		MaxResults:   aws.Int32(1),
-		Sort:         types.SortOrderDesc,
-	}
-	output, err := e.ecsClient.ListTaskDefinitions(ctx, input)
-	if err != nil {
-		log.Printf("getEcsTaskDefinitionArn: list task defs error: %s, %v", familyPfx, err)
-		return "", err
+// ecsTaskIp returns the private IP address of a task's network interface, or an empty string if it doesn't have one yet
+func ecsTaskIp(task types.Task) string {
+	for _, attachment := range task.Attachments {
+		if aws.ToString(attachment.Type) == ecsAttachmentType_Eni {
+			for _, detail := range attachment.Details {
+				if aws.ToString(detail.Name) == ecsAttachmentDetail_PrivateIp {
+					return aws.ToString(detail.Value)
+				}
+			}
+		}
 	}
-	return output.TaskDefinitionArns[0], nil
+	return ""
 }
 
-func (e Ecs) stopEcsTasks(cluster, family string) error {
-	if taskArns, err := e.listEcsTasks(cluster, family); err != nil {
-		log.Printf("stopEcsTasks: list tasks error: %s, %s, %v", cluster, family, err)
-		return err
-	} else {
-		ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-		defer cancel()
-
-		for _, taskArn := range taskArns {
-			stopTasksInput := &ecs.StopTaskInput{
-				Task:    aws.String(taskArn),
-				Cluster: aws.String(cluster),
-			}
-			if _, err = e.ecsClient.StopTask(ctx, stopTasksInput); err != nil {
-				log.Printf("stopEcsTasks: stop task error: %s, %s, %v", cluster, family, err)
-				return err
+// checkEcsServiceStable checks whether a service is stable using the same criteria as the AWS "ServicesStable" waiter,
+// i.e. only the deployment for the new task definition remains, and it has completed with all desired tasks running.
+func (e Ecs) checkEcsServiceStable(cluster, service, taskDefArn string, ecsService types.Service) (bool, error) {
+	for _, deployment := range ecsService.Deployments {
+		if (aws.ToString(deployment.TaskDefinition) == taskDefArn) && (deployment.RolloutState == types.DeploymentRolloutStateFailed) {
+			reason := ""
+			if deployment.RolloutStateReason != nil {
+				reason = *deployment.RolloutStateReason
 			}
+			return false, fmt.Errorf("checkEcsServiceStable: deployment failed: %s, %s, %s, %s", cluster, service, taskDefArn, reason)
 		}
 	}
-	return nil
+	if (len(ecsService.Deployments) != 1) || (aws.ToString(ecsService.Deployments[0].TaskDefinition) != taskDefArn) {
+		// Older deployments are still being drained, or the new deployment hasn't started
+		return false, nil
+	}
+	deployment := ecsService.Deployments[0]
+	// The rollout state is only reported for services using the rolling update deployment controller
+	if (len(deployment.RolloutState) > 0) && (deployment.RolloutState != types.DeploymentRolloutStateCompleted) {
+		return false, nil
+	}
+	return ecsService.RunningCount == ecsService.DesiredCount, nil
 }
 
-func (e Ecs) checkEcsService(cluster, taskDefArn string) (bool, error) {
-	family := e.taskFamilyFromArn(taskDefArn)
-	if taskArns, err := e.listEcsTasks(cluster, family); err != nil {
-		log.Printf("checkEcsService: list tasks error: %s, %s, %s, %v", cluster, family, taskDefArn, err)
-		return false, err
-	} else if len(taskArns) > 0 {
-		// For each running task, check if it's been up for a few minutes.
-		if deployed, _, err := e.CheckTask(cluster, taskDefArn, true, true, taskArns...); err != nil {
-			log.Printf("checkEcsService: check task error: %s, %s, %s, %v", cluster, family, taskDefArn, err)
-			return false, err
-		} else if !deployed {
+// checkEcsTaskSet checks whether the task set for the new task definition has all the tasks for its current scale running,
+// and that ECS considers it stable. For services behind a load balancer, this includes the tasks passing health checks.
+func (e Ecs) checkEcsTaskSet(cluster, service string, task *manager.Task, ecsService types.Service) (bool, error) {
+	taskSet := findEcsTaskSet(ecsService, func(taskSet types.TaskSet) bool {
+		return aws.ToString(taskSet.TaskDefinition) == task.Id
+	})
+	if taskSet == nil {
+		return false, fmt.Errorf("checkEcsTaskSet: task set not found: %s, %s, %s", cluster, service, task.Id)
+	}
+	if task.RolloutPercent > 0 {
+		// Right after a staged rollout is ramped up, the task set can still look stable at its previous scale, so wait
+		// for ECS to pick up the new scale first. ECS rounds the task set's desired count up.
+		desiredCount := int32((int(ecsService.DesiredCount)*task.RolloutPercent + 99) / 100)
+		if (taskSet.Scale == nil) || (taskSet.Scale.Value != float64(task.RolloutPercent)) || (taskSet.ComputedDesiredCount != desiredCount) {
+			return false, nil
+		} else if (task.RolloutPercent >= 100) && (aws.ToString(taskSet.Status) != ecsTaskSetStatus_Primary) {
 			return false, nil
 		}
-		return true, nil
 	}
-	return false, nil
+	return (taskSet.StabilityStatus == types.StabilityStatusSteadyState) && (taskSet.RunningCount >= taskSet.ComputedDesiredCount), nil
 }
 
-func (e Ecs) listEcsTasks(cluster, family string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
-	defer cancel()
+func (e Ecs) listEcsTasks(ctx context.Context, cluster, family string) ([]string, error) {
+	return e.listEcsTasksByStatus(ctx, cluster, family, types.DesiredStatusRunning)
+}
 
+// listEcsTasksByStatus lists tasks in a family, or in all families if none is specified, with the specified desired
+// status. Stopped tasks are only listed for a short time after they stop.
+func (e Ecs) listEcsTasksByStatus(ctx context.Context, cluster, family string, desiredStatus types.DesiredStatus) ([]string, error) {
 	listTasksInput := &ecs.ListTasksInput{
 		Cluster:       aws.String(cluster),
-		DesiredStatus: types.DesiredStatusRunning,
-		Family:        aws.String(family),
+		DesiredStatus: desiredStatus,
 	}
-	listTasksOutput, err := e.ecsClient.ListTasks(ctx, listTasksInput)
-	if err != nil {
-		log.Printf("listEcsTasks: list tasks error: %s, %s, %v", cluster, family, err)
-		return nil, err
+	if len(family) > 0 {
+		listTasksInput.Family = aws.String(family)
+	}
+	// Tasks are returned at most 100 at a time, so make sure we go through all the pages.
+	taskArns := make([]string, 0)
+	p := ecs.NewListTasksPaginator(e.ecsClient, listTasksInput)
+	for p.HasMorePages() {
+		if page, err := func() (*ecs.ListTasksOutput, error) {
+			httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+			defer httpCancel()
+
+			return p.NextPage(httpCtx)
+		}(); err != nil {
+			log.Printf("listEcsTasks: list tasks error: %s, %s, %v", cluster, family, err)
+			return nil, err
+		} else {
+			taskArns = append(taskArns, page.TaskArns...)
+		}
 	}
-	return listTasksOutput.TaskArns, nil
+	return taskArns, nil
 }
 
-func (e Ecs) updateEnvCluster(cluster *manager.Cluster, clusterName, clusterRepo, deployTag string) error {
-	if err := e.updateEnvTaskSet(cluster.ServiceTasks, deployType_Service, clusterName, clusterRepo, deployTag); err != nil {
+func (e Ecs) updateEnvCluster(ctx context.Context, layout *manager.Layout, cluster *manager.Cluster, clusterName, deployTag, jobId string, createIfMissing bool, rolloutPercent int, taskDefTags []types.Tag) error {
+	if err := e.updateEnvServiceTasks(ctx, layout, cluster, clusterName, deployTag, createIfMissing, rolloutPercent, taskDefTags); err != nil {
 		return err
-	} else if err = e.updateEnvTaskSet(cluster.Tasks, deployType_Task, clusterName, clusterRepo, deployTag); err != nil {
+	} else if err = e.updateEnvTaskSet(ctx, layout, cluster, cluster.Tasks, deployType_Task, clusterName, deployTag, jobId, taskDefTags); err != nil {
+		return err
+	} else if err = e.updateEnvTaskSet(ctx, layout, cluster, cluster.Runners, deployType_Runner, clusterName, deployTag, jobId, taskDefTags); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (e Ecs) updateEnvTaskSet(taskSet *manager.TaskSet, deployType string, cluster, clusterRepo, deployTag string) error {
+func (e Ecs) updateEnvTaskSet(ctx context.Context, layout *manager.Layout, cluster *manager.Cluster, taskSet *manager.TaskSet, deployType string, clusterName, deployTag, jobId string, taskDefTags []types.Tag) error {
 	if taskSet != nil {
 		for taskSetName, task := range taskSet.Tasks {
-			taskSetRepo := clusterRepo
-			if taskSet.Repo != nil {
-				taskSetRepo = e.getEcrRepo(*taskSet.Repo)
+			image, err := e.taskImage(layout, cluster, taskSet, task, clusterName, taskSetName, deployTag)
+			if err != nil {
+				return err
 			}
 			switch deployType {
-			case deployType_Service:
-				if err := e.updateEnvServiceTask(task, cluster, taskSetName, taskSetRepo, deployTag); err != nil {
+			case deployType_Task:
+				if err := e.updateEnvTask(ctx, task, clusterName, taskSetName, image, taskDefTags); err != nil {
 					return err
 				}
-			case deployType_Task:
-				if err := e.updateEnvTask(task, cluster, taskSetName, taskSetRepo, deployTag); err != nil {
+			case deployType_Runner:
+				if err := e.updateEnvRunner(ctx, task, clusterName, taskSetName, image, jobId, taskDefTags); err != nil {
 					return err
 				}
 			default:
@@ -495,12 +2554,105 @@ func (e Ecs) updateEnvTaskSet(taskSet *manager.TaskSet, deployType string, clust
 	return nil
 }
 
-func (e Ecs) updateEnvServiceTask(task *manager.Task, cluster, service, taskSetRepo, deployTag string) error {
-	taskRepo := taskSetRepo
-	if task.Repo != nil {
-		taskRepo = e.getEcrRepo(*task.Repo)
+// ecsServiceUpdate is a service with a newly registered task definition that hasn't been deployed yet
+type ecsServiceUpdate struct {
+	service    string
+	task       *manager.Task
+	taskDefArn string
+	ecsService types.Service // The service as it was before the update
+}
+
+// updateEnvServiceTasks updates the services in a cluster together, e.g. so that the CAS API and scheduler aren't left
+// running different versions. The new task definitions for all services are registered before any service is updated,
+// so that a failure to register one doesn't leave the cluster half-deployed. If updating any service then fails, the
+// services already updated are rolled back to their previous task definitions.
+//
+// Services that are created or use task sets can't be rolled back this way, so they're deployed as soon as their task
+// definitions are registered.
+func (e Ecs) updateEnvServiceTasks(ctx context.Context, layout *manager.Layout, cluster *manager.Cluster, clusterName, deployTag string, createIfMissing bool, rolloutPercent int, taskDefTags []types.Tag) error {
+	taskSet := cluster.ServiceTasks
+	if taskSet == nil {
+		return nil
+	}
+	serviceUpdates := make([]ecsServiceUpdate, 0, len(taskSet.Tasks))
+	for service, task := range taskSet.Tasks {
+		if image, err := e.taskImage(layout, cluster, taskSet, task, clusterName, service, deployTag); err != nil {
+			return err
+		} else if newTaskDefArn, ecsService, err := e.prepareEcsService(ctx, clusterName, service, taskFamily(service, task), image, task, createIfMissing, rolloutPercent, taskDefTags); err != nil {
+			return err
+		} else if ecsService == nil {
+			// The service was created or uses task sets, so the layout has the task definition it was running, if any
+			task.PrevId = task.Id
+			task.Id = newTaskDefArn
+		} else {
+			serviceUpdates = append(serviceUpdates, ecsServiceUpdate{service, task, newTaskDefArn, *ecsService})
+		}
+	}
+	for idx, serviceUpdate := range serviceUpdates {
+		if err := e.deployEcsService(ctx, clusterName, serviceUpdate.service, serviceUpdate.taskDefArn, serviceUpdate.task.Replicas, serviceUpdate.ecsService); err != nil {
+			// Also roll back the service that failed, since it might have been updated before e.g. draining failed
+			e.rollbackEcsServices(ctx, clusterName, serviceUpdates[:idx+1])
+			return fmt.Errorf("updateEnvServiceTasks: %s, %s: %w", clusterName, serviceUpdate.service, err)
+		}
+		serviceUpdate.task.PrevId = aws.ToString(serviceUpdate.ecsService.TaskDefinition)
+		serviceUpdate.task.Id = serviceUpdate.taskDefArn
+	}
+	return nil
+}
+
+// rollbackEcsServices restores services to the task definitions and desired counts they had before they were updated.
+// Failures are only logged so that as many services as possible are restored.
+func (e Ecs) rollbackEcsServices(ctx context.Context, cluster string, serviceUpdates []ecsServiceUpdate) {
+	for _, serviceUpdate := range serviceUpdates {
+		prevTaskDefArn := aws.ToString(serviceUpdate.ecsService.TaskDefinition)
+		log.Printf("rollbackEcsServices: rolling back service: %s, %s, %s", cluster, serviceUpdate.service, prevTaskDefArn)
+		if err := e.deployEcsService(ctx, cluster, serviceUpdate.service, prevTaskDefArn, 0, serviceUpdate.ecsService); err != nil {
+			log.Printf("rollbackEcsServices: rollback error: %s, %s, %s, %v", cluster, serviceUpdate.service, prevTaskDefArn, err)
+		} else {
+			serviceUpdate.task.Id = prevTaskDefArn
+		}
+	}
+}
+
+// taskImage returns the image to deploy for a task
+func (e Ecs) taskImage(layout *manager.Layout, cluster *manager.Cluster, taskSet *manager.TaskSet, task *manager.Task, clusterName, taskName, deployTag string) (string, error) {
+	repo := resolveRepo(layout, cluster, taskSet, task)
+	if repo == nil {
+		return "", fmt.Errorf("taskImage: missing repo: %s, %s", clusterName, taskName)
+	}
+	tag := deployTag
+	if len(task.Tag) > 0 {
+		tag = task.Tag
+	}
+	return e.getEcrRepo(*repo) + ":" + tag, nil
+}
+
+// resolveRepo returns the repo for a task's image. The most specific repo wins, i.e. the task's own repo, then the repo
+// of its task set, then the repo of its cluster, and finally the layout repo, e.g. so that a configured layout can deploy
+// a runner from its own repo.
+func resolveRepo(layout *manager.Layout, cluster *manager.Cluster, taskSet *manager.TaskSet, task *manager.Task) *manager.Repo {
+	if (task != nil) && (task.Repo != nil) {
+		return task.Repo
+	} else if (taskSet != nil) && (taskSet.Repo != nil) {
+		return taskSet.Repo
+	} else if (cluster != nil) && (cluster.Repo != nil) {
+		return cluster.Repo
+	} else if layout != nil {
+		return layout.Repo
+	}
+	return nil
+}
+
+// taskFamily returns the task definition family of a service, task, or runner, which is named after it by default
+func taskFamily(taskName string, task *manager.Task) string {
+	if len(task.Family) > 0 {
+		return task.Family
 	}
-	if id, err := e.updateEcsService(cluster, service, taskRepo+":"+deployTag, task.Name, task.Temp); err != nil {
+	return taskName
+}
+
+func (e Ecs) updateEnvTask(ctx context.Context, task *manager.Task, cluster, taskName, image string, taskDefTags []types.Tag) error {
+	if id, err := e.updateEcsTask(ctx, cluster, taskFamily(taskName, task), image, task.Name, taskDefTags); err != nil {
 		return err
 	} else {
 		task.Id = id
@@ -508,60 +2660,236 @@ func (e Ecs) updateEnvServiceTask(task *manager.Task, cluster, service, taskSetR
 	}
 }
 
-func (e Ecs) updateEnvTask(task *manager.Task, cluster, taskName, taskSetRepo, deployTag string) error {
-	taskRepo := taskSetRepo
-	if task.Repo != nil {
-		taskRepo = e.getEcrRepo(*task.Repo)
-	}
-	if id, err := e.updateEcsTask(cluster, taskName, taskRepo+":"+deployTag, task.Name, task.Temp); err != nil {
+func (e Ecs) updateEnvRunner(ctx context.Context, task *manager.Task, cluster, runnerName, image, jobId string, taskDefTags []types.Tag) error {
+	// Runners are launched on demand, so only their task definition needs to be updated
+	if id, err := e.updateEcsTaskFamily(ctx, taskFamily(runnerName, task), image, task.Name, taskDefTags); err != nil {
 		return err
 	} else {
 		task.Id = id
+		// Runners that the deployment depends on (e.g. migrations) are launched right away using the new task
+		// definition. The network configuration for such runners is stored in SSM, e.g. under
+		// "/ceramic-dev-cas-migration/network_configuration".
+		if task.WaitForCompletion {
+			if taskArn, err := e.LaunchTask(ctx, cluster, id, task.Name, manager.LaunchOptions{
+				JobId:            jobId,
+				VpcConfigParams:  []string{"/" + runnerName + "/network_configuration"},
+				CapacityProvider: task.CapacityProvider,
+				Placement:        task.Placement,
+			}); err != nil {
+				log.Printf("updateEnvRunner: launch task error: %s, %s, %s, %v", cluster, runnerName, id, err)
+				return err
+			} else {
+				task.TaskArn = taskArn
+			}
+		}
 		return nil
 	}
 }
 
-func (e Ecs) checkEnvCluster(cluster *manager.Cluster, clusterName string) (bool, error) {
-	if deployed, err := e.checkEnvTaskSet(cluster.ServiceTasks, deployType_Service, clusterName); err != nil {
+func (e Ecs) restartEnvCluster(ctx context.Context, cluster *manager.Cluster, clusterName string) error {
+	if cluster.ServiceTasks != nil {
+		for service := range cluster.ServiceTasks.Tasks {
+			if err := e.restartEcsService(ctx, clusterName, service); err != nil {
+				return err
+			}
+		}
+	}
+	// Runners are launched on demand, so there's nothing to restart for them
+	if cluster.Tasks != nil {
+		for _, task := range cluster.Tasks.Tasks {
+			if err := e.stopEcsTasks(ctx, clusterName, e.taskFamilyFromArn(task.Id), nil); err != nil {
+				log.Printf("restartEnvCluster: stop tasks error: %s, %s, %v", clusterName, task.Id, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e Ecs) restartEcsService(ctx context.Context, cluster, service string) error {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	// Force a new deployment of the service using its current task definition
+	updateSvcInput := &ecs.UpdateServiceInput{
+		Service:            aws.String(service),
+		Cluster:            aws.String(cluster),
+		ForceNewDeployment: true,
+	}
+	if _, err := e.ecsClient.UpdateService(httpCtx, updateSvcInput); err != nil {
+		log.Printf("restartEcsService: update service error: %s, %s, %v", cluster, service, err)
+		return err
+	}
+	return nil
+}
+
+// checkEcsServiceRestart checks whether the deployment forced by a restart has replaced all the tasks of a service
+func (e Ecs) checkEcsServiceRestart(ctx context.Context, cluster, service string, since time.Time) (bool, error) {
+	output, err := e.describeEcsService(ctx, cluster, service)
+	if err != nil {
+		log.Printf("checkEcsServiceRestart: describe service error: %s, %s, %v", cluster, service, err)
+		return false, err
+	} else if err = e.stopDrainedEcsTasks(ctx, cluster, service, output.Services[0]); err != nil {
+		return false, err
+	}
+	// The previous deployment is removed once the new one has replaced all of its tasks
+	if deployments := output.Services[0].Deployments; len(deployments) == 1 {
+		deployment := deployments[0]
+		return (deployment.CreatedAt != nil) && !deployment.CreatedAt.Before(since) && (deployment.RunningCount == deployment.DesiredCount), nil
+	}
+	return false, nil
+}
+
+// checkEcsTaskRestart checks whether the tasks of a family that were stopped by a restart have been replaced by stable
+// tasks started since the restart
+func (e Ecs) checkEcsTaskRestart(ctx context.Context, cluster, taskDefArn string, since time.Time) (bool, error) {
+	family := e.taskFamilyFromArn(taskDefArn)
+	if taskArns, err := e.listEcsTasks(ctx, cluster, family); err != nil {
+		log.Printf("checkEcsTaskRestart: list tasks error: %s, %s, %v", cluster, family, err)
+		return false, err
+	} else if len(taskArns) == 0 {
+		// The tasks haven't come back up yet
+		return false, nil
+	} else if tasks, err := e.describeEcsTasks(ctx, cluster, taskArns); err != nil {
+		log.Printf("checkEcsTaskRestart: describe tasks error: %s, %s, %v", cluster, family, err)
+		return false, err
+	} else {
+		for _, task := range tasks {
+			if (task.CreatedAt == nil) || task.CreatedAt.Before(since) {
+				return false, nil
+			}
+		}
+		restarted, _, err := e.CheckTask(ctx, cluster, taskDefArn, true, true, taskArns...)
+		return restarted, err
+	}
+}
+
+func (e Ecs) checkEnvCluster(ctx context.Context, cluster *manager.Cluster, clusterName string) (bool, error) {
+	if deployed, err := e.checkEnvTaskSet(ctx, cluster.ServiceTasks, deployType_Service, clusterName); err != nil {
 		return false, err
 	} else if !deployed {
 		return false, nil
-	} else if deployed, err = e.checkEnvTaskSet(cluster.Tasks, deployType_Task, clusterName); err != nil {
+	} else if deployed, err = e.checkEnvTaskSet(ctx, cluster.Tasks, deployType_Task, clusterName); err != nil {
+		return false, err
+	} else if !deployed {
+		return false, nil
+	} else if deployed, err = e.checkEnvTaskSet(ctx, cluster.Runners, deployType_Runner, clusterName); err != nil {
 		return false, err
 	} else {
 		return deployed, nil
 	}
 }
 
-func (e Ecs) checkEnvTaskSet(taskSet *manager.TaskSet, deployType string, cluster string) (bool, error) {
+func (e Ecs) checkEnvTaskSet(ctx context.Context, taskSet *manager.TaskSet, deployType string, cluster string) (bool, error) {
 	if taskSet != nil {
-		for _, task := range taskSet.Tasks {
+		// All tasks in the set must be deployed for the set to be considered deployed
+		for taskName, task := range taskSet.Tasks {
 			switch deployType {
 			case deployType_Service:
-				if deployed, err := e.checkEcsService(cluster, task.Id); err != nil {
+				if deployed, err := e.checkEcsService(ctx, cluster, taskName, task, stabilizeTimeout(taskSet, task)); err != nil {
 					return false, err
 				} else if !deployed {
 					return false, nil
 				}
-				return true, nil
 			case deployType_Task:
-				// Only check tasks that are meant to stay up permanently
-				if !task.Temp {
-					if deployed, _, err := e.CheckTask(cluster, "", true, true, task.Id); err != nil {
+				if deployed, err := e.checkEcsTask(ctx, cluster, task.Id); err != nil {
+					return false, err
+				} else if !deployed {
+					return false, nil
+				}
+			case deployType_Runner:
+				// Only check runners that the deployment waits for. Other runners (e.g. anchor workers) are launched and
+				// checked by their own jobs.
+				if task.WaitForCompletion {
+					if completed, err := e.checkEcsTaskCompletion(ctx, cluster, task.TaskArn); err != nil {
 						return false, err
-					} else if !deployed {
+					} else if !completed {
 						return false, nil
 					}
-					return true, nil
 				}
 			default:
-				return false, fmt.Errorf("updateTaskSet: invalid deploy type: %s", deployType)
+				return false, fmt.Errorf("checkEnvTaskSet: invalid deploy type: %s", deployType)
+			}
+		}
+	}
+	return true, nil
+}
+
+// checkEcsTask checks whether tasks using the specified task definition are running and stable. Since there is no
+// service managing permanent tasks, look up the tasks for the task family and make sure that they are running the new
+// task definition, and that the tasks running older task definitions have stopped.
+func (e Ecs) checkEcsTask(ctx context.Context, cluster, taskDefArn string) (bool, error) {
+	if taskArns, err := e.listEcsTasks(ctx, cluster, e.taskFamilyFromArn(taskDefArn)); err != nil {
+		log.Printf("checkEcsTask: list tasks error: %s, %s, %v", cluster, taskDefArn, err)
+		return false, err
+	} else if len(taskArns) == 0 {
+		// The task hasn't come up yet
+		return false, nil
+	} else if deployed, _, err := e.CheckTask(ctx, cluster, taskDefArn, true, true, taskArns...); err != nil {
+		log.Printf("checkEcsTask: check task error: %s, %s, %v", cluster, taskDefArn, err)
+		return false, err
+	} else if !deployed {
+		return false, nil
+	}
+	return e.checkEcsTasksStopped(ctx, cluster, taskDefArn)
+}
+
+// checkEcsTasksStopped checks whether the tasks in a family that were stopped for a deployment, i.e. the ones not running
+// the new task definition, have finished stopping.
+func (e Ecs) checkEcsTasksStopped(ctx context.Context, cluster, taskDefArn string) (bool, error) {
+	if taskArns, err := e.listEcsTasksByStatus(ctx, cluster, e.taskFamilyFromArn(taskDefArn), types.DesiredStatusStopped); err != nil {
+		log.Printf("checkEcsTasksStopped: list stopped tasks error: %s, %s, %v", cluster, taskDefArn, err)
+		return false, err
+	} else if len(taskArns) == 0 {
+		return true, nil
+	} else if taskStates, err := e.CheckTasks(ctx, cluster, false, taskArns...); err != nil {
+		log.Printf("checkEcsTasksStopped: check tasks error: %s, %s, %v", cluster, taskDefArn, err)
+		return false, err
+	} else {
+		for _, taskState := range taskStates {
+			if (taskState.TaskDefArn != taskDefArn) && (taskState.Status != manager.TaskStatus_Stopped) && (taskState.Status != manager.TaskStatus_Missing) {
+				return false, nil
 			}
 		}
+		return true, nil
+	}
+}
+
+// checkEcsTaskCompletion checks whether a temporary task launched for a deployment has stopped. A task that stopped
+// without exiting successfully (including one that never started its container) fails the deployment.
+func (e Ecs) checkEcsTaskCompletion(ctx context.Context, cluster, taskArn string) (bool, error) {
+	if len(taskArn) == 0 {
+		return false, fmt.Errorf("checkEcsTaskCompletion: task not launched: %s", cluster)
+	} else if stopped, exitCode, err := e.CheckTask(ctx, cluster, "", false, false, taskArn); err != nil {
+		log.Printf("checkEcsTaskCompletion: check task error: %s, %s, %v", cluster, taskArn, err)
+		return false, err
+	} else if !stopped {
+		return false, nil
+	} else if exitCode == nil {
+		return false, fmt.Errorf("checkEcsTaskCompletion: task stopped without exit code: %s, %s", cluster, taskArn)
+	} else if *exitCode != 0 {
+		return false, fmt.Errorf("checkEcsTaskCompletion: task exited with code %d: %s, %s", *exitCode, cluster, taskArn)
 	}
 	return true, nil
 }
 
+func (e Ecs) taskDefTags(sha, version, jobId string, ts time.Time) []types.Tag {
+	tags := []types.Tag{
+		{Key: aws.String(resourceTag), Value: aws.String(string(e.env))},
+		{Key: aws.String(timestampTag), Value: aws.String(ts.UTC().Format(time.RFC3339))},
+	}
+	if len(sha) > 0 {
+		tags = append(tags, types.Tag{Key: aws.String(shaTag), Value: aws.String(sha)})
+	}
+	if len(version) > 0 {
+		tags = append(tags, types.Tag{Key: aws.String(versionTag), Value: aws.String(version)})
+	}
+	if len(jobId) > 0 {
+		tags = append(tags, types.Tag{Key: aws.String(jobIdTag), Value: aws.String(jobId)})
+	}
+	return tags
+}
+
 func (e Ecs) taskFamilyFromArn(taskArn string) string {
 	// Given our configuration, the task family is the same as the name of the task definition. For a task definition
 	// ARN like "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-qa-ex-ipfs-nd-go-new-peer:18", we can get
@@ -575,9 +2903,9 @@ func (e Ecs) serviceNameFromArn(serviceArn string) string {
 	return strings.Split(serviceArn, "/")[2]
 }
 
-func (e Ecs) parseEcsFailures(ecsFailures []types.Failure) []ecsFailure {
-	failures := make([]ecsFailure, len(ecsFailures))
-	for idx, f := range ecsFailures {
+func (e Ecs) parseEcsFailures(awsFailures []types.Failure) ecsFailures {
+	failures := make(ecsFailures, len(awsFailures))
+	for idx, f := range awsFailures {
 		if f.Arn != nil {
 			failures[idx].arn = *f.Arn
 		}
@@ -591,9 +2919,56 @@ func (e Ecs) parseEcsFailures(ecsFailures []types.Failure) []ecsFailure {
 	return failures
 }
 
+// DescribeImage looks up an image by tag in a private ECR repository, e.g. to find the commit hash that a moving tag
+// like "latest-green" currently points to.
+func (e Ecs) DescribeImage(ctx context.Context, repo manager.Repo, tag string) (*manager.ImageDetail, error) {
+	if repo.Public {
+		return nil, fmt.Errorf("describeImage: public repositories not supported: %s", repo.Name)
+	}
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	input := &ecr.DescribeImagesInput{
+		RepositoryName: aws.String(repo.Name),
+		ImageIds:       []ecrTypes.ImageIdentifier{{ImageTag: aws.String(tag)}},
+	}
+	if registryId := ecrRegistryId(repo); len(registryId) > 0 {
+		input.RegistryId = aws.String(registryId)
+	}
+	if output, err := e.ecrClient.DescribeImages(httpCtx, input); err != nil {
+		var notFoundErr *ecrTypes.ImageNotFoundException
+		if errors.As(err, &notFoundErr) {
+			return nil, fmt.Errorf("describeImage: %s:%s: %w", repo.Name, tag, manager.Error_ImageTagNotFound)
+		}
+		log.Printf("describeImage: describe images error: %s, %s, %v", repo.Name, tag, err)
+		return nil, err
+	} else if len(output.ImageDetails) == 0 {
+		return nil, fmt.Errorf("describeImage: %s:%s: %w", repo.Name, tag, manager.Error_ImageTagNotFound)
+	} else {
+		imageDetail := output.ImageDetails[0]
+		return &manager.ImageDetail{Digest: aws.ToString(imageDetail.ImageDigest), Tags: imageDetail.ImageTags}, nil
+	}
+}
+
+// ecrRegistryId returns the account ID of the registry holding a repository, or an empty string for our own registry
+func ecrRegistryId(repo manager.Repo) string {
+	if len(repo.Registry) > 0 {
+		// Registry URIs start with the account ID, e.g. "123456789012.dkr.ecr.us-east-2.amazonaws.com"
+		return strings.SplitN(repo.Registry, ".", 2)[0]
+	}
+	return repo.AccountId
+}
+
 func (e Ecs) getEcrRepo(repo manager.Repo) string {
 	if repo.Public {
 		return publicEcrUri + repo.Name
+	} else if len(repo.Registry) > 0 {
+		return strings.TrimSuffix(repo.Registry, "/") + "/" + repo.Name
+	} else if len(repo.AccountId) > 0 {
+		// The region is always present since it was validated when building our own registry URI
+		if ecrUri, err := buildEcrUri(repo.AccountId, e.region); err == nil {
+			return ecrUri + repo.Name
+		}
 	}
 	return e.ecrUri + repo.Name
 }
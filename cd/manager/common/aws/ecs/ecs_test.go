@@ -0,0 +1,649 @@
+package ecs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+func TestNewEcsMaxFailedTasks(t *testing.T) {
+	tests := []struct {
+		name           string
+		value          string
+		maxFailedTasks int32
+		err            bool
+	}{
+		{name: "default", maxFailedTasks: defaultMaxFailedTasks},
+		{name: "valid", value: "5", maxFailedTasks: 5},
+		{name: "disabled", value: "0", maxFailedTasks: 0},
+		{name: "malformed", value: "five", err: true},
+		{name: "negative", value: "-1", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(manager.EnvVar_Env, string(manager.EnvType_Dev))
+			t.Setenv("AWS_ACCOUNT_ID", "967314784947")
+			t.Setenv("MAX_FAILED_TASKS", test.value)
+			e, err := newEcs(aws.Config{Region: "us-east-2"})
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			} else if (err == nil) && (e.maxFailedTasks != test.maxFailedTasks) {
+				t.Errorf("got %d, want %d", e.maxFailedTasks, test.maxFailedTasks)
+			}
+		})
+	}
+}
+
+func TestNewEcsStrictServiceCheck(t *testing.T) {
+	tests := []struct {
+		name               string
+		value              string
+		strictServiceCheck bool
+		err                bool
+	}{
+		{name: "default", strictServiceCheck: false},
+		{name: "enabled", value: "true", strictServiceCheck: true},
+		{name: "disabled", value: "false", strictServiceCheck: false},
+		{name: "malformed", value: "yes", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(manager.EnvVar_Env, string(manager.EnvType_Dev))
+			t.Setenv("AWS_ACCOUNT_ID", "967314784947")
+			t.Setenv("STRICT_SERVICE_CHECK", test.value)
+			e, err := newEcs(aws.Config{Region: "us-east-2"})
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			} else if (err == nil) && (e.strictServiceCheck != test.strictServiceCheck) {
+				t.Errorf("got %v, want %v", e.strictServiceCheck, test.strictServiceCheck)
+			}
+		})
+	}
+}
+
+func TestNewEcsSsmWithDecryption(t *testing.T) {
+	tests := []struct {
+		name              string
+		value             string
+		ssmWithDecryption bool
+		err               bool
+	}{
+		{name: "default", ssmWithDecryption: false},
+		{name: "enabled", value: "true", ssmWithDecryption: true},
+		{name: "malformed", value: "on", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(manager.EnvVar_Env, string(manager.EnvType_Dev))
+			t.Setenv("AWS_ACCOUNT_ID", "967314784947")
+			t.Setenv("SSM_WITH_DECRYPTION", test.value)
+			e, err := newEcs(aws.Config{Region: "us-east-2"})
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			} else if (err == nil) && (e.ssmWithDecryption != test.ssmWithDecryption) {
+				t.Errorf("got %v, want %v", e.ssmWithDecryption, test.ssmWithDecryption)
+			}
+		})
+	}
+}
+
+func TestCheckEcsTaskSet(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	taskSet := func(status string, percent float64, desired, running int32, stability types.StabilityStatus) types.TaskSet {
+		return types.TaskSet{
+			Id:                   aws.String("ecs-svc/1234"),
+			Status:               aws.String(status),
+			TaskDefinition:       aws.String(taskDefArn),
+			Scale:                &types.Scale{Unit: types.ScaleUnitPercent, Value: percent},
+			ComputedDesiredCount: desired,
+			RunningCount:         running,
+			StabilityStatus:      stability,
+		}
+	}
+	tests := []struct {
+		name     string
+		percent  int
+		taskSet  types.TaskSet
+		deployed bool
+	}{
+		{name: "not staged", taskSet: taskSet("ACTIVE", 100, 10, 10, types.StabilityStatusSteadyState), deployed: true},
+		{name: "step reached", percent: 50, taskSet: taskSet("ACTIVE", 50, 5, 5, types.StabilityStatusSteadyState), deployed: true},
+		{name: "step rounds up", percent: 15, taskSet: taskSet("ACTIVE", 15, 2, 2, types.StabilityStatusSteadyState), deployed: true},
+		{name: "stabilizing", percent: 50, taskSet: taskSet("ACTIVE", 50, 5, 3, types.StabilityStatusStabilizing)},
+		{name: "previous scale", percent: 50, taskSet: taskSet("ACTIVE", 10, 1, 1, types.StabilityStatusSteadyState)},
+		{name: "desired count not updated", percent: 50, taskSet: taskSet("ACTIVE", 50, 1, 1, types.StabilityStatusSteadyState)},
+		{name: "not primary yet", percent: 100, taskSet: taskSet("ACTIVE", 100, 10, 10, types.StabilityStatusSteadyState)},
+		{name: "primary", percent: 100, taskSet: taskSet("PRIMARY", 100, 10, 10, types.StabilityStatusSteadyState), deployed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ecsService := types.Service{DesiredCount: 10, TaskSets: []types.TaskSet{test.taskSet}}
+			task := &manager.Task{Id: taskDefArn, RolloutPercent: test.percent}
+			if deployed, err := (Ecs{}).checkEcsTaskSet("ceramic-dev", "ceramic-dev-node", task, ecsService); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if deployed != test.deployed {
+				t.Errorf("got %v, want %v", deployed, test.deployed)
+			}
+		})
+	}
+	t.Run("missing task set", func(t *testing.T) {
+		task := &manager.Task{Id: taskDefArn}
+		if _, err := (Ecs{}).checkEcsTaskSet("ceramic-dev", "ceramic-dev-node", task, types.Service{DesiredCount: 10}); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestCheckEcsServiceStabilizeTimeout(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	const prevTaskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:42"
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		ts := now.Add(-d)
+		return &ts
+	}
+	tests := []struct {
+		name      string
+		service   types.Service
+		stepStart time.Time
+		timedOut  bool
+	}{
+		{
+			name: "new deployment",
+			service: types.Service{Deployments: []types.Deployment{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(5 * time.Minute)},
+				{TaskDefinition: aws.String(prevTaskDefArn), CreatedAt: ago(time.Hour)},
+			}},
+		},
+		{
+			name: "older deployment of the same task definition",
+			service: types.Service{Deployments: []types.Deployment{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(5 * time.Minute)},
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(time.Hour)},
+			}},
+		},
+		{
+			name: "deployment timed out",
+			service: types.Service{Deployments: []types.Deployment{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(time.Hour)},
+			}},
+			timedOut: true,
+		},
+		{
+			name: "task set stability changed recently",
+			service: types.Service{TaskSets: []types.TaskSet{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(time.Hour), StabilityStatusAt: ago(time.Minute)},
+			}},
+			timedOut: true,
+		},
+		{
+			name: "current rollout step",
+			service: types.Service{TaskSets: []types.TaskSet{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(time.Hour)},
+			}},
+			stepStart: now.Add(-5 * time.Minute),
+		},
+		{name: "no matching deployment", service: types.Service{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &manager.Task{Id: taskDefArn}
+			if !test.stepStart.IsZero() {
+				task.RolloutStepStart = test.stepStart.UnixNano()
+			}
+			err := checkEcsServiceStabilizeTimeout("ceramic-dev", "ceramic-dev-node", task, 20*time.Minute, test.service)
+			if test.timedOut && !errors.Is(err, manager.Error_StabilizeTimeout) {
+				t.Errorf("expected stabilize timeout, got %v", err)
+			} else if !test.timedOut && (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReportEcsServiceEvents(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		ts := now.Add(-d)
+		return &ts
+	}
+	// Events are listed newest first, with one from before the deployment started
+	events := []types.ServiceEvent{
+		{Id: aws.String("3"), CreatedAt: ago(time.Minute), Message: aws.String("(service ceramic-dev-node) was unable to place a task")},
+		{Id: aws.String("2"), CreatedAt: ago(2 * time.Minute), Message: aws.String("(service ceramic-dev-node) has started 1 tasks")},
+		{Id: aws.String("1"), CreatedAt: ago(time.Hour), Message: aws.String("(service ceramic-dev-node) failed to launch a task")},
+	}
+	tests := []struct {
+		name        string
+		service     types.Service
+		lastEventId string
+		want        []string
+	}{
+		{
+			name: "deployment",
+			service: types.Service{Events: events, Deployments: []types.Deployment{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(5 * time.Minute)},
+			}},
+			want: []string{"(service ceramic-dev-node) was unable to place a task"},
+		},
+		{
+			name: "task set",
+			service: types.Service{Events: events, TaskSets: []types.TaskSet{
+				{TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(5 * time.Minute)},
+			}},
+			want: []string{"(service ceramic-dev-node) was unable to place a task"},
+		},
+		{
+			name:        "since last event",
+			service:     types.Service{Events: events},
+			lastEventId: "2",
+			want:        []string{"(service ceramic-dev-node) was unable to place a task"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &manager.Task{Id: taskDefArn, LastEventId: test.lastEventId}
+			reportEcsServiceEvents("ceramic-dev", "ceramic-dev-node", task, test.service)
+			if fmt.Sprint(task.Events) != fmt.Sprint(test.want) {
+				t.Errorf("got events %v, want %v", task.Events, test.want)
+			}
+			if task.LastEventId != "3" {
+				t.Errorf("got last event %s, want 3", task.LastEventId)
+			}
+		})
+	}
+}
+
+func TestResolveRepo(t *testing.T) {
+	layoutRepo := &manager.Repo{Name: "layout"}
+	clusterRepo := &manager.Repo{Name: "cluster"}
+	taskSetRepo := &manager.Repo{Name: "taskSet"}
+	taskRepo := &manager.Repo{Name: "task"}
+	// Try every combination of overrides, from the least to the most specific
+	for combination := 0; combination < 16; combination++ {
+		layout := &manager.Layout{}
+		cluster := &manager.Cluster{}
+		taskSet := &manager.TaskSet{}
+		task := &manager.Task{}
+		var want *manager.Repo
+		if combination&1 != 0 {
+			layout.Repo = layoutRepo
+			want = layoutRepo
+		}
+		if combination&2 != 0 {
+			cluster.Repo = clusterRepo
+			want = clusterRepo
+		}
+		if combination&4 != 0 {
+			taskSet.Repo = taskSetRepo
+			want = taskSetRepo
+		}
+		if combination&8 != 0 {
+			task.Repo = taskRepo
+			want = taskRepo
+		}
+		if repo := resolveRepo(layout, cluster, taskSet, task); repo != want {
+			t.Errorf("combination %04b: got %v, want %v", combination, repo, want)
+		}
+	}
+	if repo := resolveRepo(&manager.Layout{Repo: layoutRepo}, nil, nil, nil); repo != layoutRepo {
+		t.Errorf("missing cluster, task set, and task: got %v, want %v", repo, layoutRepo)
+	}
+	if repo := resolveRepo(nil, nil, nil, nil); repo != nil {
+		t.Errorf("missing layout: got %v, want nil", repo)
+	}
+}
+
+// newFakeEcs returns an Ecs whose ECS client talks to a local server. The handler is called with the name of each ECS
+// API action (e.g. "ListTasks") and the decoded request, and returns the response to encode.
+func newFakeEcs(t *testing.T, handler func(action string, input map[string]interface{}) interface{}) Ecs {
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The target header is of the form "AmazonEC2ContainerServiceV20141113.ListTasks"
+		target := r.Header.Get("X-Amz-Target")
+		action := target[strings.LastIndex(target, ".")+1:]
+		input := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("%s: malformed request: %v", action, err)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if err := json.NewEncoder(w).Encode(handler(action, input)); err != nil {
+			t.Errorf("%s: failed to encode response: %v", action, err)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return Ecs{
+		ecsClient: ecs.New(ecs.Options{
+			BaseEndpoint:     aws.String(server.URL),
+			Region:           "us-east-2",
+			Credentials:      credentials.NewStaticCredentialsProvider("id", "secret", ""),
+			RetryMaxAttempts: 1,
+		}),
+	}
+}
+
+func TestStopTaskReason(t *testing.T) {
+	var reason string
+	e := newFakeEcs(t, func(action string, input map[string]interface{}) interface{} {
+		if action != "StopTask" {
+			t.Errorf("unexpected action: %s", action)
+		}
+		reason, _ = input["reason"].(string)
+		return map[string]interface{}{}
+	})
+	// Each "é" takes two bytes, so cutting the reason by bytes would split one of them
+	if err := e.StopTask(context.Background(), "ceramic-dev", "task", strings.Repeat("é", 300)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !utf8.ValidString(reason) {
+		t.Errorf("invalid UTF-8 in reason: %q", reason)
+	} else if utf8.RuneCountInString(reason) != maxStopReasonLen {
+		t.Errorf("got %d characters, want %d", utf8.RuneCountInString(reason), maxStopReasonLen)
+	}
+}
+
+func TestStopEcsTasks(t *testing.T) {
+	const pageSize = 100
+	taskArn := func(i int) string {
+		return fmt.Sprintf("arn:aws:ecs:us-east-2:967314784947:task/ceramic-dev/%032d", i)
+	}
+	stopped := make(map[string]bool)
+	e := newFakeEcs(t, func(action string, input map[string]interface{}) interface{} {
+		switch action {
+		case "ListTasks":
+			// Return two pages of tasks, the first one full and the second one partial
+			if nextToken, _ := input["nextToken"].(string); nextToken == "page-2" {
+				return map[string]interface{}{"taskArns": []string{taskArn(pageSize), taskArn(pageSize + 1)}}
+			}
+			taskArns := make([]string, pageSize)
+			for i := range taskArns {
+				taskArns[i] = taskArn(i)
+			}
+			return map[string]interface{}{"taskArns": taskArns, "nextToken": "page-2"}
+		case "StopTask":
+			stopped[input["task"].(string)] = true
+			return map[string]interface{}{}
+		default:
+			t.Errorf("unexpected action: %s", action)
+			return map[string]interface{}{}
+		}
+	})
+	if err := e.stopEcsTasks(context.Background(), "ceramic-dev", "ceramic-dev-node", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stopped) != pageSize+2 {
+		t.Errorf("got %d tasks stopped, want %d", len(stopped), pageSize+2)
+	}
+	for i := 0; i < pageSize+2; i++ {
+		if !stopped[taskArn(i)] {
+			t.Errorf("task not stopped: %s", taskArn(i))
+		}
+	}
+}
+
+func TestStopDrainedEcsTasks(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	const oldTaskArn = "arn:aws:ecs:us-east-2:967314784947:task/ceramic-dev/0123456789abcdef0123456789abcdef"
+	const newTaskArn = "arn:aws:ecs:us-east-2:967314784947:task/ceramic-dev/fedcba9876543210fedcba9876543210"
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		ts := now.Add(-d)
+		return &ts
+	}
+	service := func(maxPercent int32, deployedAt time.Duration, oldRunning int32) types.Service {
+		return types.Service{
+			DeploymentConfiguration: &types.DeploymentConfiguration{MaximumPercent: aws.Int32(maxPercent)},
+			Deployments: []types.Deployment{
+				{Status: aws.String("PRIMARY"), TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(deployedAt)},
+				{Status: aws.String("ACTIVE"), TaskDefinition: aws.String(taskDefArn), CreatedAt: ago(time.Hour), RunningCount: oldRunning},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		service types.Service
+		stopped bool
+	}{
+		{name: "rolling", service: service(200, 10*time.Minute, 1)},
+		{name: "draining", service: service(100, time.Minute, 1)},
+		{name: "drained", service: service(100, 10*time.Minute, 1), stopped: true},
+		{name: "old tasks already stopped", service: service(100, 10*time.Minute, 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stopped := make(map[string]bool)
+			e := newFakeEcs(t, func(action string, input map[string]interface{}) interface{} {
+				switch action {
+				case "ListTasks":
+					return map[string]interface{}{"taskArns": []string{oldTaskArn, newTaskArn}}
+				case "DescribeTasks":
+					return map[string]interface{}{"tasks": []map[string]interface{}{
+						{"taskArn": oldTaskArn, "taskDefinitionArn": taskDefArn, "createdAt": float64(now.Add(-time.Hour).Unix())},
+						{"taskArn": newTaskArn, "taskDefinitionArn": taskDefArn, "createdAt": float64(now.Unix())},
+					}}
+				case "StopTask":
+					stopped[input["task"].(string)] = true
+					return map[string]interface{}{}
+				default:
+					t.Errorf("unexpected action: %s", action)
+					return map[string]interface{}{}
+				}
+			})
+			e.drainDelay = 5 * time.Minute
+			if err := e.stopDrainedEcsTasks(context.Background(), "ceramic-dev", "ceramic-dev-node", test.service); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stopped[oldTaskArn] != test.stopped {
+				t.Errorf("got old task stopped %v, want %v", stopped[oldTaskArn], test.stopped)
+			}
+			if stopped[newTaskArn] {
+				t.Error("new task stopped")
+			}
+		})
+	}
+}
+
+func TestCheckEcsServicePulls(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	const taskArn = "arn:aws:ecs:us-east-2:967314784947:task/ceramic-dev/0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name    string
+		service types.Service
+		err     error
+	}{
+		{
+			name:    "no failed tasks",
+			service: types.Service{Deployments: []types.Deployment{{TaskDefinition: aws.String(taskDefArn), RunningCount: 1}}},
+		},
+		{
+			name:    "failed tasks",
+			service: types.Service{Deployments: []types.Deployment{{TaskDefinition: aws.String(taskDefArn), FailedTasks: 1}}},
+			err:     manager.Error_ImagePullFailed,
+		},
+		{
+			name:    "task set at desired count",
+			service: types.Service{TaskSets: []types.TaskSet{{TaskDefinition: aws.String(taskDefArn), ComputedDesiredCount: 2, RunningCount: 1, PendingCount: 1}}},
+		},
+		{
+			name:    "task set short of desired count",
+			service: types.Service{TaskSets: []types.TaskSet{{TaskDefinition: aws.String(taskDefArn), ComputedDesiredCount: 2, RunningCount: 1}}},
+			err:     manager.Error_ImagePullFailed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newFakeEcs(t, func(action string, input map[string]interface{}) interface{} {
+				if test.err == nil {
+					t.Errorf("unexpected call for a healthy service: %s", action)
+				}
+				switch action {
+				case "ListTasks":
+					return map[string]interface{}{"taskArns": []string{taskArn}}
+				case "DescribeTasks":
+					return map[string]interface{}{"tasks": []map[string]interface{}{{
+						"taskArn":           taskArn,
+						"taskDefinitionArn": taskDefArn,
+						"lastStatus":        "STOPPED",
+						"containers":        []map[string]interface{}{{"image": "ceramic-prod:abc1234", "reason": "CannotPullContainerError: not found"}},
+					}}}
+				default:
+					t.Errorf("unexpected action: %s", action)
+					return map[string]interface{}{}
+				}
+			})
+			if err := e.checkEcsServicePulls(context.Background(), "ceramic-dev", "ceramic-dev-node", taskDefArn, test.service); !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCheckLayoutTasks(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-ipfs-gw:7"
+	const prevTaskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-ipfs-gw:6"
+	const taskArn = "arn:aws:ecs:us-east-2:967314784947:task/ceramic-dev/0123456789abcdef0123456789abcdef"
+	const prevTaskArn = "arn:aws:ecs:us-east-2:967314784947:task/ceramic-dev/fedcba9876543210fedcba9876543210"
+	startedAt := float64(time.Now().Add(-time.Hour).Unix())
+	tests := []struct {
+		name     string
+		task     map[string]interface{} // Task running in the family, if any
+		stopped  map[string]interface{} // Task stopped for the deployment, if any
+		deployed bool
+		err      error
+	}{
+		{name: "not started"},
+		{
+			name: "pending",
+			task: map[string]interface{}{"taskArn": taskArn, "taskDefinitionArn": taskDefArn, "lastStatus": "PROVISIONING"},
+		},
+		{
+			name: "failed to start",
+			task: map[string]interface{}{
+				"taskArn":           taskArn,
+				"taskDefinitionArn": taskDefArn,
+				"lastStatus":        "STOPPED",
+				"containers":        []map[string]interface{}{{"image": "ceramic-prod:abc1234", "reason": "CannotPullContainerError: not found"}},
+			},
+			err: manager.Error_ImagePullFailed,
+		},
+		{
+			name: "previous task definition",
+			task: map[string]interface{}{"taskArn": taskArn, "taskDefinitionArn": prevTaskDefArn, "lastStatus": "RUNNING", "startedAt": startedAt},
+		},
+		{
+			name:     "running",
+			task:     map[string]interface{}{"taskArn": taskArn, "taskDefinitionArn": taskDefArn, "lastStatus": "RUNNING", "startedAt": startedAt},
+			deployed: true,
+		},
+		{
+			name:    "previous task stopping",
+			task:    map[string]interface{}{"taskArn": taskArn, "taskDefinitionArn": taskDefArn, "lastStatus": "RUNNING", "startedAt": startedAt},
+			stopped: map[string]interface{}{"taskArn": prevTaskArn, "taskDefinitionArn": prevTaskDefArn, "lastStatus": "DEPROVISIONING"},
+		},
+		{
+			name:     "previous task stopped",
+			task:     map[string]interface{}{"taskArn": taskArn, "taskDefinitionArn": taskDefArn, "lastStatus": "RUNNING", "startedAt": startedAt},
+			stopped:  map[string]interface{}{"taskArn": prevTaskArn, "taskDefinitionArn": prevTaskDefArn, "lastStatus": "STOPPED"},
+			deployed: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newFakeEcs(t, func(action string, input map[string]interface{}) interface{} {
+				switch action {
+				case "ListTasks":
+					if input["desiredStatus"] == "STOPPED" {
+						if test.stopped == nil {
+							return map[string]interface{}{"taskArns": []string{}}
+						}
+						return map[string]interface{}{"taskArns": []string{prevTaskArn}}
+					} else if test.task == nil {
+						return map[string]interface{}{"taskArns": []string{}}
+					}
+					return map[string]interface{}{"taskArns": []string{taskArn}}
+				case "DescribeTasks":
+					if tasks, _ := input["tasks"].([]interface{}); (len(tasks) > 0) && (tasks[0] == prevTaskArn) {
+						return map[string]interface{}{"tasks": []map[string]interface{}{test.stopped}}
+					}
+					return map[string]interface{}{"tasks": []map[string]interface{}{test.task}}
+				default:
+					t.Errorf("unexpected action: %s", action)
+					return map[string]interface{}{}
+				}
+			})
+			layout := &manager.Layout{Clusters: map[string]*manager.Cluster{
+				"ceramic-dev": {Tasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+					"ceramic-dev-ipfs-gw": {Id: taskDefArn},
+				}}},
+			}}
+			deployed, err := e.CheckLayout(context.Background(), layout)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if deployed != test.deployed {
+				t.Errorf("got %v, want %v", deployed, test.deployed)
+			}
+		})
+	}
+}
+
+func TestValidateOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		valid     map[string]string
+		err       string
+	}{
+		{name: "none"},
+		{name: "empty", overrides: map[string]string{}},
+		{
+			name:      "valid",
+			overrides: map[string]string{"CERAMIC_NETWORK": "dev-unstable", " LOG_LEVEL ": " debug\n"},
+			valid:     map[string]string{"CERAMIC_NETWORK": "dev-unstable", "LOG_LEVEL": "debug"},
+		},
+		{name: "empty key", overrides: map[string]string{"": "debug", "LOG_LEVEL": "debug"}, err: `""`},
+		{name: "blank key", overrides: map[string]string{"  ": "debug"}, err: `"  "`},
+		{name: "empty value", overrides: map[string]string{"LOG_LEVEL": "", "CERAMIC_NETWORK": " "}, err: `"CERAMIC_NETWORK", "LOG_LEVEL"`},
+		{name: "duplicate key", overrides: map[string]string{"LOG_LEVEL": "debug", "LOG_LEVEL ": "info"}, err: `"LOG_LEVEL`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid, err := validateOverrides(test.overrides)
+			if len(test.err) > 0 {
+				if (err == nil) || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want keys %s", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(valid) != fmt.Sprint(test.valid) {
+				t.Errorf("got %v, want %v", valid, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+var _ manager.Deployment = &MultiRegionEcs{}
+
+// MultiRegionEcs deploys to a primary region as well as to any number of additional regions. Layouts for the additional
+// regions are carried in the `Regions` field of the primary region's layout.
+//
+// Tasks are only launched and checked in the primary region.
+type MultiRegionEcs struct {
+	Ecs
+	regions map[string]Ecs
+}
+
+func NewMultiRegionEcs(cfg aws.Config, regionCfgs map[string]aws.Config) (manager.Deployment, error) {
+	regions := make(map[string]Ecs, len(regionCfgs))
+	for region, regionCfg := range regionCfgs {
+		if e, err := newEcs(regionCfg); err != nil {
+			return nil, fmt.Errorf("newMultiRegionEcs: %s: %w", region, err)
+		} else {
+			regions[region] = e
+		}
+	}
+	if e, err := newEcs(cfg); err != nil {
+		return nil, err
+	} else {
+		return &MultiRegionEcs{e, regions}, nil
+	}
+}
+
+func (m MultiRegionEcs) GetLayout(ctx context.Context, clusters []string) (*manager.Layout, error) {
+	if layout, err := m.Ecs.GetLayout(ctx, clusters); err != nil {
+		return nil, err
+	} else {
+		layout.Regions = make(map[string]*manager.Layout, len(m.regions))
+		for region, e := range m.regions {
+			if regionLayout, err := e.GetLayout(ctx, clusters); err != nil {
+				log.Printf("getLayout: get region layout error: %s, %v, %v", region, clusters, err)
+				return nil, err
+			} else {
+				layout.Regions[region] = regionLayout
+			}
+		}
+		return layout, nil
+	}
+}
+
+func (m MultiRegionEcs) UpdateLayout(ctx context.Context, layout *manager.Layout, deployTag, sha, version, jobId string, createIfMissing bool, rolloutPercent int) error {
+	errs := []error{m.Ecs.UpdateLayout(ctx, layout, deployTag, sha, version, jobId, createIfMissing, rolloutPercent)}
+	if errors.Is(errs[0], context.Canceled) {
+		return errs[0]
+	}
+	// Keep updating the other regions after a failure so that all failures are reported, not just the first one
+	if err := m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		if err := e.UpdateLayout(ctx, regionLayout, deployTag, sha, version, jobId, createIfMissing, rolloutPercent); errors.Is(err, context.Canceled) {
+			return err
+		} else {
+			errs = append(errs, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return manager.JoinClusterErrors(errs...)
+}
+
+func (m MultiRegionEcs) RampLayout(ctx context.Context, layout *manager.Layout, percent int) error {
+	if err := m.Ecs.RampLayout(ctx, layout, percent); err != nil {
+		return err
+	}
+	return m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		return e.RampLayout(ctx, regionLayout, percent)
+	})
+}
+
+func (m MultiRegionEcs) RevertLayout(ctx context.Context, layout *manager.Layout, revision string) error {
+	// Revision numbers differ between regions, so other regions are reverted to the revisions registered by the same
+	// deployment as the revision in the primary region.
+	jobId, err := m.Ecs.revisionJobId(ctx, layout, revision)
+	if err != nil {
+		return err
+	} else if (len(jobId) == 0) && (len(layout.Regions) > 0) {
+		return fmt.Errorf("revertLayout: revision is not tagged with the deployment that registered it: %s", revision)
+	} else if err = m.Ecs.revertLayout(ctx, layout, revision, jobId); err != nil {
+		return err
+	}
+	return m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		return e.revertLayout(ctx, regionLayout, revision, jobId)
+	})
+}
+
+func (m MultiRegionEcs) RegisterLayout(ctx context.Context, layout *manager.Layout, deployTag, sha, version, jobId string) error {
+	if err := m.Ecs.RegisterLayout(ctx, layout, deployTag, sha, version, jobId); err != nil {
+		return err
+	}
+	return m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		return e.RegisterLayout(ctx, regionLayout, deployTag, sha, version, jobId)
+	})
+}
+
+func (m MultiRegionEcs) PromoteLayout(ctx context.Context, layout *manager.Layout) error {
+	if err := m.Ecs.PromoteLayout(ctx, layout); err != nil {
+		return err
+	}
+	return m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		return e.PromoteLayout(ctx, regionLayout)
+	})
+}
+
+func (m MultiRegionEcs) CheckLayout(ctx context.Context, layout *manager.Layout) (bool, error) {
+	if deployed, err := m.Ecs.CheckLayout(ctx, layout); err != nil {
+		return false, err
+	} else if !deployed {
+		return false, nil
+	}
+	allDeployed := true
+	if err := m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		if deployed, err := e.CheckLayout(ctx, regionLayout); err != nil {
+			return err
+		} else if !deployed {
+			allDeployed = false
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return allDeployed, nil
+}
+
+func (m MultiRegionEcs) RestartLayout(ctx context.Context, layout *manager.Layout) error {
+	if err := m.Ecs.RestartLayout(ctx, layout); err != nil {
+		return err
+	}
+	return m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		return e.RestartLayout(ctx, regionLayout)
+	})
+}
+
+func (m MultiRegionEcs) CheckRestart(ctx context.Context, layout *manager.Layout, since time.Time) (bool, error) {
+	if restarted, err := m.Ecs.CheckRestart(ctx, layout, since); err != nil {
+		return false, err
+	} else if !restarted {
+		return false, nil
+	}
+	allRestarted := true
+	if err := m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		if restarted, err := e.CheckRestart(ctx, regionLayout, since); err != nil {
+			return err
+		} else if !restarted {
+			allRestarted = false
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return allRestarted, nil
+}
+
+func (m MultiRegionEcs) PruneLayout(ctx context.Context, layout *manager.Layout, keep int, retain map[string]bool) error {
+	if err := m.Ecs.PruneLayout(ctx, layout, keep, retain); err != nil {
+		return err
+	}
+	return m.forEachRegion(layout, func(e Ecs, regionLayout *manager.Layout) error {
+		return e.PruneLayout(ctx, regionLayout, keep, retain)
+	})
+}
+
+func (m MultiRegionEcs) GetContainerImage(ctx context.Context, taskDefArn, container string) (string, error) {
+	// Task definitions are regional, so look up the image in the region from the task definition ARN, e.g.
+	// "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:18".
+	if arnParts := strings.Split(taskDefArn, ":"); len(arnParts) > 3 {
+		if e, found := m.regions[arnParts[3]]; found {
+			return e.GetContainerImage(ctx, taskDefArn, container)
+		}
+	}
+	return m.Ecs.GetContainerImage(ctx, taskDefArn, container)
+}
+
+func (m MultiRegionEcs) Preflight(ctx context.Context) error {
+	if err := m.Ecs.Preflight(ctx); err != nil {
+		return err
+	}
+	for _, e := range m.regions {
+		if err := e.Preflight(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MultiRegionEcs) Ping(ctx context.Context) error {
+	if err := m.Ecs.Ping(ctx); err != nil {
+		return err
+	}
+	for region, e := range m.regions {
+		if err := e.Ping(ctx); err != nil {
+			log.Printf("ping: region error: %s, %v", region, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MultiRegionEcs) forEachRegion(layout *manager.Layout, fn func(Ecs, *manager.Layout) error) error {
+	for region, regionLayout := range layout.Regions {
+		if e, found := m.regions[region]; !found {
+			// The layout might have been generated before a region was removed from the configuration, in which case
+			// there's nothing we can do for that region.
+			log.Printf("forEachRegion: skipping unknown region: %s", region)
+		} else if err := fn(e, regionLayout); err != nil {
+			log.Printf("forEachRegion: region error: %s, %v", region, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+// Name of the resources used to probe permissions. Nothing with this name should exist, and probes that reference task
+// definitions use revision 0, which is never valid, so that probes can't change anything.
+const preflightResource = "cd-manager-preflight"
+
+const errorCode_AccessDenied = "AccessDeniedException"
+
+// Services can only be described 10 at a time, which is enough to find the roles used by an environment
+const maxDescribeServices = 10
+
+// preflightProbe is an API call that requires one of the permissions the manager needs
+type preflightProbe struct {
+	permission string
+	probe      func(context.Context) error
+}
+
+// Preflight checks that the manager's role has the ECS, ECR, SSM and IAM permissions needed for deployments, so that a
+// misconfigured role is caught at startup instead of in the middle of a deployment. Read-only permissions are probed with real calls.
+// Permissions for calls that change something are probed against resources that don't exist, which AWS rejects only
+// after checking authorization. The returned error lists all missing permissions.
+func (e Ecs) Preflight(ctx context.Context) error {
+	cluster := manager.GetEnvClusters(string(e.env)).Private
+	taskDefArn := preflightResource + ":0"
+	probes := []preflightProbe{
+		{"ecs:DescribeClusters", func(ctx context.Context) error {
+			_, err := e.ecsClient.DescribeClusters(ctx, &ecs.DescribeClustersInput{Clusters: []string{cluster}})
+			return err
+		}},
+		{"ecs:ListServices", func(ctx context.Context) error {
+			_, err := e.ecsClient.ListServices(ctx, &ecs.ListServicesInput{Cluster: aws.String(cluster), MaxResults: aws.Int32(1)})
+			return err
+		}},
+		{"ecs:DescribeServices", func(ctx context.Context) error {
+			_, err := e.ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(cluster), Services: []string{preflightResource}})
+			return err
+		}},
+		{"ecs:UpdateService", func(ctx context.Context) error {
+			_, err := e.ecsClient.UpdateService(ctx, &ecs.UpdateServiceInput{Cluster: aws.String(cluster), Service: aws.String(preflightResource)})
+			return err
+		}},
+		{"ecs:CreateTaskSet", func(ctx context.Context) error {
+			_, err := e.ecsClient.CreateTaskSet(ctx, &ecs.CreateTaskSetInput{Cluster: aws.String(cluster), Service: aws.String(preflightResource), TaskDefinition: aws.String(taskDefArn)})
+			return err
+		}},
+		{"ecs:UpdateTaskSet", func(ctx context.Context) error {
+			_, err := e.ecsClient.UpdateTaskSet(ctx, &ecs.UpdateTaskSetInput{
+				Cluster: aws.String(cluster),
+				Service: aws.String(preflightResource),
+				TaskSet: aws.String(preflightResource),
+				Scale:   &types.Scale{Unit: types.ScaleUnitPercent, Value: 0},
+			})
+			return err
+		}},
+		{"ecs:UpdateServicePrimaryTaskSet", func(ctx context.Context) error {
+			_, err := e.ecsClient.UpdateServicePrimaryTaskSet(ctx, &ecs.UpdateServicePrimaryTaskSetInput{Cluster: aws.String(cluster), Service: aws.String(preflightResource), PrimaryTaskSet: aws.String(preflightResource)})
+			return err
+		}},
+		{"ecs:DeleteTaskSet", func(ctx context.Context) error {
+			_, err := e.ecsClient.DeleteTaskSet(ctx, &ecs.DeleteTaskSetInput{Cluster: aws.String(cluster), Service: aws.String(preflightResource), TaskSet: aws.String(preflightResource)})
+			return err
+		}},
+		{"ecs:ListTasks", func(ctx context.Context) error {
+			_, err := e.ecsClient.ListTasks(ctx, &ecs.ListTasksInput{Cluster: aws.String(cluster), MaxResults: aws.Int32(1)})
+			return err
+		}},
+		{"ecs:DescribeTasks", func(ctx context.Context) error {
+			_, err := e.ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: aws.String(cluster), Tasks: []string{preflightResource}})
+			return err
+		}},
+		{"ecs:RunTask", func(ctx context.Context) error {
+			_, err := e.ecsClient.RunTask(ctx, &ecs.RunTaskInput{Cluster: aws.String(cluster), TaskDefinition: aws.String(taskDefArn)})
+			return err
+		}},
+		{"ecs:StopTask", func(ctx context.Context) error {
+			_, err := e.ecsClient.StopTask(ctx, &ecs.StopTaskInput{Cluster: aws.String(cluster), Task: aws.String(preflightResource)})
+			return err
+		}},
+		{"ecs:ListTaskDefinitions", func(ctx context.Context) error {
+			_, err := e.ecsClient.ListTaskDefinitions(ctx, &ecs.ListTaskDefinitionsInput{FamilyPrefix: aws.String(preflightResource), MaxResults: aws.Int32(1)})
+			return err
+		}},
+		{"ecs:DescribeTaskDefinition", func(ctx context.Context) error {
+			_, err := e.ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(taskDefArn)})
+			return err
+		}},
+		{"ecs:RegisterTaskDefinition", func(ctx context.Context) error {
+			// A task definition without containers is always rejected
+			_, err := e.ecsClient.RegisterTaskDefinition(ctx, &ecs.RegisterTaskDefinitionInput{Family: aws.String(preflightResource), ContainerDefinitions: []types.ContainerDefinition{}})
+			return err
+		}},
+		{"ecs:DeregisterTaskDefinition", func(ctx context.Context) error {
+			_, err := e.ecsClient.DeregisterTaskDefinition(ctx, &ecs.DeregisterTaskDefinitionInput{TaskDefinition: aws.String(taskDefArn)})
+			return err
+		}},
+		{"ecr:DescribeImages", func(ctx context.Context) error {
+			_, err := e.ecrClient.DescribeImages(ctx, &ecr.DescribeImagesInput{RepositoryName: aws.String(preflightResource)})
+			return err
+		}},
+		{"ssm:GetParameter", func(ctx context.Context) error {
+			_, err := e.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String("/" + preflightResource)})
+			return err
+		}},
+		{"ssm:GetParametersByPath", func(ctx context.Context) error {
+			_, err := e.ssmClient.GetParametersByPath(ctx, &ssm.GetParametersByPathInput{Path: aws.String("/" + preflightResource)})
+			return err
+		}},
+	}
+	if e.checkTargetHealth {
+		probes = append(probes, preflightProbe{"elasticloadbalancing:DescribeTargetHealth", func(ctx context.Context) error {
+			_, err := e.elbClient.DescribeTargetHealth(ctx, &elb.DescribeTargetHealthInput{TargetGroupArn: aws.String(preflightResource)})
+			return err
+		}})
+	}
+	// Task definitions are tagged when they're registered, and registering them passes their roles to ECS, so tagging
+	// and passing the roles the environment's services use are probed too. If the cluster or its services can't be
+	// looked up, the probes above report the missing permissions.
+	if clusterArn, roleArns, err := e.preflightResources(ctx, cluster); err != nil {
+		log.Printf("preflight: lookup resources error: %s, %s, %v", e.region, cluster, err)
+	} else {
+		// The ARN of a task definition that can't exist in the same account and region as the cluster
+		resourceArn := clusterArn[:strings.Index(clusterArn, ":cluster/")] + ":task-definition/" + taskDefArn
+		probes = append(probes, preflightProbe{"ecs:TagResource", func(ctx context.Context) error {
+			_, err := e.ecsClient.TagResource(ctx, &ecs.TagResourceInput{
+				ResourceArn: aws.String(resourceArn),
+				Tags:        []types.Tag{{Key: aws.String(preflightResource), Value: aws.String(preflightResource)}},
+			})
+			return err
+		}})
+		for _, roleArn := range roleArns {
+			roleArn := roleArn
+			probes = append(probes, preflightProbe{"iam:PassRole (" + roleArn + ")", func(ctx context.Context) error {
+				// A task definition without containers is always rejected, but only after the role has been checked
+				_, err := e.ecsClient.RegisterTaskDefinition(ctx, &ecs.RegisterTaskDefinitionInput{
+					Family:               aws.String(preflightResource),
+					ContainerDefinitions: []types.ContainerDefinition{},
+					TaskRoleArn:          aws.String(roleArn),
+				})
+				// Missing permission to register task definitions at all is reported by its own probe
+				if (err != nil) && !strings.Contains(err.Error(), "iam:PassRole") {
+					return nil
+				}
+				return err
+			}})
+		}
+	}
+	missingPermissions := make([]string, 0, len(probes))
+	for _, p := range probes {
+		if err := e.runPreflightProbe(ctx, p); isAccessDenied(err) {
+			log.Printf("preflight: missing permission: %s, %s, %v", e.region, p.permission, err)
+			missingPermissions = append(missingPermissions, p.permission)
+		} else if errors.Is(err, context.Canceled) {
+			return err
+		}
+		// Any other error is expected, since most probes refer to resources that don't exist
+	}
+	if len(missingPermissions) > 0 {
+		return fmt.Errorf("preflight: missing permissions in %s: %s", e.region, strings.Join(missingPermissions, ", "))
+	}
+	return nil
+}
+
+// preflightResources returns the ARN of a cluster and the roles used by the task definitions of its services
+func (e Ecs) preflightResources(ctx context.Context, cluster string) (string, []string, error) {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	descClusterOutput, err := e.ecsClient.DescribeClusters(httpCtx, &ecs.DescribeClustersInput{Clusters: []string{cluster}})
+	if err != nil {
+		return "", nil, err
+	} else if (len(descClusterOutput.Clusters) == 0) || !strings.Contains(aws.ToString(descClusterOutput.Clusters[0].ClusterArn), ":cluster/") {
+		return "", nil, fmt.Errorf("preflight: cluster not found: %s", cluster)
+	}
+	clusterArn := aws.ToString(descClusterOutput.Clusters[0].ClusterArn)
+	listSvcOutput, err := e.ecsClient.ListServices(httpCtx, &ecs.ListServicesInput{Cluster: aws.String(cluster), MaxResults: aws.Int32(maxDescribeServices)})
+	if err != nil {
+		return "", nil, err
+	} else if len(listSvcOutput.ServiceArns) == 0 {
+		return clusterArn, nil, nil
+	}
+	descSvcOutput, err := e.ecsClient.DescribeServices(httpCtx, &ecs.DescribeServicesInput{Cluster: aws.String(cluster), Services: listSvcOutput.ServiceArns})
+	if err != nil {
+		return "", nil, err
+	}
+	roleArns := make([]string, 0, len(descSvcOutput.Services))
+	found := make(map[string]bool)
+	for _, service := range descSvcOutput.Services {
+		descTaskDefOutput, err := e.ecsClient.DescribeTaskDefinition(httpCtx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: service.TaskDefinition})
+		if err != nil {
+			return "", nil, err
+		}
+		for _, roleArn := range []*string{descTaskDefOutput.TaskDefinition.ExecutionRoleArn, descTaskDefOutput.TaskDefinition.TaskRoleArn} {
+			if (roleArn != nil) && !found[*roleArn] {
+				found[*roleArn] = true
+				roleArns = append(roleArns, *roleArn)
+			}
+		}
+	}
+	return clusterArn, roleArns, nil
+}
+
+func (e Ecs) runPreflightProbe(ctx context.Context, p preflightProbe) error {
+	httpCtx, httpCancel := context.WithTimeout(ctx, manager.DefaultHttpWaitTime)
+	defer httpCancel()
+
+	return p.probe(httpCtx)
+}
+
+// isAccessDenied returns true if an AWS API call failed because the caller isn't authorized to make it
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return (apiErr.ErrorCode() == errorCode_AccessDenied) || strings.Contains(apiErr.ErrorMessage(), "not authorized to perform")
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package job
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,20 +14,95 @@ import (
 )
 
 func IsFinishedJob(jobState JobState) bool {
-	return (jobState.Stage == JobStage_Skipped) || (jobState.Stage == JobStage_Canceled) || (jobState.Stage == JobStage_Failed) || (jobState.Stage == JobStage_Completed)
+	return (jobState.Stage == JobStage_Skipped) || (jobState.Stage == JobStage_Canceled) || (jobState.Stage == JobStage_Failed) || (jobState.Stage == JobStage_Completed) || (jobState.Stage == JobStage_RolledBack)
 }
 
 func IsActiveJob(jobState JobState) bool {
 	return (jobState.Stage == JobStage_Started) || (jobState.Stage == JobStage_Waiting)
 }
 
+func IsWaitingApproval(jobState JobState) bool {
+	return jobState.Stage == JobStage_WaitingApproval
+}
+
+// IsTimedOut returns whether a job has been running for longer than the specified delay. Time spent in the queue isn't
+// counted, so that a job that waited behind other jobs still gets its full time to complete.
 func IsTimedOut(jobState JobState, delay time.Duration) bool {
-	// If no timestamp was stored, use the timestamp from the last update.
-	startTime := jobState.Ts
+	return IsTimedOutAt(jobState, delay, time.Now())
+}
+
+// IsTimedOutAt returns whether a job had been running for longer than the specified delay at the specified time
+func IsTimedOutAt(jobState JobState, delay time.Duration, now time.Time) bool {
+	return now.Add(-delay).After(StartTime(jobState))
+}
+
+// StartTime returns when a job entered the "started" stage. If no start time was stored, e.g. for a job that hasn't
+// started yet, the timestamp from the last update is used.
+func StartTime(jobState JobState) time.Time {
 	if s, found := jobState.Params[JobParam_Start].(float64); found {
-		startTime = time.Unix(0, int64(s))
+		return time.Unix(0, int64(s))
 	}
-	return time.Now().Add(-delay).After(startTime)
+	return jobState.Ts
+}
+
+// Copy returns a copy of a job state with its own params, so that changes made to the params of the copy don't affect
+// the original, e.g. a job state held in a cache.
+func Copy(jobState JobState) JobState {
+	params := make(map[string]interface{}, len(jobState.Params))
+	for k, v := range jobState.Params {
+		params[k] = v
+	}
+	jobState.Params = params
+	return jobState
+}
+
+// DefaultPriority is the priority of jobs that don't specify one. Urgent jobs, e.g. prod hotfix deployments, can be given
+// a higher priority so that they're dequeued and advanced ahead of other jobs, while background jobs can be given a
+// negative priority.
+const DefaultPriority = 0
+
+// Priority returns the priority of a job. Jobs with higher priorities are dequeued and advanced first, and jobs have
+// priority DefaultPriority if not specified.
+func Priority(jobState JobState) int {
+	if priority, found := jobState.Params[JobParam_Priority].(float64); found {
+		return int(priority)
+	}
+	return DefaultPriority
+}
+
+// IsValidPriority returns whether a job priority parameter is a whole number
+func IsValidPriority(priority interface{}) bool {
+	parsedPriority, ok := priority.(float64)
+	return ok && (parsedPriority == float64(int(parsedPriority)))
+}
+
+// MaxRetries is the most times a job can be retried. Each retry waits longer than the previous one before starting, so
+// keep the number of retries small.
+const MaxRetries = 5
+
+// IsValidMaxRetries returns whether a job's max retries parameter is a whole number between 0 and MaxRetries
+func IsValidMaxRetries(maxRetries interface{}) bool {
+	parsedMaxRetries, ok := maxRetries.(float64)
+	return ok && (parsedMaxRetries >= 0) && (parsedMaxRetries <= MaxRetries) && (parsedMaxRetries == float64(int(parsedMaxRetries)))
+}
+
+// SortByPriority orders jobs by descending priority. Jobs with the same priority keep their original order, i.e. FIFO for
+// jobs ordered by timestamp.
+func SortByPriority(jobs []JobState) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return Priority(jobs[i]) > Priority(jobs[j])
+	})
+}
+
+// SortByPriorityAndTime orders jobs by descending priority, and jobs with the same priority by timestamp, i.e. FIFO. This
+// is used for jobs whose order is otherwise arbitrary, e.g. jobs read from the cache.
+func SortByPriorityAndTime(jobs []JobState) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if iPriority, jPriority := Priority(jobs[i]), Priority(jobs[j]); iPriority != jPriority {
+			return iPriority > jPriority
+		}
+		return jobs[i].Ts.Before(jobs[j].Ts)
+	})
 }
 
 func CreateJobTable(ctx context.Context, client *dynamodb.Client, table string) error {
@@ -0,0 +1,79 @@
+package job
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCopy(t *testing.T) {
+	jobState := JobState{JobId: "deploy", Params: map[string]interface{}{JobParam_Start: float64(1)}}
+	copied := Copy(jobState)
+	copied.Params[JobParam_NextPoll] = float64(2)
+	if _, found := jobState.Params[JobParam_NextPoll]; found {
+		t.Error("original params modified")
+	}
+	if (copied.JobId != jobState.JobId) || (copied.Params[JobParam_Start] != float64(1)) {
+		t.Errorf("got %+v, want copy of %+v", copied, jobState)
+	}
+}
+
+func TestIsValidPriority(t *testing.T) {
+	tests := []struct {
+		priority interface{}
+		valid    bool
+	}{
+		{priority: float64(0), valid: true},
+		{priority: float64(10), valid: true},
+		{priority: float64(-5), valid: true},
+		{priority: 1.5},
+		{priority: "10"},
+		{priority: true},
+		{priority: nil},
+	}
+	for _, test := range tests {
+		if valid := IsValidPriority(test.priority); valid != test.valid {
+			t.Errorf("%v: got %v, want %v", test.priority, valid, test.valid)
+		}
+	}
+}
+
+func TestIsValidMaxRetries(t *testing.T) {
+	tests := []struct {
+		maxRetries interface{}
+		valid      bool
+	}{
+		{maxRetries: float64(0), valid: true},
+		{maxRetries: float64(MaxRetries), valid: true},
+		{maxRetries: float64(MaxRetries + 1)},
+		{maxRetries: float64(-1)},
+		{maxRetries: 1.5},
+		{maxRetries: "3"},
+		{maxRetries: nil},
+	}
+	for _, test := range tests {
+		if valid := IsValidMaxRetries(test.maxRetries); valid != test.valid {
+			t.Errorf("%v: got %v, want %v", test.maxRetries, valid, test.valid)
+		}
+	}
+}
+
+func TestSortByPriorityAndTime(t *testing.T) {
+	now := time.Now()
+	withPriority := func(jobId string, priority float64, ts time.Time) JobState {
+		return JobState{JobId: jobId, Ts: ts, Params: map[string]interface{}{JobParam_Priority: priority}}
+	}
+	jobs := []JobState{
+		{JobId: "default-new", Ts: now.Add(time.Minute)},
+		withPriority("low", -1, now.Add(-time.Hour)),
+		withPriority("hotfix-new", 10, now.Add(time.Minute)),
+		{JobId: "default-old", Ts: now},
+		withPriority("hotfix-old", 10, now),
+	}
+	SortByPriorityAndTime(jobs)
+	want := []string{"hotfix-old", "hotfix-new", "default-old", "default-new", "low"}
+	for i, jobState := range jobs {
+		if jobState.JobId != want[i] {
+			t.Fatalf("position %d: got %s, want %s", i, jobState.JobId, want[i])
+		}
+	}
+}
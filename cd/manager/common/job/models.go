@@ -16,6 +16,10 @@ const (
 	JobType_TestE2E   JobType = "test_e2e"
 	JobType_TestSmoke JobType = "test_smoke"
 	JobType_Workflow  JobType = "workflow"
+	JobType_Restart   JobType = "restart"
+	JobType_StopTask  JobType = "stop_task"
+	JobType_Prepull   JobType = "prepull"
+	JobType_Reconcile JobType = "reconcile"
 )
 
 type JobStage string
@@ -29,38 +33,112 @@ const (
 	JobStage_Failed    JobStage = "failed"
 	JobStage_Canceled  JobStage = "canceled"
 	JobStage_Completed JobStage = "completed"
+	// A rollback deployment that completed, i.e. one queued automatically to restore the previously deployed tag after a
+	// deployment failed (or was canceled, if requested), or one requested to return to an earlier task definition
+	// revision. Rollbacks end in this stage instead of "completed".
+	JobStage_RolledBack JobStage = "rolled_back"
+	// A deployment that needs to be approved before it can be dequeued
+	JobStage_WaitingApproval JobStage = "waiting_approval"
 )
 
 const (
-	JobParam_Id       string = "id"
-	JobParam_Error    string = "error"
-	JobParam_WaitTime string = "waitTime"
-	JobParam_Start    string = "start"
-	JobParam_Source   string = "source"
+	JobParam_Id          string = "id"
+	JobParam_Error       string = "error"
+	JobParam_ErrorCode   string = "errorCode"
+	JobParam_WaitTime    string = "waitTime"
+	JobParam_Start       string = "start"
+	JobParam_Source      string = "source"
+	JobParam_NextPoll    string = "nextPoll"
+	JobParam_DependsOn   string = "dependsOn"
+	JobParam_CanceledBy  string = "canceledBy"
+	JobParam_Priority    string = "priority"
+	JobParam_Requester   string = "requester"
+	JobParam_MaxRetries  string = "maxRetries"
+	JobParam_Retries     string = "retries"
+	JobParam_TraceParent string = "traceparent"
+	JobParam_TraceState  string = "tracestate"
 )
 
 const (
-	DeployJobParam_Component string = "component"
-	DeployJobParam_Sha       string = "sha"
-	DeployJobParam_ShaTag    string = "shaTag"
-	DeployJobParam_DeployTag string = "deployTag"
-	DeployJobParam_Layout    string = "layout"
-	DeployJobParam_Manual    string = "manual"
-	DeployJobParam_Force     string = "force"
-	DeployJobParam_Rollback  string = "rollback"
+	DeployJobParam_Component        string = "component"
+	DeployJobParam_Sha              string = "sha"
+	DeployJobParam_ShaTag           string = "shaTag"
+	DeployJobParam_DeployTag        string = "deployTag"
+	DeployJobParam_Layout           string = "layout"
+	DeployJobParam_LayoutDiff       string = "layoutDiff"
+	DeployJobParam_Manual           string = "manual"
+	DeployJobParam_Force            string = "force"
+	DeployJobParam_Rollback         string = "rollback"
+	DeployJobParam_TestE2E          string = "testE2e"
+	DeployJobParam_CreateIfMissing  string = "createIfMissing"
+	DeployJobParam_ApprovedBy       string = "approvedBy"
+	DeployJobParam_Version          string = "version"
+	DeployJobParam_RollbackOnCancel string = "rollbackOnCancel"
+	DeployJobParam_RolloutSteps     string = "rolloutSteps"
+	DeployJobParam_RolloutStep      string = "rolloutStep"
+	DeployJobParam_RolloutStepStart string = "rolloutStepStart"
+	DeployJobParam_Revision         string = "revision"
+	DeployJobParam_ImageDigest      string = "imageDigest"
+	DeployJobParam_Shas             string = "shas"
+	DeployJobParam_RegisterOnly     string = "registerOnly"
+	DeployJobParam_PromoteJob       string = "promoteJob"
+	DeployJobParam_Target           string = "target"
+	DeployJobParam_ServiceEvents    string = "serviceEvents"
+	DeployJobParam_Maintenance      string = "maintenance"
+	DeployJobParam_ServiceChanges   string = "serviceChanges"
+	DeployJobParam_Emergency        string = "emergency"
+	DeployJobParam_PreDeployTask    string = "preDeployTask"
+	DeployJobParam_PreDeployTaskArn string = "preDeployTaskArn"
+	DeployJobParam_HeldNotified     string = "heldNotified"
+	DeployJobParam_SupersededBy     string = "supersededBy"
 )
 
 const (
 	DeployJobTarget_Latest   = "latest"
 	DeployJobTarget_Release  = "release"
 	DeployJobTarget_Rollback = "rollback"
+	DeployJobTarget_Promote  = "promote"
 )
 
 const (
-	AnchorJobParam_Delayed   string = "delayed"
-	AnchorJobParam_Stalled   string = "stalled"
-	AnchorJobParam_Version   string = "version"
-	AnchorJobParam_Overrides string = "overrides"
+	AnchorJobParam_Delayed          string = "delayed"
+	AnchorJobParam_Stalled          string = "stalled"
+	AnchorJobParam_Version          string = "version"
+	AnchorJobParam_Overrides        string = "overrides"
+	AnchorJobParam_Command          string = "command"
+	AnchorJobParam_ExitCode         string = "exitCode"
+	AnchorJobParam_Secrets          string = "secrets"
+	AnchorJobParam_Network          string = "network"
+	AnchorJobParam_NetworkParams    string = "networkParams"
+	AnchorJobParam_OverridesPath    string = "overridesPath"
+	AnchorJobParam_CapacityProvider string = "capacityProvider"
+)
+
+const (
+	RestartJobParam_Component string = "component"
+	RestartJobParam_Cluster   string = "cluster"
+	RestartJobParam_Service   string = "service"
+	RestartJobParam_Layout    string = "layout"
+)
+
+const (
+	StopTaskJobParam_Cluster     string = "cluster"
+	StopTaskJobParam_Task        string = "task"
+	StopTaskJobParam_Reason      string = "reason"
+	StopTaskJobParam_RequestedBy string = "requestedBy"
+)
+
+const (
+	PrepullJobParam_Component string = "component"
+	PrepullJobParam_DeployTag string = "deployTag"
+	PrepullJobParam_Layout    string = "layout"
+	PrepullJobParam_DeployJob string = "deployJob"
+	PrepullJobParam_Cluster   string = "cluster"
+)
+
+const (
+	ReconcileJobParam_Components string = "components"
+	ReconcileJobParam_Drift      string = "drift"
 )
 
 const (
@@ -1,6 +1,7 @@
 package jobmanager
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/maps"
@@ -28,11 +30,31 @@ type JobManager struct {
 	apiGw         manager.ApiGw
 	repo          manager.Repository
 	notifs        manager.Notifs
+	metrics       manager.Metrics // Optional, can be nil
 	maxAnchorJobs int
 	minAnchorJobs int
 	paused        bool
+	prepullImages bool
 	env           manager.EnvType
 	waitGroup     *sync.WaitGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+	// Set once shutdown starts so that no new jobs are accepted or started
+	shuttingDown *atomic.Bool
+	// Time that jobs being advanced have to finish on shutdown before calls still in flight are aborted
+	drainTime time.Duration
+	// Time for which a job lease is held without being renewed, e.g. after the instance holding it crashed
+	leaseDuration time.Duration
+	// Last known state of the maintenance flag, used if the flag can't be read from the database
+	maintenance bool
+	// Interval at which components are checked for drift from their last recorded deployment. Disabled if 0.
+	reconcileInterval time.Duration
+	// Components checked for drift
+	reconcileComponents []string
+	// Start of the last interval for which a drift check was queued
+	lastReconcile time.Time
+	// Windows outside which prod deployments aren't allowed to start
+	deployWindows *jobs.DeployWindows
 }
 
 const (
@@ -47,7 +69,28 @@ const (
 const defaultCasMaxAnchorWorkers = 1
 const defaultCasMinAnchorWorkers = 0
 
-func NewJobManager(cache manager.Cache, db manager.Database, d manager.Deployment, apiGw manager.ApiGw, repo manager.Repository, notifs manager.Notifs) (manager.Manager, error) {
+// ECS gives tasks 30 seconds to exit after sending SIGTERM by default, so leave some room for the rest of the shutdown
+const defaultShutdownDrainTime = 25 * time.Second
+
+const defaultJobLeaseDuration = time.Minute
+
+// Leases are renewed every third of their duration, so shorter leases would expire while the renewal is still in flight
+const minJobLeaseDuration = time.Second
+
+// Parameters that are only set by the job manager or through their own endpoints (e.g. approvals, cancellations and
+// rollbacks), and that requested jobs aren't allowed to include. Rollbacks skip approval, the deploy windows and the
+// maintenance hold, so they can only be queued by the manager.
+var reservedJobParams = []string{job.DeployJobParam_ApprovedBy, job.JobParam_CanceledBy, job.DeployJobParam_Rollback}
+
+var defaultReconcileComponents = []string{
+	string(manager.DeployComponent_Ceramic),
+	string(manager.DeployComponent_Cas),
+	string(manager.DeployComponent_CasV5),
+	string(manager.DeployComponent_Ipfs),
+	string(manager.DeployComponent_RustCeramic),
+}
+
+func NewJobManager(cache manager.Cache, db manager.Database, d manager.Deployment, apiGw manager.ApiGw, repo manager.Repository, notifs manager.Notifs, metrics manager.Metrics) (manager.Manager, error) {
 	maxAnchorJobs := defaultCasMaxAnchorWorkers
 	if configMaxAnchorWorkers, found := os.LookupEnv("CAS_MAX_ANCHOR_WORKERS"); found {
 		if parsedMaxAnchorWorkers, err := strconv.Atoi(configMaxAnchorWorkers); err == nil {
@@ -64,10 +107,87 @@ func NewJobManager(cache manager.Cache, db manager.Database, d manager.Deploymen
 		return nil, fmt.Errorf("newJobManager: invalid anchor worker config: %d, %d", minAnchorJobs, maxAnchorJobs)
 	}
 	paused, _ := strconv.ParseBool(os.Getenv("PAUSED"))
-	return &JobManager{cache, db, d, apiGw, repo, notifs, maxAnchorJobs, minAnchorJobs, paused, manager.EnvType(os.Getenv(manager.EnvVar_Env)), new(sync.WaitGroup)}, nil
+	// Reject a malformed value instead of silently skipping the pre-pull gate that it was meant to enable
+	prepullImages := false
+	if configPrepullImages, found := os.LookupEnv("PREPULL_IMAGES"); found && (len(configPrepullImages) > 0) {
+		var err error
+		if prepullImages, err = strconv.ParseBool(configPrepullImages); err != nil {
+			return nil, fmt.Errorf("newJobManager: invalid PREPULL_IMAGES: %w", err)
+		}
+	}
+	drainTime := defaultShutdownDrainTime
+	if configDrainTime, found := os.LookupEnv("SHUTDOWN_DRAIN_TIME"); found {
+		// Without any drain time, shutdown would abort the calls of jobs being advanced right away
+		if parsedDrainTime, err := time.ParseDuration(configDrainTime); (err != nil) || (parsedDrainTime <= 0) {
+			return nil, fmt.Errorf("newJobManager: invalid shutdown drain time: %s", configDrainTime)
+		} else {
+			drainTime = parsedDrainTime
+		}
+	}
+	leaseDuration := defaultJobLeaseDuration
+	if configLeaseDuration, found := os.LookupEnv("JOB_LEASE_DURATION"); found {
+		if parsedLeaseDuration, err := time.ParseDuration(configLeaseDuration); (err != nil) || (parsedLeaseDuration < minJobLeaseDuration) {
+			return nil, fmt.Errorf("newJobManager: invalid job lease duration: %s", configLeaseDuration)
+		} else {
+			leaseDuration = parsedLeaseDuration
+		}
+	}
+	var reconcileInterval time.Duration
+	if configReconcileInterval, found := os.LookupEnv("RECONCILE_INTERVAL"); found {
+		if parsedReconcileInterval, err := time.ParseDuration(configReconcileInterval); err != nil {
+			return nil, fmt.Errorf("newJobManager: invalid reconcile interval: %s, %w", configReconcileInterval, err)
+		} else {
+			reconcileInterval = parsedReconcileInterval
+		}
+	}
+	reconcileComponents := defaultReconcileComponents
+	if configReconcileComponents, found := os.LookupEnv("RECONCILE_COMPONENTS"); found && (len(configReconcileComponents) > 0) {
+		reconcileComponents = strings.Split(configReconcileComponents, ",")
+	}
+	for _, component := range reconcileComponents {
+		if _, err := manager.ComponentRepo(manager.DeployComponent(component)); err != nil {
+			return nil, fmt.Errorf("newJobManager: invalid reconcile component: %s", component)
+		}
+	}
+	// Wait for the next interval to start before checking for drift, so that restarts don't trigger extra checks
+	var lastReconcile time.Time
+	if reconcileInterval > 0 {
+		lastReconcile = time.Now().Truncate(reconcileInterval)
+	}
+	// Parse the deploy windows up front, otherwise a misconfiguration would only surface when deployments are advanced
+	deployWindows, err := jobs.ParseDeployWindows()
+	if err != nil {
+		return nil, fmt.Errorf("newJobManager: invalid deploy windows: %w", err)
+	}
+	// Same for the number of task definitions that deployments keep when pruning
+	if _, err = jobs.ParseKeepTaskDefs(); err != nil {
+		return nil, fmt.Errorf("newJobManager: %w", err)
+	}
+	// And for the time that prod deployments wait for approval
+	if _, err = jobs.ParseApprovalWindow(); err != nil {
+		return nil, fmt.Errorf("newJobManager: %w", err)
+	}
+	// This context is cancelled on shutdown so that any outstanding calls made while advancing jobs are aborted
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobManager{cache, db, d, apiGw, repo, notifs, metrics, maxAnchorJobs, minAnchorJobs, paused, prepullImages, manager.EnvType(os.Getenv(manager.EnvVar_Env)), new(sync.WaitGroup), ctx, cancel, new(atomic.Bool), drainTime, leaseDuration, false, reconcileInterval, reconcileComponents, lastReconcile, deployWindows}, nil
 }
 
+// NewJob queues a requested job. No new jobs are accepted once shutdown has started.
 func (m *JobManager) NewJob(jobState job.JobState) (job.JobState, error) {
+	if m.shuttingDown.Load() {
+		return jobState, manager.Error_ShuttingDown
+	}
+	for _, param := range reservedJobParams {
+		if _, found := jobState.Params[param]; found {
+			return jobState, fmt.Errorf("newJob: %w: %s", manager.Error_ReservedParam, param)
+		}
+	}
+	return m.enqueueJob(jobState)
+}
+
+// enqueueJob queues a job, including during shutdown so that jobs the manager creates itself while draining (e.g.
+// rollbacks of failed deployments) aren't lost.
+func (m *JobManager) enqueueJob(jobState job.JobState) (job.JobState, error) {
 	jobState.Stage = job.JobStage_Queued
 	// Only set the job ID/time if not already set by the caller
 	if len(jobState.JobId) == 0 {
@@ -79,7 +199,16 @@ func (m *JobManager) NewJob(jobState job.JobState) (job.JobState, error) {
 	if jobState.Params == nil {
 		jobState.Params = make(map[string]interface{}, 0)
 	}
-	return jobState, m.db.QueueJob(jobState)
+	// Reject a bad priority up front, otherwise the job would be queued and then fail to be advanced. Jobs default to
+	// job.DefaultPriority, and prod hotfixes can be given a higher priority so that they're dequeued and advanced ahead
+	// of other jobs.
+	if priority, found := jobState.Params[job.JobParam_Priority]; found && !job.IsValidPriority(priority) {
+		return jobState, fmt.Errorf("newJob: %w: %v", manager.Error_InvalidPriority, priority)
+	} else if maxRetries, found := jobState.Params[job.JobParam_MaxRetries]; found && !job.IsValidMaxRetries(maxRetries) {
+		// Deployments that fail for a transient reason, e.g. throttling, can be retried from the beginning
+		return jobState, fmt.Errorf("newJob: %w: %v", manager.Error_InvalidMaxRetries, maxRetries)
+	}
+	return jobState, m.db.EnqueueJob(jobState, job.Priority(jobState))
 }
 
 func (m *JobManager) CheckJob(jobId string) job.JobState {
@@ -102,8 +231,21 @@ func (m *JobManager) ProcessJobs(shutdownCh chan bool) {
 			case <-shutdownCh:
 				log.Println("manager: stop processing jobs...")
 				tick.Stop()
-				// Attempt to acquire the run token to ensure that no jobs are being processed while shutting down
-				<-runToken
+				m.shuttingDown.Store(true)
+				// Give a running iteration time to finish so that jobs being advanced can reach their next stage. Then
+				// abort any calls still in flight. Jobs will not be advanced to a new stage because of the cancellation,
+				// and will be picked back up from their current stage after a restart, e.g. started deployments resume
+				// checking the environment.
+				select {
+				case <-runToken:
+				case <-time.After(m.drainTime):
+					log.Println("manager: drain time elapsed, aborting jobs being advanced...")
+					m.cancel()
+					// Attempt to acquire the run token to ensure that no jobs are being processed while shutting down
+					<-runToken
+				}
+				m.cancel()
+				log.Println("manager: drained jobs")
 				return
 			case <-tick.C:
 				// Acquire the run token so that no loop iterations can run in parallel (shouldn't happen), and so that
@@ -127,6 +269,150 @@ func (m *JobManager) Pause() {
 	log.Printf("pause: job manager %s", status)
 }
 
+// SetMaintenance turns on maintenance mode, which holds queued deployments in the queue across all manager instances
+// until it is cleared. Deployments that were already dequeued are not affected.
+func (m *JobManager) SetMaintenance(setBy string) error {
+	if err := m.db.SetMaintenance(true, setBy); err != nil {
+		log.Printf("setMaintenance: failed to set maintenance flag: %s, %v", setBy, err)
+		return err
+	}
+	log.Printf("setMaintenance: deployments paused by %s", setBy)
+	return nil
+}
+
+// ClearMaintenance turns off maintenance mode so that held deployments are processed again
+func (m *JobManager) ClearMaintenance(clearedBy string) error {
+	if err := m.db.SetMaintenance(false, clearedBy); err != nil {
+		log.Printf("clearMaintenance: failed to clear maintenance flag: %s, %v", clearedBy, err)
+		return err
+	}
+	log.Printf("clearMaintenance: deployments resumed by %s", clearedBy)
+	return nil
+}
+
+func (m *JobManager) GetMaintenance() (*manager.Maintenance, error) {
+	return m.db.GetMaintenance()
+}
+
+func (m *JobManager) DescribeLayout(component manager.DeployComponent) (*manager.LayoutDrift, error) {
+	return jobs.DescribeEnvLayout(m.ctx, m.d, string(m.env), component)
+}
+
+func (m *JobManager) DetectDrift(component manager.DeployComponent) ([]manager.DriftItem, error) {
+	return jobs.DetectDrift(m.ctx, m.d, m.db, string(m.env), component)
+}
+
+func (m *JobManager) GetServiceStatus(cluster, service string) (*manager.ServiceStatus, error) {
+	return m.d.GetServiceStatus(m.ctx, cluster, service)
+}
+
+func (m *JobManager) GetCurrentImage(cluster, service string) (string, error) {
+	return m.d.GetCurrentImage(m.ctx, cluster, service)
+}
+
+func (m *JobManager) ListRunningTasks(cluster string, managerOnly bool) ([]manager.TaskInfo, error) {
+	return m.d.ListRunningTasks(m.ctx, cluster, managerOnly)
+}
+
+// ActiveJobs returns jobs that have been dequeued but haven't finished yet
+func (m *JobManager) ActiveJobs() []job.JobState {
+	activeJobs := m.db.OrderedJobs(job.JobStage_Dequeued)
+	activeJobs = append(activeJobs, m.db.OrderedJobs(job.JobStage_Started)...)
+	return append(activeJobs, m.db.OrderedJobs(job.JobStage_Waiting)...)
+}
+
+func (m *JobManager) ApproveJob(jobId, approver string) error {
+	// Look the job up in the database rather than the cache, since another manager instance might have queued it
+	if jobState, err := m.db.LatestJobState(jobId); err != nil {
+		log.Printf("approveJob: job lookup failed: %s, %v", jobId, err)
+		return err
+	} else {
+		return m.db.ApproveJob(jobState, approver)
+	}
+}
+
+func (m *JobManager) CancelJob(jobId, canceledBy string, rollback bool) error {
+	// Look the job up in the database rather than the cache, since another manager instance might have dequeued it
+	if jobState, err := m.db.LatestJobState(jobId); err != nil {
+		log.Printf("cancelJob: job lookup failed: %s, %v", jobId, err)
+		return err
+	} else if jobState.Stage == job.JobStage_Queued {
+		// Jobs that haven't been dequeued yet can be dropped from the queue right away
+		return m.cancelQueuedJob(jobState, canceledBy)
+	} else {
+		return m.db.CancelJob(jobState, canceledBy, rollback)
+	}
+}
+
+func (m *JobManager) cancelQueuedJob(queuedJob job.JobState, canceledBy string) error {
+	if jobState, err := m.db.CancelQueuedJob(queuedJob, canceledBy); err != nil {
+		log.Printf("cancelQueuedJob: cancel failed: %s, %v", queuedJob.JobId, err)
+		return err
+	} else {
+		log.Printf("cancelQueuedJob: canceled job: %s", manager.PrintJob(jobState))
+		m.notifs.NotifyJob(jobState)
+		m.recordJob(jobState)
+	}
+	return nil
+}
+
+// RollbackTo queues a rollback of a component's services to an earlier revision of their task definitions. The revision
+// is checked before the rollback is queued so that a bad revision is reported right away.
+func (m *JobManager) RollbackTo(component manager.DeployComponent, revision string) error {
+	if m.shuttingDown.Load() {
+		return manager.Error_ShuttingDown
+	} else if deployTag, err := jobs.ResolveRevision(m.ctx, m.d, string(m.env), component, revision); err != nil {
+		return err
+	} else {
+		_, err = m.enqueueJob(job.JobState{
+			Type: job.JobType_Deploy,
+			Params: map[string]interface{}{
+				job.DeployJobParam_Component: string(component),
+				job.DeployJobParam_Rollback:  true,
+				job.DeployJobParam_Sha:       job.DeployJobTarget_Rollback,
+				job.DeployJobParam_ShaTag:    deployTag,
+				job.DeployJobParam_Revision:  revision,
+				job.DeployJobParam_Force:     true,
+				job.JobParam_Source:          manager.ServiceName,
+			},
+		})
+		return err
+	}
+}
+
+// PromoteJob queues a deployment that points a component's services at the task definitions registered by a completed
+// register-only deployment. The registered deployment is checked before the promotion is queued so that a bad job ID is
+// reported right away.
+func (m *JobManager) PromoteJob(jobId string) error {
+	if registeredJob, err := jobs.RegisteredJob(m.db, jobId); err != nil {
+		return err
+	} else {
+		params := map[string]interface{}{
+			job.DeployJobParam_Component:  registeredJob.Params[job.DeployJobParam_Component],
+			job.DeployJobParam_Sha:        job.DeployJobTarget_Promote,
+			job.DeployJobParam_ShaTag:     registeredJob.Params[job.DeployJobParam_DeployTag],
+			job.DeployJobParam_PromoteJob: jobId,
+			job.DeployJobParam_Manual:     true,
+			job.JobParam_Source:           manager.ServiceName,
+		}
+		if version, found := registeredJob.Params[job.DeployJobParam_Version]; found {
+			params[job.DeployJobParam_Version] = version
+		}
+		_, err = m.NewJob(job.JobState{Type: job.JobType_Deploy, Params: params})
+		return err
+	}
+}
+
+// CheckReady checks whether the job manager can reach the services it needs to process jobs
+func (m *JobManager) CheckReady() error {
+	if err := m.db.Ping(); err != nil {
+		return fmt.Errorf("checkReady: database unreachable: %w", err)
+	} else if err = m.d.Ping(m.ctx); err != nil {
+		return fmt.Errorf("checkReady: deployment service unreachable: %w", err)
+	}
+	return nil
+}
+
 func (m *JobManager) processJobs() {
 	now := time.Now()
 	// Age out completed/failed/skipped jobs older than 1 day
@@ -143,10 +429,16 @@ func (m *JobManager) processJobs() {
 	}
 	// Find all jobs in progress and advance their state before looking for new jobs
 	m.advanceJobs(m.cache.JobsByMatcher(job.IsActiveJob))
-	// Don't start any new jobs if the job manager is paused. Existing jobs will continue to be advanced.
-	if !m.paused {
-		// Advance each freshly discovered "queued" job to the "dequeued" stage
-		m.advanceJobs(m.db.QueuedJobs())
+	// Check jobs waiting for approval even if the job manager is paused so that unapproved jobs expire on time.
+	// Approved jobs will be dequeued but not started while paused.
+	m.advanceJobs(m.cache.JobsByMatcher(job.IsWaitingApproval))
+	// Don't start any new jobs if the job manager is paused or shutting down. Existing jobs will continue to be advanced.
+	if !m.paused && !m.shuttingDown.Load() {
+		// Queue a drift check at the start of each reconciliation interval
+		m.scheduleReconcileJob(now)
+		// Advance each freshly discovered "queued" job to the "dequeued" stage, leaving deployments queued while in
+		// maintenance mode.
+		m.advanceJobs(m.holdDeployJobs(m.db.QueuedJobs()))
 		// Jobs in the "dequeued" stage are in the cache but haven't been "started" yet and can thus begin processing
 		dequeuedJobs := m.db.OrderedJobs(job.JobStage_Dequeued)
 		if len(dequeuedJobs) > 0 {
@@ -155,7 +447,10 @@ func (m *JobManager) processJobs() {
 			// - one smoke test at a time (compatible with non-deploy jobs)
 			// - one E2E test at a time (compatible with non-deploy jobs)
 			// - one workflow at a time (compatible with non-deploy jobs)
+			// - one restart at a time (compatible with anchor jobs)
 			// - any number of anchor workers (compatible with any other type of job)
+			// - any number of task stops (compatible with any other type of job)
+			// - any number of image pre-pulls (compatible with any other type of job)
 			//
 			// Loop over compatible dequeued jobs until we find an incompatible one and need to wait for existing jobs
 			// to complete.
@@ -166,23 +461,78 @@ func (m *JobManager) processJobs() {
 				((dequeuedJobs[0].Type != job.JobType_Deploy) || !m.processDeployJobs(dequeuedJobs)) {
 				m.processTestJobs(dequeuedJobs)
 				m.processWorkflowJobs(dequeuedJobs)
+				m.processRestartJobs(dequeuedJobs)
 			}
 		}
 		// Anchor jobs can be run independently of deployments and do not need any exclusion rules
 		m.processAnchorJobs(dequeuedJobs)
+		// Task stops are used to clean up stuck tasks, so they should never have to wait for other jobs
+		m.processStopTaskJobs(dequeuedJobs)
+		// Image pre-pulls gate deployments, so they should never have to wait for other jobs
+		m.processPrepullJobs(dequeuedJobs)
+		// Drift checks only read from ECS, so they can run alongside any other jobs
+		m.processReconcileJobs(dequeuedJobs)
 	}
 	// Wait for all of this iteration's job advancement goroutines to finish before we iterate again. The ticker will
 	// automatically drop ticks then pick back up later if a round of processing takes longer than 1 tick.
 	m.waitGroup.Wait()
 }
 
+// holdDeployJobs returns the queued jobs that can be advanced. While maintenance mode is on, deployments are left in the
+// queue, except for rollbacks, and a notification is sent the first time each of them is held.
+func (m *JobManager) holdDeployJobs(queuedJobs []job.JobState) []job.JobState {
+	if maintenance, err := m.db.GetMaintenance(); err != nil {
+		log.Printf("holdDeployJobs: failed to read maintenance flag, using last known state: %v, %v", m.maintenance, err)
+	} else if maintenance.Enabled != m.maintenance {
+		m.maintenance = maintenance.Enabled
+		log.Printf("holdDeployJobs: maintenance mode changed: %v, %s", maintenance.Enabled, maintenance.SetBy)
+	}
+	if !m.maintenance {
+		return queuedJobs
+	}
+	jobsToAdvance := make([]job.JobState, 0, len(queuedJobs))
+	for _, jobState := range queuedJobs {
+		// Let rollbacks through so that a failed deployment can still restore the environment
+		if rollback, _ := jobState.Params[job.DeployJobParam_Rollback].(bool); (jobState.Type != job.JobType_Deploy) || rollback {
+			jobsToAdvance = append(jobsToAdvance, jobState)
+			continue
+		}
+		// The notification is recorded on the job in the database so that it's only sent once across all manager
+		// instances and restarts.
+		if notify, err := m.db.MarkJobHeld(jobState); err != nil {
+			log.Printf("holdDeployJobs: failed to mark held deployment: %s, %v", manager.PrintJob(jobState), err)
+		} else if notify {
+			log.Printf("holdDeployJobs: holding deployment for maintenance: %s", manager.PrintJob(jobState))
+			// Flag the notification without changing the stored job
+			notifState := jobState
+			notifState.Params = make(map[string]interface{}, len(jobState.Params)+1)
+			for k, v := range jobState.Params {
+				notifState.Params[k] = v
+			}
+			notifState.Params[job.DeployJobParam_Maintenance] = true
+			m.notifs.NotifyJob(notifState)
+		}
+	}
+	return jobsToAdvance
+}
+
 func (m *JobManager) advanceJobs(jobs []job.JobState) {
 	if len(jobs) > 0 {
-		for _, jobState := range jobs {
-			m.advanceJob(jobState)
+		// Advance higher priority jobs first, e.g. so that a hotfix deployment isn't held up behind other jobs waiting for
+		// a job lease or for their calls to AWS. Jobs are advanced in parallel, so finish advancing each priority level
+		// before starting on the next one, otherwise the order in which they're started makes no difference.
+		job.SortByPriorityAndTime(jobs)
+		for start := 0; start < len(jobs); {
+			priority := job.Priority(jobs[start])
+			end := start
+			for (end < len(jobs)) && (job.Priority(jobs[end]) == priority) {
+				m.advanceJob(jobs[end])
+				end++
+			}
+			// Wait for any running job advancement goroutines to finish
+			m.waitGroup.Wait()
+			start = end
 		}
-		// Wait for any running job advancement goroutines to finish
-		m.waitGroup.Wait()
 	}
 }
 
@@ -232,6 +582,9 @@ func (m *JobManager) processForceDeployJobs(dequeuedJobs []job.JobState) bool {
 		for _, dequeuedJob := range dequeuedJobs {
 			if dequeuedJob.Type == job.JobType_Deploy {
 				if forceDeploy, found := forceDeploys[dequeuedJob.Params[job.DeployJobParam_Component].(string)]; found && (dequeuedJob.JobId != forceDeploy.JobId) {
+					// Record which deployment replaced the skipped one so that deployments depending on it can wait
+					// for the replacement instead
+					dequeuedJob.Params[job.DeployJobParam_SupersededBy] = forceDeploy.JobId
 					if err := m.updateJobStage(dequeuedJob, job.JobStage_Skipped, nil); err != nil {
 						// Return `true` from here so that no state is changed and the loop can restart cleanly. Any
 						// jobs already skipped won't be picked up again, which is ok.
@@ -246,7 +599,10 @@ func (m *JobManager) processForceDeployJobs(dequeuedJobs []job.JobState) bool {
 		})
 		for _, activeDeploy := range activeDeploys {
 			if _, found := forceDeploys[activeDeploy.Params[job.DeployJobParam_Component].(string)]; found {
-				if err := m.updateJobStage(activeDeploy, job.JobStage_Canceled, nil); err != nil {
+				// Another instance might be advancing the deployment, so request the cancellation instead of writing the
+				// canceled stage directly. The deployment is canceled the next time it's advanced.
+				if err := m.db.CancelJob(activeDeploy, manager.ServiceName, false); err != nil {
+					log.Printf("processForceDeployJobs: cancel failed: %v, %s", err, manager.PrintJob(activeDeploy))
 					// Return `true` from here so that no state is changed and the loop can restart cleanly. Any jobs
 					// already skipped won't be picked up again, which is ok.
 					return true
@@ -276,13 +632,38 @@ func (m *JobManager) processDeployJobs(dequeuedJobs []job.JobState) bool {
 			if (dequeuedJob.Type == job.JobType_TestE2E) || (dequeuedJob.Type == job.JobType_TestSmoke) {
 				break
 			} else if (dequeuedJob.Type == job.JobType_Deploy) && (dequeuedJob.Params[job.DeployJobParam_Component].(string) == deployComponent) {
-				// Skip the current deploy job, and replace it with a newer one.
-				if err := m.updateJobStage(deployJob, job.JobStage_Skipped, nil); err != nil {
+				// Skip the older of the two deploy jobs and keep the newer one. Dequeued jobs are ordered by priority
+				// first, so a prioritized deploy can be ahead of older deploys for the same component.
+				skippedJob, keptJob := deployJob, dequeuedJob
+				if dequeuedJob.Ts.Before(deployJob.Ts) {
+					skippedJob, keptJob = dequeuedJob, deployJob
+				}
+				// Record which deployment replaced the skipped one so that deployments depending on it can wait for
+				// the replacement instead
+				skippedJob.Params[job.DeployJobParam_SupersededBy] = keptJob.JobId
+				if err := m.updateJobStage(skippedJob, job.JobStage_Skipped, nil); err != nil {
 					// Return `true` from here so that no state is changed and the loop can restart cleanly. Any
 					// jobs already skipped won't be picked up again, which is ok.
 					return true
 				}
-				deployJob = dequeuedJob
+				if skippedJob.JobId == deployJob.JobId {
+					deployJob = dequeuedJob
+				}
+			}
+		}
+		// If enabled, pull the image being deployed using a throwaway task before the deployment starts so that any
+		// problems with the image surface before any services are updated. Force deploys (including rollbacks) skip
+		// this step so that they aren't held up.
+		if m.prepullImages {
+			if prepulled, err := m.prepullImage(deployJob); err != nil {
+				// Don't advance the deployment through the job state machine so that no rollback is attempted, since
+				// nothing has been deployed yet.
+				if err = m.updateJobStage(deployJob, job.JobStage_Failed, err); err != nil {
+					log.Printf("processDeployJobs: job update failed: %v, %s", err, manager.PrintJob(deployJob))
+				}
+				return true
+			} else if !prepulled {
+				return true
 			}
 		}
 		m.advanceJob(deployJob)
@@ -338,7 +719,7 @@ func (m *JobManager) processVxAnchorJobs(dequeuedJobs []job.JobState, processV5J
 	numJobs := len(dequeuedAnchors)
 	if !processV5Jobs {
 		for i := 0; i < m.minAnchorJobs-numJobs; i++ {
-			if _, err := m.NewJob(job.JobState{
+			if _, err := m.enqueueJob(job.JobState{
 				Type: job.JobType_Anchor,
 				Params: map[string]interface{}{
 					job.JobParam_Source: manager.ServiceName,
@@ -398,6 +779,155 @@ func (m *JobManager) processWorkflowJobs(dequeuedJobs []job.JobState) bool {
 	return false
 }
 
+func (m *JobManager) processRestartJobs(dequeuedJobs []job.JobState) bool {
+	// Check if there are any non-anchor jobs in progress. Restarts can run in parallel with anchor jobs but not with any
+	// other jobs.
+	if len(m.getActiveNonAnchorJobs()) == 0 {
+		for _, dequeuedJob := range dequeuedJobs {
+			if dequeuedJob.Type == job.JobType_Restart {
+				m.advanceJob(dequeuedJob)
+				return true
+			}
+		}
+	} else {
+		log.Printf("processRestartJobs: other jobs in progress")
+	}
+	return false
+}
+
+func (m *JobManager) processStopTaskJobs(dequeuedJobs []job.JobState) bool {
+	stopsStarted := false
+	for _, dequeuedJob := range dequeuedJobs {
+		if dequeuedJob.Type == job.JobType_StopTask {
+			m.advanceJob(dequeuedJob)
+			stopsStarted = true
+		}
+	}
+	return stopsStarted
+}
+
+func (m *JobManager) processPrepullJobs(dequeuedJobs []job.JobState) bool {
+	prepullsStarted := false
+	for _, dequeuedJob := range dequeuedJobs {
+		if dequeuedJob.Type == job.JobType_Prepull {
+			m.advanceJob(dequeuedJob)
+			prepullsStarted = true
+		}
+	}
+	return prepullsStarted
+}
+
+func (m *JobManager) processReconcileJobs(dequeuedJobs []job.JobState) bool {
+	reconcilesStarted := false
+	// Every manager instance queues the same drift check, so only advance each check once
+	reconcileJobs := make(map[string]bool)
+	for _, dequeuedJob := range dequeuedJobs {
+		if (dequeuedJob.Type == job.JobType_Reconcile) && !reconcileJobs[dequeuedJob.JobId] {
+			reconcileJobs[dequeuedJob.JobId] = true
+			// Skip checks already picked up by another instance. Caching their latest state keeps them from being
+			// returned with the queued jobs again.
+			if latestJob, found, err := m.latestReconcileJob(dequeuedJob.JobId, dequeuedJob.Ts); err != nil {
+				log.Printf("processReconcileJobs: failed to look up drift check: %v, %s", err, manager.PrintJob(dequeuedJob))
+				continue
+			} else if found && (latestJob.Stage != job.JobStage_Queued) {
+				m.cache.WriteJob(latestJob)
+				continue
+			}
+			m.advanceJob(dequeuedJob)
+			reconcilesStarted = true
+		}
+	}
+	return reconcilesStarted
+}
+
+// latestReconcileJob returns the most recent state of a drift check recorded by any manager instance, if the check was
+// queued at or after the specified time.
+func (m *JobManager) latestReconcileJob(jobId string, since time.Time) (job.JobState, bool, error) {
+	var latestJob *job.JobState
+	// Iterate the DB in descending order of timestamp so that the most recent state of the job is found first
+	if err := m.db.IterateByType(job.JobType_Reconcile, false, func(js job.JobState) bool {
+		if js.JobId == jobId {
+			latestJob = &js
+			// Stop iterating, we found the job we were looking for.
+			return false
+		}
+		// Stop iterating once past the time the job was queued
+		return !js.Ts.Before(since)
+	}); err != nil {
+		return job.JobState{}, false, err
+	} else if latestJob == nil {
+		return job.JobState{}, false, nil
+	}
+	return *latestJob, true, nil
+}
+
+// scheduleReconcileJob queues a drift check if a new reconciliation interval has started. The job ID is derived from the
+// start of the interval so that manager instances checking at the same time queue the same job, and a check already
+// queued by another instance isn't queued again.
+func (m *JobManager) scheduleReconcileJob(now time.Time) {
+	if m.reconcileInterval <= 0 {
+		return
+	}
+	intervalStart := now.Truncate(m.reconcileInterval)
+	if !intervalStart.After(m.lastReconcile) {
+		return
+	}
+	jobId := fmt.Sprintf("%s-%d", job.JobType_Reconcile, intervalStart.Unix())
+	if _, found, err := m.latestReconcileJob(jobId, intervalStart); err != nil {
+		log.Printf("scheduleReconcileJob: failed to look up drift check: %s, %v", jobId, err)
+		return
+	} else if found {
+		m.lastReconcile = intervalStart
+		return
+	}
+	components := make([]interface{}, len(m.reconcileComponents))
+	for i, component := range m.reconcileComponents {
+		components[i] = component
+	}
+	if _, err := m.enqueueJob(job.JobState{
+		JobId: jobId,
+		Type:  job.JobType_Reconcile,
+		Params: map[string]interface{}{
+			job.ReconcileJobParam_Components: components,
+			job.JobParam_Source:              manager.ServiceName,
+		},
+	}); err != nil {
+		log.Printf("scheduleReconcileJob: failed to queue drift check: %v", err)
+		return
+	}
+	m.lastReconcile = intervalStart
+}
+
+// prepullImage returns whether the image for a deployment has been pre-pulled successfully. If not already done, a
+// pre-pull job is queued for the deployment. The pre-pull job ID is derived from the deployment job ID so that its
+// status can be looked up in subsequent iterations.
+func (m *JobManager) prepullImage(deployJob job.JobState) (bool, error) {
+	prepullJobId := deployJob.JobId + "-" + string(job.JobType_Prepull)
+	if prepullJob, found := m.cache.JobById(prepullJobId); !found {
+		if _, err := m.enqueueJob(job.JobState{
+			JobId: prepullJobId,
+			Type:  job.JobType_Prepull,
+			Params: map[string]interface{}{
+				job.PrepullJobParam_Component: deployJob.Params[job.DeployJobParam_Component],
+				job.PrepullJobParam_DeployTag: deployJob.Params[job.DeployJobParam_DeployTag],
+				job.PrepullJobParam_Layout:    deployJob.Params[job.DeployJobParam_Layout],
+				job.PrepullJobParam_DeployJob: deployJob.JobId,
+				job.JobParam_Source:           manager.ServiceName,
+			},
+		}); err != nil {
+			// Try again in the next iteration
+			log.Printf("prepullImage: failed to queue pre-pull job: %v, %s", err, manager.PrintJob(deployJob))
+		}
+		return false, nil
+	} else if prepullJob.Stage == job.JobStage_Completed {
+		return true, nil
+	} else if job.IsFinishedJob(prepullJob) {
+		prepullErr, _ := prepullJob.Params[job.JobParam_Error].(string)
+		return false, fmt.Errorf("prepullImage: image pre-pull %s: %s, %s", prepullJob.Stage, prepullJobId, prepullErr)
+	}
+	return false, nil
+}
+
 func (m *JobManager) advanceJob(jobState job.JobState) {
 	m.waitGroup.Add(1)
 	go func() {
@@ -419,17 +949,72 @@ func (m *JobManager) advanceJob(jobState job.JobState) {
 			}
 		}()
 
-		currentJobStage := jobState.Stage
+		// Only advance jobs that no other manager instance is advancing. The lease is kept between advancements, so that
+		// a job sticks with the same instance, until the job is finished or the instance stops renewing it.
+		if acquired, err := m.db.AcquireJobLease(jobState.JobId, m.leaseDuration); err != nil {
+			log.Printf("advanceJob: acquire lease failed: %v, %s", err, manager.PrintJob(jobState))
+			return
+		} else if !acquired {
+			return
+		}
+		stopRenewal := m.renewJobLease(jobState)
+		defer stopRenewal()
+
+		// Pick up requests to cancel or approve a deployment, which can be made through any manager instance
+		if jobState.Type == job.JobType_Deploy {
+			if syncedJobState, err := m.db.SyncJobParams(jobState); err != nil {
+				log.Printf("advanceJob: sync job failed: %v, %s", err, manager.PrintJob(jobState))
+				return
+			} else {
+				jobState = syncedJobState
+			}
+		}
+
+		// Advance a copy of the job state so that the cached state only changes when it's explicitly written below
+		jobState = job.Copy(jobState)
 		if jobSm, err := m.prepareJobSm(jobState); err != nil {
 			log.Printf("advanceJob: job generation failed: %v, %s", err, manager.PrintJob(jobState))
-		} else if newJobState, err := jobSm.Advance(); err != nil {
+		} else if newJobState, result, err := jobSm.Advance(manager.WithTraceContext(m.ctx, jobState)); err != nil {
 			// Advancing should automatically update the cache and database in case of failures
 			log.Printf("advanceJob: job advancement failed: %v, %s", err, manager.PrintJob(jobState))
-		} else if newJobState.Stage != currentJobStage {
+		} else if result.Transitioned {
 			log.Printf("advanceJob: next job state: %s", manager.PrintJob(newJobState))
+			m.recordJob(newJobState)
 			m.postProcessJob(newJobState)
+			// Release the lease of requeued jobs too so that any instance can pick them back up
+			if result.Finished || result.Requeued {
+				if err = m.db.ReleaseJobLease(newJobState.JobId); err != nil {
+					log.Printf("advanceJob: release lease failed: %v, %s", err, manager.PrintJob(newJobState))
+				}
+			}
+		} else if cachedJob, found := m.cache.JobById(newJobState.JobId); found && (cachedJob.Id == newJobState.Id) {
+			// Keep the params of a job that stayed in the same stage, e.g. when its status should next be polled. These
+			// aren't always written to the database, so they're lost if the manager restarts, which is fine.
+			m.cache.WriteJob(newJobState)
+		}
+	}()
+}
+
+// renewJobLease keeps renewing the lease on a job while it's being advanced, since advancing a job can take longer than
+// the lease duration. The returned function stops the renewal.
+func (m *JobManager) renewJobLease(jobState job.JobState) func() {
+	stopCh := make(chan bool)
+	go func() {
+		tick := time.NewTicker(m.leaseDuration / 3)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-tick.C:
+				if err := m.db.RenewJobLease(jobState.JobId, m.leaseDuration); err != nil {
+					// There's no safe way to interrupt the job, so just report that another instance might be advancing it
+					log.Printf("renewJobLease: renew lease failed: %v, %s", err, manager.PrintJob(jobState))
+				}
+			}
 		}
 	}()
+	return func() { close(stopCh) }
 }
 
 func (m *JobManager) postProcessJob(jobState job.JobState) {
@@ -437,10 +1022,14 @@ func (m *JobManager) postProcessJob(jobState job.JobState) {
 	case job.JobType_Deploy:
 		{
 			switch jobState.Stage {
-			// For completed ECS deployments, run smoke tests after 5 minutes to give the services time to stabilize.
-			case job.JobStage_Completed:
+			// For completed ECS deployments (including rollbacks), run smoke tests after 5 minutes to give the services
+			// time to stabilize. Register-only deployments don't change any services, so there's nothing to test.
+			case job.JobStage_Completed, job.JobStage_RolledBack:
 				{
-					if _, err := m.NewJob(job.JobState{
+					if registerOnly, _ := jobState.Params[job.DeployJobParam_RegisterOnly].(bool); registerOnly {
+						break
+					}
+					if _, err := m.enqueueJob(job.JobState{
 						Ts:   time.Now().Add(manager.DefaultWaitTime),
 						Type: job.JobType_TestSmoke,
 						Params: map[string]interface{}{
@@ -449,45 +1038,126 @@ func (m *JobManager) postProcessJob(jobState job.JobState) {
 					}); err != nil {
 						log.Printf("postProcessJob: failed to queue smoke tests after deploy: %v, %s", err, manager.PrintJob(jobState))
 					}
-				}
-			// For failed deployments, rollback to the previously deployed tag.
-			case job.JobStage_Failed:
-				{
-					// Only rollback if this wasn't already a rollback attempt that failed
-					if rollback, _ := jobState.Params[job.DeployJobParam_Rollback].(bool); !rollback {
-						if component, found := jobState.Params[job.DeployJobParam_Component].(string); !found {
-							log.Printf("postProcessJob: missing component (ceramic, ipfs, cas, casv5, rust-ceramic): %s", manager.PrintJob(jobState))
-						} else if deployTags, err := m.db.GetDeployTags(); err != nil { // Get latest deployed tag from database
-							log.Printf("postProcessJob: failed to retrieve deploy tags: %v, %s", err, manager.PrintJob(jobState))
-						} else if deployTag, found := deployTags[manager.DeployComponent(component)]; !found {
-							log.Printf("postProcessJob: missing component build tag: %s, %s", component, manager.PrintJob(jobState))
-						} else if _, err := m.NewJob(job.JobState{
-							Type: job.JobType_Deploy,
+					// If requested, also run the E2E tests against the freshly deployed environment. These take longer
+					// to run than the smoke tests and are thus only run on demand.
+					if testE2e, _ := jobState.Params[job.DeployJobParam_TestE2E].(bool); testE2e {
+						if _, err := m.enqueueJob(job.JobState{
+							Ts:   time.Now().Add(manager.DefaultWaitTime),
+							Type: job.JobType_TestE2E,
 							Params: map[string]interface{}{
-								job.DeployJobParam_Component: jobState.Params[job.DeployJobParam_Component],
-								job.DeployJobParam_Rollback:  true,
-								job.DeployJobParam_Sha:       job.DeployJobTarget_Rollback,
-								job.DeployJobParam_ShaTag:    strings.Split(deployTag, ",")[0], // Strip deploy target
-								// No point in waiting for other jobs to complete before redeploying a working image
-								job.DeployJobParam_Force: true,
-								job.JobParam_Source:      manager.ServiceName,
+								job.JobParam_Source: manager.ServiceName,
 							},
 						}); err != nil {
-							log.Printf("postProcessJob: failed to queue rollback after failed deploy: %v, %s", err, manager.PrintJob(jobState))
+							log.Printf("postProcessJob: failed to queue e2e tests after deploy: %v, %s", err, manager.PrintJob(jobState))
+						}
+					}
+				}
+			// For failed deployments, rollback to the previously deployed tag. Deployments that failed before their
+			// layout was generated (e.g. because no services matched) didn't change anything, so there's nothing to roll
+			// back.
+			case job.JobStage_Failed:
+				{
+					if _, found := jobState.Params[job.DeployJobParam_Layout]; found {
+						m.rollbackDeploy(jobState)
+					}
+				}
+			// Retried deployments start over from scratch, so first restore the services that the failed attempt might
+			// have updated. The retry is dequeued after the rollback since it waits before starting. As with failed
+			// deployments, attempts that failed before their layout was generated didn't change anything.
+			case job.JobStage_Queued:
+				{
+					if _, retried := jobState.Params[job.JobParam_Retries].(float64); retried {
+						if _, found := jobState.Params[job.DeployJobParam_Layout]; found {
+							m.rollbackDeploy(jobState)
 						}
 					}
 				}
+			// For canceled deployments, rollback if requested. Deployments canceled before they were started didn't
+			// change anything, so there's nothing to roll back.
+			case job.JobStage_Canceled:
+				{
+					rollbackOnCancel, _ := jobState.Params[job.DeployJobParam_RollbackOnCancel].(bool)
+					if _, started := jobState.Params[job.JobParam_Start].(float64); started && rollbackOnCancel {
+						m.rollbackDeploy(jobState)
+					}
+				}
 			}
 		}
 	}
 }
 
+// rollbackDeploy queues a deployment of the previously deployed tag for the component of a deployment that didn't
+// complete, along with any other components deployed with it
+func (m *JobManager) rollbackDeploy(jobState job.JobState) {
+	// Only rollback if this wasn't already a rollback attempt that failed
+	if rollback, _ := jobState.Params[job.DeployJobParam_Rollback].(bool); !rollback {
+		if component, found := jobState.Params[job.DeployJobParam_Component].(string); !found {
+			log.Printf("rollbackDeploy: missing component (ceramic, ipfs, cas, casv5, rust-ceramic): %s", manager.PrintJob(jobState))
+		} else if deployTag, err := m.db.GetDeployTag(manager.DeployComponent(component)); err != nil { // Get latest deployed tag from database
+			log.Printf("rollbackDeploy: failed to retrieve deploy tag: %v, %s", err, manager.PrintJob(jobState))
+		} else if len(deployTag) == 0 {
+			log.Printf("rollbackDeploy: missing component build tag: %s, %s", component, manager.PrintJob(jobState))
+		} else {
+			params := map[string]interface{}{
+				job.DeployJobParam_Component: jobState.Params[job.DeployJobParam_Component],
+				job.DeployJobParam_Rollback:  true,
+				job.DeployJobParam_Sha:       job.DeployJobTarget_Rollback,
+				job.DeployJobParam_ShaTag:    deployTag,
+				job.DeployJobParam_Version:   m.deployVersion(manager.DeployComponent(component)),
+				// No point in waiting for other jobs to complete before redeploying a working image
+				job.DeployJobParam_Force: true,
+				job.JobParam_Source:      manager.ServiceName,
+			}
+			// Whoever requested the original deployment should also hear about it if the rollback fails
+			if requester, found := jobState.Params[job.JobParam_Requester]; found {
+				params[job.JobParam_Requester] = requester
+			}
+			if shas := m.rollbackShas(jobState); len(shas) > 0 {
+				params[job.DeployJobParam_Shas] = shas
+			}
+			if _, err = m.enqueueJob(job.JobState{Type: job.JobType_Deploy, Params: params}); err != nil {
+				log.Printf("rollbackDeploy: failed to queue rollback after %s deploy: %v, %s", jobState.Stage, err, manager.PrintJob(jobState))
+			}
+		}
+	}
+}
+
+// rollbackShas returns the previously deployed commit hashes of the other components deployed along with a deployment's
+// component. Components whose previous deployment can't be found are left out so that the rest can still be rolled back.
+func (m *JobManager) rollbackShas(jobState job.JobState) map[string]interface{} {
+	shas, _ := jobState.Params[job.DeployJobParam_Shas].(map[string]interface{})
+	component, _ := jobState.Params[job.DeployJobParam_Component].(string)
+	rollbackShas := make(map[string]interface{}, len(shas))
+	for otherComponent := range shas {
+		if otherComponent == component {
+			continue
+		} else if deployTag, err := m.db.GetDeployTag(manager.DeployComponent(otherComponent)); err != nil {
+			log.Printf("rollbackShas: failed to retrieve deploy tag: %s, %v, %s", otherComponent, err, manager.PrintJob(jobState))
+		} else if !manager.IsValidSha(deployTag) {
+			log.Printf("rollbackShas: missing component deploy tag: %s, %s, %s", otherComponent, deployTag, manager.PrintJob(jobState))
+		} else {
+			rollbackShas[otherComponent] = deployTag
+		}
+	}
+	return rollbackShas
+}
+
+// deployVersion returns the release label of the tag deployed for a component, if any
+func (m *JobManager) deployVersion(component manager.DeployComponent) string {
+	if deployVersions, err := m.db.GetDeployVersions(); err != nil {
+		log.Printf("deployVersion: failed to retrieve deploy versions: %s, %v", component, err)
+		return ""
+	} else {
+		return deployVersions[component]
+	}
+}
+
 func (m *JobManager) prepareJobSm(jobState job.JobState) (manager.JobSm, error) {
 	var jobSm manager.JobSm
 	var err error = nil
 	switch jobState.Type {
 	case job.JobType_Deploy:
-		jobSm, err = jobs.DeployJob(jobState, m.db, m.notifs, m.d, m.repo)
+		jobSm, err = jobs.DeployJob(jobState, m.db, m.notifs, m.d, m.repo, manager.SystemClock{}, m.deployWindows)
 	case job.JobType_Anchor:
 		jobSm = jobs.AnchorJob(jobState, m.db, m.notifs, m.d)
 	case job.JobType_TestE2E:
@@ -496,6 +1166,14 @@ func (m *JobManager) prepareJobSm(jobState job.JobState) (manager.JobSm, error)
 		jobSm = jobs.SmokeTestJob(jobState, m.db, m.notifs, m.d)
 	case job.JobType_Workflow:
 		jobSm, err = jobs.GitHubWorkflowJob(jobState, m.db, m.notifs, m.repo)
+	case job.JobType_Restart:
+		jobSm, err = jobs.RestartJob(jobState, m.db, m.notifs, m.d)
+	case job.JobType_StopTask:
+		jobSm, err = jobs.StopTaskJob(jobState, m.db, m.notifs, m.d)
+	case job.JobType_Prepull:
+		jobSm, err = jobs.PrepullJob(jobState, m.db, m.notifs, m.d)
+	case job.JobType_Reconcile:
+		jobSm, err = jobs.ReconcileJob(jobState, m.db, m.notifs, m.d)
 	default:
 		err = fmt.Errorf("prepareJobSm: unknown job type: %s", manager.PrintJob(jobState))
 	}
@@ -507,16 +1185,40 @@ func (m *JobManager) prepareJobSm(jobState job.JobState) (manager.JobSm, error)
 	return jobSm, err
 }
 
+// updateJobStage moves a job to a new stage outside the job's state machine. The job's lease is taken first so that the
+// update can't race another instance advancing the same job.
 func (m *JobManager) updateJobStage(jobState job.JobState, jobStage job.JobStage, e error) error {
-	_, err := manager.AdvanceJob(jobState, jobStage, time.Now(), e, m.db, m.notifs)
+	if acquired, err := m.db.AcquireJobLease(jobState.JobId, m.leaseDuration); err != nil {
+		return err
+	} else if !acquired {
+		return fmt.Errorf("updateJobStage: %w: %s", manager.Error_LeaseLost, manager.PrintJob(jobState))
+	}
+	newJobState, _, err := manager.AdvanceJob(jobState, jobStage, time.Now(), e, m.db, m.notifs)
+	if err == nil {
+		m.recordJob(newJobState)
+		if job.IsFinishedJob(newJobState) {
+			if err = m.db.ReleaseJobLease(newJobState.JobId); err != nil {
+				// The lease will expire on its own, so there's no need to fail the update
+				log.Printf("updateJobStage: release lease failed: %v, %s", err, manager.PrintJob(newJobState))
+			}
+		}
+		return nil
+	}
 	return err
 }
 
+func (m *JobManager) recordJob(jobState job.JobState) {
+	if m.metrics != nil {
+		m.metrics.RecordJob(jobState)
+	}
+}
+
 func (m *JobManager) getActiveDeploys() []job.JobState {
 	return m.cache.JobsByMatcher(func(js job.JobState) bool {
-		// We have active deployments if there are any deploy jobs in progress, or workflow jobs with a "deploy" label.
+		// We have active deployments if there are any deploy or restart jobs in progress, or workflow jobs with a
+		// "deploy" label.
 		if job.IsActiveJob(js) {
-			if js.Type == job.JobType_Deploy {
+			if (js.Type == job.JobType_Deploy) || (js.Type == job.JobType_Restart) {
 				return true
 			} else if js.Type == job.JobType_Workflow {
 				if workflow, err := job.CreateWorkflowJob(js); err == nil {
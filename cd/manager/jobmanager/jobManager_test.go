@@ -0,0 +1,166 @@
+package jobmanager
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+// fakeDb returns the deploy tags of components, and records queued jobs. Only the methods used by the tests are
+// implemented.
+type fakeDb struct {
+	manager.Database
+	deployTags map[manager.DeployComponent]string
+	queued     map[string]job.JobState
+}
+
+func (db fakeDb) EnqueueJob(jobState job.JobState, _ int) error {
+	db.queued[jobState.JobId] = jobState
+	return nil
+}
+
+func (db fakeDb) GetDeployTag(component manager.DeployComponent) (string, error) {
+	if deployTag, found := db.deployTags[component]; found {
+		return deployTag, nil
+	}
+	return "", fmt.Errorf("deploy tag not found: %s", component)
+}
+
+func TestRollbackShas(t *testing.T) {
+	const prevIpfsSha = "0123456789abcdef0123456789abcdef01234567"
+	const newIpfsSha = "89abcdef0123456789abcdef0123456789abcdef"
+	m := &JobManager{db: fakeDb{deployTags: map[manager.DeployComponent]string{
+		manager.DeployComponent_Ceramic: "fedcba9876543210fedcba9876543210fedcba98",
+		manager.DeployComponent_Ipfs:    prevIpfsSha,
+		manager.DeployComponent_Cas:     "",
+	}}}
+	tests := []struct {
+		name string
+		shas map[string]interface{}
+		want map[string]interface{}
+	}{
+		{name: "no companions", want: map[string]interface{}{}},
+		{
+			name: "companion",
+			shas: map[string]interface{}{string(manager.DeployComponent_Ipfs): newIpfsSha},
+			want: map[string]interface{}{string(manager.DeployComponent_Ipfs): prevIpfsSha},
+		},
+		{
+			name: "component itself",
+			shas: map[string]interface{}{
+				string(manager.DeployComponent_Ceramic): "fedcba9876543210fedcba9876543210fedcba98",
+				string(manager.DeployComponent_Ipfs):    newIpfsSha,
+			},
+			want: map[string]interface{}{string(manager.DeployComponent_Ipfs): prevIpfsSha},
+		},
+		{
+			name: "companion never deployed",
+			shas: map[string]interface{}{
+				string(manager.DeployComponent_Cas):         newIpfsSha,
+				string(manager.DeployComponent_RustCeramic): newIpfsSha,
+				string(manager.DeployComponent_Ipfs):        newIpfsSha,
+			},
+			want: map[string]interface{}{string(manager.DeployComponent_Ipfs): prevIpfsSha},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := map[string]interface{}{job.DeployJobParam_Component: string(manager.DeployComponent_Ceramic)}
+			if test.shas != nil {
+				params[job.DeployJobParam_Shas] = test.shas
+			}
+			shas := m.rollbackShas(job.JobState{JobId: "deploy", Type: job.JobType_Deploy, Params: params})
+			if fmt.Sprint(shas) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", shas, test.want)
+			}
+		})
+	}
+}
+
+func TestNewJobManagerDrainTime(t *testing.T) {
+	tests := []struct {
+		value     string
+		drainTime time.Duration
+		err       bool
+	}{
+		{value: "10s", drainTime: 10 * time.Second},
+		{value: "0s", err: true},
+		{value: "-5s", err: true},
+		{value: "ten seconds", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("SHUTDOWN_DRAIN_TIME", test.value)
+			m, err := NewJobManager(nil, nil, nil, nil, nil, nil, nil)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			} else if (err == nil) && (m.(*JobManager).drainTime != test.drainTime) {
+				t.Errorf("got %s, want %s", m.(*JobManager).drainTime, test.drainTime)
+			}
+		})
+	}
+}
+
+func TestNewJobManagerPrepullImages(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		prepullImages bool
+		err           bool
+	}{
+		{name: "default", prepullImages: false},
+		{name: "enabled", value: "true", prepullImages: true},
+		{name: "malformed", value: "ture", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("PREPULL_IMAGES", test.value)
+			m, err := NewJobManager(nil, nil, nil, nil, nil, nil, nil)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			} else if (err == nil) && (m.(*JobManager).prepullImages != test.prepullImages) {
+				t.Errorf("got %v, want %v", m.(*JobManager).prepullImages, test.prepullImages)
+			}
+		})
+	}
+}
+
+func TestNewJobShuttingDown(t *testing.T) {
+	db := fakeDb{queued: make(map[string]job.JobState)}
+	m := &JobManager{db: db, shuttingDown: new(atomic.Bool)}
+	m.shuttingDown.Store(true)
+	// Requested jobs are rejected during shutdown, but jobs created by the manager itself are still queued
+	if _, err := m.NewJob(job.JobState{JobId: "requested", Type: job.JobType_Deploy}); !errors.Is(err, manager.Error_ShuttingDown) {
+		t.Errorf("got error %v, want %v", err, manager.Error_ShuttingDown)
+	}
+	if _, err := m.enqueueJob(job.JobState{JobId: "rollback", Type: job.JobType_Deploy}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, found := db.queued["requested"]; found {
+		t.Error("requested job queued during shutdown")
+	}
+	if jobState, found := db.queued["rollback"]; !found || (jobState.Stage != job.JobStage_Queued) {
+		t.Errorf("internal job not queued during shutdown: %+v", jobState)
+	}
+}
+
+func TestNewJobReservedParams(t *testing.T) {
+	for _, param := range reservedJobParams {
+		t.Run(param, func(t *testing.T) {
+			db := fakeDb{queued: make(map[string]job.JobState)}
+			m := &JobManager{db: db, shuttingDown: new(atomic.Bool)}
+			jobState := job.JobState{JobId: "requested", Type: job.JobType_Deploy, Params: map[string]interface{}{param: "someone"}}
+			if _, err := m.NewJob(jobState); !errors.Is(err, manager.Error_ReservedParam) {
+				t.Errorf("got error %v, want %v", err, manager.Error_ReservedParam)
+			}
+			if _, found := db.queued["requested"]; found {
+				t.Error("job with reserved parameter queued")
+			}
+		})
+	}
+}
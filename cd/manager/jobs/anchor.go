@@ -1,10 +1,13 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
+
 	"github.com/3box/pipeline-tools/cd/manager"
 	"github.com/3box/pipeline-tools/cd/manager/common/job"
 )
@@ -24,7 +27,7 @@ func AnchorJob(jobState job.JobState, db manager.Database, notifs manager.Notifs
 	return &anchorJob{baseJob{jobState, db, notifs}, os.Getenv(manager.EnvVar_Env), d}
 }
 
-func (a anchorJob) Advance() (job.JobState, error) {
+func (a anchorJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
 	now := time.Now()
 	switch a.state.Stage {
 	case job.JobStage_Queued:
@@ -37,7 +40,7 @@ func (a anchorJob) Advance() (job.JobState, error) {
 		}
 	case job.JobStage_Dequeued:
 		{
-			if taskId, err := a.launchWorker(); err != nil {
+			if taskId, err := a.launchWorker(ctx); err != nil {
 				return a.advance(job.JobStage_Failed, now, err)
 			} else {
 				// Record the worker task identifier and its start time
@@ -48,18 +51,18 @@ func (a anchorJob) Advance() (job.JobState, error) {
 		}
 	case job.JobStage_Started:
 		{
-			if started, err := a.checkWorker(true); err != nil {
+			if started, err := a.checkWorker(ctx, true); err != nil {
 				return a.advance(job.JobStage_Failed, now, err)
 			} else if started {
 				return a.advance(job.JobStage_Waiting, now, nil)
 			} else {
 				// Return so we come back again to check
-				return a.state, nil
+				return a.state, manager.AdvanceResult{}, nil
 			}
 		}
 	case job.JobStage_Waiting:
 		{
-			if stopped, err := a.checkWorker(false); err != nil {
+			if stopped, err := a.checkWorker(ctx, false); err != nil {
 				return a.advance(job.JobStage_Failed, now, err)
 			} else if stopped {
 				return a.advance(job.JobStage_Completed, now, nil)
@@ -73,7 +76,7 @@ func (a anchorJob) Advance() (job.JobState, error) {
 				return a.advance(job.JobStage_Waiting, now, nil)
 			} else {
 				// Return so we come back again to check
-				return a.state, nil
+				return a.state, manager.AdvanceResult{}, nil
 			}
 		}
 	default:
@@ -83,7 +86,7 @@ func (a anchorJob) Advance() (job.JobState, error) {
 	}
 }
 
-func (a anchorJob) launchWorker() (string, error) {
+func (a anchorJob) launchWorker(ctx context.Context) (string, error) {
 	var overrides map[string]string = nil
 	// Check if this is a CASv5 anchor job
 	if manager.IsV5WorkerJob(a.state) {
@@ -94,22 +97,87 @@ func (a anchorJob) launchWorker() (string, error) {
 			}
 		}
 	}
-	if taskId, err := a.d.LaunchTask(
-		"ceramic-"+a.env+"-cas",
-		"ceramic-"+a.env+"-cas-anchor",
-		"cas_anchor",
-		"/ceramic-"+a.env+"-cas/anchor_network_configuration",
-		overrides); err != nil {
+	// Environment overrides can also be read from a tree of SSM parameters, e.g. "/ceramic/dev/anchor"
+	overridesPath := os.Getenv("CAS_ANCHOR_OVERRIDES_PATH")
+	if parsedOverridesPath, found := a.state.Params[job.AnchorJobParam_OverridesPath].(string); found {
+		overridesPath = parsedOverridesPath
+	}
+	// The command, if specified, replaces the worker's default command, e.g. to run a one-off migration sub-command
+	var command []string = nil
+	if parsedCommand, found := a.state.Params[job.AnchorJobParam_Command].([]interface{}); found {
+		command = make([]string, len(parsedCommand))
+		for i, arg := range parsedCommand {
+			if argStr, ok := arg.(string); !ok {
+				return "", fmt.Errorf("anchorJob: invalid command argument: %v", arg)
+			} else {
+				command[i] = argStr
+			}
+		}
+	}
+	// Secrets are passed as a map of environment variable names to SSM parameter or Secrets Manager secret ARNs
+	var secrets map[string]manager.SecretRef = nil
+	if parsedSecrets, found := a.state.Params[job.AnchorJobParam_Secrets].(map[string]interface{}); found {
+		secrets = make(map[string]manager.SecretRef, len(parsedSecrets))
+		for k, v := range parsedSecrets {
+			if valueFrom, ok := v.(string); !ok {
+				return "", fmt.Errorf("anchorJob: invalid secret reference: %s", k)
+			} else {
+				secrets[k] = manager.SecretRef{ValueFrom: valueFrom}
+			}
+		}
+	}
+	// An explicit network configuration can be used to run the worker in a specific subnet or security group
+	var networkConfig *manager.NetworkConfig = nil
+	if parsedNetworkConfig, found := a.state.Params[job.AnchorJobParam_Network].(map[string]interface{}); found {
+		networkConfig = new(manager.NetworkConfig)
+		if err := mapstructure.Decode(parsedNetworkConfig, networkConfig); err != nil {
+			return "", fmt.Errorf("anchorJob: invalid network configuration: %w", err)
+		}
+	}
+	casCluster := manager.GetEnvClusters(a.env).Cas
+	// Otherwise, the network configuration is read from SSM. Additional parameters can be merged into the default one,
+	// e.g. to add a security group for a specific workload.
+	vpcConfigParams := []string{"/" + casCluster + "/anchor_network_configuration"}
+	if parsedNetworkParams, found := a.state.Params[job.AnchorJobParam_NetworkParams].([]interface{}); found {
+		for _, networkParam := range parsedNetworkParams {
+			if networkParamStr, ok := networkParam.(string); !ok || (len(networkParamStr) == 0) {
+				return "", fmt.Errorf("anchorJob: invalid network parameter: %v", networkParam)
+			} else {
+				vpcConfigParams = append(vpcConfigParams, networkParamStr)
+			}
+		}
+	}
+	// Anchor workers can be interrupted, so they can be run with a cheaper capacity provider, e.g. Fargate Spot
+	capacityProvider := os.Getenv("CAS_ANCHOR_CAPACITY_PROVIDER")
+	if parsedCapacityProvider, found := a.state.Params[job.AnchorJobParam_CapacityProvider].(string); found {
+		capacityProvider = parsedCapacityProvider
+	}
+	if taskId, err := a.d.LaunchTask(ctx, casCluster, casCluster+"-anchor", "cas_anchor", manager.LaunchOptions{
+		JobId:            a.state.JobId,
+		RequestedBy:      a.requestedBy(),
+		Overrides:        overrides,
+		OverridesPath:    overridesPath,
+		Command:          command,
+		Secrets:          secrets,
+		VpcConfigParams:  vpcConfigParams,
+		NetworkConfig:    networkConfig,
+		CapacityProvider: capacityProvider,
+	}); err != nil {
 		return "", err
 	} else {
+		a.recordLaunchedTask(taskId, overrides)
 		return taskId, nil
 	}
 }
 
-func (a anchorJob) checkWorker(expectedToBeRunning bool) (bool, error) {
-	if status, exitCode, err := a.d.CheckTask("ceramic-"+a.env+"-cas", "", expectedToBeRunning, false, a.state.Params[job.JobParam_Id].(string)); err != nil {
+func (a anchorJob) checkWorker(ctx context.Context, expectedToBeRunning bool) (bool, error) {
+	if status, exitCode, err := a.d.CheckTask(ctx, manager.GetEnvClusters(a.env).Cas, "", expectedToBeRunning, false, a.state.Params[job.JobParam_Id].(string)); err != nil {
 		return false, err
 	} else if status {
+		// Record the worker's exit code so that it's available in the job's history and notifications
+		if exitCode != nil {
+			a.state.Params[job.AnchorJobParam_ExitCode] = float64(*exitCode)
+		}
 		// If a non-zero exit code was present, the worker failed to complete successfully.
 		if (exitCode != nil) && (*exitCode != 0) {
 			return false, fmt.Errorf("anchorJob: worker exited with code %d", *exitCode)
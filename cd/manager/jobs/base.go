@@ -1,18 +1,78 @@
 package jobs
 
 import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
 	"time"
 
 	"github.com/3box/pipeline-tools/cd/manager"
 	"github.com/3box/pipeline-tools/cd/manager/common/job"
 )
 
+// Polling for the status of long-running operations starts at every tick, then backs off to a fraction of the time
+// elapsed since the operation started, up to a maximum interval. A random fraction of the interval is added to each
+// check so that jobs started around the same time don't keep polling AWS in lockstep.
+const (
+	minPollInterval   = manager.DefaultTick
+	maxPollInterval   = 2 * time.Minute
+	pollBackoffFactor = 5
+	pollJitterFactor  = 4 // Up to 1/4th of the interval
+)
+
 type baseJob struct {
 	state  job.JobState
 	db     manager.Database
 	notifs manager.Notifs
 }
 
-func (b baseJob) advance(jobStage job.JobStage, ts time.Time, err error) (job.JobState, error) {
+func (b baseJob) advance(jobStage job.JobStage, ts time.Time, err error) (job.JobState, manager.AdvanceResult, error) {
+	// Don't move the job to a new stage if it was interrupted because the job manager is shutting down. The job will
+	// resume from its current stage once the job manager restarts.
+	if errors.Is(err, context.Canceled) {
+		return b.state, manager.AdvanceResult{}, err
+	}
 	return manager.AdvanceJob(b.state, jobStage, ts, err, b.db, b.notifs)
 }
+
+// pollDue returns whether it's time to check the status of a long-running operation again. The time of the next check is
+// stored in the job parameters of the returned job state. This isn't written to the database, but the job manager
+// writes the returned state to its cache so it's retained across job advancements. If the job manager restarts, the
+// next check will just be made immediately.
+func (b baseJob) pollDue(now time.Time) bool {
+	if nextPoll, found := b.state.Params[job.JobParam_NextPoll].(float64); found && now.Before(time.Unix(0, int64(nextPoll))) {
+		return false
+	}
+	pollInterval := now.Sub(job.StartTime(b.state)) / pollBackoffFactor
+	if pollInterval < minPollInterval {
+		pollInterval = minPollInterval
+	} else if pollInterval > maxPollInterval {
+		pollInterval = maxPollInterval
+	}
+	pollInterval += time.Duration(rand.Int63n(int64(pollInterval/pollJitterFactor) + 1))
+	b.state.Params[job.JobParam_NextPoll] = float64(now.Add(pollInterval).UnixNano())
+	return true
+}
+
+// requestedBy returns the user who requested the job, e.g. so that tasks launched by the job can be traced back to them.
+// Jobs that weren't requested by a user, e.g. those scheduled by the manager itself, report their source instead.
+func (b baseJob) requestedBy() string {
+	if requester, _ := b.state.Params[job.JobParam_Requester].(string); len(requester) > 0 {
+		return requester
+	}
+	source, _ := b.state.Params[job.JobParam_Source].(string)
+	return source
+}
+
+func (b baseJob) recordLaunchedTask(taskArn string, overrides map[string]string) {
+	if err := b.db.WriteLaunchedTask(manager.LaunchedTask{
+		JobId:     b.state.JobId,
+		TaskArn:   taskArn,
+		Ts:        time.Now(),
+		Overrides: overrides,
+	}); err != nil {
+		// This isn't an error big enough to fail the job, just report and move on.
+		log.Printf("recordLaunchedTask: failed to record launched task: %s, %v, %s", taskArn, err, manager.PrintJob(b.state))
+	}
+}
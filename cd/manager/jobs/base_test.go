@@ -0,0 +1,36 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+func TestRequestedBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      map[string]interface{}
+		requestedBy string
+	}{
+		{name: "none"},
+		{
+			name:        "user",
+			params:      map[string]interface{}{job.JobParam_Requester: "123456789012345678", job.JobParam_Source: "discord"},
+			requestedBy: "123456789012345678",
+		},
+		{
+			name:        "scheduled",
+			params:      map[string]interface{}{job.JobParam_Source: manager.ServiceName},
+			requestedBy: manager.ServiceName,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := baseJob{state: job.JobState{Params: test.params}}
+			if requestedBy := b.requestedBy(); requestedBy != test.requestedBy {
+				t.Errorf("got %q, want %q", requestedBy, test.requestedBy)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+var _ manager.Clock = &fakeClock{}
+
+// fakeClock only moves when told to, so that time-based job transitions can be exercised without waiting
+type fakeClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward by the specified duration
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
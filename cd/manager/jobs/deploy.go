@@ -1,14 +1,15 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/exp/slices"
-
 	"github.com/3box/pipeline-tools/cd/manager"
 	"github.com/3box/pipeline-tools/cd/manager/common/job"
 )
@@ -21,12 +22,38 @@ type deployJob struct {
 	sha       string
 	shaTag    string
 	deployTag string
+	version   string // Optional release label, e.g. "v2.14.0"
 	manual    bool
 	rollback  bool
 	force     bool
 	env       string
 	d         manager.Deployment
 	repo      manager.Repository
+	// Number of task definition revisions to keep for each task family after a deployment. Pruning is disabled if 0.
+	keepTaskDefs int
+	// Time for which a deployment waits for approval before it's canceled
+	approvalWindow time.Duration
+	// Percentages of the desired count that services are deployed to in stages, e.g. [10, 50, 100]. Services are
+	// deployed all at once if empty.
+	rolloutSteps []int
+	// Earlier task definition revision to revert services to, instead of registering new task definitions
+	revision string
+	// Commit hashes of other components to deploy along with this one, e.g. for coordinated deployments from a monorepo
+	shas map[manager.DeployComponent]string
+	// Only register new task definitions for the component's services, without updating the services
+	registerOnly bool
+	// Register-only deployment whose task definitions the services are promoted to, instead of registering new ones
+	promoteJob string
+	// Service alias or fully-qualified service name to limit the deployment to (see serviceAliases)
+	target string
+	// Windows outside which prod deployments aren't allowed to start
+	windows *DeployWindows
+	// Emergency deployments bypass the deploy windows
+	emergency bool
+	clock     manager.Clock
+	// Runner to launch before the services are updated (e.g. a schema migration), with the deployment only proceeding
+	// once it has exited successfully
+	preDeployTask string
 }
 
 const (
@@ -36,100 +63,190 @@ const (
 	envBranch_Prod string = "main"
 )
 
-const (
-	serviceSuffix_CeramicNode  string = "node"
-	serviceSuffix_IpfsNode     string = "ipfs-nd"
-	serviceSuffix_CasApi       string = "api"
-	serviceSuffix_CasWorker    string = "anchor"
-	serviceSuffix_CasScheduler string = "scheduler"
-	serviceSuffix_Elp          string = "elp"
-)
+const defaultFailureTime = 30 * time.Minute
 
-const (
-	containerName_CeramicNode    string = "ceramic_node"
-	containerName_IpfsNode       string = "go-ipfs"
-	containerName_CasApi         string = "cas_api"
-	containerName_CasWorker      string = "cas_anchor"
-	containerName_CasV5Scheduler string = "scheduler"
-	containerName_RustCeramic    string = "rust-ceramic"
-)
+const defaultKeepTaskDefs = 10
 
-const defaultFailureTime = 30 * time.Minute
+const defaultApprovalWindow = 12 * time.Hour
+
+// ParseKeepTaskDefs returns the number of task definition revisions to keep per family when pruning after a deployment,
+// from KEEP_TASK_DEFS. Zero disables pruning.
+func ParseKeepTaskDefs() (int, error) {
+	if configKeepTaskDefs, found := os.LookupEnv("KEEP_TASK_DEFS"); !found {
+		return defaultKeepTaskDefs, nil
+	} else if keepTaskDefs, err := strconv.Atoi(configKeepTaskDefs); (err != nil) || (keepTaskDefs < 0) {
+		return 0, fmt.Errorf("deployJob: invalid number of task definitions to keep: %s", configKeepTaskDefs)
+	} else {
+		return keepTaskDefs, nil
+	}
+}
+
+// ParseApprovalWindow returns the time for which prod deployments wait for approval before they're canceled, from
+// DEPLOY_APPROVAL_WINDOW.
+func ParseApprovalWindow() (time.Duration, error) {
+	if configApprovalWindow, found := os.LookupEnv("DEPLOY_APPROVAL_WINDOW"); !found {
+		return defaultApprovalWindow, nil
+	} else if approvalWindow, err := time.ParseDuration(configApprovalWindow); (err != nil) || (approvalWindow <= 0) {
+		return 0, fmt.Errorf("deployJob: invalid approval window: %s", configApprovalWindow)
+	} else {
+		return approvalWindow, nil
+	}
+}
 
-func DeployJob(jobState job.JobState, db manager.Database, notifs manager.Notifs, d manager.Deployment, repo manager.Repository) (manager.JobSm, error) {
+func DeployJob(jobState job.JobState, db manager.Database, notifs manager.Notifs, d manager.Deployment, repo manager.Repository, clock manager.Clock, windows *DeployWindows) (manager.JobSm, error) {
 	if component, found := jobState.Params[job.DeployJobParam_Component].(string); !found {
 		return nil, fmt.Errorf("deployJob: missing component (ceramic, ipfs, cas, casv5, rust-ceramic)")
 	} else if sha, found := jobState.Params[job.DeployJobParam_Sha].(string); !found {
 		return nil, fmt.Errorf("deployJob: missing target")
 	} else if shaTag, found := jobState.Params[job.DeployJobParam_ShaTag].(string); !found {
 		return nil, fmt.Errorf("deployJob: missing tag")
+	} else if rolloutSteps, err := parseRolloutSteps(jobState.Params); err != nil {
+		return nil, err
+	} else if shas, err := parseShas(jobState.Params, manager.DeployComponent(component), sha); err != nil {
+		return nil, err
+	} else if preDeployTask, _ := jobState.Params[job.DeployJobParam_PreDeployTask].(string); (len(preDeployTask) > 0) && ((jobState.Params[job.DeployJobParam_Revision] != nil) || (jobState.Params[job.DeployJobParam_RegisterOnly] == true)) {
+		// Reverted and register-only deployments only include services, so there's no runner to launch
+		return nil, fmt.Errorf("deployJob: pre-deploy task not supported for reverted or register-only deployments: %s", preDeployTask)
 	} else {
 		deployTag, _ := jobState.Params[job.DeployJobParam_DeployTag].(string)
+		version, _ := jobState.Params[job.DeployJobParam_Version].(string)
 		manual, _ := jobState.Params[job.DeployJobParam_Manual].(bool)
 		rollback, _ := jobState.Params[job.DeployJobParam_Rollback].(bool)
 		force, _ := jobState.Params[job.DeployJobParam_Force].(bool)
-		return &deployJob{baseJob{jobState, db, notifs}, manager.DeployComponent(component), sha, shaTag, deployTag, manual, rollback, force, os.Getenv(manager.EnvVar_Env), d, repo}, nil
+		revision, _ := jobState.Params[job.DeployJobParam_Revision].(string)
+		registerOnly, _ := jobState.Params[job.DeployJobParam_RegisterOnly].(bool)
+		promoteJob, _ := jobState.Params[job.DeployJobParam_PromoteJob].(string)
+		target, _ := jobState.Params[job.DeployJobParam_Target].(string)
+		emergency, _ := jobState.Params[job.DeployJobParam_Emergency].(bool)
+		keepTaskDefs, err := ParseKeepTaskDefs()
+		if err != nil {
+			return nil, err
+		}
+		approvalWindow, err := ParseApprovalWindow()
+		if err != nil {
+			return nil, err
+		}
+		return &deployJob{baseJob{jobState, db, notifs}, manager.DeployComponent(component), sha, shaTag, deployTag, version, manual, rollback, force, os.Getenv(manager.EnvVar_Env), d, repo, keepTaskDefs, approvalWindow, rolloutSteps, revision, shas, registerOnly, promoteJob, target, windows, emergency, clock, preDeployTask}, nil
 	}
 }
 
-func (d deployJob) Advance() (job.JobState, error) {
-	now := time.Now()
+func (d deployJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
+	now := d.clock.Now()
+	// Honor cancellation requests before doing anything else. The job manager takes care of rolling back canceled
+	// deployments, if requested.
+	if canceledBy, _ := d.state.Params[job.JobParam_CanceledBy].(string); len(canceledBy) > 0 {
+		// Don't leave the pre-deploy task running for a deployment that won't happen
+		if d.state.Stage == job.JobStage_Waiting {
+			d.stopPreDeployTask(ctx, "deployment canceled")
+		}
+		return d.advance(job.JobStage_Canceled, now, nil)
+	}
 	switch d.state.Stage {
 	case job.JobStage_Queued:
 		{
-			if deployTags, err := d.db.GetDeployTags(); err != nil {
-				return d.advance(job.JobStage_Failed, now, err)
-			} else if err = d.prepareJob(); err != nil {
-				return d.advance(job.JobStage_Failed, now, err)
-			} else if deployTag, found := d.state.Params[job.DeployJobParam_DeployTag].(string); found &&
-				!d.manual && !d.force &&
-				(deployTag == strings.Split(deployTags[d.component], ",")[0]) {
-				// Skip automated jobs if the tag being deployed is the same as the tag already deployed. We don't do
-				// this for manual jobs because deploying an already deployed tag might be intentional, or for force
-				// deploys/rollbacks because we WANT to push through such deployments.
-				//
-				// Rollbacks are also force deploys, so we don't need to check for the former explicitly since we're
-				// already checking for force deploys.
-				return d.advance(job.JobStage_Skipped, now, nil)
-			} else if envLayout, err := d.generateEnvLayout(d.component); err != nil {
-				return d.advance(job.JobStage_Failed, now, err)
+			// Reject deployments submitted outside the deploy windows. Cancel instead of failing the deployment so that
+			// no rollback is attempted, since nothing was deployed.
+			if err := d.checkDeployWindows(now); err != nil {
+				return d.advance(job.JobStage_Canceled, now, err)
+			}
+			if d.requiresApproval() {
+				return d.advance(job.JobStage_WaitingApproval, now, nil)
+			}
+			// Advance the timestamp by a tiny amount so that the "dequeued" event remains at the same position on the
+			// timeline as the "queued" event but still ahead of it.
+			return d.dequeue(ctx, now, d.state.Ts.Add(time.Nanosecond))
+		}
+	case job.JobStage_WaitingApproval:
+		{
+			if approvedBy, _ := d.state.Params[job.DeployJobParam_ApprovedBy].(string); len(approvedBy) > 0 {
+				// Deployments approved after the deploy window closed wait for the next window to open
+				if d.checkDeployWindows(now) != nil {
+					return d.state, manager.AdvanceResult{}, nil
+				}
+				return d.dequeue(ctx, now, now)
+			} else if now.After(d.state.Ts.Add(d.approvalWindow)) {
+				// Cancel instead of failing the deployment so that no rollback is attempted, since nothing was deployed.
+				return d.advance(job.JobStage_Canceled, now, manager.Error_ApprovalExpired)
 			} else {
-				d.state.Params[job.DeployJobParam_Layout] = *envLayout
-				// Advance the timestamp by a tiny amount so that the "dequeued" event remains at the same position on
-				// the timeline as the "queued" event but still ahead of it.
-				return d.advance(job.JobStage_Dequeued, d.state.Ts.Add(time.Nanosecond), nil)
+				// Return so we come back again to check
+				return d.state, manager.AdvanceResult{}, nil
 			}
 		}
 	case job.JobStage_Dequeued:
 		{
-			if err := d.updateEnv(); err != nil {
+			// Run the pre-deploy task, if any, before touching the services
+			if len(d.preDeployTask) > 0 {
+				if err := d.launchPreDeployTask(ctx); err != nil {
+					return d.advance(job.JobStage_Failed, now, err)
+				}
+				return d.advance(job.JobStage_Waiting, now, nil)
+			}
+			return d.start(ctx, now)
+		}
+	case job.JobStage_Waiting:
+		{
+			if !d.pollDue(now) {
+				// Return so we come back again to check
+				return d.state, manager.AdvanceResult{}, nil
+			} else if completed, err := d.checkPreDeployTask(ctx); err != nil {
+				// Nothing was deployed yet, so the deployment won't be rolled back
 				return d.advance(job.JobStage_Failed, now, err)
-			} else {
-				d.state.Params[job.JobParam_Start] = float64(time.Now().UnixNano())
-				// For started deployments update the build tag in the DB
-				if err = d.db.UpdateBuildTag(d.component, d.deployTag); err != nil {
-					// This isn't an error big enough to fail the job, just report and move on.
-					log.Printf("deployJob: failed to update build tag: %v, %s", err, manager.PrintJob(d.state))
+			} else if completed {
+				// Take the runner out of the layout so that it isn't launched again when the environment is updated
+				if err = d.removePreDeployRunner(); err != nil {
+					return d.advance(job.JobStage_Failed, now, err)
 				}
-				return d.advance(job.JobStage_Started, now, nil)
+				return d.start(ctx, now)
+			} else if job.IsTimedOutAt(d.state, defaultFailureTime, now) {
+				d.stopPreDeployTask(ctx, "pre-deploy task timed out")
+				return d.advance(job.JobStage_Failed, now, fmt.Errorf("deployJob: %w: %s", manager.Error_CompletionTimeout, d.preDeployTask))
+			} else {
+				// Return so we come back again to check
+				return d.state, manager.AdvanceResult{}, nil
 			}
 		}
 	case job.JobStage_Started:
 		{
-			if deployed, err := d.checkEnv(); err != nil {
+			// A deployment resumed after a restart picks up from here, i.e. the environment isn't updated again and
+			// the task definitions recorded in the layout are checked.
+			if !d.pollDue(now) {
+				// Return so we come back again to check
+				return d.state, manager.AdvanceResult{}, nil
+			}
+			// Only notify about service events seen during this check
+			delete(d.state.Params, job.DeployJobParam_ServiceEvents)
+			if deployed, err := d.checkEnv(ctx); err != nil {
 				return d.advance(job.JobStage_Failed, now, err)
+			} else if step, staged := d.rolloutStep(); deployed && staged && (step+1 < len(d.rolloutSteps)) {
+				// The current step of a staged rollout is healthy, so ramp up to the next one
+				if err = d.rampEnv(ctx, step+1, now); err != nil {
+					return d.advance(job.JobStage_Failed, now, err)
+				}
+				return d.advance(job.JobStage_Started, now, nil)
 			} else if deployed {
-				// For completed deployments update the deployed tag in the DB, and append the deployment target.
-				if err = d.db.UpdateDeployTag(d.component, d.deployTag+","+d.sha); err != nil {
-					// This isn't an error big enough to fail the job, just report and move on.
-					log.Printf("deployJob: failed to update deploy tag: %v, %s", err, manager.PrintJob(d.state))
+				// Deployments limited to some services leave the component's other services at the previously deployed
+				// tag, so only record full deployments.
+				if len(d.target) == 0 {
+					d.updateDeployTags()
+				}
+				d.pruneEnv(ctx)
+				// The layout check above verifies that the services are running the task definitions for this
+				// deployment, i.e. for rollbacks, the ones with the tag or revision being rolled back to. Mark rollbacks
+				// distinctly so that it's clear that the environment was returned to an earlier deployment.
+				if d.rollback {
+					return d.advance(job.JobStage_RolledBack, now, nil)
 				}
 				return d.advance(job.JobStage_Completed, now, nil)
-			} else if job.IsTimedOut(d.state, defaultFailureTime) {
+			} else if d.timedOut(now) {
 				return d.advance(job.JobStage_Failed, now, manager.Error_CompletionTimeout)
+			} else if serviceEvents := d.serviceEvents(); len(serviceEvents) > 0 {
+				// Send a notification for notable service events (e.g. placement failures) since they usually explain
+				// why a deployment is stuck.
+				d.state.Params[job.DeployJobParam_ServiceEvents] = serviceEvents
+				return d.advance(job.JobStage_Started, now, nil)
 			} else {
 				// Return so we come back again to check
-				return d.state, nil
+				return d.state, manager.AdvanceResult{}, nil
 			}
 		}
 	default:
@@ -143,11 +260,175 @@ func (d deployJob) Advance() (job.JobState, error) {
 	}
 }
 
-func (d deployJob) prepareJob() error {
+// start updates the environment and moves the deployment to the "started" stage
+func (d deployJob) start(ctx context.Context, now time.Time) (job.JobState, manager.AdvanceResult, error) {
+	if err := d.updateEnv(ctx, now); err != nil {
+		return d.advance(job.JobStage_Failed, now, err)
+	} else if d.registerOnly {
+		// Nothing was deployed, so there's nothing to wait for and no tags to update. The registered task definitions
+		// are recorded in the layout for a later promotion.
+		return d.advance(job.JobStage_Completed, now, nil)
+	}
+	d.state.Params[job.JobParam_Start] = float64(now.UnixNano())
+	d.recordServiceChanges()
+	// For started deployments update the build tag in the DB
+	if err := d.db.UpdateBuildTag(d.component, d.deployTag); err != nil {
+		// This isn't an error big enough to fail the job, just report and move on.
+		log.Printf("deployJob: failed to update build tag: %v, %s", err, manager.PrintJob(d.state))
+	} else if err = d.db.UpdateBuildVersion(d.component, d.version); err != nil {
+		log.Printf("deployJob: failed to update build version: %v, %s", err, manager.PrintJob(d.state))
+	}
+	for component, sha := range d.shas {
+		if err := d.db.UpdateBuildTag(component, sha); err != nil {
+			log.Printf("deployJob: failed to update build tag: %s, %v, %s", component, err, manager.PrintJob(d.state))
+		}
+	}
+	return d.advance(job.JobStage_Started, now, nil)
+}
+
+// updateDeployTags records the deployed tag and version of each component deployed. For completed deployments, the
+// deployment target is appended to the tag.
+func (d deployJob) updateDeployTags() {
+	if err := d.db.UpdateDeployTag(d.component, d.deployTag+","+d.sha); err != nil {
+		// This isn't an error big enough to fail the job, just report and move on.
+		log.Printf("deployJob: failed to update deploy tag: %v, %s", err, manager.PrintJob(d.state))
+	} else if err = d.db.UpdateDeployVersion(d.component, d.version); err != nil {
+		// Always update the version, even if empty, so that it never refers to a previous deployment
+		log.Printf("deployJob: failed to update deploy version: %v, %s", err, manager.PrintJob(d.state))
+	} else if err = d.db.UpdateDeployJob(d.component, d.state.JobId); err != nil {
+		log.Printf("deployJob: failed to update deploy job: %v, %s", err, manager.PrintJob(d.state))
+	}
+	// The release label only applies to the component being deployed, so clear it for the other components
+	for component, sha := range d.shas {
+		if err := d.db.UpdateDeployTag(component, sha+","+sha); err != nil {
+			log.Printf("deployJob: failed to update deploy tag: %s, %v, %s", component, err, manager.PrintJob(d.state))
+		} else if err = d.db.UpdateDeployVersion(component, ""); err != nil {
+			log.Printf("deployJob: failed to update deploy version: %s, %v, %s", component, err, manager.PrintJob(d.state))
+		}
+	}
+}
+
+// dequeue prepares a deployment to be started, or skips it if the tag being deployed is already deployed
+func (d deployJob) dequeue(ctx context.Context, now, dequeueTs time.Time) (job.JobState, manager.AdvanceResult, error) {
+	if ready, err := d.checkDependency(); err != nil {
+		return d.advance(job.JobStage_Failed, now, err)
+	} else if !ready {
+		// Return so we come back again to check
+		return d.state, manager.AdvanceResult{}, nil
+	} else if deployTags, err := d.db.GetDeployTags(); err != nil {
+		return d.advance(job.JobStage_Failed, now, err)
+	} else if err = d.prepareJob(ctx); err != nil {
+		return d.advance(job.JobStage_Failed, now, err)
+	} else if deployTag, found := d.state.Params[job.DeployJobParam_DeployTag].(string); found &&
+		!d.manual && !d.force &&
+		(deployTag == strings.Split(deployTags[d.component], ",")[0]) {
+		// Skip automated jobs if the tag being deployed is the same as the tag already deployed. We don't do this for
+		// manual jobs because deploying an already deployed tag might be intentional, or for force deploys/rollbacks
+		// because we WANT to push through such deployments.
+		//
+		// Rollbacks are also force deploys, so we don't need to check for the former explicitly since we're already
+		// checking for force deploys.
+		return d.advance(job.JobStage_Skipped, now, nil)
+	} else if envLayout, err := d.generateLayout(ctx); err != nil {
+		return d.advance(job.JobStage_Failed, now, err)
+	} else {
+		d.diffLayout(envLayout)
+		// Only services are reverted to an earlier revision, or have their task definitions registered ahead of time, so
+		// leave everything else out of the layout.
+		if (len(d.revision) > 0) || d.registerOnly {
+			serviceLayout(envLayout)
+		}
+		// Only deploy the targeted services, if any, e.g. to redeploy just the IPFS gateway during an incident
+		if len(d.target) > 0 {
+			if err = targetLayout(d.env, envLayout, d.target); err != nil {
+				return d.advance(job.JobStage_Failed, now, err)
+			}
+		}
+		// Fail instead of completing a deployment that wouldn't change anything, e.g. because of a misconfigured layout
+		if layoutTaskCount(envLayout) == 0 {
+			return d.advance(job.JobStage_Failed, now, fmt.Errorf("deployJob: %w for component: %s", manager.Error_NoServices, d.component))
+		}
+		// Make sure that the pre-deploy task can be found before the deployment is dequeued
+		if len(d.preDeployTask) > 0 {
+			if _, _, _, err = d.preDeployRunner(envLayout); err != nil {
+				return d.advance(job.JobStage_Failed, now, err)
+			}
+		}
+		d.state.Params[job.DeployJobParam_Layout] = *envLayout
+		return d.advance(job.JobStage_Dequeued, dequeueTs, nil)
+	}
+}
+
+// generateLayout returns the layout to deploy. Promotions deploy the layout recorded by the register-only deployment
+// being promoted, which has the task definitions that were registered for it.
+func (d deployJob) generateLayout(ctx context.Context) (*manager.Layout, error) {
+	if len(d.promoteJob) > 0 {
+		if registeredJob, err := RegisteredJob(d.db, d.promoteJob); err != nil {
+			return nil, err
+		} else {
+			return layoutFromParams(registeredJob.Params, job.DeployJobParam_Layout)
+		}
+	} else if envLayout, err := generateEnvLayout(ctx, d.d, d.env, d.component); err != nil {
+		return nil, err
+	} else if err = d.mergeComponentLayouts(ctx, envLayout); err != nil {
+		return nil, err
+	} else {
+		return envLayout, nil
+	}
+}
+
+// RegisteredJob returns the final state of a completed register-only deployment, whose task definitions can be
+// promoted.
+func RegisteredJob(db manager.Database, jobId string) (job.JobState, error) {
+	var registeredJob *job.JobState
+	// Iterate the job's states in descending order of timestamp so that the most recent state is found first
+	if err := db.IterateByJob(jobId, false, func(js job.JobState) bool {
+		registeredJob = &js
+		// Stop iterating, we found the job we were looking for.
+		return false
+	}); err != nil {
+		return job.JobState{}, err
+	} else if registeredJob == nil {
+		return job.JobState{}, fmt.Errorf("registeredJob: job not found: %s", jobId)
+	} else if registerOnly, _ := registeredJob.Params[job.DeployJobParam_RegisterOnly].(bool); !registerOnly {
+		return job.JobState{}, fmt.Errorf("registeredJob: not a register-only deployment: %s", jobId)
+	} else if registeredJob.Stage != job.JobStage_Completed {
+		return job.JobState{}, fmt.Errorf("registeredJob: deployment not completed: %s, %s", jobId, registeredJob.Stage)
+	}
+	return *registeredJob, nil
+}
+
+// mergeComponentLayouts adds the layouts of the other components being deployed to the layout of this component, with
+// each component's tasks deployed from the image for its own commit hash
+func (d deployJob) mergeComponentLayouts(ctx context.Context, layout *manager.Layout) error {
+	for component, sha := range d.shas {
+		if componentLayout, err := generateEnvLayout(ctx, d.d, d.env, component); err != nil {
+			return err
+		} else if err = mergeLayout(layout, componentLayout, sha); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requiresApproval returns whether a deployment needs to be approved before it can be dequeued. Prod deployments need
+// approval, except for rollbacks, which restore a working deployment and shouldn't be held up, and register-only
+// deployments, which don't change any services.
+func (d deployJob) requiresApproval() bool {
+	// Retried deployments that were already approved don't need to be approved again. Only the job manager requeues
+	// deployments for retries, and requested jobs can't include an approval.
+	approvedBy, _ := d.state.Params[job.DeployJobParam_ApprovedBy].(string)
+	_, retried := d.state.Params[job.JobParam_Retries].(float64)
+	return (manager.EnvType(d.env) == manager.EnvType_Prod) && !d.rollback && !d.registerOnly && !(retried && (len(approvedBy) > 0))
+}
+
+func (d deployJob) prepareJob(ctx context.Context) error {
 	deployTag := ""
 	// - If the specified deployment target is "latest", fetch the latest branch commit hash from GitHub.
-	// - Else if the specified deployment target is "release" or "rollback", use the specified tag.
+	// - Else if the specified deployment target is "release", "rollback" or "promote", use the specified tag.
 	// - Else if it's a valid hash, use it.
+	// - Else treat it as an image tag alias (e.g. "latest-green") and resolve it to the commit hash of the image it
+	//   currently points to.
 	if d.sha == job.DeployJobTarget_Latest {
 		if repo, err := manager.ComponentRepo(d.component); err != nil {
 			return err
@@ -161,27 +442,328 @@ func (d deployJob) prepareJob() error {
 		} else {
 			deployTag = latestSha
 		}
-	} else if (d.sha == job.DeployJobTarget_Release) || (d.sha == job.DeployJobTarget_Rollback) {
+	} else if (d.sha == job.DeployJobTarget_Release) || (d.sha == job.DeployJobTarget_Rollback) || (d.sha == job.DeployJobTarget_Promote) {
 		deployTag = d.shaTag
 	} else if manager.IsValidSha(d.sha) {
 		deployTag = d.sha
+	} else if resolvedSha, err := d.resolveTagAlias(ctx); err != nil {
+		return err
 	} else {
-		return fmt.Errorf("prepareJob: invalid deployment type")
+		deployTag = resolvedSha
 	}
 	d.state.Params[job.DeployJobParam_DeployTag] = deployTag
 	return nil
 }
 
-func (d deployJob) updateEnv() error {
+// resolveTagAlias looks up the image that a tag alias points to in the component's ECR repository and returns the commit
+// hash it was tagged with. The image's digest is recorded too so that the deployment can be pinned to the image that the
+// alias pointed to when the job started, since tags, including the commit hash tag, can be moved.
+func (d deployJob) resolveTagAlias(ctx context.Context) (string, error) {
+	if ecrRepo, err := componentEcrRepo(d.component); err != nil {
+		return "", err
+	} else if imageDetail, err := d.d.DescribeImage(ctx, ecrRepo, d.sha); err != nil {
+		return "", fmt.Errorf("prepareJob: could not resolve tag alias %s: %w", d.sha, err)
+	} else {
+		for _, tag := range imageDetail.Tags {
+			if manager.IsValidSha(tag) {
+				d.state.Params[job.DeployJobParam_ImageDigest] = imageDetail.Digest
+				return tag, nil
+			}
+		}
+		return "", fmt.Errorf("prepareJob: image for tag alias %s has no commit hash tag: %s, %v", d.sha, imageDetail.Digest, imageDetail.Tags)
+	}
+}
+
+// pinImageDigest pins the component's tasks to the digest that a tag alias resolved to when the job started, if any. The
+// commit hash tag is kept in the image reference (e.g. "ceramic-prod:3ba6b9a@sha256:...") so that the deployed commit
+// can still be read from the task definition, but the digest decides which image is pulled, so an alias or tag that's
+// moved while the deployment is in progress has no effect.
+func (d deployJob) pinImageDigest(layout *manager.Layout) error {
+	if digest, _ := d.state.Params[job.DeployJobParam_ImageDigest].(string); len(digest) > 0 {
+		if ecrRepo, err := componentEcrRepo(d.component); err != nil {
+			return err
+		} else {
+			pinImage(layout, ecrRepo, d.deployTag+"@"+digest)
+		}
+	}
+	return nil
+}
+
+func (d deployJob) updateEnv(ctx context.Context, now time.Time) error {
+	// Layout should already be present
+	layout, err := d.layout()
+	if err != nil {
+		return err
+	}
+	// Updating the environment records the new task definitions on the layout's tasks. A layout reloaded from the
+	// database (e.g. after a restart) is decoded into new objects, so store the updated layout explicitly, otherwise a
+	// resumed job would end up checking stale task definitions.
+	defer func() { d.state.Params[job.DeployJobParam_Layout] = *layout }()
+	if err = d.pinImageDigest(layout); err != nil {
+		return err
+	}
+	if len(d.revision) > 0 {
+		return d.d.RevertLayout(ctx, layout, d.revision)
+	} else if d.registerOnly {
+		return d.d.RegisterLayout(ctx, layout, d.deployTag, d.sha, d.version, d.state.JobId)
+	} else if len(d.promoteJob) > 0 {
+		return d.d.PromoteLayout(ctx, layout)
+	} else {
+		// Services missing from the environment (e.g. when bootstrapping a new environment) are only created if requested
+		createIfMissing, _ := d.state.Params[job.DeployJobParam_CreateIfMissing].(bool)
+		rolloutPercent := 0
+		if len(d.rolloutSteps) > 0 {
+			rolloutPercent = d.rolloutSteps[0]
+		}
+		if err = d.d.UpdateLayout(ctx, layout, d.deployTag, d.sha, d.version, d.state.JobId, createIfMissing, rolloutPercent); err != nil {
+			return err
+		} else if len(d.rolloutSteps) > 0 {
+			if !layoutStaged(layout) {
+				// None of the services use task sets, so they were all deployed at once and there are no steps to go
+				// through.
+				log.Printf("deployJob: no services deployed in stages, ignoring rollout steps: %s", manager.PrintJob(d.state))
+				return nil
+			}
+			// Record the full schedule, including the final 100% step if it was added, so that progress can be reported
+			rolloutSteps := make([]interface{}, len(d.rolloutSteps))
+			for i, step := range d.rolloutSteps {
+				rolloutSteps[i] = float64(step)
+			}
+			d.state.Params[job.DeployJobParam_RolloutSteps] = rolloutSteps
+			d.state.Params[job.DeployJobParam_RolloutStep] = float64(0)
+			d.state.Params[job.DeployJobParam_RolloutStepStart] = float64(now.UnixNano())
+		}
+		return nil
+	}
+}
+
+// rampEnv moves a staged rollout to the specified step
+func (d deployJob) rampEnv(ctx context.Context, step int, now time.Time) error {
 	// Layout should already be present
-	layout, _ := d.state.Params[job.DeployJobParam_Layout].(manager.Layout)
-	return d.d.UpdateLayout(&layout, d.deployTag)
+	storedLayout, err := d.layout()
+	if err != nil {
+		return err
+	}
+	// Ramping records the new scale on the layout's tasks, so update a copy instead of the stored layout
+	layout := copyLayout(storedLayout)
+	if err = d.d.RampLayout(ctx, layout, d.rolloutSteps[step]); err != nil {
+		return err
+	}
+	d.state.Params[job.DeployJobParam_Layout] = *layout
+	d.state.Params[job.DeployJobParam_RolloutStep] = float64(step)
+	d.state.Params[job.DeployJobParam_RolloutStepStart] = float64(now.UnixNano())
+	return nil
+}
+
+// preDeployRunner returns the runner to launch as the pre-deploy task, along with its cluster
+func (d deployJob) preDeployRunner(layout *manager.Layout) (string, *manager.Cluster, *manager.Task, error) {
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.Runners != nil {
+			if task, found := cluster.Runners.Tasks[d.preDeployTask]; found {
+				return clusterName, cluster, task, nil
+			}
+		}
+	}
+	return "", nil, nil, fmt.Errorf("deployJob: pre-deploy task not found in layout: %s", d.preDeployTask)
+}
+
+// launchPreDeployTask registers a task definition for the pre-deploy runner with the image being deployed and launches
+// it. Only the runner is updated, so the services are left untouched until the task has exited successfully.
+func (d deployJob) launchPreDeployTask(ctx context.Context) error {
+	layout, err := d.layout()
+	if err != nil {
+		return err
+	}
+	clusterName, cluster, task, err := d.preDeployRunner(layout)
+	if err != nil {
+		return err
+	}
+	// Launch the runner here instead of as part of the layout update so that the deployment can track it
+	runner := *task
+	runner.WaitForCompletion = false
+	runnerLayout := &manager.Layout{
+		Clusters: map[string]*manager.Cluster{clusterName: {
+			Runners: &manager.TaskSet{Tasks: map[string]*manager.Task{d.preDeployTask: &runner}, Repo: cluster.Runners.Repo},
+			Repo:    cluster.Repo,
+		}},
+		Repo: layout.Repo,
+	}
+	if err = d.pinImageDigest(runnerLayout); err != nil {
+		return err
+	} else if err = d.d.UpdateLayout(ctx, runnerLayout, d.deployTag, d.sha, d.version, d.state.JobId, false, 0); err != nil {
+		return err
+	}
+	taskArn, err := d.d.LaunchTask(ctx, clusterName, runner.Id, runner.Name, manager.LaunchOptions{
+		JobId:            d.state.JobId,
+		RequestedBy:      d.requestedBy(),
+		VpcConfigParams:  []string{"/" + d.preDeployTask + "/network_configuration"},
+		CapacityProvider: runner.CapacityProvider,
+		Placement:        runner.Placement,
+	})
+	if err != nil {
+		return err
+	}
+	d.recordLaunchedTask(taskArn, nil)
+	d.state.Params[job.DeployJobParam_PreDeployTaskArn] = taskArn
+	return nil
+}
+
+// checkPreDeployTask returns whether the pre-deploy task has exited successfully, or an error if it failed
+func (d deployJob) checkPreDeployTask(ctx context.Context) (bool, error) {
+	taskArn, _ := d.state.Params[job.DeployJobParam_PreDeployTaskArn].(string)
+	if layout, err := d.layout(); err != nil {
+		return false, err
+	} else if clusterName, _, _, err := d.preDeployRunner(layout); err != nil {
+		return false, err
+	} else if stopped, exitCode, err := d.d.CheckTask(ctx, clusterName, "", false, false, taskArn); err != nil {
+		return false, err
+	} else if !stopped {
+		return false, nil
+	} else if exitCode == nil {
+		return false, fmt.Errorf("deployJob: %w: %s stopped without exit code", manager.Error_PreDeployFailed, d.preDeployTask)
+	} else if *exitCode != 0 {
+		return false, fmt.Errorf("deployJob: %w: %s exited with code %d", manager.Error_PreDeployFailed, d.preDeployTask, *exitCode)
+	}
+	return true, nil
+}
+
+// removePreDeployRunner removes the pre-deploy runner from the layout being deployed, once it has run
+func (d deployJob) removePreDeployRunner() error {
+	layout, err := d.layout()
+	if err != nil {
+		return err
+	}
+	clusterName, cluster, _, err := d.preDeployRunner(layout)
+	if err != nil {
+		return err
+	}
+	// Copy the layout before updating it so that the stored layout isn't modified through shared maps
+	runners := make(map[string]*manager.Task, len(cluster.Runners.Tasks)-1)
+	for name, task := range cluster.Runners.Tasks {
+		if name != d.preDeployTask {
+			runners[name] = task
+		}
+	}
+	updatedCluster := *cluster
+	if len(runners) > 0 {
+		updatedRunners := *cluster.Runners
+		updatedRunners.Tasks = runners
+		updatedCluster.Runners = &updatedRunners
+	} else {
+		updatedCluster.Runners = nil
+	}
+	clusters := make(map[string]*manager.Cluster, len(layout.Clusters))
+	for name, c := range layout.Clusters {
+		clusters[name] = c
+	}
+	clusters[clusterName] = &updatedCluster
+	layout.Clusters = clusters
+	d.state.Params[job.DeployJobParam_Layout] = *layout
+	return nil
+}
+
+// stopPreDeployTask stops a pre-deploy task that is no longer needed, e.g. because it didn't complete in time
+func (d deployJob) stopPreDeployTask(ctx context.Context, reason string) {
+	taskArn, _ := d.state.Params[job.DeployJobParam_PreDeployTaskArn].(string)
+	if layout, err := d.layout(); err != nil {
+		log.Printf("deployJob: failed to stop pre-deploy task: %s, %v, %s", taskArn, err, manager.PrintJob(d.state))
+	} else if clusterName, _, _, err := d.preDeployRunner(layout); err != nil {
+		log.Printf("deployJob: failed to stop pre-deploy task: %s, %v, %s", taskArn, err, manager.PrintJob(d.state))
+	} else if err = d.d.StopTask(ctx, clusterName, taskArn, reason); err != nil {
+		log.Printf("deployJob: failed to stop pre-deploy task: %s, %v, %s", taskArn, err, manager.PrintJob(d.state))
+	}
+}
+
+// rolloutStep returns the current step of a staged rollout, and whether any services are being deployed in stages
+func (d deployJob) rolloutStep() (int, bool) {
+	step, found := d.state.Params[job.DeployJobParam_RolloutStep].(float64)
+	return int(step), found
+}
+
+// timedOut returns whether a started deployment ran out of time to complete. Each step of a staged rollout gets the full
+// time, counted from when the step started.
+func (d deployJob) timedOut(now time.Time) bool {
+	if stepStart, found := d.state.Params[job.DeployJobParam_RolloutStepStart].(float64); found {
+		return now.Add(-defaultFailureTime).After(time.Unix(0, int64(stepStart)))
+	}
+	return job.IsTimedOutAt(d.state, defaultFailureTime, now)
+}
+
+// parseRolloutSteps reads the steps of a staged rollout from the job parameters. Steps must be increasing percentages,
+// and a final 100% step is added if missing so that deployments always finish fully rolled out.
+func parseRolloutSteps(params map[string]interface{}) ([]int, error) {
+	parsedSteps, found := params[job.DeployJobParam_RolloutSteps].([]interface{})
+	if !found {
+		return nil, nil
+	}
+	rolloutSteps := make([]int, 0, len(parsedSteps)+1)
+	for _, step := range parsedSteps {
+		if percent, ok := step.(float64); !ok || (percent <= 0) || (percent > 100) || (percent != float64(int(percent))) {
+			return nil, fmt.Errorf("deployJob: invalid rollout step: %v", step)
+		} else if (len(rolloutSteps) > 0) && (int(percent) <= rolloutSteps[len(rolloutSteps)-1]) {
+			return nil, fmt.Errorf("deployJob: rollout steps must increase: %v", parsedSteps)
+		} else {
+			rolloutSteps = append(rolloutSteps, int(percent))
+		}
+	}
+	if (len(rolloutSteps) == 0) || (rolloutSteps[len(rolloutSteps)-1] < 100) {
+		rolloutSteps = append(rolloutSteps, 100)
+	}
+	return rolloutSteps, nil
+}
+
+// checkDeployWindows returns an error if a prod deployment isn't allowed to start at the specified time. Rollbacks and
+// register-only deployments don't change what's running, so they're always allowed, as are emergency deployments.
+func (d deployJob) checkDeployWindows(now time.Time) error {
+	// Rollbacks, including reverts to an earlier revision, restore a known good state and are always allowed
+	if (manager.EnvType(d.env) != manager.EnvType_Prod) || d.rollback || (len(d.revision) > 0) || d.registerOnly || (d.windows == nil) {
+		return nil
+	}
+	err := d.windows.check(now)
+	if (err != nil) && d.emergency {
+		log.Printf("checkDeployWindows: bypassing deploy windows for emergency deployment: %s, %v", d.state.JobId, err)
+		return nil
+	}
+	return err
+}
+
+// parseShas reads the commit hashes of other components to deploy along with a component from the job parameters. Only
+// full commit hashes are accepted, and an entry for the component itself must match the deployment target.
+func parseShas(params map[string]interface{}, component manager.DeployComponent, sha string) (map[manager.DeployComponent]string, error) {
+	parsedShas, found := params[job.DeployJobParam_Shas].(map[string]interface{})
+	if !found {
+		return nil, nil
+	}
+	shas := make(map[manager.DeployComponent]string, len(parsedShas))
+	for parsedComponent, parsedSha := range parsedShas {
+		if componentSha, ok := parsedSha.(string); !ok || !manager.IsValidSha(componentSha) {
+			return nil, fmt.Errorf("deployJob: invalid sha for %s: %v", parsedComponent, parsedSha)
+		} else if _, err := componentEcrRepo(manager.DeployComponent(parsedComponent)); err != nil {
+			return nil, fmt.Errorf("deployJob: invalid component in shas: %s", parsedComponent)
+		} else if manager.DeployComponent(parsedComponent) == component {
+			if componentSha != sha {
+				return nil, fmt.Errorf("deployJob: sha for %s does not match deployment target: %s", component, componentSha)
+			}
+		} else {
+			shas[manager.DeployComponent(parsedComponent)] = componentSha
+		}
+	}
+	return shas, nil
 }
 
-func (d deployJob) checkEnv() (bool, error) {
+func (d deployJob) checkEnv(ctx context.Context) (bool, error) {
 	// Layout should already be present
-	layout, _ := d.state.Params[job.DeployJobParam_Layout].(manager.Layout)
-	if deployed, err := d.d.CheckLayout(&layout); err != nil {
+	storedLayout, err := d.layout()
+	if err != nil {
+		return false, err
+	}
+	// The check records the service events seen on the layout's tasks, so check a copy instead of updating the stored
+	// layout in place, which is shared with the cached job state. Then keep track of the events seen so that they're
+	// only reported once.
+	layout := copyLayout(storedLayout)
+	deployed, err := d.d.CheckLayout(ctx, layout)
+	d.state.Params[job.DeployJobParam_Layout] = *layout
+	if err != nil {
 		return false, err
 	} else if !deployed || ((d.component != manager.DeployComponent_Ipfs) && (d.component != manager.DeployComponent_RustCeramic)) {
 		return deployed, nil
@@ -192,105 +774,219 @@ func (d deployJob) checkEnv() (bool, error) {
 	// In this case, we want to check whether *some* version of Ceramic is stable and not any specific version, like we
 	// normally do when checking for successful deployments, so it's OK to rebuild the Ceramic layout on-the-fly each
 	// time instead of storing it in the database.
-	if ceramicLayout, err := d.generateEnvLayout(manager.DeployComponent_Ceramic); err != nil {
+	if ceramicLayout, err := generateEnvLayout(ctx, d.d, d.env, manager.DeployComponent_Ceramic); err != nil {
 		return false, err
 	} else {
-		return d.d.CheckLayout(ceramicLayout)
+		return d.d.CheckLayout(ctx, ceramicLayout)
 	}
 }
 
-func (d deployJob) generateEnvLayout(component manager.DeployComponent) (*manager.Layout, error) {
-	privateCluster := "ceramic-" + d.env
-	publicCluster := "ceramic-" + d.env + "-ex"
-	casCluster := "ceramic-" + d.env + "-cas"
-	casV5Cluster := "app-cas-" + d.env
-	rustCluster := "ceramic-" + d.env + "-rust"
-	clusters := []string{privateCluster, publicCluster, casCluster, casV5Cluster, rustCluster}
-	if ecrRepo, err := d.componentEcrRepo(component); err != nil {
-		return nil, err
-	} else
-	// Populate the service layout by retrieving the clusters/services from ECS
-	if currentLayout, err := d.d.GetLayout(clusters); err != nil {
-		return nil, err
+// serviceEvents returns the notable service events seen during the last check of the deployment, prefixed with the name
+// of the service they were emitted by
+func (d deployJob) serviceEvents() []interface{} {
+	if layout, err := d.layout(); err == nil {
+		return layoutServiceEvents(layout)
+	}
+	return nil
+}
+
+// recordServiceChanges records which task definitions the deployment moved each service from and to, so that there's a
+// record of exactly what changed that doesn't require digging through the layout.
+func (d deployJob) recordServiceChanges() {
+	if layout, err := d.layout(); err != nil {
+		log.Printf("deployJob: failed to read layout for service changes: %v, %s", err, manager.PrintJob(d.state))
 	} else {
-		newLayout := &manager.Layout{Clusters: map[string]*manager.Cluster{}, Repo: &ecrRepo}
-		for cluster, clusterLayout := range currentLayout.Clusters {
-			for service, task := range clusterLayout.ServiceTasks.Tasks {
-				if newTask := d.componentTask(component, cluster, service, strings.Split(task.Name, ",")); newTask != nil {
-					if newLayout.Clusters[cluster] == nil {
-						// We found at least one matching task, so we can start populating the cluster layout.
-						newLayout.Clusters[cluster] = &manager.Cluster{ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{}}}
-					}
-					// Set the task definition to the one currently running. For most cases, this will be overwritten by
-					// a new definition, but for some cases, we might want to use a layout with currently running
-					// definitions and not updated ones, e.g. to check if an existing deployment is stable.
-					newTask.Id = task.Id
-					newLayout.Clusters[cluster].ServiceTasks.Tasks[service] = newTask
+		d.state.Params[job.DeployJobParam_ServiceChanges] = layoutServiceChanges(layout, "")
+	}
+}
+
+func layoutServiceChanges(layout *manager.Layout, region string) []manager.ServiceChange {
+	serviceChanges := make([]manager.ServiceChange, 0)
+	for clusterName, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service, task := range cluster.ServiceTasks.Tasks {
+				if task.PrevId != task.Id {
+					serviceChanges = append(serviceChanges, manager.ServiceChange{
+						Region:  region,
+						Cluster: clusterName,
+						Service: service,
+						From:    task.PrevId,
+						To:      task.Id,
+					})
 				}
 			}
 		}
-		// If CAS is bing deployed, add the Anchor Worker to the layout since it doesn't get updated through an ECS
-		// service.
-		if component == manager.DeployComponent_Cas {
-			newLayout.Clusters[casCluster].Tasks = &manager.TaskSet{Tasks: map[string]*manager.Task{
-				casCluster + "-" + serviceSuffix_CasWorker: {
-					Temp: true, // Anchor workers do not stay up permanently
-					Name: containerName_CasWorker,
-				},
-			}}
+	}
+	for regionName, regionLayout := range layout.Regions {
+		serviceChanges = append(serviceChanges, layoutServiceChanges(regionLayout, regionName)...)
+	}
+	// Map iteration order is random, so sort the changes to keep them readable
+	sort.Slice(serviceChanges, func(i, j int) bool {
+		if serviceChanges[i].Region != serviceChanges[j].Region {
+			return serviceChanges[i].Region < serviceChanges[j].Region
+		} else if serviceChanges[i].Cluster != serviceChanges[j].Cluster {
+			return serviceChanges[i].Cluster < serviceChanges[j].Cluster
+		}
+		return serviceChanges[i].Service < serviceChanges[j].Service
+	})
+	return serviceChanges
+}
+
+func layoutServiceEvents(layout *manager.Layout) []interface{} {
+	serviceEvents := make([]interface{}, 0)
+	for _, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service, task := range cluster.ServiceTasks.Tasks {
+				for _, event := range task.Events {
+					serviceEvents = append(serviceEvents, service+": "+event)
+				}
+			}
 		}
-		return newLayout, nil
 	}
+	for _, regionLayout := range layout.Regions {
+		serviceEvents = append(serviceEvents, layoutServiceEvents(regionLayout)...)
+	}
+	return serviceEvents
 }
 
-func (d deployJob) componentTask(component manager.DeployComponent, cluster, service string, containerNames []string) *manager.Task {
-	// Skip any ELP services (e.g. "ceramic-elp-1-1-node")
-	serviceNameParts := strings.Split(service, "-")
-	if (len(serviceNameParts) >= 2) && (serviceNameParts[1] == serviceSuffix_Elp) {
-		return nil
+func (d deployJob) pruneEnv(ctx context.Context) {
+	// Task definition revisions accumulate with every deployment, so clean up older revisions once a deployment is
+	// complete. This isn't an error big enough to fail the job, just report and move on.
+	if d.keepTaskDefs > 0 {
+		if layout, err := d.layout(); err != nil {
+			log.Printf("deployJob: failed to read layout for pruning: %v, %s", err, manager.PrintJob(d.state))
+		} else if retain, err := d.registeredTaskDefs(); err != nil {
+			log.Printf("deployJob: failed to find registered task definitions: %v, %s", err, manager.PrintJob(d.state))
+		} else if err = d.d.PruneLayout(ctx, layout, d.keepTaskDefs, retain); err != nil {
+			log.Printf("deployJob: failed to prune task definitions: %v, %s", err, manager.PrintJob(d.state))
+		}
 	}
-	switch component {
-	case manager.DeployComponent_Ceramic:
-		// Ceramic nodes are deployed to the private and public clusters, but not to the CAS cluster.
-		if (cluster != "ceramic-"+d.env+"-cas") && strings.Contains(service, serviceSuffix_CeramicNode) {
-			return &manager.Task{Name: containerName_CeramicNode}
+}
+
+// registeredTaskDefs returns the task definitions registered by completed register-only deployments of the component
+// that haven't been promoted yet, so that pruning doesn't deregister them before they can be promoted.
+func (d deployJob) registeredTaskDefs() (map[string]bool, error) {
+	retain := make(map[string]bool)
+	promoted := make(map[string]bool)
+	// Iterate the DB in descending order of timestamp so that promotions are seen before the deployments they promote
+	if err := d.db.IterateByType(job.JobType_Deploy, false, func(js job.JobState) bool {
+		if component, _ := js.Params[job.DeployJobParam_Component].(string); (manager.DeployComponent(component) == d.component) && (js.Stage == job.JobStage_Completed) {
+			if promoteJob, _ := js.Params[job.DeployJobParam_PromoteJob].(string); len(promoteJob) > 0 {
+				promoted[promoteJob] = true
+			} else if registerOnly, _ := js.Params[job.DeployJobParam_RegisterOnly].(bool); registerOnly && !promoted[js.JobId] {
+				if jobLayout, err := layoutFromParams(js.Params, job.DeployJobParam_Layout); err == nil {
+					layoutTaskDefs(jobLayout, retain)
+				}
+			}
 		}
-	case manager.DeployComponent_Ipfs:
-		if strings.Contains(service, serviceSuffix_IpfsNode) && slices.Contains(containerNames, containerName_IpfsNode) {
-			return &manager.Task{Name: containerName_IpfsNode}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return retain, nil
+}
+
+// layoutTaskDefs adds the task definitions of all tasks in a layout, including its regions, to a set
+func layoutTaskDefs(layout *manager.Layout, taskDefs map[string]bool) {
+	for _, cluster := range layout.Clusters {
+		for _, taskSet := range []*manager.TaskSet{cluster.ServiceTasks, cluster.Tasks, cluster.Runners} {
+			if taskSet != nil {
+				for _, task := range taskSet.Tasks {
+					if len(task.Id) > 0 {
+						taskDefs[task.Id] = true
+					}
+				}
+			}
 		}
-	case manager.DeployComponent_Cas:
-		if (cluster == "ceramic-"+d.env+"-cas") && strings.Contains(service, serviceSuffix_CasApi) {
-			return &manager.Task{Name: containerName_CasApi}
+	}
+	for _, regionLayout := range layout.Regions {
+		layoutTaskDefs(regionLayout, taskDefs)
+	}
+}
+
+// checkDependency returns whether the deployment that this deployment depends on, if any, has completed. The dependent
+// deployment stays queued till then, and fails if the dependency fails or is canceled. A dependency that was collapsed
+// into a newer deployment of the same component is replaced by that deployment, and one that was skipped because its
+// tag was already deployed counts as completed.
+func (d deployJob) checkDependency() (bool, error) {
+	dependsOn, _ := d.state.Params[job.JobParam_DependsOn].(string)
+	if len(dependsOn) == 0 {
+		return true, nil
+	} else if dependsOn == d.state.JobId {
+		return false, fmt.Errorf("deployJob: deployment cannot depend on itself: %s", dependsOn)
+	}
+	visited := make(map[string]bool)
+	for !visited[dependsOn] {
+		visited[dependsOn] = true
+		var dependency *job.JobState
+		// Iterate the DB in descending order of timestamp so that the most recent state of the dependency is found first
+		if err := d.db.IterateByJob(dependsOn, false, func(js job.JobState) bool {
+			dependency = &js
+			return false
+		}); err != nil {
+			return false, err
+		} else if dependency == nil {
+			// The dependency might not have been written yet, e.g. if it was queued through another manager instance
+			return false, nil
+		} else if dependency.Stage == job.JobStage_Completed {
+			return true, nil
+		} else if dependency.Stage == job.JobStage_Skipped {
+			supersededBy, _ := dependency.Params[job.DeployJobParam_SupersededBy].(string)
+			if len(supersededBy) == 0 {
+				return true, nil
+			} else if supersededBy == d.state.JobId {
+				// The dependency was collapsed into this deployment
+				return true, nil
+			}
+			dependsOn = supersededBy
+		} else if job.IsFinishedJob(*dependency) {
+			return false, fmt.Errorf("deployJob: dependency %s: %s", dependency.Stage, dependsOn)
+		} else {
+			return false, nil
 		}
-	case manager.DeployComponent_CasV5:
-		if (cluster == "app-cas-"+d.env) && strings.Contains(service, serviceSuffix_CasScheduler) {
-			return &manager.Task{Name: containerName_CasV5Scheduler}
+	}
+	return false, fmt.Errorf("deployJob: circular dependency: %s", dependsOn)
+}
+
+// diffLayout records how a layout differs from the one used for the last successful deployment of the component, so that
+// structural changes (e.g. added or removed services) are visible in the logs and notifications.
+func (d deployJob) diffLayout(layout *manager.Layout) {
+	var prevLayout *manager.Layout
+	// Look up the last full deployment of the component directly, then iterate its states in descending order of
+	// timestamp so that its final layout is found first.
+	if prevJobId, err := d.db.GetDeployJob(d.component); err != nil {
+		// This isn't an error big enough to fail the job, just report and move on.
+		log.Printf("deployJob: failed to find previous deployment: %v, %s", err, manager.PrintJob(d.state))
+		return
+	} else if len(prevJobId) == 0 {
+		// Deployments recorded before deployment job IDs were stored have nothing to compare against
+		return
+	} else if err = d.db.IterateByJob(prevJobId, false, func(js job.JobState) bool {
+		if jobLayout, err := layoutFromParams(js.Params, job.DeployJobParam_Layout); err == nil {
+			prevLayout = jobLayout
+			// Stop iterating, we found the layout we were looking for.
+			return false
 		}
-	case manager.DeployComponent_RustCeramic:
-		if strings.Contains(service, serviceSuffix_IpfsNode) && slices.Contains(containerNames, containerName_RustCeramic) {
-			return &manager.Task{Name: containerName_RustCeramic}
+		return true
+	}); err != nil {
+		log.Printf("deployJob: failed to find previous layout: %v, %s", err, manager.PrintJob(d.state))
+		return
+	}
+	if prevLayout != nil {
+		if diff := manager.DiffLayout(prevLayout, layout); !diff.IsEmpty() {
+			log.Printf("deployJob: layout changes since last deployment:\n%s\n%s", diff, manager.PrintJob(d.state))
+			d.state.Params[job.DeployJobParam_LayoutDiff] = diff.String()
 		}
-	default:
-		log.Printf("componentTask: unknown component: %s", component)
 	}
-	return nil
 }
 
-func (d deployJob) componentEcrRepo(component manager.DeployComponent) (manager.Repo, error) {
-	switch component {
-	case manager.DeployComponent_Ceramic:
-		return manager.Repo{Name: "ceramic-prod"}, nil
-	case manager.DeployComponent_Ipfs:
-		return manager.Repo{Name: "go-ipfs-prod"}, nil
-	case manager.DeployComponent_Cas:
-		return manager.Repo{Name: "ceramic-prod-cas"}, nil
-	case manager.DeployComponent_CasV5:
-		return manager.Repo{Name: "app-cas-scheduler"}, nil
-	case manager.DeployComponent_RustCeramic:
-		return manager.Repo{Name: "ceramic-one", Public: true}, nil
-	default:
-		return manager.Repo{}, fmt.Errorf("componentEcrRepo: unknown component: %s", component)
+func (d deployJob) layout() (*manager.Layout, error) {
+	if layout, err := layoutFromParams(d.state.Params, job.DeployJobParam_Layout); err != nil {
+		return nil, err
+	} else if layout.Repo == nil { // The main layout repo should never be null
+		return nil, fmt.Errorf("deployJob: missing layout repo")
+	} else {
+		return layout, nil
 	}
 }
 
@@ -0,0 +1,182 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+// DeployWindows restricts when prod deployments are allowed to start. Deployments are allowed at any time if no windows
+// are configured, and never during a blackout.
+type DeployWindows struct {
+	// Recurring windows during which deployments are allowed, e.g. business hours
+	allowed []deployWindow
+	// One-off periods during which deployments aren't allowed, e.g. change freezes
+	blackouts []blackoutPeriod
+	// Time zone in which the allowed windows are specified
+	location *time.Location
+}
+
+type deployWindow struct {
+	days  [7]bool
+	start time.Duration // Wall clock time of day, e.g. 14h for "14:00"
+	end   time.Duration // Wall clock time of day, e.g. 24h for "24:00"
+	spec  string
+}
+
+type blackoutPeriod struct {
+	start time.Time
+	end   time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseDeployWindows reads the allowed deploy windows and blackout periods from the environment. It's meant to be called
+// once at startup so that a misconfiguration is caught right away, instead of failing every deployment.
+//
+// DEPLOY_WINDOWS is a comma-separated list of day/hour ranges, e.g. "Mon-Thu 14:00-22:00,Fri 14:00-18:00", interpreted
+// in the DEPLOY_WINDOWS_TZ time zone (UTC by default). DEPLOY_BLACKOUTS is a comma-separated list of RFC3339 intervals,
+// e.g. "2023-12-20T00:00:00Z/2024-01-03T00:00:00Z".
+func ParseDeployWindows() (*DeployWindows, error) {
+	location := time.UTC
+	if configTz, found := os.LookupEnv("DEPLOY_WINDOWS_TZ"); found && (len(configTz) > 0) {
+		parsedLocation, err := time.LoadLocation(configTz)
+		if err != nil {
+			return nil, fmt.Errorf("deployJob: invalid deploy windows time zone: %s, %w", configTz, err)
+		}
+		location = parsedLocation
+	}
+	w := &DeployWindows{location: location}
+	if configWindows := strings.TrimSpace(os.Getenv("DEPLOY_WINDOWS")); len(configWindows) > 0 {
+		for _, spec := range strings.Split(configWindows, ",") {
+			window, err := parseDeployWindow(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, err
+			}
+			w.allowed = append(w.allowed, window)
+		}
+	}
+	if configBlackouts := strings.TrimSpace(os.Getenv("DEPLOY_BLACKOUTS")); len(configBlackouts) > 0 {
+		for _, spec := range strings.Split(configBlackouts, ",") {
+			blackout, err := parseBlackoutPeriod(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, err
+			}
+			w.blackouts = append(w.blackouts, blackout)
+		}
+	}
+	return w, nil
+}
+
+// parseDeployWindow parses a window like "Mon-Fri 14:00-22:00" or "Sat 16:00-18:00". Day ranges can wrap around the
+// end of the week, e.g. "Fri-Mon", but windows can't span midnight and need to be split instead.
+func parseDeployWindow(spec string) (deployWindow, error) {
+	window := deployWindow{spec: spec}
+	parts := strings.Fields(spec)
+	if len(parts) != 2 {
+		return window, fmt.Errorf("deployJob: invalid deploy window: %s", spec)
+	}
+	days := strings.SplitN(strings.ToLower(parts[0]), "-", 2)
+	firstDay, found := weekdays[days[0]]
+	if !found {
+		return window, fmt.Errorf("deployJob: invalid deploy window day: %s", spec)
+	}
+	lastDay := firstDay
+	if len(days) == 2 {
+		if lastDay, found = weekdays[days[1]]; !found {
+			return window, fmt.Errorf("deployJob: invalid deploy window day: %s", spec)
+		}
+	}
+	for day := firstDay; ; day = (day + 1) % 7 {
+		window.days[day] = true
+		if day == lastDay {
+			break
+		}
+	}
+	hours := strings.SplitN(parts[1], "-", 2)
+	if len(hours) != 2 {
+		return window, fmt.Errorf("deployJob: invalid deploy window hours: %s", spec)
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(hours[0]); err != nil {
+		return window, fmt.Errorf("deployJob: invalid deploy window hours: %s, %w", spec, err)
+	} else if window.end, err = parseTimeOfDay(hours[1]); err != nil {
+		return window, fmt.Errorf("deployJob: invalid deploy window hours: %s, %w", spec, err)
+	} else if window.start >= window.end {
+		return window, fmt.Errorf("deployJob: deploy window must end after it starts: %s", spec)
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into a wall clock time of day. "24:00" is allowed so that windows can end at midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseBlackoutPeriod(spec string) (blackoutPeriod, error) {
+	var blackout blackoutPeriod
+	bounds := strings.SplitN(spec, "/", 2)
+	if len(bounds) != 2 {
+		return blackout, fmt.Errorf("deployJob: invalid deploy blackout: %s", spec)
+	}
+	var err error
+	if blackout.start, err = time.Parse(time.RFC3339, bounds[0]); err != nil {
+		return blackout, fmt.Errorf("deployJob: invalid deploy blackout start: %s, %w", spec, err)
+	} else if blackout.end, err = time.Parse(time.RFC3339, bounds[1]); err != nil {
+		return blackout, fmt.Errorf("deployJob: invalid deploy blackout end: %s, %w", spec, err)
+	} else if !blackout.end.After(blackout.start) {
+		return blackout, fmt.Errorf("deployJob: deploy blackout must end after it starts: %s", spec)
+	}
+	return blackout, nil
+}
+
+// check returns an error explaining why deployments aren't allowed at the specified time, or nil if they are. Window
+// bounds are wall clock times in the configured time zone, so a "14:00-22:00" window still opens at 14:00 on the days
+// that daylight saving time starts or ends.
+func (w DeployWindows) check(now time.Time) error {
+	for _, blackout := range w.blackouts {
+		if !now.Before(blackout.start) && now.Before(blackout.end) {
+			return fmt.Errorf("%w: blackout until %s", manager.Error_DeployBlackout, blackout.end.UTC().Format(time.RFC3339))
+		}
+	}
+	if len(w.allowed) == 0 {
+		return nil
+	}
+	local := now.In(w.location)
+	specs := make([]string, len(w.allowed))
+	for i, window := range w.allowed {
+		if window.days[local.Weekday()] {
+			start := wallClockTime(local, window.start)
+			end := wallClockTime(local, window.end)
+			if !local.Before(start) && local.Before(end) {
+				return nil
+			}
+		}
+		specs[i] = window.spec
+	}
+	return fmt.Errorf("%w: deployments are allowed %s (%s)", manager.Error_DeployBlackout, strings.Join(specs, ", "), w.location)
+}
+
+// wallClockTime returns the time at the specified time of day on the same day as t, in t's location. A time of day of
+// 24 hours is normalized to midnight of the following day.
+func wallClockTime(t time.Time, timeOfDay time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), int(timeOfDay/time.Hour), int((timeOfDay%time.Hour)/time.Minute), 0, 0, t.Location())
+}
@@ -0,0 +1,208 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+func TestParseDeployWindow(t *testing.T) {
+	tests := []struct {
+		spec    string
+		days    []time.Weekday
+		start   time.Duration
+		end     time.Duration
+		wantErr bool
+	}{
+		{spec: "Mon 14:00-22:00", days: []time.Weekday{time.Monday}, start: 14 * time.Hour, end: 22 * time.Hour},
+		{spec: "mon-thu 09:30-17:45", days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday}, start: 9*time.Hour + 30*time.Minute, end: 17*time.Hour + 45*time.Minute},
+		{spec: "Fri-Mon 00:00-24:00", days: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, start: 0, end: 24 * time.Hour},
+		{spec: "Sat 16:00-18:00", days: []time.Weekday{time.Saturday}, start: 16 * time.Hour, end: 18 * time.Hour},
+		{spec: "Mon", wantErr: true},
+		{spec: "Mon 14:00", wantErr: true},
+		{spec: "Funday 14:00-22:00", wantErr: true},
+		{spec: "Mon-Funday 14:00-22:00", wantErr: true},
+		{spec: "Mon 22:00-14:00", wantErr: true},
+		{spec: "Mon 14:00-14:00", wantErr: true},
+		{spec: "Mon 25:00-26:00", wantErr: true},
+		{spec: "Mon 14:00-22:00 UTC", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			window, err := parseDeployWindow(test.spec)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", window)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var days [7]bool
+			for _, day := range test.days {
+				days[day] = true
+			}
+			if window.days != days {
+				t.Errorf("days: got %v, want %v", window.days, days)
+			}
+			if window.start != test.start {
+				t.Errorf("start: got %v, want %v", window.start, test.start)
+			}
+			if window.end != test.end {
+				t.Errorf("end: got %v, want %v", window.end, test.end)
+			}
+		})
+	}
+}
+
+func TestParseBlackoutPeriod(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "2023-12-20T00:00:00Z/2024-01-03T00:00:00Z"},
+		{spec: "2023-12-20T00:00:00-05:00/2023-12-21T00:00:00-05:00"},
+		{spec: "2023-12-20T00:00:00Z", wantErr: true},
+		{spec: "2023-12-20/2024-01-03", wantErr: true},
+		{spec: "2024-01-03T00:00:00Z/2023-12-20T00:00:00Z", wantErr: true},
+		{spec: "2024-01-03T00:00:00Z/2024-01-03T00:00:00Z", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			if _, err := parseBlackoutPeriod(test.spec); (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseDeployWindows(t *testing.T) {
+	tests := []struct {
+		name      string
+		windows   string
+		tz        string
+		blackouts string
+		allowed   int
+		location  string
+		wantErr   bool
+	}{
+		{name: "unset", location: "UTC"},
+		{name: "windows", windows: "Mon-Thu 14:00-22:00, Fri 14:00-18:00", tz: "America/New_York", allowed: 2, location: "America/New_York"},
+		{name: "blackouts only", blackouts: "2023-12-20T00:00:00Z/2024-01-03T00:00:00Z", location: "UTC"},
+		{name: "invalid window", windows: "Mon-Thu 14:00-22:00,Fri", wantErr: true},
+		{name: "invalid time zone", windows: "Mon 14:00-22:00", tz: "Mars/Olympus_Mons", wantErr: true},
+		{name: "invalid blackout", blackouts: "2023-12-20", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEPLOY_WINDOWS", test.windows)
+			t.Setenv("DEPLOY_WINDOWS_TZ", test.tz)
+			t.Setenv("DEPLOY_BLACKOUTS", test.blackouts)
+			w, err := ParseDeployWindows()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", w)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(w.allowed) != test.allowed {
+				t.Errorf("allowed: got %d, want %d", len(w.allowed), test.allowed)
+			}
+			if w.location.String() != test.location {
+				t.Errorf("location: got %s, want %s", w.location, test.location)
+			}
+		})
+	}
+}
+
+func TestDeployWindowsCheck(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(value string) time.Time {
+		ts, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	mustWindow := func(spec string) deployWindow {
+		window, err := parseDeployWindow(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return window
+	}
+	weekdays := &DeployWindows{allowed: []deployWindow{mustWindow("Mon-Fri 14:00-22:00")}, location: time.UTC}
+	tests := []struct {
+		name    string
+		windows *DeployWindows
+		now     string
+		allowed bool
+	}{
+		{name: "no windows", windows: &DeployWindows{location: time.UTC}, now: "2024-01-06T03:00:00Z", allowed: true},
+		{name: "inside window", windows: weekdays, now: "2024-01-08T14:00:00Z", allowed: true},
+		{name: "before window", windows: weekdays, now: "2024-01-08T13:59:59Z"},
+		{name: "window end is exclusive", windows: weekdays, now: "2024-01-08T22:00:00Z"},
+		{name: "wrong day", windows: weekdays, now: "2024-01-06T15:00:00Z"},
+		{
+			name:    "window until midnight",
+			windows: &DeployWindows{allowed: []deployWindow{mustWindow("Sat 20:00-24:00")}, location: time.UTC},
+			now:     "2024-01-06T23:59:00Z",
+			allowed: true,
+		},
+		{
+			name:    "window in time zone",
+			windows: &DeployWindows{allowed: []deployWindow{mustWindow("Mon 09:00-17:00")}, location: newYork},
+			now:     "2024-01-08T14:30:00Z", // 09:30 EST
+			allowed: true,
+		},
+		{
+			// Clocks skip from 02:00 to 03:00 on 2024-03-10, so only 2.5 hours have passed since midnight at 03:30
+			name:    "window after daylight saving time starts",
+			windows: &DeployWindows{allowed: []deployWindow{mustWindow("Sun 03:00-04:00")}, location: newYork},
+			now:     "2024-03-10T07:30:00Z", // 03:30 EDT
+			allowed: true,
+		},
+		{
+			// Clocks fall back from 02:00 to 01:00 on 2024-11-03, so 4.5 hours have passed since midnight at 03:30
+			name:    "window after daylight saving time ends",
+			windows: &DeployWindows{allowed: []deployWindow{mustWindow("Sun 04:00-05:00")}, location: newYork},
+			now:     "2024-11-03T08:30:00Z", // 03:30 EST
+		},
+		{
+			name: "blackout inside window",
+			windows: &DeployWindows{
+				allowed:   weekdays.allowed,
+				blackouts: []blackoutPeriod{{start: parse("2024-01-08T00:00:00Z"), end: parse("2024-01-09T00:00:00Z")}},
+				location:  time.UTC,
+			},
+			now: "2024-01-08T15:00:00Z",
+		},
+		{
+			name: "after blackout",
+			windows: &DeployWindows{
+				blackouts: []blackoutPeriod{{start: parse("2024-01-08T00:00:00Z"), end: parse("2024-01-09T00:00:00Z")}},
+				location:  time.UTC,
+			},
+			now:     "2024-01-09T00:00:00Z",
+			allowed: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.windows.check(parse(test.now))
+			if test.allowed && (err != nil) {
+				t.Errorf("expected deployment to be allowed, got %v", err)
+			} else if !test.allowed && !errors.Is(err, manager.Error_DeployBlackout) {
+				t.Errorf("expected blackout error, got %v", err)
+			}
+		})
+	}
+}
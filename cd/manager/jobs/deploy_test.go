@@ -0,0 +1,436 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+// fakeDb records the deploy tags written by a job, returns the latest state of other jobs, and fails reads if requested.
+// Only the methods used by the tests are implemented.
+type fakeDb struct {
+	manager.Database
+	deployTags map[manager.DeployComponent]string
+	jobs       map[string]job.JobState
+	err        error
+}
+
+func (db *fakeDb) IterateByJob(jobId string, _ bool, iter func(job.JobState) bool) error {
+	if db.err != nil {
+		return db.err
+	} else if jobState, found := db.jobs[jobId]; found {
+		iter(jobState)
+	}
+	return nil
+}
+
+func (db *fakeDb) AdvanceJob(job.JobState) error {
+	return nil
+}
+
+func (db *fakeDb) UpdateDeployTag(component manager.DeployComponent, deployTag string) error {
+	db.deployTags[component] = deployTag
+	return nil
+}
+
+// GetDeployTag strips the deployment target recorded along with the tag, like the real database
+func (db *fakeDb) GetDeployTag(component manager.DeployComponent) (string, error) {
+	if db.err != nil {
+		return "", db.err
+	}
+	return strings.Split(db.deployTags[component], ",")[0], nil
+}
+
+func (db *fakeDb) UpdateDeployVersion(manager.DeployComponent, string) error {
+	return nil
+}
+
+func (db *fakeDb) UpdateDeployJob(manager.DeployComponent, string) error {
+	return nil
+}
+
+type fakeNotifs struct{}
+
+func (n fakeNotifs) NotifyJob(...job.JobState) bool {
+	return true
+}
+
+// fakeDeployment reports whether the services in a layout are deployed, and records how often the environment is
+// updated and how staged rollouts are ramped. It can also return the layout currently running in the environment, and
+// the image of each task definition.
+type fakeDeployment struct {
+	manager.Deployment
+	deployed bool
+	updates  int
+	checked  []*manager.Layout
+	ramped   []int
+	layout   *manager.Layout
+	images   map[string]string
+}
+
+func (d *fakeDeployment) GetLayout(context.Context, []string) (*manager.Layout, error) {
+	return d.layout, nil
+}
+
+func (d *fakeDeployment) ListServices(_ context.Context, cluster string) ([]string, error) {
+	services := make([]string, 0)
+	if clusterLayout, found := d.layout.Clusters[cluster]; found && (clusterLayout.ServiceTasks != nil) {
+		for service := range clusterLayout.ServiceTasks.Tasks {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (d *fakeDeployment) GetContainerImage(_ context.Context, taskDefArn, _ string) (string, error) {
+	return d.images[taskDefArn], nil
+}
+
+func (d *fakeDeployment) UpdateLayout(context.Context, *manager.Layout, string, string, string, string, bool, int) error {
+	d.updates++
+	return nil
+}
+
+func (d *fakeDeployment) CheckLayout(_ context.Context, layout *manager.Layout) (bool, error) {
+	d.checked = append(d.checked, layout)
+	return d.deployed, nil
+}
+
+func (d *fakeDeployment) RampLayout(_ context.Context, layout *manager.Layout, percent int) error {
+	d.ramped = append(d.ramped, percent)
+	return nil
+}
+
+func TestDeployJobAdvance(t *testing.T) {
+	t.Setenv("KEEP_TASK_DEFS", "0")
+	start := time.Date(2024, 1, 8, 15, 0, 0, 0, time.UTC)
+	layout := func() manager.Layout {
+		return manager.Layout{
+			Clusters: map[string]*manager.Cluster{
+				"ceramic-dev": {
+					ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+						"ceramic-dev-node": {Id: "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"},
+					}},
+				},
+			},
+			Repo: &manager.Repo{Name: "ceramic-dev"},
+		}
+	}
+	type step struct {
+		elapsed  time.Duration // Time since the start of the test
+		deployed bool
+		stage    job.JobStage
+		err      error
+	}
+	tests := []struct {
+		name   string
+		stage  job.JobStage
+		params map[string]interface{}
+		steps  []step
+		ramped []int
+	}{
+		{
+			name:  "approval expires",
+			stage: job.JobStage_WaitingApproval,
+			steps: []step{
+				{elapsed: 11 * time.Hour, stage: job.JobStage_WaitingApproval},
+				{elapsed: 12*time.Hour + time.Minute, stage: job.JobStage_Canceled, err: manager.Error_ApprovalExpired},
+			},
+		},
+		{
+			name:  "deployed",
+			stage: job.JobStage_Started,
+			steps: []step{
+				{elapsed: 5 * time.Minute, stage: job.JobStage_Started},
+				{elapsed: 10 * time.Minute, deployed: true, stage: job.JobStage_Completed},
+			},
+		},
+		{
+			name:  "times out",
+			stage: job.JobStage_Started,
+			steps: []step{
+				{elapsed: 25 * time.Minute, stage: job.JobStage_Started},
+				{elapsed: 31 * time.Minute, stage: job.JobStage_Failed, err: manager.Error_CompletionTimeout},
+			},
+		},
+		{
+			name:  "staged rollout",
+			stage: job.JobStage_Started,
+			params: map[string]interface{}{
+				job.DeployJobParam_RolloutSteps:     []interface{}{float64(50), float64(100)},
+				job.DeployJobParam_RolloutStep:      float64(0),
+				job.DeployJobParam_RolloutStepStart: float64(start.UnixNano()),
+			},
+			steps: []step{
+				{elapsed: 10 * time.Minute, deployed: true, stage: job.JobStage_Started},
+				// Each step gets the full time to complete, counted from when the step started
+				{elapsed: 35 * time.Minute, stage: job.JobStage_Started},
+				{elapsed: 41 * time.Minute, stage: job.JobStage_Failed, err: manager.Error_CompletionTimeout},
+			},
+			ramped: []int{100},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := map[string]interface{}{
+				job.DeployJobParam_Component: string(manager.DeployComponent_Ceramic),
+				job.DeployJobParam_Sha:       "0123456789abcdef0123456789abcdef01234567",
+				job.DeployJobParam_ShaTag:    "0123456",
+				job.DeployJobParam_Layout:    layout(),
+				job.JobParam_Start:           float64(start.UnixNano()),
+			}
+			for k, v := range test.params {
+				params[k] = v
+			}
+			jobState := job.JobState{JobId: "deploy", Type: job.JobType_Deploy, Stage: test.stage, Ts: start, Params: params}
+			db := &fakeDb{deployTags: make(map[manager.DeployComponent]string)}
+			d := &fakeDeployment{}
+			clock := newFakeClock(start)
+			for _, step := range test.steps {
+				clock.advance(start.Add(step.elapsed).Sub(clock.Now()))
+				d.deployed = step.deployed
+				jobSm, err := DeployJob(jobState, db, fakeNotifs{}, d, nil, clock, nil)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if jobState, _, err = jobSm.Advance(context.Background()); err != nil {
+					t.Fatalf("%s: unexpected error: %v", step.elapsed, err)
+				}
+				if jobState.Stage != step.stage {
+					t.Fatalf("%s: got stage %s, want %s", step.elapsed, jobState.Stage, step.stage)
+				}
+				errMsg, _ := jobState.Params[job.JobParam_Error].(string)
+				if (step.err != nil) && !strings.Contains(errMsg, step.err.Error()) {
+					t.Errorf("%s: got error %q, want %q", step.elapsed, errMsg, step.err)
+				} else if (step.err == nil) && (len(errMsg) > 0) {
+					t.Errorf("%s: unexpected error: %s", step.elapsed, errMsg)
+				}
+			}
+			if fmt.Sprint(d.ramped) != fmt.Sprint(test.ramped) {
+				t.Errorf("ramped: got %v, want %v", d.ramped, test.ramped)
+			}
+			if jobState.Stage == job.JobStage_Completed {
+				if deployTag := db.deployTags[manager.DeployComponent_Ceramic]; len(deployTag) == 0 {
+					t.Error("expected deploy tag to be updated")
+				}
+			}
+		})
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   bool
+	}{
+		{name: "not approved", params: map[string]interface{}{}, want: true},
+		{
+			name:   "approval on requested job",
+			params: map[string]interface{}{job.DeployJobParam_ApprovedBy: "someone"},
+			want:   true,
+		},
+		{
+			name:   "approved retry",
+			params: map[string]interface{}{job.DeployJobParam_ApprovedBy: "someone", job.JobParam_Retries: float64(1)},
+			want:   false,
+		},
+		{
+			name:   "unapproved retry",
+			params: map[string]interface{}{job.JobParam_Retries: float64(1)},
+			want:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := deployJob{baseJob: baseJob{state: job.JobState{JobId: "deploy", Params: test.params}}, env: string(manager.EnvType_Prod)}
+			if got := d.requiresApproval(); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeployJobResume(t *testing.T) {
+	t.Setenv("KEEP_TASK_DEFS", "0")
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	start := time.Date(2024, 1, 8, 15, 0, 0, 0, time.UTC)
+	// A started job reloaded from the database after a restart, with the layout holding the task definitions it deployed
+	jobState := job.JobState{
+		JobId: "deploy",
+		Type:  job.JobType_Deploy,
+		Stage: job.JobStage_Started,
+		Ts:    start,
+		Params: map[string]interface{}{
+			job.DeployJobParam_Component: string(manager.DeployComponent_Ceramic),
+			job.DeployJobParam_Sha:       "0123456789abcdef0123456789abcdef01234567",
+			job.DeployJobParam_ShaTag:    "0123456",
+			job.DeployJobParam_Layout: map[string]interface{}{
+				"clusters": map[string]interface{}{
+					"ceramic-dev": map[string]interface{}{
+						"serviceTasks": map[string]interface{}{
+							"tasks": map[string]interface{}{"ceramic-dev-node": map[string]interface{}{"id": taskDefArn}},
+						},
+					},
+				},
+				"repo": map[string]interface{}{"name": "ceramic-dev"},
+			},
+			job.JobParam_Start: float64(start.UnixNano()),
+		},
+	}
+	db := &fakeDb{deployTags: make(map[manager.DeployComponent]string)}
+	d := &fakeDeployment{}
+	clock := newFakeClock(start)
+	for _, deployed := range []bool{false, true} {
+		clock.advance(5 * time.Minute)
+		d.deployed = deployed
+		jobSm, err := DeployJob(jobState, db, fakeNotifs{}, d, nil, clock, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if jobState, _, err = jobSm.Advance(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if d.updates != 0 {
+		t.Errorf("resumed job updated the environment %d times", d.updates)
+	}
+	if len(d.checked) != 2 {
+		t.Fatalf("got %d checks, want 2", len(d.checked))
+	}
+	for _, layout := range d.checked {
+		if task := layout.Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"]; task.Id != taskDefArn {
+			t.Errorf("checked task %q, want %q", task.Id, taskDefArn)
+		}
+	}
+	if jobState.Stage != job.JobStage_Completed {
+		t.Errorf("got stage %s, want %s", jobState.Stage, job.JobStage_Completed)
+	}
+}
+
+func TestCheckDependency(t *testing.T) {
+	deploy := func(jobId string, stage job.JobStage, supersededBy string) job.JobState {
+		params := map[string]interface{}{job.DeployJobParam_Component: string(manager.DeployComponent_Ipfs)}
+		if len(supersededBy) > 0 {
+			params[job.DeployJobParam_SupersededBy] = supersededBy
+		}
+		return job.JobState{JobId: jobId, Type: job.JobType_Deploy, Stage: stage, Params: params}
+	}
+	tests := []struct {
+		name      string
+		dependsOn string
+		jobs      []job.JobState
+		ready     bool
+		err       bool
+	}{
+		{name: "no dependency", ready: true},
+		{name: "self", dependsOn: "deploy", err: true},
+		{name: "not found", dependsOn: "ipfs"},
+		{name: "in progress", dependsOn: "ipfs", jobs: []job.JobState{deploy("ipfs", job.JobStage_Started, "")}},
+		{name: "completed", dependsOn: "ipfs", jobs: []job.JobState{deploy("ipfs", job.JobStage_Completed, "")}, ready: true},
+		{name: "failed", dependsOn: "ipfs", jobs: []job.JobState{deploy("ipfs", job.JobStage_Failed, "")}, err: true},
+		{name: "already deployed", dependsOn: "ipfs", jobs: []job.JobState{deploy("ipfs", job.JobStage_Skipped, "")}, ready: true},
+		{
+			name:      "collapsed, replacement in progress",
+			dependsOn: "ipfs",
+			jobs:      []job.JobState{deploy("ipfs", job.JobStage_Skipped, "ipfs-2"), deploy("ipfs-2", job.JobStage_Started, "")},
+		},
+		{
+			name:      "collapsed twice, replacement completed",
+			dependsOn: "ipfs",
+			jobs: []job.JobState{
+				deploy("ipfs", job.JobStage_Skipped, "ipfs-2"),
+				deploy("ipfs-2", job.JobStage_Skipped, "ipfs-3"),
+				deploy("ipfs-3", job.JobStage_Completed, ""),
+			},
+			ready: true,
+		},
+		{
+			name:      "collapsed, replacement failed",
+			dependsOn: "ipfs",
+			jobs:      []job.JobState{deploy("ipfs", job.JobStage_Skipped, "ipfs-2"), deploy("ipfs-2", job.JobStage_Failed, "")},
+			err:       true,
+		},
+		{name: "collapsed into this deployment", dependsOn: "ipfs", jobs: []job.JobState{deploy("ipfs", job.JobStage_Skipped, "deploy")}, ready: true},
+		{
+			name:      "circular",
+			dependsOn: "ipfs",
+			jobs:      []job.JobState{deploy("ipfs", job.JobStage_Skipped, "ipfs-2"), deploy("ipfs-2", job.JobStage_Skipped, "ipfs")},
+			err:       true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := &fakeDb{jobs: make(map[string]job.JobState)}
+			for _, jobState := range test.jobs {
+				db.jobs[jobState.JobId] = jobState
+			}
+			params := map[string]interface{}{}
+			if len(test.dependsOn) > 0 {
+				params[job.JobParam_DependsOn] = test.dependsOn
+			}
+			d := deployJob{baseJob: baseJob{state: job.JobState{JobId: "deploy", Type: job.JobType_Deploy, Params: params}, db: db}}
+			ready, err := d.checkDependency()
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error: %v", err, test.err)
+			} else if ready != test.ready {
+				t.Errorf("got ready %v, want %v", ready, test.ready)
+			}
+		})
+	}
+}
+
+func TestParseKeepTaskDefs(t *testing.T) {
+	tests := []struct {
+		config       string
+		keepTaskDefs int
+		err          bool
+	}{
+		{config: "5", keepTaskDefs: 5},
+		{config: "0", keepTaskDefs: 0},
+		{config: "-1", err: true},
+		{config: "ten", err: true},
+		{config: "", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.config, func(t *testing.T) {
+			t.Setenv("KEEP_TASK_DEFS", test.config)
+			keepTaskDefs, err := ParseKeepTaskDefs()
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error: %v", err, test.err)
+			} else if keepTaskDefs != test.keepTaskDefs {
+				t.Errorf("got %d, want %d", keepTaskDefs, test.keepTaskDefs)
+			}
+		})
+	}
+}
+
+func TestParseApprovalWindow(t *testing.T) {
+	tests := []struct {
+		config         string
+		approvalWindow time.Duration
+		err            bool
+	}{
+		{config: "6h", approvalWindow: 6 * time.Hour},
+		{config: "0s", err: true},
+		{config: "-1h", err: true},
+		{config: "six hours", err: true},
+		{config: "", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.config, func(t *testing.T) {
+			t.Setenv("DEPLOY_APPROVAL_WINDOW", test.config)
+			approvalWindow, err := ParseApprovalWindow()
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error: %v", err, test.err)
+			} else if approvalWindow != test.approvalWindow {
+				t.Errorf("got %s, want %s", approvalWindow, test.approvalWindow)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -28,7 +29,7 @@ func E2eTestJob(jobState job.JobState, db manager.Database, notifs manager.Notif
 	return &e2eTestJob{baseJob{jobState, db, notifs}, d}
 }
 
-func (e e2eTestJob) Advance() (job.JobState, error) {
+func (e e2eTestJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
 	now := time.Now()
 	switch e.state.Stage {
 	case job.JobStage_Queued:
@@ -41,7 +42,7 @@ func (e e2eTestJob) Advance() (job.JobState, error) {
 		}
 	case job.JobStage_Dequeued:
 		{
-			if err := e.startAllTests(); err != nil {
+			if err := e.startAllTests(ctx); err != nil {
 				return e.advance(job.JobStage_Failed, now, err)
 			} else {
 				e.state.Params[job.JobParam_Start] = float64(time.Now().UnixNano())
@@ -50,7 +51,7 @@ func (e e2eTestJob) Advance() (job.JobState, error) {
 		}
 	case job.JobStage_Started:
 		{
-			if running, err := e.checkAllTests(true); err != nil {
+			if running, err := e.checkAllTests(ctx, true); err != nil {
 				return e.advance(job.JobStage_Failed, now, err)
 			} else if running {
 				return e.advance(job.JobStage_Waiting, now, nil)
@@ -58,12 +59,12 @@ func (e e2eTestJob) Advance() (job.JobState, error) {
 				return e.advance(job.JobStage_Failed, now, manager.Error_StartupTimeout)
 			} else {
 				// Return so we come back again to check
-				return e.state, nil
+				return e.state, manager.AdvanceResult{}, nil
 			}
 		}
 	case job.JobStage_Waiting:
 		{
-			if stopped, err := e.checkAllTests(false); err != nil {
+			if stopped, err := e.checkAllTests(ctx, false); err != nil {
 				return e.advance(job.JobStage_Failed, now, err)
 			} else if stopped {
 				return e.advance(job.JobStage_Completed, now, nil)
@@ -71,7 +72,7 @@ func (e e2eTestJob) Advance() (job.JobState, error) {
 				return e.advance(job.JobStage_Failed, now, manager.Error_CompletionTimeout)
 			} else {
 				// Return so we come back again to check
-				return e.state, nil
+				return e.state, manager.AdvanceResult{}, nil
 			}
 		}
 	default:
@@ -81,41 +82,49 @@ func (e e2eTestJob) Advance() (job.JobState, error) {
 	}
 }
 
-func (e e2eTestJob) startAllTests() error {
-	if err := e.startTests(e2eTest_PrivatePublic); err != nil {
+func (e e2eTestJob) startAllTests(ctx context.Context) error {
+	if err := e.startTests(ctx, e2eTest_PrivatePublic); err != nil {
 		return err
-	} else if err = e.startTests(e2eTest_LocalClientPublic); err != nil {
+	} else if err = e.startTests(ctx, e2eTest_LocalClientPublic); err != nil {
 		return err
 	} else {
 		return nil
 	}
 }
 
-func (e e2eTestJob) startTests(config string) error {
+func (e e2eTestJob) startTests(ctx context.Context, config string) error {
+	// Multiple test tasks are launched from the same task family for each job, so qualify the launch with the config.
 	if id, err := e.d.LaunchServiceTask(
+		ctx,
 		"ceramic-qa-tests",
 		"ceramic-qa-tests-e2e_tests",
 		"ceramic-qa-tests-e2e_tests",
 		"e2e_tests",
-		map[string]string{
-			"NODE_ENV":                      config,
-			"ETH_RPC_URL":                   os.Getenv("BLOCKCHAIN_RPC_URL"),
-			"AWS_ACCESS_KEY_ID":             os.Getenv("E2E_AWS_ACCESS_KEY_ID"),
-			"AWS_SECRET_ACCESS_KEY":         os.Getenv("E2E_AWS_SECRET_ACCESS_KEY"),
-			"AWS_REGION":                    os.Getenv("AWS_REGION"),
-			"CERAMIC_NODE_PRIVATE_SEED_URL": os.Getenv("CERAMIC_NODE_PRIVATE_SEED_URL"),
+		manager.LaunchOptions{
+			JobId:       e.state.JobId + "/" + config,
+			RequestedBy: e.requestedBy(),
+			Overrides: map[string]string{
+				"NODE_ENV":                      config,
+				"ETH_RPC_URL":                   os.Getenv("BLOCKCHAIN_RPC_URL"),
+				"AWS_ACCESS_KEY_ID":             os.Getenv("E2E_AWS_ACCESS_KEY_ID"),
+				"AWS_SECRET_ACCESS_KEY":         os.Getenv("E2E_AWS_SECRET_ACCESS_KEY"),
+				"AWS_REGION":                    os.Getenv("AWS_REGION"),
+				"CERAMIC_NODE_PRIVATE_SEED_URL": os.Getenv("CERAMIC_NODE_PRIVATE_SEED_URL"),
+			},
 		}); err != nil {
 		return err
 	} else {
 		e.state.Params[config] = id
+		// Don't record the full set of overrides since they contain credentials
+		e.recordLaunchedTask(id, map[string]string{"NODE_ENV": config})
 		return nil
 	}
 }
 
-func (e e2eTestJob) checkAllTests(expectedToBeRunning bool) (bool, error) {
-	if privatePublicStatus, err := e.checkTests(e.state.Params[e2eTest_PrivatePublic].(string), expectedToBeRunning); err != nil {
+func (e e2eTestJob) checkAllTests(ctx context.Context, expectedToBeRunning bool) (bool, error) {
+	if privatePublicStatus, err := e.checkTests(ctx, e.state.Params[e2eTest_PrivatePublic].(string), expectedToBeRunning); err != nil {
 		return false, err
-	} else if localClientPublicStatus, err := e.checkTests(e.state.Params[e2eTest_LocalClientPublic].(string), expectedToBeRunning); err != nil {
+	} else if localClientPublicStatus, err := e.checkTests(ctx, e.state.Params[e2eTest_LocalClientPublic].(string), expectedToBeRunning); err != nil {
 		return false, err
 	} else if privatePublicStatus && localClientPublicStatus {
 		return true, nil
@@ -123,8 +132,8 @@ func (e e2eTestJob) checkAllTests(expectedToBeRunning bool) (bool, error) {
 	return false, nil
 }
 
-func (e e2eTestJob) checkTests(taskId string, expectedToBeRunning bool) (bool, error) {
-	if status, exitCode, err := e.d.CheckTask("ceramic-qa-tests", "", expectedToBeRunning, false, taskId); err != nil {
+func (e e2eTestJob) checkTests(ctx context.Context, taskId string, expectedToBeRunning bool) (bool, error) {
+	if status, exitCode, err := e.d.CheckTask(ctx, "ceramic-qa-tests", "", expectedToBeRunning, false, taskId); err != nil {
 		return false, err
 	} else if status {
 		// If a non-zero exit code was present, at least one of the test tasks failed to complete successfully.
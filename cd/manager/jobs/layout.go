@@ -0,0 +1,717 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+const (
+	serviceSuffix_CeramicNode  string = "node"
+	serviceSuffix_IpfsNode     string = "ipfs-nd"
+	serviceSuffix_CasApi       string = "api"
+	serviceSuffix_CasWorker    string = "anchor"
+	serviceSuffix_CasScheduler string = "scheduler"
+	serviceSuffix_Elp          string = "elp"
+)
+
+const (
+	containerName_CeramicNode    string = "ceramic_node"
+	containerName_IpfsNode       string = "go-ipfs"
+	containerName_CasApi         string = "cas_api"
+	containerName_CasWorker      string = "cas_anchor"
+	containerName_CasV5Scheduler string = "scheduler"
+	containerName_RustCeramic    string = "rust-ceramic"
+)
+
+// ComponentLayout describes how the layout for a component is built from the clusters and services found in ECS
+type ComponentLayout struct {
+	EcrRepo manager.Repo
+	// Task returns the task to deploy for a service if the service belongs to the component, nil otherwise
+	Task func(envClusters manager.EnvClusters, cluster, service string, containerNames []string) *manager.Task
+	// Runners optionally returns the runners to add to a cluster that contains at least one of the component's services
+	Runners func(envClusters manager.EnvClusters, cluster string) map[string]*manager.Task
+}
+
+var componentLayouts = map[manager.DeployComponent]ComponentLayout{
+	manager.DeployComponent_Ceramic: {
+		EcrRepo: manager.Repo{Name: "ceramic-prod"},
+		Task: func(envClusters manager.EnvClusters, cluster, service string, _ []string) *manager.Task {
+			// Ceramic nodes are deployed to the private and public clusters, but not to the CAS cluster.
+			if (cluster != envClusters.Cas) && strings.Contains(service, serviceSuffix_CeramicNode) {
+				return &manager.Task{Name: containerName_CeramicNode}
+			}
+			return nil
+		},
+	},
+	manager.DeployComponent_Ipfs: {
+		EcrRepo: manager.Repo{Name: "go-ipfs-prod"},
+		Task: func(_ manager.EnvClusters, _, service string, containerNames []string) *manager.Task {
+			if strings.Contains(service, serviceSuffix_IpfsNode) && slices.Contains(containerNames, containerName_IpfsNode) {
+				return &manager.Task{Name: containerName_IpfsNode}
+			}
+			return nil
+		},
+	},
+	manager.DeployComponent_Cas: {
+		EcrRepo: manager.Repo{Name: "ceramic-prod-cas"},
+		Task: func(envClusters manager.EnvClusters, cluster, service string, _ []string) *manager.Task {
+			if (cluster == envClusters.Cas) && strings.Contains(service, serviceSuffix_CasApi) {
+				return &manager.Task{Name: containerName_CasApi}
+			}
+			return nil
+		},
+		// The Anchor Worker doesn't get updated through an ECS service, so add it to the layout separately
+		Runners: func(envClusters manager.EnvClusters, cluster string) map[string]*manager.Task {
+			if cluster == envClusters.Cas {
+				return map[string]*manager.Task{cluster + "-" + serviceSuffix_CasWorker: {Name: containerName_CasWorker}}
+			}
+			return nil
+		},
+	},
+	manager.DeployComponent_CasV5: {
+		EcrRepo: manager.Repo{Name: "app-cas-scheduler"},
+		Task: func(envClusters manager.EnvClusters, cluster, service string, _ []string) *manager.Task {
+			if (cluster == envClusters.CasV5) && strings.Contains(service, serviceSuffix_CasScheduler) {
+				return &manager.Task{Name: containerName_CasV5Scheduler}
+			}
+			return nil
+		},
+	},
+	manager.DeployComponent_RustCeramic: {
+		EcrRepo: manager.Repo{Name: "ceramic-one", Public: true},
+		Task: func(_ manager.EnvClusters, _, service string, containerNames []string) *manager.Task {
+			if strings.Contains(service, serviceSuffix_IpfsNode) && slices.Contains(containerNames, containerName_RustCeramic) {
+				return &manager.Task{Name: containerName_RustCeramic}
+			}
+			return nil
+		},
+	},
+}
+
+func generateEnvLayout(ctx context.Context, d manager.Deployment, env string, component manager.DeployComponent) (*manager.Layout, error) {
+	if ecrRepo, err := componentEcrRepo(component); err != nil {
+		return nil, err
+	} else if layoutConfig, err := loadLayoutConfig(env); err != nil {
+		return nil, err
+	} else
+	// Populate the service layout by retrieving the clusters/services from ECS
+	if currentLayout, err := d.GetLayout(ctx, envClusterNames(env)); err != nil {
+		return nil, err
+	} else {
+		return envComponentLayout(env, component, ecrRepo, currentLayout, layoutConfig), nil
+	}
+}
+
+// DescribeEnvLayout returns the layout that would be used to deploy a component, without changing anything. It also
+// cross-checks the layout against the services currently present in ECS so that drift is visible:
+//   - services in the layout that aren't present in ECS. Built-in layouts are generated from the services in ECS, so
+//     only services in a configured layout (see loadLayoutConfig) can be missing, e.g. after being deleted or renamed.
+//   - services present in ECS that aren't part of any component's layout (e.g. ELP services, manually created services)
+func DescribeEnvLayout(ctx context.Context, d manager.Deployment, env string, component manager.DeployComponent) (*manager.LayoutDrift, error) {
+	if ecrRepo, err := componentEcrRepo(component); err != nil {
+		return nil, err
+	} else if layoutConfig, err := loadLayoutConfig(env); err != nil {
+		return nil, err
+	} else if currentLayout, err := d.GetLayout(ctx, envClusterNames(env)); err != nil {
+		return nil, err
+	} else {
+		drift := &manager.LayoutDrift{
+			Layout:    envComponentLayout(env, component, ecrRepo, currentLayout, layoutConfig),
+			Missing:   map[string][]string{},
+			Unmanaged: map[string][]string{},
+		}
+		clusterServices := make(map[string][]string, len(currentLayout.Clusters))
+		for cluster, currentClusterLayout := range currentLayout.Clusters {
+			if services, err := d.ListServices(ctx, cluster); err != nil {
+				return nil, err
+			} else {
+				clusterServices[cluster] = services
+				for _, service := range services {
+					containerNames := make([]string, 0)
+					if task, found := currentClusterLayout.ServiceTasks.Tasks[service]; found {
+						containerNames = strings.Split(task.Name, ",")
+					}
+					if !isManagedService(env, cluster, service, containerNames, layoutConfig) {
+						drift.Unmanaged[cluster] = append(drift.Unmanaged[cluster], service)
+					}
+				}
+			}
+		}
+		// Check the layout's clusters rather than the ones found in ECS, so that services in clusters that don't exist
+		// are reported too.
+		for cluster, clusterLayout := range drift.Layout.Clusters {
+			if clusterLayout.ServiceTasks != nil {
+				for service := range clusterLayout.ServiceTasks.Tasks {
+					if !slices.Contains(clusterServices[cluster], service) {
+						drift.Missing[cluster] = append(drift.Missing[cluster], service)
+					}
+				}
+				slices.Sort(drift.Missing[cluster])
+			}
+		}
+		return drift, nil
+	}
+}
+
+// ResolveRevision checks that an active task definition revision from the same deployment exists for each service
+// deployed for a component, and returns the image tag that the revisions deploy. The revision is a task definition ARN
+// or "family:revision" of one of the services, or a revision number for components whose services share a task family.
+func ResolveRevision(ctx context.Context, d manager.Deployment, env string, component manager.DeployComponent, revision string) (string, error) {
+	layout, err := generateEnvLayout(ctx, d, env, component)
+	if err != nil {
+		return "", err
+	} else if err = d.ResolveRevision(ctx, layout, revision); err != nil {
+		return "", err
+	}
+	deployTag := ""
+	for _, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for service, task := range cluster.ServiceTasks.Tasks {
+				if image, err := d.GetContainerImage(ctx, task.Id, task.Name); err != nil {
+					return "", fmt.Errorf("resolveRevision: %s: %w", service, err)
+				} else if tag := imageTag(image); len(deployTag) == 0 {
+					deployTag = tag
+				} else if tag != deployTag {
+					return "", fmt.Errorf("resolveRevision: revisions deploy different image tags: %s, %s, %s", service, deployTag, tag)
+				}
+			}
+		}
+	}
+	if len(deployTag) == 0 {
+		return "", fmt.Errorf("resolveRevision: no services found: %s", component)
+	}
+	return deployTag, nil
+}
+
+// serviceLayout removes everything but services from a layout, including from its regional layouts
+func serviceLayout(layout *manager.Layout) {
+	for _, cluster := range layout.Clusters {
+		cluster.Tasks = nil
+		cluster.Runners = nil
+	}
+	for _, regionLayout := range layout.Regions {
+		serviceLayout(regionLayout)
+	}
+}
+
+// mergeLayout adds the clusters and tasks of another component's layout to a layout, so that both components are
+// deployed together. Merged tasks carry their own repo and image tag since they differ from those of the layout they
+// are merged into. A task that's part of both layouts is an error since it can only be deployed from one image.
+func mergeLayout(layout, otherLayout *manager.Layout, tag string) error {
+	for clusterName, otherCluster := range otherLayout.Clusters {
+		cluster, found := layout.Clusters[clusterName]
+		if !found {
+			cluster = &manager.Cluster{}
+			layout.Clusters[clusterName] = cluster
+		}
+		if taskSet, err := mergeTaskSet(cluster.ServiceTasks, otherCluster.ServiceTasks, otherLayout, otherCluster, tag); err != nil {
+			return err
+		} else {
+			cluster.ServiceTasks = taskSet
+		}
+		if taskSet, err := mergeTaskSet(cluster.Tasks, otherCluster.Tasks, otherLayout, otherCluster, tag); err != nil {
+			return err
+		} else {
+			cluster.Tasks = taskSet
+		}
+		if taskSet, err := mergeTaskSet(cluster.Runners, otherCluster.Runners, otherLayout, otherCluster, tag); err != nil {
+			return err
+		} else {
+			cluster.Runners = taskSet
+		}
+	}
+	for region, otherRegionLayout := range otherLayout.Regions {
+		if regionLayout, found := layout.Regions[region]; !found {
+			return fmt.Errorf("mergeLayout: missing region: %s", region)
+		} else if err := mergeLayout(regionLayout, otherRegionLayout, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeTaskSet(taskSet, otherTaskSet *manager.TaskSet, otherLayout *manager.Layout, otherCluster *manager.Cluster, tag string) (*manager.TaskSet, error) {
+	if otherTaskSet == nil {
+		return taskSet, nil
+	} else if taskSet == nil {
+		taskSet = &manager.TaskSet{Tasks: make(map[string]*manager.Task, len(otherTaskSet.Tasks))}
+	}
+	for taskName, task := range otherTaskSet.Tasks {
+		if _, found := taskSet.Tasks[taskName]; found {
+			return nil, fmt.Errorf("mergeLayout: task in multiple components: %s", taskName)
+		}
+		// Pin the repo that the task would have been deployed from as part of its own component's layout
+		if task.Repo == nil {
+			if otherTaskSet.Repo != nil {
+				task.Repo = otherTaskSet.Repo
+			} else if otherCluster.Repo != nil {
+				task.Repo = otherCluster.Repo
+			} else {
+				task.Repo = otherLayout.Repo
+			}
+		}
+		// Likewise for the stabilization timeout the task would have had
+		if len(task.StabilizeTimeout) == 0 {
+			task.StabilizeTimeout = otherTaskSet.StabilizeTimeout
+		}
+		task.Tag = tag
+		taskSet.Tasks[taskName] = task
+	}
+	return taskSet, nil
+}
+
+// layoutTaskCount returns the number of services, tasks, and runners in a layout, including additional regions
+// copyLayout returns a copy of a layout whose clusters and tasks can be updated without affecting the original, e.g. the
+// layout stored in a cached job state. Repos and placements are shared since they're never updated.
+func copyLayout(layout *manager.Layout) *manager.Layout {
+	layoutCopy := *layout
+	layoutCopy.Clusters = make(map[string]*manager.Cluster, len(layout.Clusters))
+	for clusterName, cluster := range layout.Clusters {
+		clusterCopy := *cluster
+		clusterCopy.ServiceTasks = copyTaskSet(cluster.ServiceTasks)
+		clusterCopy.Tasks = copyTaskSet(cluster.Tasks)
+		clusterCopy.Runners = copyTaskSet(cluster.Runners)
+		layoutCopy.Clusters[clusterName] = &clusterCopy
+	}
+	if layout.Regions != nil {
+		layoutCopy.Regions = make(map[string]*manager.Layout, len(layout.Regions))
+		for region, regionLayout := range layout.Regions {
+			layoutCopy.Regions[region] = copyLayout(regionLayout)
+		}
+	}
+	return &layoutCopy
+}
+
+// layoutStaged returns whether any services in a layout, including its regional layouts, are being deployed in stages
+func layoutStaged(layout *manager.Layout) bool {
+	for _, cluster := range layout.Clusters {
+		if cluster.ServiceTasks != nil {
+			for _, task := range cluster.ServiceTasks.Tasks {
+				if task.RolloutPercent > 0 {
+					return true
+				}
+			}
+		}
+	}
+	for _, regionLayout := range layout.Regions {
+		if layoutStaged(regionLayout) {
+			return true
+		}
+	}
+	return false
+}
+
+func layoutTaskCount(layout *manager.Layout) int {
+	count := 0
+	for _, cluster := range layout.Clusters {
+		for _, taskSet := range []*manager.TaskSet{cluster.ServiceTasks, cluster.Tasks, cluster.Runners} {
+			if taskSet != nil {
+				count += len(taskSet.Tasks)
+			}
+		}
+	}
+	for _, regionLayout := range layout.Regions {
+		count += layoutTaskCount(regionLayout)
+	}
+	return count
+}
+
+// serviceAlias identifies a well-known service by a friendly name, so that it can be targeted without knowing its
+// fully-qualified name, e.g. "ipfs-nd" for "ceramic-dev-ex-ipfs-nd". A service matches if its name ends with the suffix
+// after a "-" and, if a cluster is specified, it runs in that cluster.
+type serviceAlias struct {
+	cluster func(envClusters manager.EnvClusters) string
+	suffix  string
+}
+
+var serviceAliases = map[string]serviceAlias{
+	"ceramic-node":  {nil, serviceSuffix_CeramicNode},
+	"ipfs-nd":       {nil, serviceSuffix_IpfsNode},
+	"cas-api":       {func(envClusters manager.EnvClusters) string { return envClusters.Cas }, serviceSuffix_CasApi},
+	"cas-scheduler": {func(envClusters manager.EnvClusters) string { return envClusters.CasV5 }, serviceSuffix_CasScheduler},
+}
+
+// targetLayout removes everything from a layout except the services matching a target, which is either a service alias
+// (see serviceAliases) or a fully-qualified service name. Regional layouts are filtered the same way.
+func targetLayout(env string, layout *manager.Layout, target string) error {
+	filterLayoutServices(layout, targetMatcher(env, target))
+	if layoutTaskCount(layout) == 0 {
+		return fmt.Errorf("targetLayout: %w for target: %s", manager.Error_NoServices, target)
+	}
+	return nil
+}
+
+func targetMatcher(env, target string) func(cluster, service string) bool {
+	if alias, found := serviceAliases[target]; found {
+		envClusters := manager.GetEnvClusters(env)
+		return func(cluster, service string) bool {
+			return ((alias.cluster == nil) || (cluster == alias.cluster(envClusters))) && strings.HasSuffix(service, "-"+alias.suffix)
+		}
+	}
+	return func(_, service string) bool {
+		return service == target
+	}
+}
+
+func filterLayoutServices(layout *manager.Layout, matches func(cluster, service string) bool) {
+	for clusterName, cluster := range layout.Clusters {
+		cluster.Tasks = nil
+		cluster.Runners = nil
+		if cluster.ServiceTasks != nil {
+			for service := range cluster.ServiceTasks.Tasks {
+				if !matches(clusterName, service) {
+					delete(cluster.ServiceTasks.Tasks, service)
+				}
+			}
+		}
+	}
+	for _, regionLayout := range layout.Regions {
+		filterLayoutServices(regionLayout, matches)
+	}
+}
+
+func envClusterNames(env string) []string {
+	envClusters := manager.GetEnvClusters(env)
+	return []string{envClusters.Private, envClusters.Public, envClusters.Cas, envClusters.CasV5, envClusters.Rust}
+}
+
+func envComponentLayout(env string, component manager.DeployComponent, ecrRepo manager.Repo, currentLayout *manager.Layout, layoutConfig map[manager.DeployComponent]*manager.Layout) *manager.Layout {
+	newLayout := componentLayout(env, component, ecrRepo, currentLayout, layoutConfig)
+	// Deployments to additional regions use the same layout structure as the primary region
+	if len(currentLayout.Regions) > 0 {
+		newLayout.Regions = make(map[string]*manager.Layout, len(currentLayout.Regions))
+		for region, regionLayout := range currentLayout.Regions {
+			newLayout.Regions[region] = componentLayout(env, component, ecrRepo, regionLayout, layoutConfig)
+		}
+	}
+	return newLayout
+}
+
+// isManagedService returns true if the service is part of the layout for any component
+func isManagedService(env, cluster, service string, containerNames []string, layoutConfig map[manager.DeployComponent]*manager.Layout) bool {
+	if isConfiguredService(layoutConfig, cluster, service) {
+		return true
+	}
+	for component := range componentLayouts {
+		// Components with a configured layout only manage the services in their configuration
+		if _, found := layoutConfig[component]; !found && (componentTask(env, component, cluster, service, containerNames) != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func componentLayout(env string, component manager.DeployComponent, ecrRepo manager.Repo, currentLayout *manager.Layout, layoutConfig map[manager.DeployComponent]*manager.Layout) *manager.Layout {
+	if configLayout, found := layoutConfig[component]; found {
+		return configComponentLayout(configLayout, ecrRepo, currentLayout)
+	}
+	newLayout := &manager.Layout{Clusters: map[string]*manager.Cluster{}, Repo: &ecrRepo}
+	for cluster, clusterLayout := range currentLayout.Clusters {
+		for service, task := range clusterLayout.ServiceTasks.Tasks {
+			if newTask := componentTask(env, component, cluster, service, strings.Split(task.Name, ",")); newTask != nil {
+				if newLayout.Clusters[cluster] == nil {
+					// We found at least one matching task, so we can start populating the cluster layout.
+					newLayout.Clusters[cluster] = &manager.Cluster{ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{}}}
+				}
+				// Set the task definition to the one currently running. For most cases, this will be overwritten by
+				// a new definition, but for some cases, we might want to use a layout with currently running
+				// definitions and not updated ones, e.g. to check if an existing deployment is stable.
+				newTask.Id = task.Id
+				newLayout.Clusters[cluster].ServiceTasks.Tasks[service] = newTask
+			}
+		}
+	}
+	// Add any runners for the component to the clusters being deployed
+	if runnersFn := componentLayouts[component].Runners; runnersFn != nil {
+		envClusters := manager.GetEnvClusters(env)
+		for cluster, clusterLayout := range newLayout.Clusters {
+			if runners := runnersFn(envClusters, cluster); len(runners) > 0 {
+				clusterLayout.Runners = &manager.TaskSet{Tasks: runners}
+			}
+		}
+	}
+	return newLayout
+}
+
+func componentTask(env string, component manager.DeployComponent, cluster, service string, containerNames []string) *manager.Task {
+	// Skip any ELP services
+	if isElpService(env, service) {
+		return nil
+	}
+	if componentLayout, found := componentLayouts[component]; !found {
+		log.Printf("componentTask: unknown component: %s", component)
+	} else if componentLayout.Task != nil {
+		return componentLayout.Task(manager.GetEnvClusters(env), cluster, service, containerNames)
+	}
+	return nil
+}
+
+// layoutFromParams reads a layout stored in job parameters. Layouts read back from the database should already have been
+// converted to a `Layout`, but layouts that were stored in a different shape (e.g. by an older version of the manager)
+// are decoded here. Either way, the layout is validated so that we fail with a clear error instead of a panic or a
+// silently empty deployment.
+func layoutFromParams(params map[string]interface{}, param string) (*manager.Layout, error) {
+	var layout manager.Layout
+	switch storedLayout := params[param].(type) {
+	case manager.Layout:
+		layout = storedLayout
+	case *manager.Layout:
+		if storedLayout == nil {
+			return nil, fmt.Errorf("layoutFromParams: missing layout")
+		}
+		layout = *storedLayout
+	case map[string]interface{}:
+		if err := mapstructure.Decode(storedLayout, &layout); err != nil {
+			return nil, fmt.Errorf("layoutFromParams: malformed layout: %w", err)
+		}
+	case nil:
+		return nil, fmt.Errorf("layoutFromParams: missing layout")
+	default:
+		return nil, fmt.Errorf("layoutFromParams: unexpected layout type: %T", storedLayout)
+	}
+	migrateLayout(&layout)
+	if err := validateLayout(&layout); err != nil {
+		return nil, err
+	}
+	return &layout, nil
+}
+
+// migrateLayout moves temporary tasks in a layout stored by an older version of the manager to their cluster's runners,
+// which is what they're deployed as now. Clusters are copied before being updated so that the stored layout isn't
+// modified.
+func migrateLayout(layout *manager.Layout) {
+	if layout.Clusters != nil {
+		clusters := make(map[string]*manager.Cluster, len(layout.Clusters))
+		for clusterName, cluster := range layout.Clusters {
+			if (cluster != nil) && (cluster.Tasks != nil) {
+				tasks := make(map[string]*manager.Task, len(cluster.Tasks.Tasks))
+				runners := make(map[string]*manager.Task)
+				if cluster.Runners != nil {
+					for name, task := range cluster.Runners.Tasks {
+						runners[name] = task
+					}
+				}
+				for name, task := range cluster.Tasks.Tasks {
+					if (task != nil) && task.Temp {
+						runner := *task
+						runner.Temp = false
+						if runner.Repo == nil {
+							// Keep the repo override the task got from its task set
+							runner.Repo = cluster.Tasks.Repo
+						}
+						runners[name] = &runner
+					} else {
+						tasks[name] = task
+					}
+				}
+				if len(tasks) < len(cluster.Tasks.Tasks) {
+					migratedCluster := *cluster
+					migratedTasks := *cluster.Tasks
+					migratedTasks.Tasks = tasks
+					migratedCluster.Tasks = &migratedTasks
+					migratedRunners := manager.TaskSet{}
+					if cluster.Runners != nil {
+						migratedRunners = *cluster.Runners
+					}
+					migratedRunners.Tasks = runners
+					migratedCluster.Runners = &migratedRunners
+					cluster = &migratedCluster
+				}
+			}
+			clusters[clusterName] = cluster
+		}
+		layout.Clusters = clusters
+	}
+	if layout.Regions != nil {
+		regions := make(map[string]*manager.Layout, len(layout.Regions))
+		for region, regionLayout := range layout.Regions {
+			if regionLayout != nil {
+				migratedLayout := *regionLayout
+				migrateLayout(&migratedLayout)
+				regionLayout = &migratedLayout
+			}
+			regions[region] = regionLayout
+		}
+		layout.Regions = regions
+	}
+}
+
+func validateLayout(layout *manager.Layout) error {
+	if layout.Clusters == nil {
+		return fmt.Errorf("validateLayout: missing clusters")
+	} else if err := validateRepo(layout.Repo); err != nil {
+		return err
+	}
+	for region, regionLayout := range layout.Regions {
+		if regionLayout == nil {
+			return fmt.Errorf("validateLayout: missing region layout: %s", region)
+		} else if err := validateLayout(regionLayout); err != nil {
+			return fmt.Errorf("validateLayout: invalid region layout: %s: %w", region, err)
+		}
+	}
+	for clusterName, cluster := range layout.Clusters {
+		if cluster == nil {
+			return fmt.Errorf("validateLayout: missing cluster layout: %s", clusterName)
+		} else if err := validateRepo(cluster.Repo); err != nil {
+			return err
+		}
+		for _, taskSet := range []*manager.TaskSet{cluster.ServiceTasks, cluster.Tasks, cluster.Runners} {
+			if taskSet != nil {
+				if err := validateRepo(taskSet.Repo); err != nil {
+					return err
+				} else if (len(taskSet.StabilizeTimeout) > 0) && ((taskSet != cluster.ServiceTasks) || !isValidStabilizeTimeout(taskSet.StabilizeTimeout)) {
+					return fmt.Errorf("validateLayout: invalid stabilize timeout: %s, %s", clusterName, taskSet.StabilizeTimeout)
+				}
+				for taskName, task := range taskSet.Tasks {
+					if task == nil {
+						return fmt.Errorf("validateLayout: missing task layout: %s, %s", clusterName, taskName)
+					} else if err := validateRepo(task.Repo); err != nil {
+						return err
+					} else if task.WaitForCompletion && (taskSet != cluster.Runners) {
+						// Only runners can be launched and waited upon
+						return fmt.Errorf("validateLayout: invalid wait for completion: %s, %s", clusterName, taskName)
+					} else if (len(task.CapacityProvider) > 0) && (taskSet != cluster.Runners) {
+						// Services and permanent tasks always use the capacity configured for them in ECS
+						return fmt.Errorf("validateLayout: invalid capacity provider: %s, %s", clusterName, taskName)
+					} else if (task.Placement != nil) && ((taskSet != cluster.Runners) || (len(task.CapacityProvider) == 0) || strings.HasPrefix(task.CapacityProvider, "FARGATE")) {
+						// Placement only applies to runners launched on EC2 capacity, Fargate rejects it
+						return fmt.Errorf("validateLayout: invalid placement: %s, %s", clusterName, taskName)
+					} else if (len(task.StabilizeTimeout) > 0) && ((taskSet != cluster.ServiceTasks) || !isValidStabilizeTimeout(task.StabilizeTimeout)) {
+						// Only services are checked for stabilization
+						return fmt.Errorf("validateLayout: invalid stabilize timeout: %s, %s, %s", clusterName, taskName, task.StabilizeTimeout)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isValidStabilizeTimeout(stabilizeTimeout string) bool {
+	parsedStabilizeTimeout, err := time.ParseDuration(stabilizeTimeout)
+	return (err == nil) && (parsedStabilizeTimeout > 0)
+}
+
+func validateRepo(repo *manager.Repo) error {
+	if repo != nil {
+		// Only one kind of registry can be used for a repo
+		numRegistries := 0
+		for _, registrySpecified := range []bool{repo.Public, len(repo.Registry) > 0, len(repo.AccountId) > 0} {
+			if registrySpecified {
+				numRegistries++
+			}
+		}
+		if numRegistries > 1 {
+			return fmt.Errorf("validateRepo: conflicting registries: %s", repo.Name)
+		}
+	}
+	return nil
+}
+
+// isElpService returns true for ELP services. The prod ELP services were originally created with names that did not
+// include the environment (e.g. "ceramic-elp-1-1-node"), unlike all other services. Match both that and the
+// environment-qualified form (e.g. "ceramic-prod-elp-1-1-node") so that renaming the services doesn't cause them to be
+// picked up by deployments. The global prefix follows the configured cluster prefix.
+func isElpService(env, service string) bool {
+	prefix := manager.GetEnvClusters(env).Prefix
+	return strings.HasPrefix(service, prefix+"-"+serviceSuffix_Elp+"-") ||
+		strings.HasPrefix(service, prefix+"-"+env+"-"+serviceSuffix_Elp+"-")
+}
+
+// pinImage sets the image tag of the tasks deploying images from the specified repo, unless they already deploy a tag of
+// their own. Tasks inherit their repo from their task set, cluster, or layout, the same way as when they're deployed.
+func pinImage(layout *manager.Layout, repo manager.Repo, tag string) {
+	pinTaskSet := func(taskSet *manager.TaskSet, inheritedRepo *manager.Repo) {
+		if taskSet == nil {
+			return
+		} else if taskSet.Repo != nil {
+			inheritedRepo = taskSet.Repo
+		}
+		for _, task := range taskSet.Tasks {
+			taskRepo := inheritedRepo
+			if task.Repo != nil {
+				taskRepo = task.Repo
+			}
+			if (len(task.Tag) == 0) && (taskRepo != nil) && (*taskRepo == repo) {
+				task.Tag = tag
+			}
+		}
+	}
+	for _, cluster := range layout.Clusters {
+		clusterRepo := layout.Repo
+		if cluster.Repo != nil {
+			clusterRepo = cluster.Repo
+		}
+		pinTaskSet(cluster.ServiceTasks, clusterRepo)
+		pinTaskSet(cluster.Tasks, clusterRepo)
+		pinTaskSet(cluster.Runners, clusterRepo)
+	}
+	for _, regionLayout := range layout.Regions {
+		pinImage(regionLayout, repo, tag)
+	}
+}
+
+func componentEcrRepo(component manager.DeployComponent) (manager.Repo, error) {
+	if componentLayout, found := componentLayouts[component]; !found {
+		return manager.Repo{}, fmt.Errorf("componentEcrRepo: unknown component: %s", component)
+	} else {
+		return componentLayout.EcrRepo, nil
+	}
+}
+
+// DetectDrift compares the image currently configured for each service in a component's layout against the last
+// recorded deployment for the component, and returns any mismatches, e.g. from manual changes to task definitions.
+func DetectDrift(ctx context.Context, d manager.Deployment, db manager.Database, env string, component manager.DeployComponent) ([]manager.DriftItem, error) {
+	if expectedTag, err := db.GetDeployTag(component); err != nil {
+		return nil, err
+	} else if len(expectedTag) == 0 {
+		return nil, fmt.Errorf("detectDrift: no recorded deployment for component: %s", component)
+	} else if layout, err := generateEnvLayout(ctx, d, env, component); err != nil {
+		return nil, err
+	} else {
+		driftItems, err := layoutDrift(ctx, d, "", layout, expectedTag)
+		if err != nil {
+			return nil, err
+		}
+		for region, regionLayout := range layout.Regions {
+			if regionDriftItems, err := layoutDrift(ctx, d, region, regionLayout, expectedTag); err != nil {
+				return nil, err
+			} else {
+				driftItems = append(driftItems, regionDriftItems...)
+			}
+		}
+		return driftItems, nil
+	}
+}
+
+func layoutDrift(ctx context.Context, d manager.Deployment, region string, layout *manager.Layout, expectedTag string) ([]manager.DriftItem, error) {
+	driftItems := make([]manager.DriftItem, 0)
+	for cluster, clusterLayout := range layout.Clusters {
+		if clusterLayout.ServiceTasks != nil {
+			for service, task := range clusterLayout.ServiceTasks.Tasks {
+				if image, err := d.GetContainerImage(ctx, task.Id, task.Name); err != nil {
+					return nil, err
+				} else if imageParts := strings.Split(image, ":"); imageParts[len(imageParts)-1] != expectedTag {
+					driftItems = append(driftItems, manager.DriftItem{
+						Region:      region,
+						Cluster:     cluster,
+						Service:     service,
+						Container:   task.Name,
+						Image:       image,
+						ExpectedTag: expectedTag,
+					})
+				}
+			}
+		}
+	}
+	return driftItems, nil
+}
@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+// loadLayoutConfig reads component layouts from the JSON file in LAYOUT_CONFIG_FILE, if set. This allows the topology of
+// an environment to be changed without a new release of the manager. Components missing from the file fall back to the
+// built-in layouts. The file maps components to layouts, e.g.
+//
+//	{
+//	  "cas": {
+//	    "clusters": {
+//	      "ceramic-dev-cas": {
+//	        "serviceTasks": { "stabilizeTimeout": "15m", "tasks": { "ceramic-dev-cas-api": { "name": "cas_api" } } },
+//	        "runners": { "tasks": { "ceramic-dev-cas-anchor": { "name": "cas_anchor" } } }
+//	      }
+//	    }
+//	  }
+//	}
+//
+// The file is read every time a layout is generated so that changes take effect without restarting the manager.
+func loadLayoutConfig(env string) (map[manager.DeployComponent]*manager.Layout, error) {
+	configFile := os.Getenv("LAYOUT_CONFIG_FILE")
+	if len(configFile) == 0 {
+		return nil, nil
+	}
+	var layouts map[manager.DeployComponent]*manager.Layout
+	if data, err := os.ReadFile(configFile); err != nil {
+		return nil, fmt.Errorf("loadLayoutConfig: failed to read layout config: %s, %w", configFile, err)
+	} else if err = json.Unmarshal(data, &layouts); err != nil {
+		return nil, fmt.Errorf("loadLayoutConfig: failed to parse layout config: %s, %w", configFile, err)
+	}
+	for component, layout := range layouts {
+		if _, found := componentLayouts[component]; !found {
+			return nil, fmt.Errorf("loadLayoutConfig: unknown component: %s", component)
+		} else if err := validateConfigLayout(env, layout); err != nil {
+			return nil, fmt.Errorf("loadLayoutConfig: invalid layout: %s: %w", component, err)
+		}
+	}
+	return layouts, nil
+}
+
+// validateConfigLayout checks that a configured layout only refers to clusters belonging to the environment, and that it
+// doesn't contain anything that's only ever populated from ECS.
+func validateConfigLayout(env string, layout *manager.Layout) error {
+	if layout == nil {
+		return fmt.Errorf("validateConfigLayout: missing layout")
+	} else if len(layout.Regions) > 0 {
+		// The regions to deploy to are determined by the manager configuration, and each gets the same layout
+		return fmt.Errorf("validateConfigLayout: regions cannot be configured")
+	} else if err := validateLayout(layout); err != nil {
+		return err
+	}
+	envClusters := envClusterNames(env)
+	for clusterName, cluster := range layout.Clusters {
+		if !slices.Contains(envClusters, clusterName) {
+			return fmt.Errorf("validateConfigLayout: unknown cluster: %s, %s", env, clusterName)
+		}
+		for _, taskSet := range []*manager.TaskSet{cluster.ServiceTasks, cluster.Tasks, cluster.Runners} {
+			if taskSet != nil {
+				for taskName, task := range taskSet.Tasks {
+					if isElpService(env, taskName) {
+						return fmt.Errorf("validateConfigLayout: elp services cannot be deployed: %s, %s", clusterName, taskName)
+					} else if len(task.Name) == 0 {
+						return fmt.Errorf("validateConfigLayout: missing container name: %s, %s", clusterName, taskName)
+					} else if (len(task.Id) > 0) || (len(task.TaskArn) > 0) {
+						return fmt.Errorf("validateConfigLayout: task state cannot be configured: %s, %s", clusterName, taskName)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// configComponentLayout builds a component layout from its configured layout. Service task definitions are set to the
+// ones currently running, the same as for the built-in layouts.
+func configComponentLayout(configLayout *manager.Layout, ecrRepo manager.Repo, currentLayout *manager.Layout) *manager.Layout {
+	newLayout := &manager.Layout{Clusters: make(map[string]*manager.Cluster, len(configLayout.Clusters)), Repo: &ecrRepo}
+	if configLayout.Repo != nil {
+		repo := *configLayout.Repo
+		newLayout.Repo = &repo
+	}
+	for clusterName, cluster := range configLayout.Clusters {
+		newCluster := &manager.Cluster{
+			ServiceTasks: copyTaskSet(cluster.ServiceTasks),
+			Tasks:        copyTaskSet(cluster.Tasks),
+			Runners:      copyTaskSet(cluster.Runners),
+			Repo:         cluster.Repo,
+		}
+		if (newCluster.ServiceTasks != nil) && (currentLayout.Clusters[clusterName] != nil) {
+			for service, task := range newCluster.ServiceTasks.Tasks {
+				if currentTask, found := currentLayout.Clusters[clusterName].ServiceTasks.Tasks[service]; found {
+					task.Id = currentTask.Id
+				}
+			}
+		}
+		newLayout.Clusters[clusterName] = newCluster
+	}
+	return newLayout
+}
+
+// copyTaskSet copies a task set so that layouts generated from the same configuration don't share task state
+func copyTaskSet(taskSet *manager.TaskSet) *manager.TaskSet {
+	if taskSet == nil {
+		return nil
+	}
+	newTaskSet := &manager.TaskSet{Tasks: make(map[string]*manager.Task, len(taskSet.Tasks)), Repo: taskSet.Repo, StabilizeTimeout: taskSet.StabilizeTimeout}
+	for taskName, task := range taskSet.Tasks {
+		newTask := *task
+		newTaskSet.Tasks[taskName] = &newTask
+	}
+	return newTaskSet
+}
+
+// isConfiguredService returns true if the service is part of any configured layout
+func isConfiguredService(layoutConfig map[manager.DeployComponent]*manager.Layout, cluster, service string) bool {
+	for _, layout := range layoutConfig {
+		if clusterLayout, found := layout.Clusters[cluster]; found && (clusterLayout.ServiceTasks != nil) {
+			if _, found = clusterLayout.ServiceTasks.Tasks[service]; found {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,374 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+func TestTargetMatcher(t *testing.T) {
+	tests := []struct {
+		target  string
+		cluster string
+		service string
+		matches bool
+	}{
+		{target: "ceramic-node", cluster: "ceramic-dev", service: "ceramic-dev-node", matches: true},
+		{target: "ceramic-node", cluster: "ceramic-dev-ex", service: "ceramic-dev-ex-node", matches: true},
+		{target: "ceramic-node", cluster: "ceramic-dev", service: "ceramic-dev-node-exporter"},
+		{target: "ipfs-nd", cluster: "ceramic-dev-ex", service: "ceramic-dev-ex-ipfs-nd", matches: true},
+		{target: "ipfs-nd", cluster: "ceramic-dev-ex", service: "ceramic-dev-ex-ipfs-nd-go-new-peer"},
+		{target: "cas-api", cluster: "ceramic-dev-cas", service: "ceramic-dev-cas-api", matches: true},
+		{target: "cas-api", cluster: "ceramic-dev", service: "ceramic-dev-cas-api"},
+		{target: "cas-api", cluster: "ceramic-dev-cas", service: "ceramic-dev-cas-api-gateway"},
+		{target: "cas-scheduler", cluster: "app-cas-dev", service: "app-cas-dev-scheduler", matches: true},
+		{target: "ceramic-dev-ex-ipfs-nd-go-new-peer", cluster: "ceramic-dev-ex", service: "ceramic-dev-ex-ipfs-nd-go-new-peer", matches: true},
+		{target: "ceramic-dev-ex-ipfs-nd", cluster: "ceramic-dev-ex", service: "ceramic-dev-ex-ipfs-nd-go-new-peer"},
+	}
+	for _, test := range tests {
+		t.Run(test.target+"/"+test.service, func(t *testing.T) {
+			if matches := targetMatcher("dev", test.target)(test.cluster, test.service); matches != test.matches {
+				t.Errorf("got %v, want %v", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestCopyLayout(t *testing.T) {
+	layout := &manager.Layout{
+		Clusters: map[string]*manager.Cluster{
+			"ceramic-dev": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{"ceramic-dev-node": {Id: "ceramic-dev-node:1"}}}},
+		},
+		Repo: &manager.Repo{Name: "ceramic-prod"},
+		Regions: map[string]*manager.Layout{
+			"us-west-2": {Clusters: map[string]*manager.Cluster{
+				"ceramic-dev": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{"ceramic-dev-node": {Id: "ceramic-dev-node:1"}}}},
+			}},
+		},
+	}
+	layoutCopy := copyLayout(layout)
+	layoutCopy.Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"].LastEventId = "event-1"
+	layoutCopy.Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"].Events = []string{"unable to place a task"}
+	layoutCopy.Regions["us-west-2"].Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"].Id = "ceramic-dev-node:2"
+	layoutCopy.Clusters["ceramic-dev-ex"] = &manager.Cluster{}
+	if task := layout.Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"]; (len(task.LastEventId) > 0) || (len(task.Events) > 0) {
+		t.Errorf("original task was updated: %+v", task)
+	}
+	if task := layout.Regions["us-west-2"].Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"]; task.Id != "ceramic-dev-node:1" {
+		t.Errorf("original regional task was updated: %+v", task)
+	}
+	if _, found := layout.Clusters["ceramic-dev-ex"]; found {
+		t.Error("original clusters were updated")
+	}
+	if layoutCopy.Repo.Name != "ceramic-prod" {
+		t.Errorf("repo not copied: %+v", layoutCopy.Repo)
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	const nodeTaskDef = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	const exNodeTaskDef = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-ex-node:12"
+	d := &fakeDeployment{
+		layout: &manager.Layout{Clusters: map[string]*manager.Cluster{
+			"ceramic-dev": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+				"ceramic-dev-node": {Id: nodeTaskDef, Name: "ceramic-dev-node"},
+			}}},
+			"ceramic-dev-ex": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+				"ceramic-dev-ex-node": {Id: exNodeTaskDef, Name: "ceramic-dev-ex-node"},
+			}}},
+		}},
+		images: map[string]string{
+			nodeTaskDef:   "967314784947.dkr.ecr.us-east-2.amazonaws.com/ceramic-dev:abc1234",
+			exNodeTaskDef: "967314784947.dkr.ecr.us-east-2.amazonaws.com/ceramic-dev:def5678",
+		},
+	}
+	tests := []struct {
+		name     string
+		db       *fakeDb
+		tag      string
+		services []string
+		wantErr  bool
+	}{
+		{
+			name:     "deployed with target",
+			db:       &fakeDb{deployTags: map[manager.DeployComponent]string{manager.DeployComponent_Ceramic: "abc1234,0123456789abcdef0123456789abcdef01234567"}},
+			tag:      "abc1234",
+			services: []string{"ceramic-dev-ex-node"},
+		},
+		{
+			name:     "deployed without target",
+			db:       &fakeDb{deployTags: map[manager.DeployComponent]string{manager.DeployComponent_Ceramic: "def5678"}},
+			tag:      "def5678",
+			services: []string{"ceramic-dev-node"},
+		},
+		{
+			name:    "no recorded deployment",
+			db:      &fakeDb{deployTags: map[manager.DeployComponent]string{}},
+			wantErr: true,
+		},
+		{
+			name:    "database error",
+			db:      &fakeDb{err: errors.New("unreachable")},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			driftItems, err := DetectDrift(context.Background(), d, test.db, "dev", manager.DeployComponent_Ceramic)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", driftItems)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			services := make([]string, 0, len(driftItems))
+			for _, driftItem := range driftItems {
+				services = append(services, driftItem.Service)
+				if driftItem.ExpectedTag != test.tag {
+					t.Errorf("%s: got expected tag %s, want %s", driftItem.Service, driftItem.ExpectedTag, test.tag)
+				}
+			}
+			if fmt.Sprint(services) != fmt.Sprint(test.services) {
+				t.Errorf("got %v, want %v", services, test.services)
+			}
+		})
+	}
+}
+
+func TestComponentLayoutServices(t *testing.T) {
+	ceramicNode := func() *manager.Task { return &manager.Task{Name: containerName_CeramicNode} }
+	ipfsNode := func() *manager.Task { return &manager.Task{Name: containerName_IpfsNode} }
+	// Services currently running in prod, including the ELP services, both with their original names that leave out
+	// the environment and with environment-qualified names
+	currentLayout := &manager.Layout{Clusters: map[string]*manager.Cluster{
+		"ceramic-prod": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+			"ceramic-prod-node":            ceramicNode(),
+			"ceramic-prod-ipfs-nd":         ipfsNode(),
+			"ceramic-elp-1-1-node":         ceramicNode(),
+			"ceramic-elp-1-1-ipfs-nd":      ipfsNode(),
+			"ceramic-prod-elp-1-2-node":    ceramicNode(),
+			"ceramic-prod-elp-1-2-ipfs-nd": ipfsNode(),
+		}}},
+		"ceramic-prod-ex": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+			"ceramic-prod-ex-node":    ceramicNode(),
+			"ceramic-prod-ex-ipfs-nd": ipfsNode(),
+		}}},
+		"ceramic-prod-cas": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+			"ceramic-prod-cas-node": ceramicNode(),
+			"ceramic-prod-cas-api":  {Name: containerName_CasApi},
+		}}},
+	}}
+	tests := []struct {
+		component manager.DeployComponent
+		services  []string
+	}{
+		{
+			component: manager.DeployComponent_Ceramic,
+			services:  []string{"ceramic-prod-ex/ceramic-prod-ex-node", "ceramic-prod/ceramic-prod-node"},
+		},
+		{
+			component: manager.DeployComponent_Ipfs,
+			services:  []string{"ceramic-prod-ex/ceramic-prod-ex-ipfs-nd", "ceramic-prod/ceramic-prod-ipfs-nd"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(string(test.component), func(t *testing.T) {
+			layout := envComponentLayout("prod", test.component, manager.Repo{}, currentLayout, nil)
+			layoutServices := make([]string, 0)
+			for clusterName, cluster := range layout.Clusters {
+				for service := range cluster.ServiceTasks.Tasks {
+					layoutServices = append(layoutServices, clusterName+"/"+service)
+				}
+			}
+			sort.Strings(layoutServices)
+			if fmt.Sprint(layoutServices) != fmt.Sprint(test.services) {
+				t.Errorf("got %v, want %v", layoutServices, test.services)
+			}
+		})
+	}
+}
+
+func TestLayoutFromParams(t *testing.T) {
+	const taskDefArn = "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:43"
+	// Layout as reloaded from the database, e.g. after a restart
+	storedLayout := map[string]interface{}{
+		"clusters": map[string]interface{}{
+			"ceramic-dev": map[string]interface{}{
+				"serviceTasks": map[string]interface{}{
+					"tasks": map[string]interface{}{"ceramic-dev-node": map[string]interface{}{"id": taskDefArn}},
+				},
+			},
+		},
+		"repo": map[string]interface{}{"name": "ceramic-dev"},
+	}
+	tests := []struct {
+		name   string
+		layout interface{}
+		err    bool
+	}{
+		{name: "stored", layout: storedLayout},
+		{name: "value", layout: manager.Layout{Clusters: map[string]*manager.Cluster{}, Repo: &manager.Repo{Name: "ceramic-dev"}}},
+		{name: "missing", err: true},
+		{name: "missing clusters", layout: map[string]interface{}{"repo": map[string]interface{}{"name": "ceramic-dev"}}, err: true},
+		{name: "unexpected type", layout: "ceramic-dev", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := map[string]interface{}{"layout": test.layout}
+			layout, err := layoutFromParams(params, "layout")
+			if test.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if layout.Repo.Name != "ceramic-dev" {
+				t.Errorf("got repo %q, want %q", layout.Repo.Name, "ceramic-dev")
+			}
+			// Reading the layout must not modify the job
+			if fmt.Sprintf("%T", params["layout"]) != fmt.Sprintf("%T", test.layout) {
+				t.Errorf("params modified: got %T, want %T", params["layout"], test.layout)
+			}
+		})
+	}
+	layout, _ := layoutFromParams(map[string]interface{}{"layout": storedLayout}, "layout")
+	if task := layout.Clusters["ceramic-dev"].ServiceTasks.Tasks["ceramic-dev-node"]; task.Id != taskDefArn {
+		t.Errorf("got task %q, want %q", task.Id, taskDefArn)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	workerRepo := &manager.Repo{Name: "ceramic-prod-cas-runner"}
+	storedLayout := &manager.Layout{
+		Clusters: map[string]*manager.Cluster{
+			"ceramic-prod-cas": {
+				Tasks: &manager.TaskSet{
+					Tasks: map[string]*manager.Task{
+						"ceramic-prod-cas-anchor": {Id: "anchor", Temp: true},
+						"ceramic-prod-cas-ipfs":   {Id: "ipfs"},
+					},
+					Repo: workerRepo,
+				},
+				Runners: &manager.TaskSet{Tasks: map[string]*manager.Task{"ceramic-prod-cas-migration": {Id: "migration"}}},
+			},
+			"ceramic-prod": {Tasks: &manager.TaskSet{Tasks: map[string]*manager.Task{"ceramic-prod-ipfs": {Id: "ipfs"}}}},
+		},
+		Regions: map[string]*manager.Layout{
+			"us-west-2": {Clusters: map[string]*manager.Cluster{
+				"ceramic-prod-cas": {Tasks: &manager.TaskSet{Tasks: map[string]*manager.Task{"ceramic-prod-cas-anchor": {Id: "anchor", Temp: true}}}},
+			}},
+		},
+	}
+	layout := *storedLayout
+	migrateLayout(&layout)
+
+	cluster := layout.Clusters["ceramic-prod-cas"]
+	if _, found := cluster.Tasks.Tasks["ceramic-prod-cas-anchor"]; found {
+		t.Error("temporary task not removed from tasks")
+	}
+	if runner := cluster.Runners.Tasks["ceramic-prod-cas-anchor"]; (runner == nil) || runner.Temp || (runner.Repo != workerRepo) {
+		t.Errorf("temporary task not moved to runners: %+v", runner)
+	}
+	if (len(cluster.Tasks.Tasks) != 1) || (len(cluster.Runners.Tasks) != 2) {
+		t.Errorf("got %d tasks and %d runners, want 1 and 2", len(cluster.Tasks.Tasks), len(cluster.Runners.Tasks))
+	}
+	if layout.Clusters["ceramic-prod"].Runners != nil {
+		t.Error("runners added to cluster without temporary tasks")
+	}
+	if runner := layout.Regions["us-west-2"].Clusters["ceramic-prod-cas"].Runners; (runner == nil) || (runner.Tasks["ceramic-prod-cas-anchor"] == nil) {
+		t.Error("temporary task in region not moved to runners")
+	}
+	// The stored layout must not be modified
+	if task := storedLayout.Clusters["ceramic-prod-cas"].Tasks.Tasks["ceramic-prod-cas-anchor"]; (task == nil) || !task.Temp {
+		t.Error("stored layout modified")
+	}
+	if storedLayout.Regions["us-west-2"].Clusters["ceramic-prod-cas"].Runners != nil {
+		t.Error("stored region layout modified")
+	}
+}
+
+func TestPinImage(t *testing.T) {
+	const pinned = "3ba6b9a@sha256:0123456789abcdef"
+	ceramicRepo := manager.Repo{Name: "ceramic-prod"}
+	runnerRepo := &manager.Repo{Name: "ceramic-prod-runner"}
+	layout := &manager.Layout{
+		Clusters: map[string]*manager.Cluster{
+			"ceramic-prod": {
+				ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+					"node":   {Id: "node"},
+					"tagged": {Id: "tagged", Tag: "latest"},
+					"other":  {Id: "other", Repo: runnerRepo},
+				}},
+				Runners: &manager.TaskSet{Tasks: map[string]*manager.Task{"migration": {Id: "migration"}}, Repo: runnerRepo},
+			},
+		},
+		Repo: &ceramicRepo,
+		Regions: map[string]*manager.Layout{
+			"us-west-2": {
+				Clusters: map[string]*manager.Cluster{
+					"ceramic-prod": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{"node": {Id: "node"}}}},
+				},
+				Repo: &ceramicRepo,
+			},
+		},
+	}
+	pinImage(layout, ceramicRepo, pinned)
+
+	tests := []struct {
+		name string
+		task *manager.Task
+		tag  string
+	}{
+		{name: "component repo", task: layout.Clusters["ceramic-prod"].ServiceTasks.Tasks["node"], tag: pinned},
+		{name: "own tag", task: layout.Clusters["ceramic-prod"].ServiceTasks.Tasks["tagged"], tag: "latest"},
+		{name: "task repo", task: layout.Clusters["ceramic-prod"].ServiceTasks.Tasks["other"]},
+		{name: "task set repo", task: layout.Clusters["ceramic-prod"].Runners.Tasks["migration"]},
+		{name: "region", task: layout.Regions["us-west-2"].Clusters["ceramic-prod"].ServiceTasks.Tasks["node"], tag: pinned},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.task.Tag != test.tag {
+				t.Errorf("got %q, want %q", test.task.Tag, test.tag)
+			}
+		})
+	}
+}
+
+func TestDescribeEnvLayoutMissing(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "layout.json")
+	config := `{"cas": {"clusters": {
+		"ceramic-dev-cas": {"serviceTasks": {"tasks": {
+			"ceramic-dev-cas-api": {"name": "cas_api"},
+			"ceramic-dev-cas-worker": {"name": "cas_worker"}
+		}}},
+		"ceramic-dev-ex": {"serviceTasks": {"tasks": {"ceramic-dev-ex-cas-api": {"name": "cas_api"}}}}
+	}}}`
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LAYOUT_CONFIG_FILE", configFile)
+	d := &fakeDeployment{layout: &manager.Layout{Clusters: map[string]*manager.Cluster{
+		"ceramic-dev-cas": {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{
+			"ceramic-dev-cas-api": {Id: "api", Name: "cas_api"},
+		}}},
+	}}}
+	drift, err := DescribeEnvLayout(context.Background(), d, "dev", manager.DeployComponent_Cas)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string][]string{
+		"ceramic-dev-cas": {"ceramic-dev-cas-worker"},
+		"ceramic-dev-ex":  {"ceramic-dev-ex-cas-api"},
+	}
+	if fmt.Sprint(drift.Missing) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", drift.Missing, want)
+	}
+}
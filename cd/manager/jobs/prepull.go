@@ -0,0 +1,150 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+// Allow up to 10 minutes for the image to be pulled and the pre-pull task to run
+const prepullFailureTime = 10 * time.Minute
+
+var _ manager.JobSm = &prepullJob{}
+
+type prepullJob struct {
+	baseJob
+	component manager.DeployComponent
+	deployTag string
+	layout    *manager.Layout
+	d         manager.Deployment
+}
+
+func PrepullJob(jobState job.JobState, db manager.Database, notifs manager.Notifs, d manager.Deployment) (manager.JobSm, error) {
+	if component, found := jobState.Params[job.PrepullJobParam_Component].(string); !found {
+		return nil, fmt.Errorf("prepullJob: missing component (ceramic, ipfs, cas, casv5, rust-ceramic)")
+	} else if deployTag, found := jobState.Params[job.PrepullJobParam_DeployTag].(string); !found || (len(deployTag) == 0) {
+		return nil, fmt.Errorf("prepullJob: missing deploy tag")
+	} else if layout, err := layoutFromParams(jobState.Params, job.PrepullJobParam_Layout); err != nil {
+		return nil, err
+	} else if layout.Repo == nil { // The main layout repo should never be null
+		return nil, fmt.Errorf("prepullJob: missing layout repo")
+	} else {
+		return &prepullJob{baseJob{jobState, db, notifs}, manager.DeployComponent(component), deployTag, layout, d}, nil
+	}
+}
+
+func (p prepullJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
+	now := time.Now()
+	switch p.state.Stage {
+	case job.JobStage_Queued:
+		{
+			// No preparation needed so advance the job directly to "dequeued".
+			//
+			// Advance the timestamp by a tiny amount so that the "dequeued" event remains at the same position on the
+			// timeline as the "queued" event but still ahead of it.
+			return p.advance(job.JobStage_Dequeued, p.state.Ts.Add(time.Nanosecond), nil)
+		}
+	case job.JobStage_Dequeued:
+		{
+			if err := p.launchTask(ctx); err != nil {
+				return p.advance(job.JobStage_Failed, now, err)
+			} else {
+				p.state.Params[job.JobParam_Start] = float64(time.Now().UnixNano())
+				return p.advance(job.JobStage_Started, now, nil)
+			}
+		}
+	case job.JobStage_Started:
+		{
+			if !p.pollDue(now) {
+				// Return so we come back again to check
+				return p.state, manager.AdvanceResult{}, nil
+			} else if stopped, err := p.checkTask(ctx); err != nil {
+				return p.advance(job.JobStage_Failed, now, err)
+			} else if stopped {
+				return p.advance(job.JobStage_Completed, now, nil)
+			} else if job.IsTimedOut(p.state, prepullFailureTime) {
+				return p.advance(job.JobStage_Failed, now, manager.Error_CompletionTimeout)
+			} else {
+				// Return so we come back again to check
+				return p.state, manager.AdvanceResult{}, nil
+			}
+		}
+	default:
+		{
+			return p.advance(job.JobStage_Failed, now, fmt.Errorf("prepullJob: unexpected state: %s", manager.PrintJob(p.state)))
+		}
+	}
+}
+
+func (p prepullJob) launchTask(ctx context.Context) error {
+	// Pulling the image once is enough to surface any problems with it, so use the first service in the layout.
+	// Services are sorted so that the same one is picked if the job is retried.
+	clusterNames := make([]string, 0, len(p.layout.Clusters))
+	for clusterName := range p.layout.Clusters {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Strings(clusterNames)
+	for _, clusterName := range clusterNames {
+		cluster := p.layout.Clusters[clusterName]
+		if (cluster.ServiceTasks == nil) || (len(cluster.ServiceTasks.Tasks) == 0) {
+			continue
+		}
+		services := make([]string, 0, len(cluster.ServiceTasks.Tasks))
+		for service := range cluster.ServiceTasks.Tasks {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+		service := services[0]
+		task := cluster.ServiceTasks.Tasks[service]
+		// Use the most specific repo override, if any
+		repo := *p.layout.Repo
+		for _, repoOverride := range []*manager.Repo{cluster.Repo, cluster.ServiceTasks.Repo, task.Repo} {
+			if repoOverride != nil {
+				repo = *repoOverride
+			}
+		}
+		if taskDefArn, err := p.d.RegisterPrepullTask(ctx, task.Id, task.Name, repo, p.deployTag); err != nil {
+			return err
+		} else if taskArn, err := p.d.LaunchServiceTask(ctx, clusterName, service, taskDefArn, task.Name, manager.LaunchOptions{
+			JobId:       p.state.JobId,
+			RequestedBy: p.requestedBy(),
+		}); err != nil {
+			return err
+		} else {
+			p.state.Params[job.JobParam_Id] = taskArn
+			p.state.Params[job.PrepullJobParam_Cluster] = clusterName
+			p.recordLaunchedTask(taskArn, nil)
+			return nil
+		}
+	}
+	return fmt.Errorf("prepullJob: no services found in layout: %s", p.component)
+}
+
+// checkTask returns whether the pre-pull task's container has started, which means that its image was pulled. What the
+// container does once started doesn't matter, so a task that's still running is stopped.
+func (p prepullJob) checkTask(ctx context.Context) (bool, error) {
+	cluster, _ := p.state.Params[job.PrepullJobParam_Cluster].(string)
+	taskArn, _ := p.state.Params[job.JobParam_Id].(string)
+	if running, _, err := p.d.CheckTask(ctx, cluster, "", true, false, taskArn); err != nil {
+		return false, err
+	} else if running {
+		// The image was pulled, so this isn't an error big enough to fail the job, just report and move on.
+		if err = p.d.StopTask(ctx, cluster, taskArn, "image pulled"); err != nil {
+			log.Printf("prepullJob: failed to stop task: %s, %v, %s", taskArn, err, manager.PrintJob(p.state))
+		}
+		return true, nil
+	} else if stopped, exitCode, err := p.d.CheckTask(ctx, cluster, "", false, false, taskArn); err != nil {
+		return false, err
+	} else if !stopped {
+		return false, nil
+	} else if exitCode == nil {
+		// The container never started, e.g. because the image couldn't be pulled
+		return false, fmt.Errorf("prepullJob: task failed to start: %s, %s", cluster, taskArn)
+	}
+	return true, nil
+}
@@ -0,0 +1,154 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ manager.JobSm = &reconcileJob{}
+
+// reconcileJob compares the image that each service of a component is running against the last recorded deployment for
+// the component, e.g. to catch manual changes or deployments that silently regressed.
+type reconcileJob struct {
+	baseJob
+	components []manager.DeployComponent
+	env        string
+	d          manager.Deployment
+}
+
+func ReconcileJob(jobState job.JobState, db manager.Database, notifs manager.Notifs, d manager.Deployment) (manager.JobSm, error) {
+	if parsedComponents, found := jobState.Params[job.ReconcileJobParam_Components].([]interface{}); !found || (len(parsedComponents) == 0) {
+		return nil, fmt.Errorf("reconcileJob: missing components")
+	} else {
+		components := make([]manager.DeployComponent, 0, len(parsedComponents))
+		for _, parsedComponent := range parsedComponents {
+			component, _ := parsedComponent.(string)
+			if _, err := manager.ComponentRepo(manager.DeployComponent(component)); err != nil {
+				return nil, fmt.Errorf("reconcileJob: invalid component: %v", parsedComponent)
+			}
+			components = append(components, manager.DeployComponent(component))
+		}
+		return &reconcileJob{baseJob{jobState, db, notifs}, components, os.Getenv(manager.EnvVar_Env), d}, nil
+	}
+}
+
+func (r reconcileJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
+	now := time.Now()
+	switch r.state.Stage {
+	case job.JobStage_Queued:
+		{
+			// No preparation needed so advance the job directly to "dequeued".
+			//
+			// Advance the timestamp by a tiny amount so that the "dequeued" event remains at the same position on the
+			// timeline as the "queued" event but still ahead of it.
+			return r.advance(job.JobStage_Dequeued, r.state.Ts.Add(time.Nanosecond), nil)
+		}
+	case job.JobStage_Dequeued:
+		{
+			activeComponents, err := r.activeDeployComponents()
+			if err != nil {
+				return r.advance(job.JobStage_Failed, now, err)
+			}
+			driftItems := make([]manager.DriftItem, 0)
+			for _, component := range r.components {
+				// The deploy tag is only recorded once a deployment completes, so the services of a component being
+				// deployed would all show up as drifted.
+				if activeComponents[component] {
+					log.Printf("reconcileJob: skipping component being deployed: %s, %s", component, manager.PrintJob(r.state))
+					continue
+				}
+				if componentDriftItems, err := r.componentDrift(ctx, component); err != nil {
+					return r.advance(job.JobStage_Failed, now, err)
+				} else {
+					driftItems = append(driftItems, componentDriftItems...)
+				}
+			}
+			if len(driftItems) > 0 {
+				r.state.Params[job.ReconcileJobParam_Drift] = driftItems
+			}
+			return r.advance(job.JobStage_Completed, now, nil)
+		}
+	default:
+		{
+			return r.advance(job.JobStage_Failed, now, fmt.Errorf("reconcileJob: unexpected state: %s", manager.PrintJob(r.state)))
+		}
+	}
+}
+
+// componentDrift returns the services of a component that aren't running the component's last deployed tag. Components
+// that were never deployed, and services running images without a tag, are skipped.
+func (r reconcileJob) componentDrift(ctx context.Context, component manager.DeployComponent) ([]manager.DriftItem, error) {
+	if expectedTag, err := r.db.GetDeployTag(component); err != nil {
+		return nil, err
+	} else if len(expectedTag) == 0 {
+		return nil, nil
+	} else if layout, err := generateEnvLayout(ctx, r.d, r.env, component); err != nil {
+		return nil, err
+	} else {
+		driftItems := make([]manager.DriftItem, 0)
+		for cluster, clusterLayout := range layout.Clusters {
+			if clusterLayout.ServiceTasks != nil {
+				for service, task := range clusterLayout.ServiceTasks.Tasks {
+					if image, err := r.d.GetCurrentImage(ctx, cluster, service); err != nil {
+						return nil, err
+					} else if tag := imageTag(image); (len(tag) > 0) && (tag != expectedTag) {
+						driftItems = append(driftItems, manager.DriftItem{
+							Cluster:     cluster,
+							Service:     service,
+							Container:   task.Name,
+							Image:       image,
+							ExpectedTag: expectedTag,
+						})
+					}
+				}
+			}
+		}
+		return driftItems, nil
+	}
+}
+
+// activeDeployComponents returns the components being deployed by any manager instance, including the other components
+// deployed along with a component.
+func (r reconcileJob) activeDeployComponents() (map[manager.DeployComponent]bool, error) {
+	activeComponents := make(map[manager.DeployComponent]bool)
+	seenJobs := make(map[string]bool)
+	// Iterate the DB in descending order of timestamp so that the most recent state of each deployment is found first
+	if err := r.db.IterateByType(job.JobType_Deploy, false, func(js job.JobState) bool {
+		if !seenJobs[js.JobId] {
+			seenJobs[js.JobId] = true
+			if job.IsActiveJob(js) {
+				component, _ := js.Params[job.DeployJobParam_Component].(string)
+				activeComponents[manager.DeployComponent(component)] = true
+				shas, _ := js.Params[job.DeployJobParam_Shas].(map[string]interface{})
+				for shaComponent := range shas {
+					activeComponents[manager.DeployComponent(shaComponent)] = true
+				}
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return activeComponents, nil
+}
+
+// imageTag returns the tag of an image reference, ignoring any digest, e.g. "3ba6b9a" for both
+// "ceramic-prod-node:3ba6b9a" and "ceramic-prod-node:3ba6b9a@sha256:...". References without a tag, e.g. those pinned to
+// just a digest, return an empty string.
+func imageTag(image string) string {
+	if idx := strings.Index(image, "@"); idx != -1 {
+		image = image[:idx]
+	}
+	// A colon before the last slash separates a registry port, not a tag
+	if idx := strings.LastIndex(image, ":"); (idx != -1) && (idx > strings.LastIndex(image, "/")) {
+		return image[idx+1:]
+	}
+	return ""
+}
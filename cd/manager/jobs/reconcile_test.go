@@ -0,0 +1,25 @@
+package jobs
+
+import "testing"
+
+func TestImageTag(t *testing.T) {
+	tests := []struct {
+		image string
+		tag   string
+	}{
+		{image: "ceramic-prod-node:3ba6b9a", tag: "3ba6b9a"},
+		{image: "ceramicnetwork/js-ceramic:latest", tag: "latest"},
+		{image: "ceramic-prod-node:3ba6b9a@sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", tag: "3ba6b9a"},
+		{image: "ceramic-prod-node@sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", tag: ""},
+		{image: "localhost:5000/ceramic-prod-node", tag: ""},
+		{image: "localhost:5000/ceramic-prod-node:3ba6b9a", tag: "3ba6b9a"},
+		{image: "ceramic-prod-node", tag: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			if tag := imageTag(test.image); tag != test.tag {
+				t.Errorf("got %q, want %q", tag, test.tag)
+			}
+		})
+	}
+}
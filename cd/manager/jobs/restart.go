@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+// Allow up to 30 minutes for restarted services to stabilize
+const restartFailureTime = 30 * time.Minute
+
+// Allow for the clock of the manager being ahead of the clock used by ECS for the restarted tasks and deployments
+const restartClockSkew = 10 * time.Second
+
+var _ manager.JobSm = &restartJob{}
+
+type restartJob struct {
+	baseJob
+	component manager.DeployComponent
+	cluster   string
+	service   string
+	env       string
+	d         manager.Deployment
+}
+
+func RestartJob(jobState job.JobState, db manager.Database, notifs manager.Notifs, d manager.Deployment) (manager.JobSm, error) {
+	component, _ := jobState.Params[job.RestartJobParam_Component].(string)
+	cluster, _ := jobState.Params[job.RestartJobParam_Cluster].(string)
+	service, _ := jobState.Params[job.RestartJobParam_Service].(string)
+	if (len(component) == 0) && (len(cluster) == 0) {
+		return nil, fmt.Errorf("restartJob: missing component or cluster")
+	} else if (len(component) > 0) && (len(cluster) > 0) {
+		return nil, fmt.Errorf("restartJob: only one of component or cluster can be specified")
+	}
+	return &restartJob{baseJob{jobState, db, notifs}, manager.DeployComponent(component), cluster, service, os.Getenv(manager.EnvVar_Env), d}, nil
+}
+
+func (r restartJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
+	now := time.Now()
+	switch r.state.Stage {
+	case job.JobStage_Queued:
+		{
+			if layout, err := r.generateLayout(ctx); err != nil {
+				return r.advance(job.JobStage_Failed, now, err)
+			} else {
+				r.state.Params[job.RestartJobParam_Layout] = *layout
+				// Advance the timestamp by a tiny amount so that the "dequeued" event remains at the same position on
+				// the timeline as the "queued" event but still ahead of it.
+				return r.advance(job.JobStage_Dequeued, r.state.Ts.Add(time.Nanosecond), nil)
+			}
+		}
+	case job.JobStage_Dequeued:
+		{
+			// Layout should already be present
+			if layout, err := layoutFromParams(r.state.Params, job.RestartJobParam_Layout); err != nil {
+				return r.advance(job.JobStage_Failed, now, err)
+			} else if err = r.d.RestartLayout(ctx, layout); err != nil {
+				return r.advance(job.JobStage_Failed, now, err)
+			} else {
+				// Record the time from before the restart, so that everything started by the restart comes after it
+				r.state.Params[job.JobParam_Start] = float64(now.UnixNano())
+				return r.advance(job.JobStage_Started, now, nil)
+			}
+		}
+	case job.JobStage_Started:
+		{
+			if !r.pollDue(now) {
+				// Return so we come back again to check
+				return r.state, manager.AdvanceResult{}, nil
+			} else if layout, err := layoutFromParams(r.state.Params, job.RestartJobParam_Layout); err != nil {
+				return r.advance(job.JobStage_Failed, now, err)
+			} else if restarted, err := r.d.CheckRestart(ctx, layout, job.StartTime(r.state).Add(-restartClockSkew)); err != nil {
+				return r.advance(job.JobStage_Failed, now, err)
+			} else if restarted {
+				return r.advance(job.JobStage_Completed, now, nil)
+			} else if job.IsTimedOut(r.state, restartFailureTime) {
+				return r.advance(job.JobStage_Failed, now, manager.Error_CompletionTimeout)
+			} else {
+				// Return so we come back again to check
+				return r.state, manager.AdvanceResult{}, nil
+			}
+		}
+	default:
+		{
+			return r.advance(job.JobStage_Failed, now, fmt.Errorf("restartJob: unexpected state: %s", manager.PrintJob(r.state)))
+		}
+	}
+}
+
+func (r restartJob) generateLayout(ctx context.Context) (*manager.Layout, error) {
+	// Restart all the services for a component using the same layout we would use to deploy it
+	if len(r.component) > 0 {
+		return generateEnvLayout(ctx, r.d, r.env, r.component)
+	}
+	// Otherwise, restart all services in the specified cluster, or just the specified service.
+	if currentLayout, err := r.d.GetLayout(ctx, []string{r.cluster}); err != nil {
+		return nil, err
+	} else if newLayout := r.clusterLayout(currentLayout); newLayout == nil {
+		return nil, fmt.Errorf("restartJob: cluster or service not found: %s, %s", r.cluster, r.service)
+	} else {
+		// Restart the same cluster/service in any additional regions where it's present
+		for region, regionLayout := range currentLayout.Regions {
+			if newRegionLayout := r.clusterLayout(regionLayout); newRegionLayout != nil {
+				if newLayout.Regions == nil {
+					newLayout.Regions = make(map[string]*manager.Layout)
+				}
+				newLayout.Regions[region] = newRegionLayout
+			}
+		}
+		return newLayout, nil
+	}
+}
+
+func (r restartJob) clusterLayout(currentLayout *manager.Layout) *manager.Layout {
+	if clusterLayout, found := currentLayout.Clusters[r.cluster]; !found {
+		return nil
+	} else if len(r.service) == 0 {
+		return &manager.Layout{Clusters: map[string]*manager.Cluster{r.cluster: clusterLayout}}
+	} else if task, found := clusterLayout.ServiceTasks.Tasks[r.service]; !found {
+		return nil
+	} else {
+		return &manager.Layout{Clusters: map[string]*manager.Cluster{
+			r.cluster: {ServiceTasks: &manager.TaskSet{Tasks: map[string]*manager.Task{r.service: task}}},
+		}}
+	}
+}
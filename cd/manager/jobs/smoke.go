@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -29,7 +30,7 @@ func SmokeTestJob(jobState job.JobState, db manager.Database, notifs manager.Not
 	return &smokeTestJob{baseJob{jobState, db, notifs}, os.Getenv(manager.EnvVar_Env), d}
 }
 
-func (s smokeTestJob) Advance() (job.JobState, error) {
+func (s smokeTestJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
 	now := time.Now()
 	switch s.state.Stage {
 	case job.JobStage_Queued:
@@ -42,35 +43,40 @@ func (s smokeTestJob) Advance() (job.JobState, error) {
 		}
 	case job.JobStage_Dequeued:
 		{
-			if id, err := s.d.LaunchTask(ClusterName, FamilyPrefix+s.env, ContainerName, NetworkConfigurationParameter, nil); err != nil {
+			if id, err := s.d.LaunchTask(ctx, ClusterName, FamilyPrefix+s.env, ContainerName, manager.LaunchOptions{
+				JobId:           s.state.JobId,
+				RequestedBy:     s.requestedBy(),
+				VpcConfigParams: []string{NetworkConfigurationParameter},
+			}); err != nil {
 				return s.advance(job.JobStage_Failed, now, err)
 			} else {
 				// Update the job stage and spawned task identifier
 				s.state.Params[job.JobParam_Id] = id
+				s.recordLaunchedTask(id, nil)
 				s.state.Params[job.JobParam_Start] = float64(time.Now().UnixNano())
 				return s.advance(job.JobStage_Started, now, nil)
 			}
 		}
 	case job.JobStage_Started:
 		{
-			if started, err := s.checkTests(true); err != nil {
+			if started, err := s.checkTests(ctx, true); err != nil {
 				return s.advance(job.JobStage_Failed, now, err)
 			} else if started {
 				return s.advance(job.JobStage_Waiting, now, nil)
 			} else {
 				// Return so we come back again to check
-				return s.state, nil
+				return s.state, manager.AdvanceResult{}, nil
 			}
 		}
 	case job.JobStage_Waiting:
 		{
-			if stopped, err := s.checkTests(false); err != nil {
+			if stopped, err := s.checkTests(ctx, false); err != nil {
 				return s.advance(job.JobStage_Failed, now, err)
 			} else if stopped {
 				return s.advance(job.JobStage_Completed, now, nil)
 			} else {
 				// Return so we come back again to check
-				return s.state, nil
+				return s.state, manager.AdvanceResult{}, nil
 			}
 		}
 	default:
@@ -80,8 +86,8 @@ func (s smokeTestJob) Advance() (job.JobState, error) {
 	}
 }
 
-func (s smokeTestJob) checkTests(expectedToBeRunning bool) (bool, error) {
-	if status, exitCode, err := s.d.CheckTask(ClusterName, "", expectedToBeRunning, false, s.state.Params[job.JobParam_Id].(string)); err != nil {
+func (s smokeTestJob) checkTests(ctx context.Context, expectedToBeRunning bool) (bool, error) {
+	if status, exitCode, err := s.d.CheckTask(ctx, ClusterName, "", expectedToBeRunning, false, s.state.Params[job.JobParam_Id].(string)); err != nil {
 		return false, err
 	} else if status {
 		// If a non-zero exit code was present, the test failed to complete successfully.
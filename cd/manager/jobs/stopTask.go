@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+// Allow up to 5 minutes for stopped tasks to go down
+const stopTaskFailureTime = 5 * time.Minute
+
+var _ manager.JobSm = &stopTaskJob{}
+
+type stopTaskJob struct {
+	baseJob
+	cluster     string
+	task        string
+	reason      string
+	requestedBy string
+	d           manager.Deployment
+}
+
+func StopTaskJob(jobState job.JobState, db manager.Database, notifs manager.Notifs, d manager.Deployment) (manager.JobSm, error) {
+	if cluster, found := jobState.Params[job.StopTaskJobParam_Cluster].(string); !found || (len(cluster) == 0) {
+		return nil, fmt.Errorf("stopTaskJob: missing cluster")
+	} else if task, found := jobState.Params[job.StopTaskJobParam_Task].(string); !found || (len(task) == 0) {
+		return nil, fmt.Errorf("stopTaskJob: missing task")
+	} else if reason, found := jobState.Params[job.StopTaskJobParam_Reason].(string); !found || (len(reason) == 0) {
+		return nil, fmt.Errorf("stopTaskJob: missing reason")
+	} else if requestedBy, found := jobState.Params[job.StopTaskJobParam_RequestedBy].(string); !found || (len(requestedBy) == 0) {
+		return nil, fmt.Errorf("stopTaskJob: missing requester")
+	} else {
+		return &stopTaskJob{baseJob{jobState, db, notifs}, cluster, task, reason, requestedBy, d}, nil
+	}
+}
+
+func (s stopTaskJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
+	now := time.Now()
+	switch s.state.Stage {
+	case job.JobStage_Queued:
+		{
+			// No preparation needed so advance the job directly to "dequeued".
+			//
+			// Advance the timestamp by a tiny amount so that the "dequeued" event remains at the same position on the
+			// timeline as the "queued" event but still ahead of it.
+			return s.advance(job.JobStage_Dequeued, s.state.Ts.Add(time.Nanosecond), nil)
+		}
+	case job.JobStage_Dequeued:
+		{
+			// Include the requester in the reason so that it shows up in the ECS console as well
+			if err := s.d.StopTask(ctx, s.cluster, s.task, fmt.Sprintf("%s (requested by %s)", s.reason, s.requestedBy)); err != nil {
+				return s.advance(job.JobStage_Failed, now, err)
+			} else {
+				s.state.Params[job.JobParam_Start] = float64(time.Now().UnixNano())
+				return s.advance(job.JobStage_Started, now, nil)
+			}
+		}
+	case job.JobStage_Started:
+		{
+			if stopped, _, err := s.d.CheckTask(ctx, s.cluster, "", false, false, s.task); err != nil {
+				return s.advance(job.JobStage_Failed, now, err)
+			} else if stopped {
+				return s.advance(job.JobStage_Completed, now, nil)
+			} else if job.IsTimedOut(s.state, stopTaskFailureTime) {
+				return s.advance(job.JobStage_Failed, now, manager.Error_CompletionTimeout)
+			} else {
+				// Return so we come back again to check
+				return s.state, manager.AdvanceResult{}, nil
+			}
+		}
+	default:
+		{
+			return s.advance(job.JobStage_Failed, now, fmt.Errorf("stopTaskJob: unexpected state: %s", manager.PrintJob(s.state)))
+		}
+	}
+}
@@ -56,7 +56,7 @@ func GitHubWorkflowJob(jobState job.JobState, db manager.Database, notifs manage
 	}
 }
 
-func (w githubWorkflowJob) Advance() (job.JobState, error) {
+func (w githubWorkflowJob) Advance(ctx context.Context) (job.JobState, manager.AdvanceResult, error) {
 	now := time.Now()
 	switch w.state.Stage {
 	case job.JobStage_Queued:
@@ -92,7 +92,7 @@ func (w githubWorkflowJob) Advance() (job.JobState, error) {
 				return w.advance(job.JobStage_Failed, now, manager.Error_StartupTimeout)
 			} else {
 				// Return so we come back again to check
-				return w.state, nil
+				return w.state, manager.AdvanceResult{}, nil
 			}
 		}
 	case job.JobStage_Waiting:
@@ -111,12 +111,12 @@ func (w githubWorkflowJob) Advance() (job.JobState, error) {
 				return w.advance(job.JobStage_Failed, now, manager.Error_CompletionTimeout)
 			} else {
 				// Return so we come back again to check
-				return w.state, nil
+				return w.state, manager.AdvanceResult{}, nil
 			}
 		}
 	default:
 		{
-			return w.advance(job.JobStage_Failed, now, fmt.Errorf("githubWorkflowJob: unexpected state: %w", manager.PrintJob(w.state)))
+			return w.advance(job.JobStage_Failed, now, fmt.Errorf("githubWorkflowJob: unexpected state: %s", manager.PrintJob(w.state)))
 		}
 	}
 }
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ manager.Metrics = &Prometheus{}
+var _ prometheus.Collector = &Prometheus{}
+
+const metricsNamespace = "cd_manager"
+
+type Prometheus struct {
+	db             manager.Database
+	env            string
+	deploys        *prometheus.CounterVec
+	deployDuration *prometheus.HistogramVec
+	inFlightJobs   *prometheus.Desc
+	queuedJobs     *prometheus.Desc
+}
+
+func NewPrometheus(db manager.Database) *Prometheus {
+	return &Prometheus{
+		db,
+		os.Getenv(manager.EnvVar_Env),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "deploys_total",
+			Help:      "Number of finished deployments by component, environment, and outcome",
+		}, []string{"component", "env", "outcome"}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "deploy_duration_seconds",
+			Help:      "Time from the start of a deployment until it finished",
+			// Deployments usually take a few minutes but can take up to an hour before timing out
+			Buckets: []float64{30, 60, 120, 300, 600, 900, 1800, 3600},
+		}, []string{"component", "env", "outcome"}),
+		prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "jobs_in_flight"),
+			"Number of jobs currently being processed, by type",
+			[]string{"type"},
+			nil,
+		),
+		prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "jobs_queued"),
+			"Number of jobs waiting to be processed, by type",
+			[]string{"type"},
+			nil,
+		),
+	}
+}
+
+func (p Prometheus) RecordJob(jobState job.JobState) {
+	if (jobState.Type != job.JobType_Deploy) || !job.IsFinishedJob(jobState) {
+		return
+	}
+	component, _ := jobState.Params[job.DeployJobParam_Component].(string)
+	outcome := string(jobState.Stage)
+	p.deploys.WithLabelValues(component, p.env, outcome).Inc()
+	// Deployments that failed before starting have no duration
+	if start, found := jobState.Params[job.JobParam_Start].(float64); found {
+		p.deployDuration.WithLabelValues(component, p.env, outcome).Observe(jobState.Ts.Sub(time.Unix(0, int64(start))).Seconds())
+	}
+}
+
+func (p Prometheus) Describe(ch chan<- *prometheus.Desc) {
+	p.deploys.Describe(ch)
+	p.deployDuration.Describe(ch)
+	ch <- p.inFlightJobs
+	ch <- p.queuedJobs
+}
+
+func (p Prometheus) Collect(ch chan<- prometheus.Metric) {
+	p.deploys.Collect(ch)
+	p.deployDuration.Collect(ch)
+	// Job counts are read from the database at scrape time so that they're always current
+	inFlightJobs := make(map[job.JobType]int)
+	for _, jobStage := range []job.JobStage{job.JobStage_Dequeued, job.JobStage_Started, job.JobStage_Waiting} {
+		for _, jobState := range p.db.OrderedJobs(jobStage) {
+			inFlightJobs[jobState.Type]++
+		}
+	}
+	queuedJobs := make(map[job.JobType]int)
+	for _, jobState := range p.db.QueuedJobs() {
+		queuedJobs[jobState.Type]++
+	}
+	for jobType, count := range inFlightJobs {
+		ch <- prometheus.MustNewConstMetric(p.inFlightJobs, prometheus.GaugeValue, float64(count), string(jobType))
+	}
+	for jobType, count := range queuedJobs {
+		ch <- prometheus.MustNewConstMetric(p.queuedJobs, prometheus.GaugeValue, float64(count), string(jobType))
+	}
+}
@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -53,12 +54,75 @@ const (
 var (
 	Error_StartupTimeout    = fmt.Errorf("startup timeout")
 	Error_CompletionTimeout = fmt.Errorf("completion timeout")
+	Error_CrashLooping      = fmt.Errorf("service crash-looping")
+	Error_ApprovalExpired   = fmt.Errorf("approval expired")
+	Error_ImagePullFailed   = fmt.Errorf("image pull failed")
+	Error_ImageTagNotFound  = fmt.Errorf("image tag not found")
+	Error_ShuttingDown      = fmt.Errorf("shutting down")
+	Error_LeaseLost         = fmt.Errorf("lease lost")
+	Error_NoServices        = fmt.Errorf("no services matched")
+	Error_JobNotQueued      = fmt.Errorf("job not queued")
+	Error_StabilizeTimeout  = fmt.Errorf("stabilize timeout")
+	Error_DeployBlackout    = fmt.Errorf("outside deploy window")
+	Error_PreDeployFailed   = fmt.Errorf("pre-deploy task failed")
+	Error_JobStateChanged   = fmt.Errorf("job state changed")
+	Error_InvalidPriority   = fmt.Errorf("invalid priority")
+	Error_InvalidMaxRetries = fmt.Errorf("invalid max retries")
+	Error_ReservedParam     = fmt.Errorf("reserved parameter")
 )
 
+// ErrorCode is a machine-readable category for the error that caused a job to fail
+type ErrorCode string
+
+const (
+	ErrorCode_Timeout        ErrorCode = "timeout"
+	ErrorCode_ImageNotFound  ErrorCode = "image-not-found"
+	ErrorCode_Capacity       ErrorCode = "capacity"
+	ErrorCode_Throttling     ErrorCode = "throttling"
+	ErrorCode_Unhealthy      ErrorCode = "unhealthy"
+	ErrorCode_RollbackFailed ErrorCode = "rollback-failed"
+	ErrorCode_Blackout       ErrorCode = "blackout"
+	ErrorCode_Unknown        ErrorCode = "unknown"
+)
+
+// ErrorCoder is implemented by errors that know their own category, e.g. failures reported by the deployment service
+type ErrorCoder interface {
+	ErrorCode() ErrorCode
+}
+
+// ClusterError is the error from updating one of the clusters in a layout
+type ClusterError struct {
+	Region  string
+	Cluster string
+	Err     error
+}
+
+// ClusterErrors collects the errors from all clusters that failed to update, so that one failure doesn't hide the others
+type ClusterErrors []ClusterError
+
 const (
 	EnvVar_Env = "ENV"
 )
 
+// Default cluster naming scheme, e.g. "ceramic-dev", "ceramic-dev-ex", "ceramic-dev-cas", "app-cas-dev", etc.
+const (
+	DefaultClusterPrefix      = "ceramic"
+	DefaultCasV5ClusterPrefix = "app-cas"
+	DefaultClusterSuffix_Ex   = "-ex"
+	DefaultClusterSuffix_Cas  = "-cas"
+	DefaultClusterSuffix_Rust = "-rust"
+)
+
+// EnvClusters contains the names of all the clusters in an environment
+type EnvClusters struct {
+	Prefix  string // Global prefix
+	Private string
+	Public  string
+	Cas     string
+	CasV5   string
+	Rust    string
+}
+
 type WorkflowStatus uint8
 
 const (
@@ -74,35 +138,234 @@ const ServiceName = "cd-manager"
 // an orchestration service (e.g. AWS ECS).
 type Layout struct {
 	Clusters map[string]*Cluster `dynamodbav:"clusters,omitempty"`
-	Repo     *Repo               `dynamodbav:"repo,omitempty"` // Layout repo
+	Repo     *Repo               `dynamodbav:"repo,omitempty"`    // Layout repo
+	Regions  map[string]*Layout  `dynamodbav:"regions,omitempty"` // Layouts for additional regions, keyed by region
 }
 
 type Repo struct {
 	Name   string `dynamodbav:"name,omitempty"`
 	Public bool   `dynamodbav:"public,omitempty"`
+	// Private registry overrides for images stored outside our own account's registry, e.g. in a shared services
+	// account. Either the full registry URI (e.g. "123456789012.dkr.ecr.us-east-2.amazonaws.com") or the account ID of
+	// a registry in the same region can be specified. The task execution role must have permission to pull from it.
+	Registry  string `dynamodbav:"registry,omitempty"`
+	AccountId string `dynamodbav:"accountId,omitempty"`
 }
 
 type Cluster struct {
 	ServiceTasks *TaskSet `dynamodbav:"serviceTasks,omitempty"`
-	Tasks        *TaskSet `dynamodbav:"tasks,omitempty"`
-	Repo         *Repo    `dynamodbav:"repo,omitempty"` // Cluster repo override
+	Tasks        *TaskSet `dynamodbav:"tasks,omitempty"`   // Tasks that stay up permanently outside of services
+	Runners      *TaskSet `dynamodbav:"runners,omitempty"` // Task templates that are launched on demand (e.g. anchor workers)
+	Repo         *Repo    `dynamodbav:"repo,omitempty"`    // Cluster repo override
 }
 
 type TaskSet struct {
 	Tasks map[string]*Task `dynamodbav:"tasks,omitempty"`
 	Repo  *Repo            `dynamodbav:"repo,omitempty"` // TaskSet repo override
+	// Default stabilization timeout for the services in the set, overridden by the timeout of individual services
+	StabilizeTimeout string `dynamodbav:"stabilizeTimeout,omitempty"`
 }
 
 type Task struct {
-	Id   string `dynamodbav:"id,omitempty"`
-	Repo *Repo  `dynamodbav:"repo,omitempty"` // Task repo override
-	Temp bool   `dynamodbav:"temp,omitempty"` // Whether the task is meant to go down once it has completed
-	Name string `dynamodbav:"name,omitempty"` // Container name
+	Id string `dynamodbav:"id,omitempty"`
+	// Task definition that a service was running before it was updated by a deployment
+	PrevId string `dynamodbav:"prevId,omitempty"`
+	Repo   *Repo  `dynamodbav:"repo,omitempty"` // Task repo override
+	Name   string `dynamodbav:"name,omitempty"` // Container name, or the task definition's primary container if unset
+	// Whether a runner should be launched as part of a deployment, with the deployment only considered complete once
+	// the runner has stopped successfully (e.g. a database migration).
+	WaitForCompletion bool   `dynamodbav:"waitForCompletion,omitempty"`
+	TaskArn           string `dynamodbav:"taskArn,omitempty"` // Runner launched for a deployment waiting for its completion
+	// Capacity provider to launch runners with (e.g. "FARGATE_SPOT") instead of the on-demand Fargate launch type
+	CapacityProvider string `dynamodbav:"capacityProvider,omitempty"`
+	// Desired number of running instances for service tasks. If unset, the service's current desired count is preserved.
+	Replicas int32 `dynamodbav:"replicas,omitempty"`
+	// Image tag override, e.g. for a component deployed at its own commit as part of a multi-component deployment
+	Tag string `dynamodbav:"tag,omitempty"`
+	// Placement of runners launched on EC2 capacity. Fargate doesn't support placement, so this must be left unset for
+	// runners launched on Fargate.
+	Placement *Placement `dynamodbav:"placement,omitempty"`
+	// Percentage of a service's desired count that the task set for the new task definition is scaled to during a staged
+	// rollout. Only set for services deployed in stages, i.e. services using task sets.
+	RolloutPercent int `dynamodbav:"rolloutPercent,omitempty"`
+	// When the current step of a staged rollout started (Unix nanoseconds), so that each step gets the full stabilization
+	// timeout
+	RolloutStepStart int64 `dynamodbav:"rolloutStepStart,omitempty"`
+	// Most recent ECS service event seen while checking a deployment, so that events are only reported once
+	LastEventId string `dynamodbav:"lastEventId,omitempty"`
+	// Notable ECS service events (e.g. placement failures) seen during the last check of a deployment
+	Events []string `dynamodbav:"events,omitempty"`
+	// Time a service has to stabilize after being deployed (e.g. "20m") before the deployment fails, even if the job
+	// hasn't timed out yet. Only applies to service tasks.
+	StabilizeTimeout string `dynamodbav:"stabilizeTimeout,omitempty"`
+	// Task definition family, if it isn't named after the service, task, or runner, e.g. in environments where family
+	// names diverge from service names
+	Family string `dynamodbav:"family,omitempty"`
+	// Deprecated: tasks meant to go down once they've completed are now runners. Only read so that layouts stored by
+	// older versions of the manager can be migrated.
+	Temp bool `dynamodbav:"temp,omitempty"`
+}
+
+// SecretRef refers to a secret stored in SSM Parameter Store or Secrets Manager that should be injected into a task's
+// environment without its value appearing in plaintext anywhere.
+type SecretRef struct {
+	ValueFrom string `dynamodbav:"valueFrom"` // SSM parameter or Secrets Manager secret ARN
+}
+
+// ServiceChange records the task definitions that a deployment moved a service from and to
+type ServiceChange struct {
+	Region  string `dynamodbav:"region,omitempty" json:"region,omitempty"` // Set for additional regions
+	Cluster string `dynamodbav:"cluster" json:"cluster"`
+	Service string `dynamodbav:"service" json:"service"`
+	From    string `dynamodbav:"from,omitempty" json:"from,omitempty"` // Unset for services created by the deployment
+	To      string `dynamodbav:"to" json:"to"`
+}
+
+// LayoutDrift represents the differences between a component's layout and the services actually present in ECS
+type LayoutDrift struct {
+	Layout    *Layout
+	Missing   map[string][]string // Services in the layout that are missing in ECS, keyed by cluster
+	Unmanaged map[string][]string // Services in ECS that aren't in any component's layout, keyed by cluster
+}
+
+// LayoutDiff represents the differences between two layouts. Entries are paths to the clusters, task sets, and tasks
+// that changed, e.g. "ceramic-dev-cas/runners/ceramic-dev-cas-anchor", prefixed by the region for additional regions.
+type LayoutDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string // Repo, container name, wait for completion, or family changes, with the old and new values
+}
+
+type TaskStatus string
+
+const (
+	TaskStatus_Pending TaskStatus = "pending" // Not running yet (or not stable yet), or in the process of stopping
+	TaskStatus_Running TaskStatus = "running"
+	TaskStatus_Stopped TaskStatus = "stopped"
+	TaskStatus_Missing TaskStatus = "missing" // Not found, e.g. because it stopped and was removed from the cluster
+)
+
+// TaskState represents the current state of a task launched by the manager
+type TaskState struct {
+	Status        TaskStatus
+	LastStatus    string `json:",omitempty"` // ECS status of the task
+	TaskDefArn    string `json:",omitempty"`
+	Image         string `json:",omitempty"` // Image of the task's primary container
+	ExitCode      *int32 `json:",omitempty"` // Exit code of the task's primary container, if it has stopped
+	StoppedReason string `json:",omitempty"` // Why the task stopped, e.g. because its image couldn't be pulled
+}
+
+// ServiceStatus represents the current state of a service, e.g. for external tooling
+type ServiceStatus struct {
+	Cluster      string
+	Service      string
+	TaskDef      string            // Task definition of the primary deployment
+	Images       map[string]string // Images in the task definition, keyed by container name
+	RunningCount int32
+	DesiredCount int32
+	RolloutState string     `json:",omitempty"` // Only reported for services using the rolling update deployment controller
+	LastEvent    string     `json:",omitempty"` // Most recent service event
+	LastEventTs  *time.Time `json:",omitempty"`
+}
+
+// TaskInfo represents a running task, e.g. for listing the anchor workers currently running in a cluster
+type TaskInfo struct {
+	TaskArn    string
+	Family     string
+	StartedBy  string     `json:",omitempty"` // Launch token for tasks launched by the manager, or the deployment for service tasks
+	JobId      string     `json:",omitempty"` // Job that launched the task, only set for tasks launched by the manager
+	Status     string     // Last known status, e.g. "RUNNING"
+	LaunchedAt *time.Time `json:",omitempty"`
+}
+
+// ImageDetail represents an image in a container registry
+type ImageDetail struct {
+	Digest string
+	Tags   []string
+}
+
+// DriftItem represents a service whose running image doesn't match the last recorded deployment for its component
+type DriftItem struct {
+	Region      string `json:",omitempty"` // Only set for additional regions
+	Cluster     string
+	Service     string
+	Container   string
+	Image       string // Image currently configured for the service
+	ExpectedTag string // Last recorded deploy tag for the component
+}
+
+// NetworkConfig is an explicit network configuration for launching a task, e.g. to run a one-off task in a specific
+// subnet or security group. When specified, it takes precedence over the network configuration stored in SSM.
+type NetworkConfig struct {
+	Subnets        []string
+	SecurityGroups []string
+	AssignPublicIp bool
+}
+
+// LaunchOptions are the optional settings for launching a task. The zero value launches a task exactly as its task
+// definition describes it, except for the network configuration, which must be specified for standalone tasks.
+type LaunchOptions struct {
+	JobId       string // Job launching the task, used to deduplicate launches and to tag the task
+	RequestedBy string // User that requested the job, recorded as a tag on the task
+	// Environment overrides for the task's container
+	Overrides map[string]string
+	// SSM path under which additional environment overrides are stored, e.g. "/ceramic/dev/anchor"
+	OverridesPath string
+	// Replaces the default command of the task's container, e.g. to run a one-off migration sub-command
+	Command []string
+	// Secrets injected into the container's environment, keyed by environment variable name
+	Secrets map[string]SecretRef
+	// SSM parameters with VPC configurations to launch standalone tasks with (see Ecs.LaunchTask)
+	VpcConfigParams []string
+	// Explicit network configuration for standalone tasks, which takes precedence over the VPC configuration parameters
+	NetworkConfig    *NetworkConfig
+	CapacityProvider string // e.g. "FARGATE_SPOT", uses the Fargate launch type if empty
+	Placement        *Placement
+}
+
+// Placement represents how ECS places tasks on the container instances of an EC2-backed cluster
+type Placement struct {
+	Strategies  []PlacementStrategy   `dynamodbav:"strategies,omitempty"`
+	Constraints []PlacementConstraint `dynamodbav:"constraints,omitempty"`
+}
+
+type PlacementStrategy struct {
+	Type  string `dynamodbav:"type"`            // "spread", "binpack", or "random"
+	Field string `dynamodbav:"field,omitempty"` // e.g. "attribute:ecs.availability-zone" to spread across AZs
+}
+
+type PlacementConstraint struct {
+	Type       string `dynamodbav:"type"`                 // "distinctInstance" or "memberOf"
+	Expression string `dynamodbav:"expression,omitempty"` // e.g. "attribute:ecs.instance-type =~ c5.*" for "memberOf"
+}
+
+// LaunchedTask represents a task launched by a job, e.g. an anchor worker or a test runner
+type LaunchedTask struct {
+	JobId     string            `dynamodbav:"job"`
+	TaskArn   string            `dynamodbav:"task"`
+	Ts        time.Time         `dynamodbav:"ts"`
+	Overrides map[string]string `dynamodbav:"overrides,omitempty"`
+	Ttl       time.Time         `dynamodbav:"ttl,unixtime" json:"-"` // Record expiration
+}
+
+// Maintenance represents the global maintenance flag. While it is set, queued deployments are held in the queue.
+type Maintenance struct {
+	Enabled bool      `dynamodbav:"enabled" json:"enabled"`
+	SetBy   string    `dynamodbav:"setBy,omitempty" json:"setBy,omitempty"` // Who last set or cleared the flag
+	Ts      time.Time `dynamodbav:"ts" json:"ts"`
+}
+
+// AdvanceResult describes what happened when a job was advanced, so that callers don't need to compare job states
+type AdvanceResult struct {
+	Transitioned bool // The job moved to a new stage
+	Notified     bool // A notification was sent for the new stage
+	Finished     bool // The job reached a terminal stage
+	Requeued     bool // The job failed for a transient reason and was sent back to the queue to be retried
 }
 
 // JobSm represents job state machine objects processed by the job manager
 type JobSm interface {
-	Advance() (job.JobState, error)
+	Advance(context.Context) (job.JobState, AdvanceResult, error)
 }
 
 // ApiGw represents an API Gateway service containing APIs we wish to invoke directly, i.e. not through an API call
@@ -115,16 +378,39 @@ type ApiGw interface {
 // databases provide the primitives for them to be used in this fashion.
 type Database interface {
 	InitializeJobs() error
-	QueueJob(job.JobState) error
+	EnqueueJob(jobState job.JobState, priority int) error
 	QueuedJobs() []job.JobState
 	OrderedJobs(job.JobStage) []job.JobState
 	AdvanceJob(job.JobState) error
+	RequeueJob(job.JobState) error
 	WriteJob(job.JobState) error
 	IterateByType(job.JobType, bool, func(job.JobState) bool) error
+	IterateByJob(jobId string, asc bool, iter func(job.JobState) bool) error
 	UpdateBuildTag(DeployComponent, string) error
 	UpdateDeployTag(DeployComponent, string) error
 	GetBuildTags() (map[DeployComponent]string, error)
 	GetDeployTags() (map[DeployComponent]string, error)
+	GetBuildTag(DeployComponent) (string, error)
+	GetDeployTag(DeployComponent) (string, error)
+	UpdateBuildVersion(DeployComponent, string) error
+	UpdateDeployVersion(DeployComponent, string) error
+	GetDeployVersions() (map[DeployComponent]string, error)
+	UpdateDeployJob(DeployComponent, string) error
+	GetDeployJob(DeployComponent) (string, error)
+	WriteLaunchedTask(LaunchedTask) error
+	LaunchedTasks(jobId string) ([]LaunchedTask, error)
+	ApproveJob(jobState job.JobState, approver string) error
+	CancelJob(jobState job.JobState, canceledBy string, rollback bool) error
+	CancelQueuedJob(jobState job.JobState, canceledBy string) (job.JobState, error)
+	LatestJobState(jobId string) (job.JobState, error)
+	MarkJobHeld(jobState job.JobState) (bool, error)
+	SyncJobParams(jobState job.JobState) (job.JobState, error)
+	AcquireJobLease(jobId string, duration time.Duration) (bool, error)
+	RenewJobLease(jobId string, duration time.Duration) error
+	ReleaseJobLease(jobId string) error
+	GetMaintenance() (*Maintenance, error)
+	SetMaintenance(enabled bool, setBy string) error
+	Ping() error
 }
 
 // Cache represents an in-memory cache for job states
@@ -137,17 +423,42 @@ type Cache interface {
 
 // Deployment represents a container orchestration service (e.g. AWS ECS)
 type Deployment interface {
-	LaunchServiceTask(cluster, service, family, container string, overrides map[string]string) (string, error)
-	LaunchTask(cluster, family, container, vpcConfigParam string, overrides map[string]string) (string, error)
-	CheckTask(cluster, taskDefId string, running, stable bool, taskIds ...string) (bool, *int32, error)
-	GetLayout(clusters []string) (*Layout, error)
-	UpdateLayout(*Layout, string) error
-	CheckLayout(*Layout) (bool, error)
+	LaunchServiceTask(ctx context.Context, cluster, service, family, container string, opts LaunchOptions) (string, error)
+	LaunchTask(ctx context.Context, cluster, family, container string, opts LaunchOptions) (string, error)
+	CheckTask(ctx context.Context, cluster, taskDefId string, running, stable bool, taskIds ...string) (bool, *int32, error)
+	CheckTasks(ctx context.Context, cluster string, stable bool, taskIds ...string) (map[string]TaskState, error)
+	GetLayout(ctx context.Context, clusters []string) (*Layout, error)
+	UpdateLayout(ctx context.Context, layout *Layout, deployTag, sha, version, jobId string, createIfMissing bool, rolloutPercent int) error
+	RampLayout(ctx context.Context, layout *Layout, percent int) error
+	RevertLayout(ctx context.Context, layout *Layout, revision string) error
+	ResolveRevision(ctx context.Context, layout *Layout, revision string) error
+	RegisterLayout(ctx context.Context, layout *Layout, deployTag, sha, version, jobId string) error
+	PromoteLayout(ctx context.Context, layout *Layout) error
+	CheckLayout(context.Context, *Layout) (bool, error)
+	RestartLayout(context.Context, *Layout) error
+	CheckRestart(context.Context, *Layout, time.Time) (bool, error)
+	StopTask(ctx context.Context, cluster, taskArn, reason string) error
+	PruneLayout(ctx context.Context, layout *Layout, keep int, retain map[string]bool) error
+	ListServices(ctx context.Context, cluster string) ([]string, error)
+	GetContainerImage(ctx context.Context, taskDefArn, container string) (string, error)
+	RegisterPrepullTask(ctx context.Context, taskDefArn, container string, repo Repo, tag string) (string, error)
+	GetServiceStatus(ctx context.Context, cluster, service string) (*ServiceStatus, error)
+	GetCurrentImage(ctx context.Context, cluster, service string) (string, error)
+	ListRunningTasks(ctx context.Context, cluster string, managerOnly bool) ([]TaskInfo, error)
+	DescribeImage(ctx context.Context, repo Repo, tag string) (*ImageDetail, error)
+	Preflight(context.Context) error
+	Ping(context.Context) error
 }
 
-// Notifs represents a notification service (e.g. Discord)
+// Notifs represents a notification service (e.g. Discord). NotifyJob returns whether a notification was sent for any of
+// the jobs, i.e. false if all of them were skipped (e.g. as duplicates).
 type Notifs interface {
-	NotifyJob(...job.JobState)
+	NotifyJob(...job.JobState) bool
+}
+
+// Metrics represents a metrics service that job outcomes are reported to (e.g. Prometheus)
+type Metrics interface {
+	RecordJob(job.JobState)
 }
 
 // Manager represents the job manager, which is the central job orchestrator of this service.
@@ -156,6 +467,25 @@ type Manager interface {
 	CheckJob(jobId string) job.JobState
 	ProcessJobs(shutdownCh chan bool)
 	Pause()
+	DescribeLayout(DeployComponent) (*LayoutDrift, error)
+	DetectDrift(DeployComponent) ([]DriftItem, error)
+	GetServiceStatus(cluster, service string) (*ServiceStatus, error)
+	GetCurrentImage(cluster, service string) (string, error)
+	ListRunningTasks(cluster string, managerOnly bool) ([]TaskInfo, error)
+	ActiveJobs() []job.JobState
+	ApproveJob(jobId, approver string) error
+	CancelJob(jobId, canceledBy string, rollback bool) error
+	RollbackTo(component DeployComponent, revision string) error
+	PromoteJob(jobId string) error
+	SetMaintenance(setBy string) error
+	ClearMaintenance(clearedBy string) error
+	GetMaintenance() (*Maintenance, error)
+	CheckReady() error
+}
+
+// Clock represents a source of the current time, so that time-based job transitions (e.g. timeouts) can be controlled
+type Clock interface {
+	Now() time.Time
 }
 
 // Repository represents a git service hosting our repositories (e.g. GitHub)
@@ -3,6 +3,7 @@ package notifs
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/disgoorg/disgo/discord"
@@ -14,6 +15,8 @@ import (
 
 var _ jobNotif = &anchorNotif{}
 
+const anchorNotifField_ExitCode = "Exit Code"
+
 type anchorNotif struct {
 	state        job.JobState
 	alertWebhook webhook.Client
@@ -56,6 +59,14 @@ func (a anchorNotif) getTitle() string {
 }
 
 func (a anchorNotif) getFields() []discord.EmbedField {
+	if exitCode, found := a.state.Params[job.AnchorJobParam_ExitCode].(float64); found {
+		return []discord.EmbedField{
+			{
+				Name:  anchorNotifField_ExitCode,
+				Value: strconv.Itoa(int(exitCode)),
+			},
+		}
+	}
 	return nil
 }
 
@@ -67,10 +78,10 @@ func (a anchorNotif) getUrl() string {
 	if taskId, found := a.state.Params[job.JobParam_Id].(string); found {
 		idParts := strings.Split(taskId, "/")
 		return fmt.Sprintf(
-			"https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logsV2:log-groups/log-group/$252Fecs$252Fceramic-%s-cas/log-events/cas_anchor$252Fcas_anchor$252F%s",
+			"https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logsV2:log-groups/log-group/$252Fecs$252F%s/log-events/cas_anchor$252Fcas_anchor$252F%s",
 			a.region,
 			a.region,
-			a.env,
+			manager.GetEnvClusters(a.env).Cas,
 			idParts[len(idParts)-1],
 		)
 	}
@@ -0,0 +1,63 @@
+package notifs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/disgoorg/disgo/discord"
+
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+const defaultDedupWindow = time.Minute
+
+// notifDedup coalesces identical notifications for the same job and stage that are sent within a short window of each
+// other, e.g. when a job is repeatedly moved to the same stage. Notifications for the same stage with different details
+// (e.g. a new step of a staged rollout, or new service events) are still sent.
+type notifDedup struct {
+	window time.Duration
+	sent   map[string]time.Time
+	mu     sync.Mutex
+}
+
+func newNotifDedup(window time.Duration) *notifDedup {
+	return &notifDedup{window: window, sent: make(map[string]time.Time)}
+}
+
+// shouldSend returns false if an identical notification was already sent within the dedup window, and otherwise records
+// the notification as sent.
+func (d *notifDedup) shouldSend(jobState job.JobState, title string, fields []discord.EmbedField) bool {
+	if d.window <= 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	// Clean up expired entries so that the map doesn't keep growing
+	for key, sentTs := range d.sent {
+		if now.Sub(sentTs) >= d.window {
+			delete(d.sent, key)
+		}
+	}
+	key := notifKey(jobState, title, fields)
+	if _, found := d.sent[key]; found {
+		return false
+	}
+	d.sent[key] = now
+	return true
+}
+
+// notifKey identifies a notification by job, stage, and message, including the job-specific fields. Common fields that
+// change over time for the same message (e.g. the run time) are left out so that they don't defeat the deduplication.
+func notifKey(jobState job.JobState, title string, fields []discord.EmbedField) string {
+	jobError, _ := jobState.Params[job.JobParam_Error].(string)
+	message := title + "\n" + jobError
+	for _, field := range fields {
+		message += "\n" + field.Name + ": " + field.Value
+	}
+	messageHash := sha256.Sum256([]byte(message))
+	return jobState.JobId + "/" + string(jobState.Stage) + "/" + hex.EncodeToString(messageHash[:])
+}
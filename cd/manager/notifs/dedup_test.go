@@ -0,0 +1,59 @@
+package notifs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/discord"
+
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+func TestNotifDedup(t *testing.T) {
+	started := job.JobState{JobId: "job-1", Stage: job.JobStage_Started, Params: map[string]interface{}{}}
+	eventFields := func(event string) []discord.EmbedField {
+		return []discord.EmbedField{{Name: deployNotifField_ServiceEvents, Value: event}}
+	}
+	dedup := newNotifDedup(time.Minute)
+	if !dedup.shouldSend(started, "Deployment STARTED", nil) {
+		t.Fatal("expected first notification to be sent")
+	}
+	if dedup.shouldSend(started, "Deployment STARTED", nil) {
+		t.Error("expected identical notification to be skipped")
+	}
+	if !dedup.shouldSend(started, "Deployment STARTED", eventFields("ceramic-dev-node: unable to place a task")) {
+		t.Error("expected notification with service events to be sent")
+	}
+	if !dedup.shouldSend(started, "Deployment STARTED", eventFields("ceramic-dev-node: task failed ELB health checks")) {
+		t.Error("expected notification with different service events to be sent")
+	}
+	if dedup.shouldSend(started, "Deployment STARTED", eventFields("ceramic-dev-node: task failed ELB health checks")) {
+		t.Error("expected repeated service events to be skipped")
+	}
+	if !dedup.shouldSend(job.JobState{JobId: "job-2", Stage: job.JobStage_Started}, "Deployment STARTED", nil) {
+		t.Error("expected notification for another job to be sent")
+	}
+	if !newNotifDedup(0).shouldSend(started, "Deployment STARTED", nil) || !newNotifDedup(0).shouldSend(started, "Deployment STARTED", nil) {
+		t.Error("expected notifications to be sent with deduplication disabled")
+	}
+}
+
+func TestTruncateFieldValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "short", want: "short"},
+		{value: "exactly8", want: "exactly8"},
+		{value: "truncated", want: "truncate"},
+		{value: "héllo wörld", want: "héllo wö"},
+		{value: "日本語のテキストです", want: "日本語のテキスト"},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if got := truncateFieldValue(test.value, 8); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
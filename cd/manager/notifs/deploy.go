@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 
 	"github.com/disgoorg/disgo/discord"
 	"github.com/disgoorg/disgo/webhook"
+	"github.com/mitchellh/mapstructure"
 
 	"github.com/3box/pipeline-tools/cd/manager"
 	"github.com/3box/pipeline-tools/cd/manager/common/job"
@@ -17,6 +19,19 @@ import (
 
 var _ jobNotif = &deployNotif{}
 
+const deployNotifField_LayoutDiff = "Layout Changes"
+const deployNotifField_Approval = "Approval"
+const deployNotifField_ApprovedBy = "Approved By"
+const deployNotifField_CanceledBy = "Canceled By"
+const deployNotifField_Rollout = "Rollout"
+const deployNotifField_Revision = "Revision"
+const deployNotifField_ServiceEvents = "Service Events"
+const deployNotifField_Maintenance = "Maintenance"
+const deployNotifField_Retry = "Retry"
+const deployNotifField_ServiceChanges = "Service Changes"
+const deployNotifField_Emergency = "Emergency"
+const deployNotifField_PreDeployTask = "Pre-Deploy Task"
+
 type deployNotif struct {
 	state              job.JobState
 	deploymentsWebhook webhook.Client
@@ -50,8 +65,8 @@ func (d deployNotif) getChannels() []webhook.Client {
 	if (d.env != manager.EnvType_Dev) && (d.env != manager.EnvType_Qa) {
 		webhooks = append(webhooks, d.communityWebhook)
 	}
-	// Also send deployment failures to the alerts channel
-	if d.state.Stage == job.JobStage_Failed {
+	// Also send deployment failures and the outcome of rollbacks to the alerts channel
+	if (d.state.Stage == job.JobStage_Failed) || (d.state.Stage == job.JobStage_RolledBack) {
 		webhooks = append(webhooks, d.alertWebhook)
 	}
 	return webhooks
@@ -71,11 +86,24 @@ func (d deployNotif) getTitle() string {
 	prettyStage := string(d.state.Stage)
 	if d.state.Stage == job.JobStage_Dequeued {
 		prettyStage = prettyStageDequeued
+	} else if d.state.Stage == job.JobStage_RolledBack {
+		prettyStage = prettyStageRolledBack
+	} else if d.state.Stage == job.JobStage_WaitingApproval {
+		prettyStage = prettyStageWaitingApproval
+	} else if maintenance, _ := d.state.Params[job.DeployJobParam_Maintenance].(bool); maintenance {
+		prettyStage = prettyStageMaintenance
+	} else if _, retried := d.state.Params[job.JobParam_Retries].(float64); retried && (d.state.Stage == job.JobStage_Queued) {
+		prettyStage = prettyStageRetrying
+	}
+	prettyComponent := strings.ToUpper(component)
+	// Include the release label, if any, e.g. "CERAMIC v2.14.0"
+	if version, _ := d.state.Params[job.DeployJobParam_Version].(string); len(version) > 0 {
+		prettyComponent += " " + version
 	}
 	return fmt.Sprintf(
 		"3Box Labs `%s` %s %s %s %s",
 		envName(d.env),
-		strings.ToUpper(component),
+		prettyComponent,
 		cases.Title(language.English).String(qualifier),
 		"Deployment",
 		strings.ToUpper(prettyStage),
@@ -83,7 +111,137 @@ func (d deployNotif) getTitle() string {
 }
 
 func (d deployNotif) getFields() []discord.EmbedField {
-	return nil
+	if d.state.Stage == job.JobStage_WaitingApproval {
+		return []discord.EmbedField{{
+			Name:  deployNotifField_Approval,
+			Value: fmt.Sprintf("`POST /approve?jobId=%s` with an approver token", d.state.JobId),
+		}}
+	} else if d.state.Stage == job.JobStage_Canceled {
+		if canceledBy, found := d.state.Params[job.JobParam_CanceledBy].(string); found {
+			// Only deployments that were started are rolled back
+			_, started := d.state.Params[job.JobParam_Start].(float64)
+			if rollback, _ := d.state.Params[job.DeployJobParam_RollbackOnCancel].(bool); rollback && started {
+				canceledBy += " (rolling back)"
+			}
+			return []discord.EmbedField{{
+				Name:  deployNotifField_CanceledBy,
+				Value: canceledBy,
+			}}
+		}
+		return nil
+	} else if d.state.Stage == job.JobStage_Queued {
+		if maintenance, _ := d.state.Params[job.DeployJobParam_Maintenance].(bool); maintenance {
+			return []discord.EmbedField{{
+				Name:  deployNotifField_Maintenance,
+				Value: "Deployments are paused. This deployment will start once maintenance mode is cleared with `DELETE /maintenance?clearedBy=<name>`.",
+			}}
+		} else if retries, found := d.state.Params[job.JobParam_Retries].(float64); found {
+			maxRetries, _ := d.state.Params[job.JobParam_MaxRetries].(float64)
+			return []discord.EmbedField{{
+				Name:  deployNotifField_Retry,
+				Value: fmt.Sprintf("attempt %d of %d, starting at %s", int(retries)+1, int(maxRetries)+1, d.state.Ts.UTC().Format(time.Kitchen)),
+			}}
+		}
+		return nil
+	} else if d.state.Stage == job.JobStage_Waiting {
+		if preDeployTask, found := d.state.Params[job.DeployJobParam_PreDeployTask].(string); found {
+			taskArn, _ := d.state.Params[job.DeployJobParam_PreDeployTaskArn].(string)
+			return []discord.EmbedField{{
+				Name:  deployNotifField_PreDeployTask,
+				Value: fmt.Sprintf("Waiting for %s (%s) to complete before updating the services", preDeployTask, taskArn[strings.LastIndex(taskArn, "/")+1:]),
+			}}
+		}
+		return nil
+	} else if d.state.Stage == job.JobStage_Started {
+		fields := make([]discord.EmbedField, 0, 2)
+		// Show the progress of staged rollouts, e.g. "50% (step 2 of 3)". The current step is only recorded if services
+		// are actually being deployed in stages.
+		if rolloutSteps, found := d.state.Params[job.DeployJobParam_RolloutSteps].([]interface{}); found {
+			if step, found := d.state.Params[job.DeployJobParam_RolloutStep].(float64); found && (int(step) < len(rolloutSteps)) {
+				fields = append(fields, discord.EmbedField{
+					Name:  deployNotifField_Rollout,
+					Value: fmt.Sprintf("%v%% (step %d of %d)", rolloutSteps[int(step)], int(step)+1, len(rolloutSteps)),
+				})
+			}
+		}
+		// Show notable service events, e.g. placement failures, that might explain why a deployment is stuck
+		if serviceEvents, found := d.state.Params[job.DeployJobParam_ServiceEvents].([]interface{}); found && (len(serviceEvents) > 0) {
+			events := make([]string, len(serviceEvents))
+			for i, event := range serviceEvents {
+				events[i] = fmt.Sprint(event)
+			}
+			fields = append(fields, discord.EmbedField{
+				Name:  deployNotifField_ServiceEvents,
+				Value: truncateFieldValue(strings.Join(events, "\n"), maxFieldValueLen),
+			})
+		}
+		return fields
+	} else if (d.state.Stage == job.JobStage_Completed) || (d.state.Stage == job.JobStage_RolledBack) {
+		if serviceChanges := d.serviceChanges(); len(serviceChanges) > 0 {
+			return []discord.EmbedField{{
+				Name:  deployNotifField_ServiceChanges,
+				Value: serviceChanges,
+			}}
+		}
+		return nil
+	} else if d.state.Stage != job.JobStage_Dequeued {
+		return nil
+	}
+	fields := make([]discord.EmbedField, 0, 4)
+	if emergency, _ := d.state.Params[job.DeployJobParam_Emergency].(bool); emergency {
+		fields = append(fields, discord.EmbedField{
+			Name:  deployNotifField_Emergency,
+			Value: "Deploy windows bypassed",
+		})
+	}
+	if revision, found := d.state.Params[job.DeployJobParam_Revision].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  deployNotifField_Revision,
+			Value: revision,
+		})
+	}
+	if approvedBy, found := d.state.Params[job.DeployJobParam_ApprovedBy].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  deployNotifField_ApprovedBy,
+			Value: approvedBy,
+		})
+	}
+	// Only show layout changes when the deployment is dequeued, since that's when the layout is generated
+	if layoutDiff, found := d.state.Params[job.DeployJobParam_LayoutDiff].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name: deployNotifField_LayoutDiff,
+			// Leave room for the code block delimiters
+			Value: "```\n" + truncateFieldValue(layoutDiff, maxFieldValueLen-8) + "\n```",
+		})
+	}
+	return fields
+}
+
+// serviceChanges lists the task definitions that each service was moved from and to, e.g.
+// "ceramic-dev-cas-api: ceramic-dev-cas-api:42 -> ceramic-dev-cas-api:43"
+func (d deployNotif) serviceChanges() string {
+	var serviceChanges []manager.ServiceChange
+	// Service changes read back from the database are generic maps
+	if err := mapstructure.Decode(d.state.Params[job.DeployJobParam_ServiceChanges], &serviceChanges); err != nil {
+		return ""
+	}
+	lines := make([]string, len(serviceChanges))
+	for i, serviceChange := range serviceChanges {
+		from := "(created)"
+		if len(serviceChange.From) > 0 {
+			from = taskDefName(serviceChange.From)
+		}
+		lines[i] = fmt.Sprintf("%s: %s -> %s", serviceChange.Service, from, taskDefName(serviceChange.To))
+		if len(serviceChange.Region) > 0 {
+			lines[i] = serviceChange.Region + "/" + lines[i]
+		}
+	}
+	return truncateFieldValue(strings.Join(lines, "\n"), maxFieldValueLen)
+}
+
+// taskDefName returns the "family:revision" part of a task definition ARN
+func taskDefName(taskDefArn string) string {
+	return taskDefArn[strings.LastIndex(taskDefArn, "/")+1:]
 }
 
 func (d deployNotif) getColor() discordColor {
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/disgoorg/disgo/discord"
 	"github.com/disgoorg/disgo/rest"
@@ -37,15 +38,27 @@ const (
 	notifField_TestE2E    string = "E2E Tests"
 	notifField_TestSmoke  string = "Smoke Tests"
 	notifField_Workflow   string = "Workflow(s)"
+	notifField_Restart    string = "Restart(s)"
+	notifField_StopTask   string = "Task Stop(s)"
+	notifField_Prepull    string = "Image Pre-pull(s)"
 	notifField_Logs       string = "Logs"
+	notifField_Error      string = "Error"
 )
 
 const discordPacing = 2 * time.Second
 
 const shaTagLength = 12
 
+// Discord limits embed field values to 1024 characters
+const maxFieldValueLen = 1024
+
 // Show "queued" for "dequeued" jobs to make it more understandable
 const prettyStageDequeued = "queued"
+const prettyStageRolledBack = "rolled back"
+const prettyStageWaitingApproval = "waiting for approval"
+const prettyStageMaintenance = "paused for maintenance"
+const prettyStageRetrying = "queued for retry"
+const prettyStageDrifted = "drift detected"
 
 var _ manager.Notifs = &JobNotifs{}
 
@@ -53,6 +66,7 @@ type JobNotifs struct {
 	db          manager.Database
 	cache       manager.Cache
 	testWebhook webhook.Client
+	dedup       *notifDedup
 }
 
 type jobNotif interface {
@@ -64,10 +78,16 @@ type jobNotif interface {
 }
 
 func NewJobNotifs(db manager.Database, cache manager.Cache) (manager.Notifs, error) {
+	dedupWindow := defaultDedupWindow
+	if configDedupWindow, found := os.LookupEnv("NOTIF_DEDUP_WINDOW"); found {
+		if parsedDedupWindow, err := time.ParseDuration(configDedupWindow); err == nil {
+			dedupWindow = parsedDedupWindow
+		}
+	}
 	if t, err := parseDiscordWebhookUrl("DISCORD_TEST_WEBHOOK"); err != nil {
 		return nil, err
 	} else {
-		return &JobNotifs{db, cache, t}, nil
+		return &JobNotifs{db, cache, t, newNotifDedup(dedupWindow)}, nil
 	}
 }
 
@@ -120,11 +140,15 @@ func webhooksForLabels(labels []string) ([]webhook.Client, []webhook.Client, err
 	return webhooks, failureWebhooks, nil
 }
 
-func (n JobNotifs) NotifyJob(jobs ...job.JobState) {
+func (n JobNotifs) NotifyJob(jobs ...job.JobState) bool {
+	notified := false
 	for _, jobState := range jobs {
 		if jn, err := n.getJobNotif(jobState); err != nil {
 			log.Printf("notifyJob: error creating job notification: %v, %s", err, manager.PrintJob(jobState))
+		} else if !n.dedup.shouldSend(jobState, jn.getTitle(), jn.getFields()) {
+			log.Printf("notifyJob: skipping duplicate notification: %s", manager.PrintJob(jobState))
 		} else {
+			notified = true
 			// Send all notifications to the test webhook
 			channels := append(jn.getChannels(), n.testWebhook)
 			for _, channel := range channels {
@@ -133,12 +157,14 @@ func (n JobNotifs) NotifyJob(jobs ...job.JobState) {
 						jn.getTitle(),
 						append(n.getNotifFields(jobState), jn.getFields()...),
 						jn.getColor(),
+						n.getMention(jobState),
 						channel,
 					)
 				}
 			}
 		}
 	}
+	return notified
 }
 
 func (n JobNotifs) getJobNotif(jobState job.JobState) (jobNotif, error) {
@@ -153,28 +179,55 @@ func (n JobNotifs) getJobNotif(jobState job.JobState) (jobNotif, error) {
 		return newSmokeTestNotif(jobState)
 	case job.JobType_Workflow:
 		return newWorkflowNotif(jobState)
+	case job.JobType_Restart:
+		return newRestartNotif(jobState)
+	case job.JobType_StopTask:
+		return newStopTaskNotif(jobState)
+	case job.JobType_Prepull:
+		return newPrepullNotif(jobState)
+	case job.JobType_Reconcile:
+		return newReconcileNotif(jobState)
 	default:
 		return nil, fmt.Errorf("getJobNotif: unknown job type: %s", jobState.Type)
 	}
 }
 
-func (n JobNotifs) sendNotif(title string, fields []discord.EmbedField, color discordColor, channel webhook.Client) {
+func (n JobNotifs) sendNotif(title string, fields []discord.EmbedField, color discordColor, mention *snowflake.ID, channel webhook.Client) {
 	messageEmbed := discord.Embed{
 		Title:  title,
 		Type:   discord.EmbedTypeRich,
 		Fields: fields,
 		Color:  int(color),
 	}
-	if _, err := channel.CreateMessage(discord.NewWebhookMessageCreateBuilder().
+	messageBuilder := discord.NewWebhookMessageCreateBuilder().
 		SetEmbeds(messageEmbed).
-		SetUsername(manager.ServiceName).
-		Build(),
-		rest.WithDelay(discordPacing),
-	); err != nil {
+		SetUsername(manager.ServiceName)
+	// Mentions in embeds don't ping anyone, so the mention goes in the message content. Only allow that specific user
+	// to be pinged.
+	if mention != nil {
+		messageBuilder.
+			SetContentf("<@%s>", *mention).
+			SetAllowedMentions(&discord.AllowedMentions{Users: []snowflake.ID{*mention}})
+	}
+	if _, err := channel.CreateMessage(messageBuilder.Build(), rest.WithDelay(discordPacing)); err != nil {
 		log.Printf("notifyJob: error sending discord notification: %v, %s, %v, %d", err, title, fields, color)
 	}
 }
 
+// getMention returns the Discord user to ping about a job, if any. Only the requester of a failed job is pinged.
+func (n JobNotifs) getMention(jobState job.JobState) *snowflake.ID {
+	if jobState.Stage == job.JobStage_Failed {
+		if requester, found := jobState.Params[job.JobParam_Requester].(string); found && (len(requester) > 0) {
+			if id, err := snowflake.Parse(requester); err != nil {
+				log.Printf("getMention: invalid requester: %s, %v, %s", requester, err, manager.PrintJob(jobState))
+			} else {
+				return &id
+			}
+		}
+	}
+	return nil
+}
+
 func (n JobNotifs) getNotifFields(jobState job.JobState) []discord.EmbedField {
 	fields := []discord.EmbedField{
 		{
@@ -212,6 +265,17 @@ func (n JobNotifs) getNotifFields(jobState job.JobState) []discord.EmbedField {
 			})
 		}
 	}
+	// Display the error category along with the error message for failed jobs
+	if errorCode, found := jobState.Params[job.JobParam_ErrorCode].(string); found {
+		errorMsg := fmt.Sprintf("`%s`", errorCode)
+		if jobError, found := jobState.Params[job.JobParam_Error].(string); found {
+			errorMsg += " " + jobError
+		}
+		fields = append(fields, discord.EmbedField{
+			Name:  notifField_Error,
+			Value: truncateFieldValue(errorMsg, maxFieldValueLen),
+		})
+	}
 	// Add the list of jobs in progress
 	if activeJobs := n.getActiveJobs(jobState); len(activeJobs) > 0 {
 		fields = append(fields, activeJobs...)
@@ -231,24 +295,31 @@ func (n JobNotifs) getDeployTags(jobState job.JobState) string {
 	if deployTags, err := n.db.GetDeployTags(); err != nil {
 		return ""
 	} else {
+		// Versions are only informational, so don't skip the deploy tags if they can't be retrieved
+		deployVersions, err := n.db.GetDeployVersions()
+		if err != nil {
+			deployVersions = make(map[manager.DeployComponent]string)
+		}
 		if jobState.Type == job.JobType_Deploy {
 			if deployTag, found := jobState.Params[job.DeployJobParam_DeployTag].(string); found {
 				// This should always be present
 				sha := jobState.Params[job.DeployJobParam_Sha].(string)
-				deployTags[manager.DeployComponent(jobState.Params[job.DeployJobParam_Component].(string))] = deployTag + "," + sha
+				component := manager.DeployComponent(jobState.Params[job.DeployJobParam_Component].(string))
+				deployTags[component] = deployTag + "," + sha
+				deployVersions[component], _ = jobState.Params[job.DeployJobParam_Version].(string)
 			}
 		}
 		// Prepare component messages with GitHub commit hashes and hyperlinks
-		ceramicMsg := n.getComponentMsg(manager.DeployComponent_Ceramic, deployTags)
-		casMsg := n.getComponentMsg(manager.DeployComponent_Cas, deployTags)
-		casV5Msg := n.getComponentMsg(manager.DeployComponent_CasV5, deployTags)
-		ipfsMsg := n.getComponentMsg(manager.DeployComponent_Ipfs, deployTags)
-		rustCeramicMsg := n.getComponentMsg(manager.DeployComponent_RustCeramic, deployTags)
+		ceramicMsg := n.getComponentMsg(manager.DeployComponent_Ceramic, deployTags, deployVersions)
+		casMsg := n.getComponentMsg(manager.DeployComponent_Cas, deployTags, deployVersions)
+		casV5Msg := n.getComponentMsg(manager.DeployComponent_CasV5, deployTags, deployVersions)
+		ipfsMsg := n.getComponentMsg(manager.DeployComponent_Ipfs, deployTags, deployVersions)
+		rustCeramicMsg := n.getComponentMsg(manager.DeployComponent_RustCeramic, deployTags, deployVersions)
 		return n.combineComponentMsgs(ceramicMsg, casMsg, casV5Msg, ipfsMsg, rustCeramicMsg)
 	}
 }
 
-func (n JobNotifs) getComponentMsg(component manager.DeployComponent, deployTags map[manager.DeployComponent]string) string {
+func (n JobNotifs) getComponentMsg(component manager.DeployComponent, deployTags, deployVersions map[manager.DeployComponent]string) string {
 	if deployTag, found := deployTags[component]; found && len(deployTag) > 0 {
 		if repo, err := manager.ComponentRepo(component); err == nil {
 			deployTagParts := strings.Split(deployTag, ",")
@@ -257,7 +328,12 @@ func (n JobNotifs) getComponentMsg(component manager.DeployComponent, deployTags
 			if (len(deployTagParts) > 1) && (deployTagParts[1] == job.DeployJobTarget_Release) {
 				return fmt.Sprintf("[%s (v%s)](https://github.com/%s/%s/releases/tag/v%s)", repo.Name, tagString, repo.Org, repo.Name, tagString)
 			} else if manager.IsValidSha(tagString) {
-				return fmt.Sprintf("[%s (%s)](https://github.com/%s/%s/commit/%s)", repo.Name, tagString[:shaTagLength], repo.Org, repo.Name, tagString)
+				// Show the release label, if any, along with the commit hash, e.g. "ceramic (v2.14.0, abc123)"
+				label := tagString[:shaTagLength]
+				if version := deployVersions[component]; len(version) > 0 {
+					label = version + ", " + label
+				}
+				return fmt.Sprintf("[%s (%s)](https://github.com/%s/%s/commit/%s)", repo.Name, label, repo.Org, repo.Name, tagString)
 			}
 		}
 	}
@@ -291,6 +367,9 @@ func (n JobNotifs) getActiveJobs(jobState job.JobState) []discord.EmbedField {
 	if field, found := n.getActiveJobsByType(jobState, job.JobType_Workflow); found {
 		fields = append(fields, field)
 	}
+	if field, found := n.getActiveJobsByType(jobState, job.JobType_Restart); found {
+		fields = append(fields, field)
+	}
 	return fields
 }
 
@@ -327,6 +406,12 @@ func notifField(jt job.JobType) string {
 		return notifField_TestSmoke
 	case job.JobType_Workflow:
 		return notifField_Workflow
+	case job.JobType_Restart:
+		return notifField_Restart
+	case job.JobType_StopTask:
+		return notifField_StopTask
+	case job.JobType_Prepull:
+		return notifField_Prepull
 	default:
 		return ""
 	}
@@ -334,6 +419,8 @@ func notifField(jt job.JobType) string {
 
 func colorForStage(jobStage job.JobStage) discordColor {
 	switch jobStage {
+	case job.JobStage_Queued:
+		return discordColor_Warning
 	case job.JobStage_Dequeued:
 		return discordColor_Info
 	case job.JobStage_Skipped:
@@ -348,6 +435,10 @@ func colorForStage(jobStage job.JobStage) discordColor {
 		return discordColor_Warning
 	case job.JobStage_Completed:
 		return discordColor_Ok
+	case job.JobStage_RolledBack:
+		return discordColor_Warning
+	case job.JobStage_WaitingApproval:
+		return discordColor_Warning
 	default:
 		log.Printf("colorForStage: unknown job stage: %s", jobStage)
 		return discordColor_Alert
@@ -363,3 +454,11 @@ func prettyDuration(duration time.Duration) string {
 	}
 	return ""
 }
+
+// truncateFieldValue shortens a field value to Discord's limit without splitting multi-byte characters
+func truncateFieldValue(value string, maxLen int) string {
+	if utf8.RuneCountInString(value) <= maxLen {
+		return value
+	}
+	return string([]rune(value)[:maxLen])
+}
@@ -0,0 +1,32 @@
+package notifs
+
+import (
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ manager.Notifs = MultiNotifs{}
+
+// MultiNotifs sends job notifications to multiple notification services, e.g. Discord and PagerDuty
+type MultiNotifs []manager.Notifs
+
+func NewMultiNotifs(notifs ...manager.Notifs) manager.Notifs {
+	multiNotifs := make(MultiNotifs, 0, len(notifs))
+	for _, n := range notifs {
+		// Skip optional notification services that aren't configured
+		if n != nil {
+			multiNotifs = append(multiNotifs, n)
+		}
+	}
+	return multiNotifs
+}
+
+func (m MultiNotifs) NotifyJob(jobs ...job.JobState) bool {
+	notified := false
+	for _, n := range m {
+		if n.NotifyJob(jobs...) {
+			notified = true
+		}
+	}
+	return notified
+}
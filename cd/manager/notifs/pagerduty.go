@@ -0,0 +1,163 @@
+package notifs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ manager.Notifs = &PagerDutyNotifs{}
+
+const pagerDutyEventsUrl = "https://events.pagerduty.com/v2/enqueue"
+
+const (
+	pagerDutyAction_Trigger = "trigger"
+	pagerDutyAction_Resolve = "resolve"
+)
+
+const defaultPagerDutySeverity = "critical"
+
+// PagerDutyNotifs pages on-call through the PagerDuty Events API v2 when a prod deployment fails. The alert is resolved
+// once a later deployment of all the component's services completes, or once a rollback restores them. Deployments in
+// other environments never page.
+type PagerDutyNotifs struct {
+	integrationKey string
+	severity       string
+	env            manager.EnvType
+	client         *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"` // Only needed to trigger alerts
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+// NewPagerDutyNotifs returns nil if no PagerDuty integration key is configured, since paging is optional
+func NewPagerDutyNotifs() (manager.Notifs, error) {
+	integrationKey := os.Getenv("PAGERDUTY_INTEGRATION_KEY")
+	if len(integrationKey) == 0 {
+		return nil, nil
+	}
+	severity := defaultPagerDutySeverity
+	if configSeverity, found := os.LookupEnv("PAGERDUTY_SEVERITY"); found {
+		switch configSeverity {
+		case "critical", "error", "warning", "info":
+			severity = configSeverity
+		default:
+			return nil, fmt.Errorf("newPagerDutyNotifs: invalid severity: %s", configSeverity)
+		}
+	}
+	return &PagerDutyNotifs{
+		integrationKey,
+		severity,
+		manager.EnvType(os.Getenv(manager.EnvVar_Env)),
+		&http.Client{Timeout: manager.DefaultHttpWaitTime},
+	}, nil
+}
+
+func (p PagerDutyNotifs) NotifyJob(jobs ...job.JobState) bool {
+	if p.env != manager.EnvType_Prod {
+		return false
+	}
+	notified := false
+	for _, jobState := range jobs {
+		if jobState.Type != job.JobType_Deploy {
+			continue
+		}
+		component, _ := jobState.Params[job.DeployJobParam_Component].(string)
+		action := pagerDutyAction(jobState)
+		if action == pagerDutyAction_Trigger {
+			p.sendEvent(jobState, pagerDutyAction_Trigger, component, &pagerDutyPayload{
+				Summary:       fmt.Sprintf("%s %s deployment failed", envName(p.env), component),
+				Source:        manager.ServiceName,
+				Severity:      p.severity,
+				Component:     component,
+				CustomDetails: p.details(jobState),
+			})
+		} else if action == pagerDutyAction_Resolve {
+			p.sendEvent(jobState, pagerDutyAction_Resolve, component, nil)
+		}
+		if len(action) > 0 {
+			notified = true
+		}
+	}
+	return notified
+}
+
+// pagerDutyAction returns the PagerDuty action for a deployment, if any. Failed deployments trigger an alert. Completed
+// deployments resolve it, except for register-only deployments, which don't change any services, and deployments
+// limited to some services, which might not cover the ones that failed. Rollbacks resolve the alert since they restore
+// all of the component's services.
+func pagerDutyAction(jobState job.JobState) string {
+	if jobState.Stage == job.JobStage_Failed {
+		return pagerDutyAction_Trigger
+	} else if jobState.Stage == job.JobStage_RolledBack {
+		return pagerDutyAction_Resolve
+	} else if jobState.Stage == job.JobStage_Completed {
+		registerOnly, _ := jobState.Params[job.DeployJobParam_RegisterOnly].(bool)
+		target, _ := jobState.Params[job.DeployJobParam_Target].(string)
+		if !registerOnly && (len(target) == 0) {
+			return pagerDutyAction_Resolve
+		}
+	}
+	return ""
+}
+
+func (p PagerDutyNotifs) details(jobState job.JobState) map[string]interface{} {
+	details := map[string]interface{}{"jobId": jobState.JobId}
+	for _, param := range []string{job.DeployJobParam_DeployTag, job.DeployJobParam_Version, job.JobParam_Error, job.JobParam_ErrorCode} {
+		if value, found := jobState.Params[param]; found {
+			details[param] = value
+		}
+	}
+	return details
+}
+
+func (p PagerDutyNotifs) sendEvent(jobState job.JobState, action, component string, payload *pagerDutyPayload) {
+	event := pagerDutyEvent{
+		RoutingKey:  p.integrationKey,
+		EventAction: action,
+		// Failures of the same component in the same environment are grouped into one alert, which is then resolved by
+		// the next successful deployment.
+		DedupKey: fmt.Sprintf("%s/%s/%s", manager.ServiceName, component, p.env),
+		Payload:  payload,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("pagerDuty: error creating event: %s, %v, %s", action, err, manager.PrintJob(jobState))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), manager.DefaultHttpWaitTime)
+	defer cancel()
+
+	if req, err := http.NewRequestWithContext(ctx, http.MethodPost, pagerDutyEventsUrl, bytes.NewReader(body)); err != nil {
+		log.Printf("pagerDuty: error creating request: %s, %v, %s", action, err, manager.PrintJob(jobState))
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+		if resp, err := p.client.Do(req); err != nil {
+			log.Printf("pagerDuty: error sending event: %s, %v, %s", action, err, manager.PrintJob(jobState))
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				log.Printf("pagerDuty: event rejected: %s, %s, %s", action, resp.Status, manager.PrintJob(jobState))
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package notifs
+
+import (
+	"testing"
+
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+func TestPagerDutyAction(t *testing.T) {
+	tests := []struct {
+		name   string
+		stage  job.JobStage
+		params map[string]interface{}
+		action string
+	}{
+		{name: "failed", stage: job.JobStage_Failed, action: pagerDutyAction_Trigger},
+		{name: "completed", stage: job.JobStage_Completed, action: pagerDutyAction_Resolve},
+		{name: "rolled back", stage: job.JobStage_RolledBack, action: pagerDutyAction_Resolve},
+		{name: "register-only", stage: job.JobStage_Completed, params: map[string]interface{}{job.DeployJobParam_RegisterOnly: true}},
+		{name: "targeted", stage: job.JobStage_Completed, params: map[string]interface{}{job.DeployJobParam_Target: "ceramic-prod-node"}},
+		{name: "started", stage: job.JobStage_Started},
+		{name: "canceled", stage: job.JobStage_Canceled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobState := job.JobState{Type: job.JobType_Deploy, Stage: test.stage, Params: test.params}
+			if action := pagerDutyAction(jobState); action != test.action {
+				t.Errorf("got %q, want %q", action, test.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package notifs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/webhook"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ jobNotif = &prepullNotif{}
+
+const (
+	prepullNotifField_Image     = "Image"
+	prepullNotifField_DeployJob = "Deployment"
+)
+
+type prepullNotif struct {
+	state              job.JobState
+	deploymentsWebhook webhook.Client
+	alertWebhook       webhook.Client
+	env                manager.EnvType
+}
+
+func newPrepullNotif(jobState job.JobState) (jobNotif, error) {
+	if d, err := parseDiscordWebhookUrl("DISCORD_DEPLOYMENTS_WEBHOOK"); err != nil {
+		return nil, err
+	} else if a, err := parseDiscordWebhookUrl("DISCORD_ALERT_WEBHOOK"); err != nil {
+		return nil, err
+	} else {
+		return &prepullNotif{jobState, d, a, manager.EnvType(os.Getenv(manager.EnvVar_Env))}, nil
+	}
+}
+
+func (p prepullNotif) getChannels() []webhook.Client {
+	webhooks := []webhook.Client{p.deploymentsWebhook}
+	// Also send pre-pull failures to the alerts channel since they block the deployment
+	if p.state.Stage == job.JobStage_Failed {
+		webhooks = append(webhooks, p.alertWebhook)
+	}
+	return webhooks
+}
+
+func (p prepullNotif) getTitle() string {
+	component, _ := p.state.Params[job.PrepullJobParam_Component].(string)
+	prettyStage := string(p.state.Stage)
+	if p.state.Stage == job.JobStage_Dequeued {
+		prettyStage = prettyStageDequeued
+	}
+	return fmt.Sprintf("3Box Labs `%s` %s Image Pre-pull %s", envName(p.env), strings.ToUpper(component), strings.ToUpper(prettyStage))
+}
+
+func (p prepullNotif) getFields() []discord.EmbedField {
+	fields := make([]discord.EmbedField, 0, 2)
+	if deployTag, found := p.state.Params[job.PrepullJobParam_DeployTag].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  prepullNotifField_Image,
+			Value: deployTag,
+		})
+	}
+	if deployJob, found := p.state.Params[job.PrepullJobParam_DeployJob].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  prepullNotifField_DeployJob,
+			Value: deployJob,
+		})
+	}
+	return fields
+}
+
+func (p prepullNotif) getColor() discordColor {
+	return colorForStage(p.state.Stage)
+}
+
+func (p prepullNotif) getUrl() string {
+	return ""
+}
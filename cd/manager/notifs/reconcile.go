@@ -0,0 +1,94 @@
+package notifs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/webhook"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ jobNotif = &reconcileNotif{}
+
+const (
+	reconcileNotifField_Components = "Components"
+	reconcileNotifField_Drift      = "Drift"
+)
+
+type reconcileNotif struct {
+	state        job.JobState
+	alertWebhook webhook.Client
+	env          manager.EnvType
+}
+
+func newReconcileNotif(jobState job.JobState) (jobNotif, error) {
+	if a, err := parseDiscordWebhookUrl("DISCORD_ALERT_WEBHOOK"); err != nil {
+		return nil, err
+	} else {
+		return &reconcileNotif{jobState, a, manager.EnvType(os.Getenv(manager.EnvVar_Env))}, nil
+	}
+}
+
+func (r reconcileNotif) getChannels() []webhook.Client {
+	// Reconciliations run on a schedule, so only send them to the alerts channel if something needs attention
+	if (r.state.Stage == job.JobStage_Failed) || (len(r.driftItems()) > 0) {
+		return []webhook.Client{r.alertWebhook}
+	}
+	return nil
+}
+
+func (r reconcileNotif) getTitle() string {
+	prettyStage := string(r.state.Stage)
+	if len(r.driftItems()) > 0 {
+		prettyStage = prettyStageDrifted
+	}
+	return fmt.Sprintf("3Box Labs `%s` Drift Check %s", envName(r.env), strings.ToUpper(prettyStage))
+}
+
+func (r reconcileNotif) getFields() []discord.EmbedField {
+	fields := make([]discord.EmbedField, 0, 2)
+	if components, found := r.state.Params[job.ReconcileJobParam_Components].([]interface{}); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  reconcileNotifField_Components,
+			Value: strings.Trim(fmt.Sprint(components), "[]"),
+		})
+	}
+	if driftItems := r.driftItems(); len(driftItems) > 0 {
+		lines := make([]string, len(driftItems))
+		for i, driftItem := range driftItems {
+			lines[i] = fmt.Sprintf("%s: %s (expected %s)", driftItem.Service, driftItem.Image, driftItem.ExpectedTag)
+		}
+		value := truncateFieldValue(strings.Join(lines, "\n"), maxFieldValueLen)
+		fields = append(fields, discord.EmbedField{
+			Name:  reconcileNotifField_Drift,
+			Value: value,
+		})
+	}
+	return fields
+}
+
+// driftItems returns the services found running something other than their component's last deployed tag
+func (r reconcileNotif) driftItems() []manager.DriftItem {
+	var driftItems []manager.DriftItem
+	// Drift items read back from the database are generic maps
+	if err := mapstructure.Decode(r.state.Params[job.ReconcileJobParam_Drift], &driftItems); err != nil {
+		return nil
+	}
+	return driftItems
+}
+
+func (r reconcileNotif) getColor() discordColor {
+	if len(r.driftItems()) > 0 {
+		return discordColor_Alert
+	}
+	return colorForStage(r.state.Stage)
+}
+
+func (r reconcileNotif) getUrl() string {
+	return ""
+}
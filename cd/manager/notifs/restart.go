@@ -0,0 +1,80 @@
+package notifs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/webhook"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ jobNotif = &restartNotif{}
+
+const restartNotifField_Target = "Target"
+
+type restartNotif struct {
+	state              job.JobState
+	deploymentsWebhook webhook.Client
+	alertWebhook       webhook.Client
+	env                manager.EnvType
+}
+
+func newRestartNotif(jobState job.JobState) (jobNotif, error) {
+	if d, err := parseDiscordWebhookUrl("DISCORD_DEPLOYMENTS_WEBHOOK"); err != nil {
+		return nil, err
+	} else if a, err := parseDiscordWebhookUrl("DISCORD_ALERT_WEBHOOK"); err != nil {
+		return nil, err
+	} else {
+		return &restartNotif{jobState, d, a, manager.EnvType(os.Getenv(manager.EnvVar_Env))}, nil
+	}
+}
+
+func (r restartNotif) getChannels() []webhook.Client {
+	webhooks := []webhook.Client{r.deploymentsWebhook}
+	// Also send restart failures to the alerts channel
+	if r.state.Stage == job.JobStage_Failed {
+		webhooks = append(webhooks, r.alertWebhook)
+	}
+	return webhooks
+}
+
+func (r restartNotif) getTitle() string {
+	prettyStage := string(r.state.Stage)
+	if r.state.Stage == job.JobStage_Dequeued {
+		prettyStage = prettyStageDequeued
+	}
+	return fmt.Sprintf("3Box Labs `%s` Restart %s", envName(r.env), strings.ToUpper(prettyStage))
+}
+
+func (r restartNotif) getFields() []discord.EmbedField {
+	target := ""
+	if component, found := r.state.Params[job.RestartJobParam_Component].(string); found {
+		target = strings.ToUpper(component)
+	} else if cluster, found := r.state.Params[job.RestartJobParam_Cluster].(string); found {
+		target = cluster
+		if service, found := r.state.Params[job.RestartJobParam_Service].(string); found {
+			target += "/" + service
+		}
+	}
+	if len(target) > 0 {
+		return []discord.EmbedField{
+			{
+				Name:  restartNotifField_Target,
+				Value: target,
+			},
+		}
+	}
+	return nil
+}
+
+func (r restartNotif) getColor() discordColor {
+	return colorForStage(r.state.Stage)
+}
+
+func (r restartNotif) getUrl() string {
+	return ""
+}
@@ -0,0 +1,75 @@
+package notifs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/webhook"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+var _ jobNotif = &stopTaskNotif{}
+
+const (
+	stopTaskNotifField_Task        = "Task"
+	stopTaskNotifField_Reason      = "Reason"
+	stopTaskNotifField_RequestedBy = "Requested By"
+)
+
+type stopTaskNotif struct {
+	state        job.JobState
+	alertWebhook webhook.Client
+	env          manager.EnvType
+}
+
+func newStopTaskNotif(jobState job.JobState) (jobNotif, error) {
+	if a, err := parseDiscordWebhookUrl("DISCORD_ALERT_WEBHOOK"); err != nil {
+		return nil, err
+	} else {
+		return &stopTaskNotif{jobState, a, manager.EnvType(os.Getenv(manager.EnvVar_Env))}, nil
+	}
+}
+
+func (s stopTaskNotif) getChannels() []webhook.Client {
+	// Task stops are manual interventions, so always send them to the alerts channel
+	return []webhook.Client{s.alertWebhook}
+}
+
+func (s stopTaskNotif) getTitle() string {
+	return fmt.Sprintf("3Box Labs `%s` Task Stop %s", envName(s.env), strings.ToUpper(string(s.state.Stage)))
+}
+
+func (s stopTaskNotif) getFields() []discord.EmbedField {
+	fields := make([]discord.EmbedField, 0, 3)
+	if task, found := s.state.Params[job.StopTaskJobParam_Task].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  stopTaskNotifField_Task,
+			Value: task,
+		})
+	}
+	if reason, found := s.state.Params[job.StopTaskJobParam_Reason].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  stopTaskNotifField_Reason,
+			Value: reason,
+		})
+	}
+	if requestedBy, found := s.state.Params[job.StopTaskJobParam_RequestedBy].(string); found {
+		fields = append(fields, discord.EmbedField{
+			Name:  stopTaskNotifField_RequestedBy,
+			Value: requestedBy,
+		})
+	}
+	return fields
+}
+
+func (s stopTaskNotif) getColor() discordColor {
+	return colorForStage(s.state.Stage)
+}
+
+func (s stopTaskNotif) getUrl() string {
+	return ""
+}
@@ -1,24 +1,46 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/3box/pipeline-tools/cd/manager"
 	"github.com/3box/pipeline-tools/cd/manager/common/job"
 )
 
-func Setup(addr string, m manager.Manager) http.Server {
+func Setup(addr string, m manager.Manager, exportMetrics bool, approvers map[string]string) http.Server {
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
 	mux := http.NewServeMux()
 	mux.Handle("/healthcheck", healthcheckHandler())
+	mux.Handle("/healthz", healthcheckHandler())
+	mux.Handle("/readyz", readyHandler(m))
+	mux.Handle("/jobs", jobsHandler(m))
 	mux.Handle("/time", timeHandler(time.RFC1123))
 	mux.Handle("/job", jobHandler(m))
 	mux.Handle("/pause", pauseHandler(m))
+	mux.Handle("/layout", layoutHandler(m))
+	mux.Handle("/drift", driftHandler(m))
+	mux.Handle("/service", serviceHandler(m))
+	mux.Handle("/image", imageHandler(m))
+	mux.Handle("/tasks", tasksHandler(m))
+	mux.Handle("/approve", approveHandler(m, approvers))
+	mux.Handle("/cancel", cancelHandler(m))
+	mux.Handle("/rollback", rollbackHandler(m))
+	mux.Handle("/promote", promoteHandler(m))
+	mux.Handle("/maintenance", maintenanceHandler(m))
+	if exportMetrics {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
 	return http.Server{
 		Addr:     addr,
 		Handler:  logging(logger)(mux),
@@ -32,6 +54,48 @@ func healthcheckHandler() http.HandlerFunc {
 	}
 }
 
+func readyHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any = "Ready!"
+		if err := m.CheckReady(); err != nil {
+			status = http.StatusServiceUnavailable
+			body = "not ready: " + err.Error()
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func jobsHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodGet {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else {
+			body = m.ActiveJobs()
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+// withTraceHeaders records the caller's W3C trace context, if any, so that tasks launched for the job continue the trace.
+// Trace context passed in the job parameters takes precedence.
+func withTraceHeaders(r *http.Request, jobState *job.JobState) {
+	if traceParent := r.Header.Get("traceparent"); manager.IsValidTraceParent(traceParent) {
+		if jobState.Params == nil {
+			jobState.Params = make(map[string]interface{})
+		}
+		if _, found := jobState.Params[job.JobParam_TraceParent]; !found {
+			jobState.Params[job.JobParam_TraceParent] = traceParent
+			if traceState := r.Header.Get("tracestate"); len(traceState) > 0 {
+				jobState.Params[job.JobParam_TraceState] = traceState
+			}
+		}
+	}
+}
+
 func pauseHandler(m manager.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		m.Pause()
@@ -66,7 +130,14 @@ func jobHandler(m manager.Manager) http.HandlerFunc {
 				body = "bad request: " + err.Error()
 			}
 		} else if r.Method == http.MethodPost {
-			if jobState, err = m.NewJob(jobState); err != nil {
+			withTraceHeaders(r, &jobState)
+			if jobState, err = m.NewJob(jobState); errors.Is(err, manager.Error_ShuttingDown) {
+				status = http.StatusServiceUnavailable
+				body = "could not queue job: " + err.Error()
+			} else if errors.Is(err, manager.Error_InvalidPriority) || errors.Is(err, manager.Error_InvalidMaxRetries) || errors.Is(err, manager.Error_ReservedParam) {
+				status = http.StatusBadRequest
+				body = "could not queue job: " + err.Error()
+			} else if err != nil {
 				status = http.StatusInternalServerError
 				body = "could not queue job: " + err.Error()
 			} else {
@@ -82,6 +153,281 @@ func jobHandler(m manager.Manager) http.HandlerFunc {
 	}
 }
 
+func layoutHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodGet {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if component := r.URL.Query().Get("component"); len(component) == 0 {
+			body = "missing component"
+			status = http.StatusBadRequest
+		} else if drift, err := m.DescribeLayout(manager.DeployComponent(component)); err != nil {
+			body = "could not describe layout: " + err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			body = drift
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func driftHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodGet {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if component := r.URL.Query().Get("component"); len(component) == 0 {
+			body = "missing component"
+			status = http.StatusBadRequest
+		} else if driftItems, err := m.DetectDrift(manager.DeployComponent(component)); err != nil {
+			body = "could not detect drift: " + err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			body = driftItems
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func serviceHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodGet {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if cluster := r.URL.Query().Get("cluster"); len(cluster) == 0 {
+			body = "missing cluster"
+			status = http.StatusBadRequest
+		} else if service := r.URL.Query().Get("service"); len(service) == 0 {
+			body = "missing service"
+			status = http.StatusBadRequest
+		} else if serviceStatus, err := m.GetServiceStatus(cluster, service); err != nil {
+			body = "could not get service status: " + err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			body = serviceStatus
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func imageHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodGet {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if cluster := r.URL.Query().Get("cluster"); len(cluster) == 0 {
+			body = "missing cluster"
+			status = http.StatusBadRequest
+		} else if service := r.URL.Query().Get("service"); len(service) == 0 {
+			body = "missing service"
+			status = http.StatusBadRequest
+		} else if image, err := m.GetCurrentImage(cluster, service); err != nil {
+			body = "could not get current image: " + err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			body = map[string]string{"image": image}
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func tasksHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		// Only list tasks launched by the manager (e.g. anchor workers) if requested
+		managerOnly, _ := strconv.ParseBool(r.URL.Query().Get("managerOnly"))
+		if r.Method != http.MethodGet {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if cluster := r.URL.Query().Get("cluster"); len(cluster) == 0 {
+			body = "missing cluster"
+			status = http.StatusBadRequest
+		} else if tasks, err := m.ListRunningTasks(cluster, managerOnly); err != nil {
+			body = "could not list tasks: " + err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			body = tasks
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+// ParseApprovers parses the people allowed to approve deployments from a comma-separated list of "name:token" pairs, and
+// returns the name of the approver for each token.
+func ParseApprovers(approvers string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	if len(strings.TrimSpace(approvers)) == 0 {
+		return tokens, nil
+	}
+	for _, approver := range strings.Split(approvers, ",") {
+		if name, token, found := strings.Cut(strings.TrimSpace(approver), ":"); !found || (len(name) == 0) || (len(token) == 0) {
+			return nil, fmt.Errorf("parseApprovers: invalid approver, expected name:token")
+		} else if _, found = tokens[token]; found {
+			return nil, fmt.Errorf("parseApprovers: duplicate token for %s", name)
+		} else {
+			tokens[token] = name
+		}
+	}
+	return tokens, nil
+}
+
+// authorizedApprover returns the approver whose token the request was made with, if any. Every token is compared so
+// that the time taken doesn't reveal how much of a token matched.
+func authorizedApprover(r *http.Request, approvers map[string]string) (string, bool) {
+	requestToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || (len(requestToken) == 0) {
+		return "", false
+	}
+	approver := ""
+	for token, name := range approvers {
+		if subtle.ConstantTimeCompare([]byte(requestToken), []byte(token)) == 1 {
+			approver = name
+		}
+	}
+	return approver, len(approver) > 0
+}
+
+func approveHandler(m manager.Manager, approvers map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodPost {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if approver, authorized := authorizedApprover(r, approvers); !authorized {
+			// The approver is identified by their token instead of being taken from the request
+			body = "unauthorized"
+			status = http.StatusUnauthorized
+		} else if jobId := r.URL.Query().Get("jobId"); len(jobId) == 0 {
+			body = "missing job id"
+			status = http.StatusBadRequest
+		} else if err := m.ApproveJob(jobId, approver); err != nil {
+			body = "could not approve job: " + err.Error()
+			status = http.StatusBadRequest
+		} else {
+			body = "approved " + jobId
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func rollbackHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodPost {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if component := r.URL.Query().Get("component"); len(component) == 0 {
+			body = "missing component"
+			status = http.StatusBadRequest
+		} else if revision := r.URL.Query().Get("revision"); len(revision) == 0 {
+			body = "missing revision"
+			status = http.StatusBadRequest
+		} else if err := m.RollbackTo(manager.DeployComponent(component), revision); err != nil {
+			body = "could not roll back: " + err.Error()
+			status = http.StatusBadRequest
+		} else {
+			body = "rolling back " + component + " to " + revision
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func cancelHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodPost {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if jobId := r.URL.Query().Get("jobId"); len(jobId) == 0 {
+			body = "missing job id"
+			status = http.StatusBadRequest
+		} else if canceledBy := r.URL.Query().Get("canceledBy"); len(canceledBy) == 0 {
+			body = "missing canceled by"
+			status = http.StatusBadRequest
+		} else if rollback, err := strconv.ParseBool(r.URL.Query().Get("rollback")); (err != nil) && r.URL.Query().Has("rollback") {
+			body = "invalid rollback: " + err.Error()
+			status = http.StatusBadRequest
+		} else if err = m.CancelJob(jobId, canceledBy, rollback); err != nil {
+			body = "could not cancel job: " + err.Error()
+			status = http.StatusBadRequest
+		} else {
+			body = "canceling " + jobId
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func promoteHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method != http.MethodPost {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		} else if jobId := r.URL.Query().Get("jobId"); len(jobId) == 0 {
+			body = "missing job id"
+			status = http.StatusBadRequest
+		} else if err := m.PromoteJob(jobId); err != nil {
+			body = "could not promote job: " + err.Error()
+			status = http.StatusBadRequest
+		} else {
+			body = "promoting " + jobId
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
+func maintenanceHandler(m manager.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body any
+		if r.Method == http.MethodGet {
+			if maintenance, err := m.GetMaintenance(); err != nil {
+				body = "could not check maintenance mode: " + err.Error()
+				status = http.StatusInternalServerError
+			} else {
+				body = maintenance
+			}
+		} else if r.Method == http.MethodPost {
+			if setBy := r.URL.Query().Get("setBy"); len(setBy) == 0 {
+				body = "missing setBy"
+				status = http.StatusBadRequest
+			} else if err := m.SetMaintenance(setBy); err != nil {
+				body = "could not set maintenance mode: " + err.Error()
+				status = http.StatusInternalServerError
+			} else {
+				body = "deployments paused by " + setBy
+			}
+		} else if r.Method == http.MethodDelete {
+			if clearedBy := r.URL.Query().Get("clearedBy"); len(clearedBy) == 0 {
+				body = "missing clearedBy"
+				status = http.StatusBadRequest
+			} else if err := m.ClearMaintenance(clearedBy); err != nil {
+				body = "could not clear maintenance mode: " + err.Error()
+				status = http.StatusInternalServerError
+			} else {
+				body = "deployments resumed by " + clearedBy
+			}
+		} else {
+			body = "unsupported method: " + r.Method
+			status = http.StatusMethodNotAllowed
+		}
+		writeJsonResponse(w, body, status)
+	}
+}
+
 func writeJsonResponse(w http.ResponseWriter, body any, httpStatusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(httpStatusCode)
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3box/pipeline-tools/cd/manager"
+)
+
+// fakeManager records job approvals. Only the methods used by the tests are implemented.
+type fakeManager struct {
+	manager.Manager
+	approvedBy map[string]string
+}
+
+func (m fakeManager) ApproveJob(jobId, approver string) error {
+	m.approvedBy[jobId] = approver
+	return nil
+}
+
+func TestParseApprovers(t *testing.T) {
+	tests := []struct {
+		name      string
+		approvers string
+		tokens    int
+		err       bool
+	}{
+		{name: "none", approvers: ""},
+		{name: "single", approvers: "alice:s3cr3t", tokens: 1},
+		{name: "multiple", approvers: "alice:s3cr3t, bob:t0k3n:with:colons", tokens: 2},
+		{name: "missing token", approvers: "alice", err: true},
+		{name: "empty token", approvers: "alice:", err: true},
+		{name: "empty name", approvers: ":s3cr3t", err: true},
+		{name: "duplicate token", approvers: "alice:s3cr3t,bob:s3cr3t", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens, err := ParseApprovers(test.approvers)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if len(tokens) != test.tokens {
+				t.Errorf("got %d tokens, want %d", len(tokens), test.tokens)
+			}
+		})
+	}
+}
+
+func TestApproveHandler(t *testing.T) {
+	approvers := map[string]string{"s3cr3t": "alice", "t0k3n": "bob"}
+	tests := []struct {
+		name       string
+		auth       string
+		status     int
+		approvedBy string
+	}{
+		{name: "approved", auth: "Bearer t0k3n", status: http.StatusOK, approvedBy: "bob"},
+		{name: "missing token", status: http.StatusUnauthorized},
+		{name: "wrong token", auth: "Bearer s3cr3", status: http.StatusUnauthorized},
+		{name: "wrong scheme", auth: "Basic s3cr3t", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := fakeManager{approvedBy: make(map[string]string)}
+			r := httptest.NewRequest(http.MethodPost, "/approve?jobId=deploy&approver=mallory", nil)
+			if len(test.auth) > 0 {
+				r.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			approveHandler(m, approvers)(w, r)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+			// The approver comes from the token, not the request
+			if approvedBy := m.approvedBy["deploy"]; approvedBy != test.approvedBy {
+				t.Errorf("got approver %q, want %q", approvedBy, test.approvedBy)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package manager
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+// W3C trace context header, e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+const traceParentRegex = "^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$"
+
+// Environment variables that launched tasks can read the trace context from, following the OpenTelemetry convention for
+// propagating context through the environment
+const (
+	EnvVar_TraceParent = "TRACEPARENT"
+	EnvVar_TraceState  = "TRACESTATE"
+)
+
+type traceContextKey struct{}
+
+func IsValidTraceParent(traceParent string) bool {
+	// Version "ff" and all-zero trace and parent IDs are invalid
+	if isValidTraceParent, err := regexp.MatchString(traceParentRegex, traceParent); (err != nil) || !isValidTraceParent {
+		return false
+	}
+	parts := strings.Split(traceParent, "-")
+	return (parts[0] != "ff") && (strings.Trim(parts[1], "0") != "") && (strings.Trim(parts[2], "0") != "")
+}
+
+// WithTraceContext attaches the trace context of a job, if it has a valid one, to a context so that tasks launched while
+// advancing the job continue the job's trace
+func WithTraceContext(ctx context.Context, jobState job.JobState) context.Context {
+	traceParent, _ := jobState.Params[job.JobParam_TraceParent].(string)
+	if !IsValidTraceParent(traceParent) {
+		return ctx
+	}
+	traceContext := map[string]string{EnvVar_TraceParent: traceParent}
+	if traceState, _ := jobState.Params[job.JobParam_TraceState].(string); len(traceState) > 0 {
+		traceContext[EnvVar_TraceState] = traceState
+	}
+	return context.WithValue(ctx, traceContextKey{}, traceContext)
+}
+
+// TraceContext returns the trace context attached to a context as environment variables, or nil if there isn't one
+func TraceContext(ctx context.Context) map[string]string {
+	traceContext, _ := ctx.Value(traceContextKey{}).(map[string]string)
+	return traceContext
+}
@@ -3,8 +3,13 @@ package manager
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/3box/pipeline-tools/cd/manager/common/job"
@@ -42,11 +47,69 @@ func ComponentRepo(component DeployComponent) (DeployRepo, error) {
 	}
 }
 
+// GetEnvClusters returns the cluster names for an environment. The global prefix and cluster suffixes can be overridden
+// through the environment so that forks with a different naming scheme can use the same code.
+func GetEnvClusters(env string) EnvClusters {
+	prefix := envOrDefault("CLUSTER_PREFIX", DefaultClusterPrefix)
+	casV5Prefix := envOrDefault("CASV5_CLUSTER_PREFIX", DefaultCasV5ClusterPrefix)
+	exSuffix := envOrDefault("CLUSTER_SUFFIX_EX", DefaultClusterSuffix_Ex)
+	casSuffix := envOrDefault("CLUSTER_SUFFIX_CAS", DefaultClusterSuffix_Cas)
+	rustSuffix := envOrDefault("CLUSTER_SUFFIX_RUST", DefaultClusterSuffix_Rust)
+	privateCluster := prefix + "-" + env
+	return EnvClusters{
+		Prefix:  prefix,
+		Private: privateCluster,
+		Public:  privateCluster + exSuffix,
+		Cas:     privateCluster + casSuffix,
+		CasV5:   casV5Prefix + "-" + env,
+		Rust:    privateCluster + rustSuffix,
+	}
+}
+
+// ParseEnvType returns the environment type for an environment name, or an error if the environment is unknown
+func ParseEnvType(env string) (EnvType, error) {
+	switch envType := EnvType(env); envType {
+	case EnvType_Dev, EnvType_Qa, EnvType_Tnet, EnvType_Prod:
+		return envType, nil
+	default:
+		return "", fmt.Errorf("parseEnvType: unknown env: %q", env)
+	}
+}
+
+func envOrDefault(envVar, defaultValue string) string {
+	if value, found := os.LookupEnv(envVar); found && (len(value) > 0) {
+		return value
+	}
+	return defaultValue
+}
+
 func IsValidSha(sha string) bool {
 	isValidSha, err := regexp.MatchString(commitHashRegex, sha)
 	return err == nil && isValidSha
 }
 
+// TaskDefRevision returns the task definition for a revision of the same task family as a task definition, e.g. for
+// "arn:aws:ecs:us-east-2:967314784947:task-definition/ceramic-dev-node:18" and revision "15", "ceramic-dev-node:15". The
+// revision can also be a task definition ARN or "family:revision" from the same task family.
+func TaskDefRevision(taskDefArn, revision string) (string, error) {
+	family := TaskDefFamily(taskDefArn)
+	if _, err := strconv.Atoi(revision); err == nil {
+		return family + ":" + revision, nil
+	} else if TaskDefFamily(revision) != family {
+		return "", fmt.Errorf("taskDefRevision: revision from another task family: %s, %s", family, revision)
+	}
+	return revision, nil
+}
+
+// TaskDefFamily returns the task family from a task definition ARN or "family:revision"
+func TaskDefFamily(taskDef string) string {
+	family := taskDef[strings.LastIndex(taskDef, "/")+1:]
+	if idx := strings.LastIndex(family, ":"); idx >= 0 {
+		family = family[:idx]
+	}
+	return family
+}
+
 func IsV5WorkerJob(jobState job.JobState) bool {
 	if jobState.Type == job.JobType_Anchor {
 		if version, found := jobState.Params[job.AnchorJobParam_Version].(string); found && (version == casV5Version) {
@@ -56,26 +119,142 @@ func IsV5WorkerJob(jobState job.JobState) bool {
 	return false
 }
 
+// ClassifyError maps the error that caused a job to fail to a machine-readable category
+func ClassifyError(jobState job.JobState, err error) ErrorCode {
+	// Any failure of a rollback is significant in itself since it means that the environment might be left broken
+	if jobState.Type == job.JobType_Deploy {
+		if rollback, _ := jobState.Params[job.DeployJobParam_Rollback].(bool); rollback {
+			return ErrorCode_RollbackFailed
+		}
+	}
+	// Each cluster can fail for a different reason, so only treat the failure as transient if every cluster failed for a
+	// transient reason. Otherwise, report the first cluster failure that isn't transient.
+	var clusterErrs ClusterErrors
+	if errors.As(err, &clusterErrs) && (len(clusterErrs) > 0) {
+		errorCode := ErrorCode_Unknown
+		for i, clusterErr := range clusterErrs {
+			if clusterErrCode := ClassifyError(jobState, clusterErr.Err); (i == 0) || !IsTransientError(clusterErrCode) {
+				errorCode = clusterErrCode
+				if !IsTransientError(errorCode) {
+					break
+				}
+			}
+		}
+		return errorCode
+	}
+	var errorCoder ErrorCoder
+	if errors.Is(err, Error_StartupTimeout) || errors.Is(err, Error_CompletionTimeout) || errors.Is(err, Error_ApprovalExpired) || errors.Is(err, Error_StabilizeTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCode_Timeout
+	} else if errors.Is(err, Error_CrashLooping) {
+		return ErrorCode_Unhealthy
+	} else if errors.Is(err, Error_DeployBlackout) {
+		return ErrorCode_Blackout
+	} else if errors.Is(err, Error_ImagePullFailed) || errors.Is(err, Error_ImageTagNotFound) {
+		return ErrorCode_ImageNotFound
+	} else if errors.As(err, &errorCoder) {
+		return errorCoder.ErrorCode()
+	}
+	// Fall back to looking for well-known error strings from AWS and from our own checks
+	errMsg := strings.ToLower(err.Error())
+	if strings.Contains(errMsg, "throttl") || strings.Contains(errMsg, "rate exceeded") || strings.Contains(errMsg, "toomanyrequests") {
+		return ErrorCode_Throttling
+	} else if strings.Contains(errMsg, "cannotpullcontainer") || strings.Contains(errMsg, "imagenotfound") {
+		return ErrorCode_ImageNotFound
+	} else if strings.Contains(errMsg, "capacity") || strings.Contains(errMsg, "insufficient") {
+		return ErrorCode_Capacity
+	} else if strings.Contains(errMsg, "unhealthy") || strings.Contains(errMsg, "health check") || strings.Contains(errMsg, "exited with code") {
+		return ErrorCode_Unhealthy
+	}
+	return ErrorCode_Unknown
+}
+
 // AdvanceJob will move a JobState to a new JobStage in the Database and send an appropriate notification
-func AdvanceJob(jobState job.JobState, jobStage job.JobStage, ts time.Time, err error, db Database, notifs Notifs) (job.JobState, error) {
+func AdvanceJob(jobState job.JobState, jobStage job.JobStage, ts time.Time, err error, db Database, notifs Notifs) (job.JobState, AdvanceResult, error) {
+	prevJobStage := jobState.Stage
 	jobState.Stage = jobStage
 	if jobState.Params == nil {
 		jobState.Params = map[string]interface{}{}
 	}
+	// Retry jobs that failed for a transient reason instead of failing them, if requested
+	if (jobStage == job.JobStage_Failed) && (err != nil) && shouldRetry(jobState, err) {
+		return requeueJob(jobState, ts, err, db, notifs)
+	}
+	// Errors from an earlier attempt of a retried job don't apply to the new attempt
+	if prevJobStage == job.JobStage_Queued {
+		delete(jobState.Params, job.JobParam_Error)
+		delete(jobState.Params, job.JobParam_ErrorCode)
+	}
 	// Store how much time the job spent during its previous stage. We only care about active jobs, i.e. those that have
 	// progressed beyond the "dequeued" stage.
 	if jobStage != job.JobStage_Dequeued {
 		jobState.Params[job.JobParam_WaitTime] = time.Since(jobState.Ts).String()
 	}
+	// Record when the job started, unless the job already did, so that timeouts are counted from then instead of from
+	// when the job was queued or last updated.
+	if jobStage == job.JobStage_Started {
+		if _, found := jobState.Params[job.JobParam_Start].(float64); !found {
+			jobState.Params[job.JobParam_Start] = float64(ts.UnixNano())
+		}
+	}
 	jobState.Ts = ts
 	if err != nil {
 		jobState.Params[job.JobParam_Error] = err.Error()
+		jobState.Params[job.JobParam_ErrorCode] = string(ClassifyError(jobState, err))
 	}
+	result := AdvanceResult{}
 	if err = db.AdvanceJob(jobState); err == nil {
 		// Only send a notification if the DB update was successful
-		notifs.NotifyJob(jobState)
+		result = AdvanceResult{
+			Transitioned: jobStage != prevJobStage,
+			Notified:     notifs.NotifyJob(jobState),
+			Finished:     job.IsFinishedJob(jobState),
+		}
+	}
+	return jobState, result, err
+}
+
+// IsTransientError returns whether a job failed for a reason that is likely to go away on its own, e.g. throttling or a
+// brief capacity shortage, so that retrying the job later might succeed.
+func IsTransientError(errorCode ErrorCode) bool {
+	return (errorCode == ErrorCode_Throttling) || (errorCode == ErrorCode_Capacity)
+}
+
+// shouldRetry returns whether a failed job has retries left and failed for a transient reason. Only deployments are
+// retried since they start over cleanly, i.e. the services updated by the failed attempt are rolled back and the
+// environment is updated again from scratch.
+func shouldRetry(jobState job.JobState, err error) bool {
+	if jobState.Type != job.JobType_Deploy {
+		return false
 	}
-	return jobState, err
+	maxRetries, _ := jobState.Params[job.JobParam_MaxRetries].(float64)
+	retries, _ := jobState.Params[job.JobParam_Retries].(float64)
+	return (retries < maxRetries) && IsTransientError(ClassifyError(jobState, err))
+}
+
+// requeueJob sends a failed job back to the queue so that it's retried from the beginning. Each retry waits longer
+// before being dequeued to give the cause of the failure time to clear up. Progress from the failed attempt is dropped,
+// but the error is kept so that the notification explains why the job is being retried.
+func requeueJob(jobState job.JobState, ts time.Time, err error, db Database, notifs Notifs) (job.JobState, AdvanceResult, error) {
+	retries, _ := jobState.Params[job.JobParam_Retries].(float64)
+	retries++
+	jobState.Stage = job.JobStage_Queued
+	jobState.Ts = ts.Add(time.Duration(retries) * DefaultWaitTime)
+	jobState.Params[job.JobParam_Retries] = retries
+	jobState.Params[job.JobParam_Error] = err.Error()
+	jobState.Params[job.JobParam_ErrorCode] = string(ClassifyError(jobState, err))
+	delete(jobState.Params, job.JobParam_Start)
+	delete(jobState.Params, job.JobParam_NextPoll)
+	delete(jobState.Params, job.JobParam_WaitTime)
+	delete(jobState.Params, job.DeployJobParam_ServiceEvents)
+	result := AdvanceResult{}
+	if err = db.RequeueJob(jobState); err == nil {
+		result = AdvanceResult{
+			Transitioned: true,
+			Notified:     notifs.NotifyJob(jobState),
+			Requeued:     true,
+		}
+	}
+	return jobState, result, err
 }
 
 func RetryWithResultAndError[R any](parentCtx context.Context, timeout time.Duration, numRetries int, fn func(context.Context, ...interface{}) (R, error), args ...interface{}) (R, error) {
@@ -107,3 +286,188 @@ func RetryWithError(parentCtx context.Context, timeout time.Duration, numRetries
 	}
 	return retry()
 }
+
+// DiffLayout returns the differences between an old and a new layout. Task definitions and launched tasks are state
+// rather than structure, so they're ignored.
+func DiffLayout(a, b *Layout) LayoutDiff {
+	diff := LayoutDiff{}
+	diffLayout(&diff, "", a, b)
+	return diff
+}
+
+func diffLayout(diff *LayoutDiff, path string, a, b *Layout) {
+	if a == nil {
+		a = &Layout{}
+	}
+	if b == nil {
+		b = &Layout{}
+	}
+	diffRepo(diff, path, a.Repo, b.Repo)
+	for _, clusterName := range sortedKeys(a.Clusters, b.Clusters) {
+		clusterPath := path + clusterName
+		aCluster, aFound := a.Clusters[clusterName]
+		bCluster, bFound := b.Clusters[clusterName]
+		if !bFound {
+			diff.Removed = append(diff.Removed, clusterPath)
+		} else if !aFound {
+			diff.Added = append(diff.Added, clusterPath)
+		} else if (aCluster != nil) && (bCluster != nil) {
+			diffRepo(diff, clusterPath, aCluster.Repo, bCluster.Repo)
+			diffTaskSet(diff, clusterPath+"/serviceTasks", aCluster.ServiceTasks, bCluster.ServiceTasks)
+			diffTaskSet(diff, clusterPath+"/tasks", aCluster.Tasks, bCluster.Tasks)
+			diffTaskSet(diff, clusterPath+"/runners", aCluster.Runners, bCluster.Runners)
+		}
+	}
+	for _, region := range sortedKeys(a.Regions, b.Regions) {
+		regionPath := path + region
+		if _, found := b.Regions[region]; !found {
+			diff.Removed = append(diff.Removed, regionPath)
+		} else if _, found = a.Regions[region]; !found {
+			diff.Added = append(diff.Added, regionPath)
+		} else {
+			diffLayout(diff, regionPath+"/", a.Regions[region], b.Regions[region])
+		}
+	}
+}
+
+func diffTaskSet(diff *LayoutDiff, path string, a, b *TaskSet) {
+	if (a == nil) && (b == nil) {
+		return
+	} else if a == nil {
+		diff.Added = append(diff.Added, path)
+		return
+	} else if b == nil {
+		diff.Removed = append(diff.Removed, path)
+		return
+	}
+	diffRepo(diff, path, a.Repo, b.Repo)
+	for _, taskName := range sortedKeys(a.Tasks, b.Tasks) {
+		taskPath := path + "/" + taskName
+		aTask, aFound := a.Tasks[taskName]
+		bTask, bFound := b.Tasks[taskName]
+		if !bFound {
+			diff.Removed = append(diff.Removed, taskPath)
+		} else if !aFound {
+			diff.Added = append(diff.Added, taskPath)
+		} else if (aTask != nil) && (bTask != nil) {
+			diffRepo(diff, taskPath, aTask.Repo, bTask.Repo)
+			if aTask.Name != bTask.Name {
+				diff.Changed = append(diff.Changed, fmt.Sprintf("%s: container %s -> %s", taskPath, aTask.Name, bTask.Name))
+			}
+			if aTask.WaitForCompletion != bTask.WaitForCompletion {
+				diff.Changed = append(diff.Changed, fmt.Sprintf("%s: wait for completion %t -> %t", taskPath, aTask.WaitForCompletion, bTask.WaitForCompletion))
+			}
+			if aTask.Family != bTask.Family {
+				diff.Changed = append(diff.Changed, fmt.Sprintf("%s: family %s -> %s", taskPath, aTask.Family, bTask.Family))
+			}
+		}
+	}
+}
+
+func diffRepo(diff *LayoutDiff, path string, a, b *Repo) {
+	aRepo, bRepo := printRepo(a), printRepo(b)
+	if aRepo != bRepo {
+		if len(path) == 0 {
+			path = "layout"
+		}
+		diff.Changed = append(diff.Changed, fmt.Sprintf("%s: repo %s -> %s", strings.TrimSuffix(path, "/"), aRepo, bRepo))
+	}
+}
+
+func printRepo(repo *Repo) string {
+	if repo == nil {
+		return "(none)"
+	}
+	repoString := repo.Name
+	if repo.Public {
+		repoString = "public/" + repoString
+	} else if len(repo.Registry) > 0 {
+		repoString = strings.TrimSuffix(repo.Registry, "/") + "/" + repoString
+	} else if len(repo.AccountId) > 0 {
+		repoString = repo.AccountId + "/" + repoString
+	}
+	return repoString
+}
+
+// sortedKeys returns the union of the keys of two maps in sorted order, so that diffs are stable
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, found := a[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l LayoutDiff) IsEmpty() bool {
+	return (len(l.Added) == 0) && (len(l.Removed) == 0) && (len(l.Changed) == 0)
+}
+
+// String formats the diff with one change per line, e.g. for notifications
+func (l LayoutDiff) String() string {
+	lines := make([]string, 0, len(l.Added)+len(l.Removed)+len(l.Changed))
+	for _, added := range l.Added {
+		lines = append(lines, "+ "+added)
+	}
+	for _, removed := range l.Removed {
+		lines = append(lines, "- "+removed)
+	}
+	for _, changed := range l.Changed {
+		lines = append(lines, "~ "+changed)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e ClusterError) Error() string {
+	if len(e.Cluster) == 0 {
+		return e.Err.Error()
+	} else if len(e.Region) == 0 {
+		return fmt.Sprintf("%s: %v", e.Cluster, e.Err)
+	}
+	return fmt.Sprintf("%s/%s: %v", e.Region, e.Cluster, e.Err)
+}
+
+func (e ClusterError) Unwrap() error {
+	return e.Err
+}
+
+func (e ClusterErrors) Error() string {
+	clusterErrs := make([]string, len(e))
+	for i, clusterErr := range e {
+		clusterErrs[i] = clusterErr.Error()
+	}
+	return fmt.Sprintf("%d cluster(s) failed: %s", len(e), strings.Join(clusterErrs, "; "))
+}
+
+func (e ClusterErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, clusterErr := range e {
+		errs[i] = clusterErr
+	}
+	return errs
+}
+
+// JoinClusterErrors combines the cluster errors from several layout updates, e.g. for different regions, into one
+// error. Other errors are wrapped as is. Returns nil if there were no errors.
+func JoinClusterErrors(errs ...error) error {
+	var clusterErrs ClusterErrors
+	for _, err := range errs {
+		var ce ClusterErrors
+		if err == nil {
+			continue
+		} else if errors.As(err, &ce) {
+			clusterErrs = append(clusterErrs, ce...)
+		} else {
+			clusterErrs = append(clusterErrs, ClusterError{Err: err})
+		}
+	}
+	if len(clusterErrs) == 0 {
+		return nil
+	}
+	return clusterErrs
+}
@@ -0,0 +1,164 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/3box/pipeline-tools/cd/manager/common/job"
+)
+
+func TestClassifyError(t *testing.T) {
+	throttled := errors.New("ThrottlingException: Rate exceeded")
+	noCapacity := errors.New("insufficient memory available")
+	unhealthy := errors.New("essential container exited with code 1")
+	tests := []struct {
+		name      string
+		err       error
+		errorCode ErrorCode
+	}{
+		{name: "timeout", err: fmt.Errorf("deploy: %w", Error_StabilizeTimeout), errorCode: ErrorCode_Timeout},
+		{name: "throttling", err: throttled, errorCode: ErrorCode_Throttling},
+		{name: "unknown", err: errors.New("something broke"), errorCode: ErrorCode_Unknown},
+		{
+			name:      "all clusters throttled",
+			err:       ClusterErrors{{Cluster: "ceramic-dev", Err: throttled}, {Cluster: "ceramic-dev-ex", Err: throttled}},
+			errorCode: ErrorCode_Throttling,
+		},
+		{
+			name:      "all clusters transient",
+			err:       ClusterErrors{{Cluster: "ceramic-dev", Err: throttled}, {Cluster: "ceramic-dev-ex", Err: noCapacity}},
+			errorCode: ErrorCode_Throttling,
+		},
+		{
+			name:      "throttled cluster first",
+			err:       ClusterErrors{{Cluster: "ceramic-dev", Err: throttled}, {Cluster: "ceramic-dev-ex", Err: unhealthy}},
+			errorCode: ErrorCode_Unhealthy,
+		},
+		{
+			name:      "throttled cluster last",
+			err:       ClusterErrors{{Cluster: "ceramic-dev", Err: unhealthy}, {Cluster: "ceramic-dev-ex", Err: throttled}},
+			errorCode: ErrorCode_Unhealthy,
+		},
+		{
+			name:      "wrapped cluster errors",
+			err:       fmt.Errorf("deploy: %w", ClusterErrors{{Cluster: "ceramic-dev", Err: throttled}, {Cluster: "ceramic-dev-ex", Err: Error_StabilizeTimeout}}),
+			errorCode: ErrorCode_Timeout,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if errorCode := ClassifyError(job.JobState{Type: job.JobType_Deploy}, test.err); errorCode != test.errorCode {
+				t.Errorf("got %s, want %s", errorCode, test.errorCode)
+			}
+		})
+	}
+}
+
+// fakeDb fails job writes if requested. Only the methods used by the tests are implemented.
+type fakeDb struct {
+	Database
+	err error
+}
+
+func (db fakeDb) AdvanceJob(job.JobState) error {
+	return db.err
+}
+
+func (db fakeDb) RequeueJob(job.JobState) error {
+	return db.err
+}
+
+// fakeNotifs reports notifications as skipped if requested, e.g. as duplicates
+type fakeNotifs struct {
+	skip bool
+}
+
+func (n fakeNotifs) NotifyJob(...job.JobState) bool {
+	return !n.skip
+}
+
+func TestAdvanceJob(t *testing.T) {
+	throttled := errors.New("ThrottlingException: Rate exceeded")
+	tests := []struct {
+		name     string
+		stage    job.JobStage
+		params   map[string]interface{}
+		newStage job.JobStage
+		err      error
+		db       fakeDb
+		notifs   fakeNotifs
+		result   AdvanceResult
+	}{
+		{
+			name:     "transitioned",
+			stage:    job.JobStage_Dequeued,
+			newStage: job.JobStage_Started,
+			result:   AdvanceResult{Transitioned: true, Notified: true},
+		},
+		{
+			name:     "same stage",
+			stage:    job.JobStage_Started,
+			newStage: job.JobStage_Started,
+			result:   AdvanceResult{Notified: true},
+		},
+		{
+			name:     "finished",
+			stage:    job.JobStage_Started,
+			newStage: job.JobStage_Completed,
+			result:   AdvanceResult{Transitioned: true, Notified: true, Finished: true},
+		},
+		{
+			name:     "notification skipped",
+			stage:    job.JobStage_Started,
+			newStage: job.JobStage_Started,
+			notifs:   fakeNotifs{skip: true},
+		},
+		{
+			name:     "write failed",
+			stage:    job.JobStage_Started,
+			newStage: job.JobStage_Completed,
+			db:       fakeDb{err: errors.New("write failed")},
+		},
+		{
+			name:     "failed",
+			stage:    job.JobStage_Started,
+			newStage: job.JobStage_Failed,
+			err:      throttled,
+			result:   AdvanceResult{Transitioned: true, Notified: true, Finished: true},
+		},
+		{
+			name:     "requeued",
+			stage:    job.JobStage_Started,
+			params:   map[string]interface{}{job.JobParam_MaxRetries: float64(1)},
+			newStage: job.JobStage_Failed,
+			err:      throttled,
+			result:   AdvanceResult{Transitioned: true, Notified: true, Requeued: true},
+		},
+		{
+			name:     "out of retries",
+			stage:    job.JobStage_Started,
+			params:   map[string]interface{}{job.JobParam_MaxRetries: float64(1), job.JobParam_Retries: float64(1)},
+			newStage: job.JobStage_Failed,
+			err:      throttled,
+			result:   AdvanceResult{Transitioned: true, Notified: true, Finished: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := make(map[string]interface{})
+			for k, v := range test.params {
+				params[k] = v
+			}
+			jobState := job.JobState{JobId: "deploy", Type: job.JobType_Deploy, Stage: test.stage, Ts: time.Now(), Params: params}
+			_, result, err := AdvanceJob(jobState, test.newStage, time.Now(), test.err, test.db, test.notifs)
+			if (err != nil) != (test.db.err != nil) {
+				t.Errorf("got error %v, want %v", err, test.db.err)
+			}
+			if result != test.result {
+				t.Errorf("got %+v, want %+v", result, test.result)
+			}
+		})
+	}
+}